@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
     	"strings"
 	//"time"
@@ -13,6 +14,8 @@ import (
 var loginPrefix = "LOGIN"
 var userIDAffix = "LIST"
 var tradeRequestKey = "TRADEREQUESTIDLIST"
+var shipperIndexAffix = "TradeRequestShipperMap"   //<ShipperID>TradeRequestShipperMap
+var producerIndexAffix = "TradeRequestProducerMap" //<ProducerID>TradeRequestProducerMap
 
 type SimpleChaincode struct {
 
@@ -48,6 +51,7 @@ type tradeRequest struct {
 
 type UserIDList []string
 type TradeRequestIDList []string
+type TradeRequestIndex map[string]string //Trade request ID to status
 
 func main() {
 	err := shim.Start(new(SimpleChaincode))
@@ -360,6 +364,92 @@ func (t *SimpleChaincode) createTradeRequest(stub shim.ChaincodeStubInterface, a
     tradeRequestIDListObjBytes, _ = json.Marshal(&tradeRequestIDArr)
     _ = stub.PutState(tradeRequestKey, tradeRequestIDListObjBytes)
 
+	//Index the trade request for both parties
+	err3 := t.indexTradeRequest(stub, tradeRequestObj)
+	if err3 != nil {
+		return nil, err3
+	}
+
+	return nil, nil
+}
+
+func (t *SimpleChaincode) indexTradeRequest(stub shim.ChaincodeStubInterface, tradeRequestObj tradeRequest) error {
+	var tradeRequestIDString string
+
+	tradeRequestIDString = strconv.Itoa(tradeRequestObj.TradeRequestID)
+	indexKeys := []string{tradeRequestObj.ShipperID + shipperIndexAffix, tradeRequestObj.ProducerID + producerIndexAffix}
+
+	for _, k := range indexKeys {
+		tradeRequestIndex := make(TradeRequestIndex)
+		tradeRequestIndexBytes, _ := stub.GetState(k)
+		if tradeRequestIndexBytes == nil {
+			//A new index starts with the party's trade requests from before the indexes existed, so it is never partial
+			tradeRequestIndex = t.scanTradeRequestIndex(stub, []string{k})
+		}
+		_ = json.Unmarshal(tradeRequestIndexBytes, &tradeRequestIndex)
+
+		tradeRequestIndex[tradeRequestIDString] = tradeRequestObj.TradeRequestStatus
+		tradeRequestIndexBytes, _ = json.Marshal(&tradeRequestIndex)
+		err := stub.PutState(k, tradeRequestIndexBytes)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rebuilds the shipper and producer indexes from the trade request list
+func (t *SimpleChaincode) rebuildTradeRequestIndex(stub shim.ChaincodeStubInterface, args[] string) ([]byte, error) {
+	var trList TradeRequestIDList
+	var tradeRequestObj tradeRequest
+	var userIDArr UserIDList
+	indexes := make(map[string]TradeRequestIndex)
+
+	fmt.Println("Rebuilding trade request indexes")
+
+	//Indexes of shippers and producers without trade requests are emptied
+	for _, k := range []string{"shipper", "producer"} {
+		userIDArr = nil
+		userIDArrBytes, _ := stub.GetState(k + userIDAffix)
+		_ = json.Unmarshal(userIDArrBytes, &userIDArr)
+		for _, userID := range userIDArr {
+			if k == "shipper" {
+				indexes[userID + shipperIndexAffix] = make(TradeRequestIndex)
+			} else {
+				indexes[userID + producerIndexAffix] = make(TradeRequestIndex)
+			}
+		}
+	}
+
+	trListObjBytes, _ := stub.GetState(tradeRequestKey)
+	_ = json.Unmarshal(trListObjBytes, &trList)
+	for _, k := range trList {
+		tradeRequestObj = tradeRequest{}
+		tradeRequestObjBytes, _ := stub.GetState(k)
+		err := json.Unmarshal(tradeRequestObjBytes, &tradeRequestObj)
+		if err != nil {
+			fmt.Println("Skipping trade request " + k + ": " + err.Error())
+			continue
+		}
+
+		indexKeys := []string{tradeRequestObj.ShipperID + shipperIndexAffix, tradeRequestObj.ProducerID + producerIndexAffix}
+		for _, indexKey := range indexKeys {
+			if indexes[indexKey] == nil {
+				indexes[indexKey] = make(TradeRequestIndex)
+			}
+			indexes[indexKey][k] = tradeRequestObj.TradeRequestStatus
+		}
+	}
+
+	for indexKey, tradeRequestIndex := range indexes {
+		tradeRequestIndexBytes, _ := json.Marshal(&tradeRequestIndex)
+		err := stub.PutState(indexKey, tradeRequestIndexBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fmt.Println("Rebuilt " + strconv.Itoa(len(indexes)) + " indexes from " + strconv.Itoa(len(trList)) + " trade requests")
 	return nil, nil
 }
 
@@ -373,6 +463,9 @@ func (t *SimpleChaincode) updateTradeRequestStatus(stub shim.ChaincodeStubInterf
 	
 	tradeRequestIDString = args[0]
 	tradeRequestObjBytes, _ := stub.GetState(tradeRequestIDString)
+	if tradeRequestObjBytes == nil {
+		return nil, errors.New("Trade request not found: " + tradeRequestIDString)
+	}
 	err1 := json.Unmarshal(tradeRequestObjBytes, &tradeRequestObj)
 	if err1 != nil {
 		return nil, err1
@@ -391,6 +484,12 @@ func (t *SimpleChaincode) updateTradeRequestStatus(stub shim.ChaincodeStubInterf
 		return nil, err3
 	}
 	
+	//Keep the status in the party indexes
+	err4 := t.indexTradeRequest(stub, tradeRequestObj)
+	if err4 != nil {
+		return nil, err4
+	}
+	
 	return nil, nil;
 }
 
@@ -402,84 +501,117 @@ func (t *SimpleChaincode) updateTradeRequestStatus(stub shim.ChaincodeStubInterf
 	return []byte(string(tradeRequestObjBytes)), nil
 }*/
 
+// args: userID, status (optional, all statuses if empty)
 func (t *SimpleChaincode) getTradeRequestList(stub shim.ChaincodeStubInterface, args[] string) ([]byte, error) {
-	var userID, returnMessage string
-	var lenMap int	
-    var trList TradeRequestIDList
-    var tradeRequestObj tradeRequest
-    
-    userID = args[0]
-    
-    fmt.Println("Getting Trade Requests for user: "+ userID)
+	var userID, status string
 	
-	trLisObjBytes, _ := stub.GetState(tradeRequestKey)
-	_ = json.Unmarshal(trLisObjBytes, &trList)
-    fmt.Println(trList);
-	lenMap = len(trList)
-	returnMessage = "{\"statusCode\" : \"SUCCESS\", \"body\" : ["
-
-	for _, k := range trList {
-        fmt.Println(k);
-		tradeRequestObjBytes, _ := stub.GetState(k)
-        _ = json.Unmarshal(tradeRequestObjBytes, &tradeRequestObj)
-        fmt.Println(tradeRequestObj);
-        
-        if(tradeRequestObj.ShipperID == userID || tradeRequestObj.ProducerID == userID) {
-            returnMessage = returnMessage + string(tradeRequestObjBytes)
-            
-            lenMap = lenMap - 1
-            if (lenMap!= 0) {
-                returnMessage = returnMessage + ","
-            }
-        }        
+	if len(args) < 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1 (user ID) and optionally a status")
 	}
-	returnMessage = returnMessage + "]}"
-	return []byte(returnMessage), nil
+	userID = args[0]
+	if len(args) > 1 {
+		status = args[1]
+	}
+	
+	fmt.Println("Getting Trade Requests for user: "+ userID)
+	
+	//A user's trade requests are the ones it ships or produces
+	return t.getIndexedTradeRequestList(stub, []string{userID + shipperIndexAffix, userID + producerIndexAffix}, status)
 }
 
+// args: shipperID, status (optional)
 func (t *SimpleChaincode) getShipperTradeRequestList(stub shim.ChaincodeStubInterface, args[] string) ([]byte, error) {
-	var shipperID, returnMessage string
-	var lenMap int
-	mapShipperRequestInfo := make(map[string][]byte)
+	var status string
+
+	if len(args) < 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1 (shipper ID) and optionally a status")
+	}
+	if len(args) > 1 {
+		status = args[1]
+	}
 	fmt.Println("Getting Trade Requests for one shipper")
 
-	shipperID = args[0]
-	mapShipperRequestInfoBytes, _ := stub.GetState(shipperID + "TradeRequestShipperMap")
-	_ = json.Unmarshal(mapShipperRequestInfoBytes, &mapShipperRequestInfo)
-	lenMap = len(mapShipperRequestInfo)
-	returnMessage = "{\"statusCode\" : \"SUCCESS\", \"body\" : ["
+	return t.getIndexedTradeRequestList(stub, []string{args[0] + shipperIndexAffix}, status)
+}
 
-	for k, _ := range mapShipperRequestInfo {
-		tradeRequestInfo, _ := stub.GetState(k)
-		returnMessage = returnMessage + string(tradeRequestInfo)
-		lenMap = lenMap - 1
-		if (lenMap!= 0) {
-			returnMessage = returnMessage + ","
+// args: producerID, status (optional)
+func (t *SimpleChaincode) getProducerTradeRequestList(stub shim.ChaincodeStubInterface, args[] string) ([]byte, error) {
+	var status string
+
+	if len(args) < 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1 (producer ID) and optionally a status")
+	}
+	if len(args) > 1 {
+		status = args[1]
+	}
+	fmt.Println("Getting Trade Requests for one Producer")
+
+	return t.getIndexedTradeRequestList(stub, []string{args[0] + producerIndexAffix}, status)
+}
+
+// Index of the given index keys built from the trade request list, for ledgers written before the indexes existed
+func (t *SimpleChaincode) scanTradeRequestIndex(stub shim.ChaincodeStubInterface, indexKeys []string) TradeRequestIndex {
+	var trList TradeRequestIDList
+	tradeRequestIndex := make(TradeRequestIndex)
+
+	trListObjBytes, _ := stub.GetState(tradeRequestKey)
+	_ = json.Unmarshal(trListObjBytes, &trList)
+	for _, k := range trList {
+		var tradeRequestObj tradeRequest
+		tradeRequestObjBytes, _ := stub.GetState(k)
+		_ = json.Unmarshal(tradeRequestObjBytes, &tradeRequestObj)
+		for _, indexKey := range indexKeys {
+			if indexKey == tradeRequestObj.ShipperID + shipperIndexAffix || indexKey == tradeRequestObj.ProducerID + producerIndexAffix {
+				tradeRequestIndex[k] = tradeRequestObj.TradeRequestStatus
+			}
 		}
 	}
-	returnMessage = returnMessage + "]}"
-	return []byte(returnMessage), nil
+	return tradeRequestIndex
 }
 
-func (t *SimpleChaincode) getProducerTradeRequestList(stub shim.ChaincodeStubInterface, args[] string) ([]byte, error) {
-	var producerID, returnMessage string
-	var lenMap int
-	mapProducerRequestInfo := make(map[string][]byte)
-	fmt.Println("Getting Trade Requests for one Producer")
+// Lists the trade requests of the given indexes in ID order, only those in the status unless it is empty or all
+func (t *SimpleChaincode) getIndexedTradeRequestList(stub shim.ChaincodeStubInterface, indexKeys []string, status string) ([]byte, error) {
+	var returnMessage, separator string
+	var trIDs []int
+	var indexed bool
+	statusByID := make(TradeRequestIndex)
+
+	for _, k := range indexKeys {
+		tradeRequestIndex := make(TradeRequestIndex)
+		tradeRequestIndexBytes, _ := stub.GetState(k)
+		if tradeRequestIndexBytes == nil {
+			continue
+		}
+		indexed = true
+		_ = json.Unmarshal(tradeRequestIndexBytes, &tradeRequestIndex)
+		for tradeRequestID, tradeRequestStatus := range tradeRequestIndex {
+			statusByID[tradeRequestID] = tradeRequestStatus
+		}
+	}
+	//Without any index yet the trade request list is scanned, as before the indexes existed
+	if !indexed {
+		statusByID = t.scanTradeRequestIndex(stub, indexKeys)
+	}
 
-	producerID = args[0]
-	mapProducerRequestInfoBytes, _ := stub.GetState(producerID + "TradeRequestProducerMap")
-	_ = json.Unmarshal(mapProducerRequestInfoBytes, &mapProducerRequestInfo)
-	lenMap = len(mapProducerRequestInfo)
-	returnMessage = "{\"statusCode\" : \"SUCCESS\", \"body\" : ["
+	for tradeRequestID, tradeRequestStatus := range statusByID {
+		if status == "" || strings.ToLower(status) == "all" || strings.EqualFold(tradeRequestStatus, status) {
+			trID, err := strconv.Atoi(tradeRequestID)
+			if err == nil {
+				trIDs = append(trIDs, trID)
+			}
+		}
+	}
+	//IDs are numbers, "10" comes after "9"
+	sort.Ints(trIDs)
 
-	for k, _ := range mapProducerRequestInfo {
-		tradeRequestInfo, _ := stub.GetState(k)
-		returnMessage = returnMessage + string(tradeRequestInfo)
-		lenMap = lenMap - 1
-		if (lenMap!= 0) {
-			returnMessage = returnMessage + ","
+	returnMessage = "{\"statusCode\" : \"SUCCESS\", \"body\" : ["
+	for _, trID := range trIDs {
+		tradeRequestObjBytes, _ := stub.GetState(strconv.Itoa(trID))
+		if tradeRequestObjBytes == nil {
+			continue
 		}
+		returnMessage = returnMessage + separator + string(tradeRequestObjBytes)
+		separator = ","
 	}
 	returnMessage = returnMessage + "]}"
 	return []byte(returnMessage), nil
@@ -521,6 +653,10 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function stri
 		return t.changePassword(stub, args)
 	} else if function == "updateUserInfo" {
 		return t.updateUserInfo(stub, args)
+	} else if function == "updateTradeRequestStatus" {
+		return t.updateTradeRequestStatus(stub, args)
+	} else if function == "rebuildTradeRequestIndex" {
+		return t.rebuildTradeRequestIndex(stub, args)
 	}
  
 	fmt.Println("Invoke did not find function:" + function)
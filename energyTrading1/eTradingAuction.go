@@ -0,0 +1,497 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var auctionPricingRules = []string{"Uniform", "PayAsBid"}
+
+// Sealed bid of a shipper. Quantity and price are zero until the bid is revealed.
+type auctionBid struct {
+	ShipperID    string  `json:"shipper_id"`
+	Commitment   string  `json:"commitment"`
+	QuantityMWH  float64 `json:"quantity_mwh"`
+	Price        float64 `json:"price"`
+	BidStatus    string  `json:"bid_status"`
+	BidDateMS    int     `json:"bid_date_ms"`
+	RevealDateMS int     `json:"reveal_date_ms"`
+}
+
+type auctionAward struct {
+	ShipperID   string  `json:"shipper_id"`
+	QuantityMWH float64 `json:"quantity_mwh"`
+	Price       float64 `json:"price"`
+	ContractID  int     `json:"contract_id"`
+}
+
+// Daily capacity of a pipeline segment offered by its transporter for a delivery period
+type capacityAuction struct {
+	AuctionID        string         `json:"auction_id"`
+	TransporterID    string         `json:"transporter_id"`
+	SegmentID        string         `json:"segment_id"`
+	PlanID           string         `json:"plan_id"`
+	EntryLocation    string         `json:"entry_location"`
+	StartDate        string         `json:"start_date"`
+	EndDate          string         `json:"end_date"`
+	CapacityMWH      float64        `json:"capacity_mwh"`
+	ReservePrice     float64        `json:"reserve_price"`
+	PricingRule      string         `json:"pricing_rule"`
+	BidDeadlineMS    int            `json:"bid_deadline_ms"`
+	RevealDeadlineMS int            `json:"reveal_deadline_ms"`
+	AuctionStatus    string         `json:"auction_status"`
+	ClearingPrice    float64        `json:"clearing_price"`
+	AllocatedMWH     float64        `json:"allocated_mwh"`
+	Bids             []auctionBid   `json:"bids"`
+	Awards           []auctionAward `json:"awards"`
+	CreatedDateMS    int            `json:"created_date_ms"`
+}
+
+// Highest price first, earlier bids first at the same price
+type bidsByPrice []auctionBid
+
+func (b bidsByPrice) Len() int      { return len(b) }
+func (b bidsByPrice) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b bidsByPrice) Less(i, j int) bool {
+	if b[i].Price != b[j].Price {
+		return b[i].Price > b[j].Price
+	}
+	return b[i].BidDateMS < b[j].BidDateMS
+}
+
+// Commitment a shipper submits for a sealed bid: the hex sha256 of
+// <AuctionID>|<ShipperID>|<Quantity MWh>|<Price>|<Salt>, using exactly the strings later passed to revealBid
+func bidCommitment(auctionID string, shipperID string, quantity string, price string, salt string) string {
+	hash := sha256.Sum256([]byte(auctionID + "|" + shipperID + "|" + quantity + "|" + price + "|" + salt))
+	return hex.EncodeToString(hash[:])
+}
+
+func (t *SimpleChaincode) getAuction(stub shim.ChaincodeStubInterface, auctionID string) (capacityAuction, error) {
+	var auctionObj capacityAuction
+
+	auctionObjBytes, _ := stub.GetState(auctionID)
+	if auctionObjBytes == nil {
+		return auctionObj, errors.New("Auction not found: " + auctionID)
+	}
+	_ = json.Unmarshal(auctionObjBytes, &auctionObj)
+	if auctionObj.AuctionID == "" {
+		return auctionObj, errors.New(auctionID + " is not an auction")
+	}
+	return auctionObj, nil
+}
+
+func (t *SimpleChaincode) saveAuction(stub shim.ChaincodeStubInterface, auctionObj capacityAuction) error {
+	auctionObjBytes, err := json.Marshal(&auctionObj)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(auctionObj.AuctionID, auctionObjBytes)
+}
+
+// Credit a company can still take on, or -1 when it trades without a credit facility
+func (t *SimpleChaincode) creditHeadroom(stub shim.ChaincodeStubInterface, companyID string) float64 {
+	var companyObj company
+
+	companyObjBytes, _ := stub.GetState(companyID)
+	_ = json.Unmarshal(companyObjBytes, &companyObj)
+	if !hasCreditFacility(companyObj) {
+		return -1
+	}
+	return companyObj.CreditLimit + companyObj.Collateral - t.calculateExposure(stub, companyObj).TotalExposure
+}
+
+// The transporter withholds daily capacity of one of its segments from its plan and auctions it for a period
+func (t *SimpleChaincode) createCapacityAuction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var segmentObj pipelineSegment
+	var auctionObj capacityAuction
+	var auctionIDList []string
+
+	fmt.Println("Entered function createCapacityAuction()")
+
+	if len(args) < 10 {
+		return nil, errors.New("Incorrect number of arguments. 10 expected (Auction ID, Transporter ID, Segment ID, Start Date, End Date, Daily Capacity MWh, Reserve Price, Pricing Rule Uniform/PayAsBid, Bid Deadline in MilliSecs, Reveal Deadline in MilliSecs) and optionally Current Date in MilliSecs")
+	}
+
+	existingBytes, _ := stub.GetState(args[0])
+	if existingBytes != nil {
+		return nil, errors.New("Auction already exists: " + args[0])
+	}
+
+	segmentObjBytes, _ := stub.GetState(segmentPrefix + args[2])
+	if segmentObjBytes == nil {
+		return nil, errors.New("Pipeline segment not found: " + args[2])
+	}
+	_ = json.Unmarshal(segmentObjBytes, &segmentObj)
+	if segmentObj.TransporterID != args[1] {
+		return nil, errors.New("Segment " + args[2] + " is operated by " + segmentObj.TransporterID)
+	}
+	if segmentObj.PlanID == "" {
+		return nil, errors.New("Segment " + args[2] + " is not backed by a business plan")
+	}
+	if !contains(auctionPricingRules, args[7]) {
+		return nil, errors.New("Pricing rule must be Uniform or PayAsBid, not " + args[7])
+	}
+
+	startDay, endDay, err := parseEffectivePeriod(args[3:5])
+	if err != nil {
+		return nil, err
+	}
+	if startDay == "" || endDay == "" {
+		return nil, errors.New("Auctions need a delivery start and end date")
+	}
+
+	auctionObj = capacityAuction{AuctionID: args[0], TransporterID: args[1], SegmentID: args[2], PlanID: segmentObj.PlanID, StartDate: startDay, EndDate: endDay,
+		PricingRule: args[7], AuctionStatus: "Open", Bids: []auctionBid{}, Awards: []auctionAward{}}
+	auctionObj.EntryLocation = segmentObj.FromPointID
+	pointObj, found := t.getNetworkPoint(stub, segmentObj.FromPointID)
+	if found && pointObj.PointName != "" {
+		auctionObj.EntryLocation = pointObj.PointName
+	}
+
+	auctionObj.CapacityMWH, err = strconv.ParseFloat(args[5], 64)
+	if err != nil || auctionObj.CapacityMWH <= 0 {
+		return nil, errors.New("Invalid auction capacity: " + args[5])
+	}
+	if auctionObj.CapacityMWH > segmentObj.CapacityMWH {
+		return nil, errors.New("Segment " + args[2] + " only has " + strconv.FormatFloat(segmentObj.CapacityMWH, 'f', -1, 64) + " MWh per day")
+	}
+	auctionObj.ReservePrice, err = strconv.ParseFloat(args[6], 64)
+	if err != nil || auctionObj.ReservePrice < 0 {
+		return nil, errors.New("Invalid reserve price: " + args[6])
+	}
+	auctionObj.BidDeadlineMS, _ = strconv.Atoi(args[8])
+	auctionObj.RevealDeadlineMS, _ = strconv.Atoi(args[9])
+	if auctionObj.RevealDeadlineMS <= auctionObj.BidDeadlineMS {
+		return nil, errors.New("The reveal deadline must be after the bid deadline")
+	}
+	if len(args) > 10 {
+		auctionObj.CreatedDateMS, _ = strconv.Atoi(args[10])
+	}
+
+	days, err := contractDays(contract{ContractStartDate: startDay, ContractEndDate: endDay})
+	if err != nil {
+		return nil, err
+	}
+	err = t.reserveCapacity(stub, auctionObj.PlanID, auctionObj.AuctionID, days, auctionObj.CapacityMWH)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.saveAuction(stub, auctionObj)
+	if err != nil {
+		return nil, err
+	}
+
+	auctionIDListBytes, _ := stub.GetState(auctionKey)
+	_ = json.Unmarshal(auctionIDListBytes, &auctionIDList)
+	auctionIDList = append(auctionIDList, auctionObj.AuctionID)
+	auctionIDListBytes, _ = json.Marshal(&auctionIDList)
+	_ = stub.PutState(auctionKey, auctionIDListBytes)
+
+	t.updateMasterKeyList(stub, []string{auctionObj.AuctionID})
+	t.updateMasterKeyList(stub, []string{auctionKey})
+	return nil, nil
+}
+
+// A shipper stores the commitment of its bid before the bid deadline. Bidding again replaces the earlier commitment.
+func (t *SimpleChaincode) submitSealedBid(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var companyObj company
+	var currentDate int
+	var replaced bool
+
+	fmt.Println("Entered function submitSealedBid()")
+
+	if len(args) < 4 {
+		return nil, errors.New("Incorrect number of arguments. 4 expected (Auction ID, Shipper ID, Commitment, Current Date in MilliSecs)")
+	}
+
+	auctionObj, err := t.getAuction(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	companyObjBytes, _ := stub.GetState(args[1])
+	_ = json.Unmarshal(companyObjBytes, &companyObj)
+	if companyObj.CompanyType != "Shipper" {
+		return nil, errors.New("Only shippers can bid, " + args[1] + " is not a shipper")
+	}
+
+	currentDate, _ = strconv.Atoi(args[3])
+	if auctionObj.AuctionStatus != "Open" || currentDate >= auctionObj.BidDeadlineMS {
+		return nil, errors.New("Auction " + args[0] + " no longer accepts bids")
+	}
+	if len(args[2]) != 64 {
+		return nil, errors.New("Commitment must be a hex encoded sha256 hash")
+	}
+
+	for i := range auctionObj.Bids {
+		if auctionObj.Bids[i].ShipperID == args[1] {
+			auctionObj.Bids[i].Commitment = args[2]
+			auctionObj.Bids[i].BidDateMS = currentDate
+			replaced = true
+		}
+	}
+	if !replaced {
+		auctionObj.Bids = append(auctionObj.Bids, auctionBid{ShipperID: args[1], Commitment: args[2], BidStatus: "Sealed", BidDateMS: currentDate})
+	}
+
+	err = t.saveAuction(stub, auctionObj)
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// After the bid deadline the shipper reveals quantity, price and salt, which must hash to its commitment
+func (t *SimpleChaincode) revealBid(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var currentDate int
+	var found bool
+
+	fmt.Println("Entered function revealBid()")
+
+	if len(args) < 6 {
+		return nil, errors.New("Incorrect number of arguments. 6 expected (Auction ID, Shipper ID, Daily Quantity MWh, Price, Salt, Current Date in MilliSecs)")
+	}
+
+	auctionObj, err := t.getAuction(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	currentDate, _ = strconv.Atoi(args[5])
+	if auctionObj.AuctionStatus != "Open" || currentDate < auctionObj.BidDeadlineMS || currentDate >= auctionObj.RevealDeadlineMS {
+		return nil, errors.New("Bids of auction " + args[0] + " cannot be revealed now")
+	}
+
+	quantity, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || quantity <= 0 {
+		return nil, errors.New("Invalid bid quantity: " + args[2])
+	}
+	price, err := strconv.ParseFloat(args[3], 64)
+	if err != nil || price < 0 {
+		return nil, errors.New("Invalid bid price: " + args[3])
+	}
+
+	for i := range auctionObj.Bids {
+		if auctionObj.Bids[i].ShipperID != args[1] {
+			continue
+		}
+		found = true
+		if auctionObj.Bids[i].Commitment != bidCommitment(args[0], args[1], args[2], args[3], args[4]) {
+			return nil, errors.New("Revealed bid does not match the commitment of " + args[1])
+		}
+		auctionObj.Bids[i].QuantityMWH = quantity
+		auctionObj.Bids[i].Price = price
+		auctionObj.Bids[i].BidStatus = "Revealed"
+		auctionObj.Bids[i].RevealDateMS = currentDate
+	}
+	if !found {
+		return nil, errors.New(args[1] + " has no bid in auction " + args[0])
+	}
+
+	err = t.saveAuction(stub, auctionObj)
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// After the reveal deadline the transporter clears the auction. Revealed bids at or above the reserve price win
+// from the highest price down until the capacity is allocated; bids beyond the bidder's credit headroom are passed
+// over. Under uniform pricing every winner pays the lowest winning price, or the reserve price when capacity is left
+// over; under pay-as-bid each winner pays its own price. Winners get transport contracts and unallocated capacity
+// goes back to the plan.
+func (t *SimpleChaincode) clearAuction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var currentDate int
+	var remaining, lowestPrice float64
+	var winners []auctionAward
+
+	fmt.Println("Entered function clearAuction()")
+
+	if len(args) < 3 {
+		return nil, errors.New("Incorrect number of arguments. 3 expected (Auction ID, Transporter ID, Current Date in MilliSecs)")
+	}
+
+	auctionObj, err := t.getAuction(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if auctionObj.TransporterID != args[1] {
+		return nil, errors.New("Only " + auctionObj.TransporterID + " can clear auction " + args[0])
+	}
+	if auctionObj.AuctionStatus != "Open" {
+		return nil, errors.New("Auction " + args[0] + " is already " + auctionObj.AuctionStatus)
+	}
+	currentDate, _ = strconv.Atoi(args[2])
+	if currentDate < auctionObj.RevealDeadlineMS {
+		return nil, errors.New("Auction " + args[0] + " cannot be cleared before its reveal deadline")
+	}
+
+	days, err := contractDays(contract{ContractStartDate: auctionObj.StartDate, ContractEndDate: auctionObj.EndDate})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(bidsByPrice(auctionObj.Bids))
+	remaining = auctionObj.CapacityMWH
+	for i := range auctionObj.Bids {
+		bid := &auctionObj.Bids[i]
+		if bid.BidStatus == "Sealed" {
+			bid.BidStatus = "Unrevealed"
+			continue
+		}
+		if bid.Price < auctionObj.ReservePrice {
+			bid.BidStatus = "BelowReserve"
+			continue
+		}
+		if remaining <= 0 {
+			bid.BidStatus = "Lost"
+			continue
+		}
+
+		quantity := minFloat(bid.QuantityMWH, remaining)
+		headroom := t.creditHeadroom(stub, bid.ShipperID)
+		if headroom >= 0 && quantity*float64(len(days))*bid.Price > headroom {
+			bid.BidStatus = "CreditRejected"
+			continue
+		}
+
+		remaining = remaining - quantity
+		lowestPrice = bid.Price
+		if quantity < bid.QuantityMWH {
+			bid.BidStatus = "PartiallyWon"
+		} else {
+			bid.BidStatus = "Won"
+		}
+		winners = append(winners, auctionAward{ShipperID: bid.ShipperID, QuantityMWH: quantity, Price: bid.Price})
+	}
+
+	auctionObj.ClearingPrice = lowestPrice
+	if remaining > 0 {
+		auctionObj.ClearingPrice = auctionObj.ReservePrice
+	}
+
+	//The withheld capacity is released and the winners book what they were awarded
+	err = t.releaseCapacity(stub, auctionObj.PlanID, auctionObj.AuctionID, days)
+	if err != nil {
+		return nil, err
+	}
+	for _, awardObj := range winners {
+		if auctionObj.PricingRule == "Uniform" {
+			awardObj.Price = auctionObj.ClearingPrice
+		}
+		awardObj.ContractID = t.nextFreeSequence(stub, marketContractKey, firstMarketContractID)
+
+		contractObj := contract{ContractID: awardObj.ContractID, InitiatorID: awardObj.ShipperID, ReceiverID: auctionObj.TransporterID,
+			EnergyMWH: awardObj.QuantityMWH * float64(len(days)), EntryLocation: auctionObj.EntryLocation,
+			ContractStartDate: auctionObj.StartDate, ContractEndDate: auctionObj.EndDate, PlanID: auctionObj.PlanID,
+			Pricing: contractPricing{PriceType: "Fixed", FixedPrice: awardObj.Price}}
+		err = t.addAwardedContract(stub, transportRequestKey, contractObj, auctionObj.TransporterID, currentDate)
+		if err != nil {
+			return nil, err
+		}
+
+		auctionObj.AllocatedMWH = auctionObj.AllocatedMWH + awardObj.QuantityMWH
+		auctionObj.Awards = append(auctionObj.Awards, awardObj)
+	}
+
+	auctionObj.AuctionStatus = "Cleared"
+	err = t.saveAuction(stub, auctionObj)
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// The transporter withdraws an auction that has not been cleared and the withheld capacity goes back to the plan
+func (t *SimpleChaincode) cancelAuction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Entered function cancelAuction()")
+
+	if len(args) < 2 {
+		return nil, errors.New("Incorrect number of arguments. 2 expected (Auction ID, Transporter ID)")
+	}
+
+	auctionObj, err := t.getAuction(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if auctionObj.TransporterID != args[1] {
+		return nil, errors.New("Only " + auctionObj.TransporterID + " can cancel auction " + args[0])
+	}
+	if auctionObj.AuctionStatus != "Open" {
+		return nil, errors.New("Auction " + args[0] + " is already " + auctionObj.AuctionStatus)
+	}
+
+	days, err := contractDays(contract{ContractStartDate: auctionObj.StartDate, ContractEndDate: auctionObj.EndDate})
+	if err != nil {
+		return nil, err
+	}
+	err = t.releaseCapacity(stub, auctionObj.PlanID, auctionObj.AuctionID, days)
+	if err != nil {
+		return nil, err
+	}
+
+	auctionObj.AuctionStatus = "Cancelled"
+	err = t.saveAuction(stub, auctionObj)
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (t *SimpleChaincode) getCapacityAuction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var returnMessage string
+
+	if len(args) < 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1 (Auction ID).")
+	}
+
+	auctionObj, err := t.getAuction(stub, args[0])
+	if err != nil {
+		returnMessage = "{\"statusCode\" : \"FAIL\", \"body\" : \"" + err.Error() + "\"}"
+		return []byte(returnMessage), nil
+	}
+
+	auctionObjBytes, _ := json.Marshal(&auctionObj)
+	returnMessage = "{\"statusCode\" : \"SUCCESS\", \"body\" : " + string(auctionObjBytes) + "}"
+	return []byte(returnMessage), nil
+}
+
+// All auctions, optionally only those a company runs or bids in
+func (t *SimpleChaincode) getCapacityAuctionList(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var returnMessage string
+	var auctionIDList []string
+	var auctionList = []capacityAuction{}
+
+	auctionIDListBytes, _ := stub.GetState(auctionKey)
+	_ = json.Unmarshal(auctionIDListBytes, &auctionIDList)
+
+	for _, k := range auctionIDList {
+		auctionObj, err := t.getAuction(stub, k)
+		if err != nil {
+			continue
+		}
+		if len(args) > 0 && args[0] != "" && auctionObj.TransporterID != args[0] {
+			var isBidder bool
+			for _, b := range auctionObj.Bids {
+				if b.ShipperID == args[0] {
+					isBidder = true
+				}
+			}
+			if !isBidder {
+				continue
+			}
+		}
+		auctionList = append(auctionList, auctionObj)
+	}
+
+	auctionListBytes, _ := json.Marshal(auctionList)
+	returnMessage = "{\"statusCode\" : \"SUCCESS\", \"body\" : " + string(auctionListBytes) + "}"
+	return []byte(returnMessage), nil
+}
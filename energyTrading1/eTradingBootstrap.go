@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Version of the bootstrap document format, documents must declare it as their schema_version
+var bootstrapSchemaVersion = 1
+
+var companyTypes = []string{"Buyer", "Shipper", "Producer", "Transporter"}
+
+// Operators run the network rather than trade on it, Admins may also reset it
+var userRoles = []string{"Admin", "Operator"}
+var operatorUserType = "operator" // operator_USERLIST
+
+// Minimum password length on production networks
+var minProductionPasswordLength = 8
+
+type networkConfig struct {
+	Name       string `json:"name"`
+	Production bool   `json:"production"`
+}
+
+type bootstrapDocument struct {
+	SchemaVersion int                `json:"schema_version"`
+	Network       networkConfig      `json:"network"`
+	Companies     []bootstrapCompany `json:"companies"`
+	Users         []bootstrapUser    `json:"users"`
+	Operators     []bootstrapUser    `json:"operators"`
+	Plans         []bootstrapPlan    `json:"plans"`
+	NetworkPoints []bootstrapPoint   `json:"network_points"`
+}
+
+type bootstrapCompany struct {
+	CompanyID       string  `json:"company_id"`
+	CompanyType     string  `json:"company_type"`
+	CompanyName     string  `json:"company_name"`
+	CompanyLocation string  `json:"company_location"`
+	BankBalance     float64 `json:"bank_balance"`
+}
+
+type bootstrapUser struct {
+	UserID    string `json:"user_id"`
+	Password  string `json:"password"`
+	CompanyID string `json:"company_id,omitempty"`
+	Role      string `json:"role,omitempty"`
+}
+
+// PlanDate defaults to the day of the bootstrap
+type bootstrapPlan struct {
+	PlanID        string  `json:"plan_id"`
+	CompanyID     string  `json:"company_id"`
+	PlanDate      string  `json:"plan_date,omitempty"`
+	GasPrice      float64 `json:"gas_price"`
+	EntryLocation string  `json:"entry_location"`
+	EntryCapacity int     `json:"entry_capacity"`
+	ExitLocation  string  `json:"exit_location"`
+	ExitCapacity  int     `json:"exit_capacity"`
+	EffectiveFrom string  `json:"effective_from,omitempty"`
+	EffectiveTo   string  `json:"effective_to,omitempty"`
+}
+
+type bootstrapPoint struct {
+	PointName string `json:"point_name"`
+	PointType string `json:"point_type"`
+}
+
+// Schema of the bootstrap document: the fields of the network object and of the entries of each list
+type schemaField struct {
+	Name     string
+	Kind     string // string, number, integer or boolean
+	Required bool
+	Enum     []string
+}
+
+var bootstrapSchema = map[string][]schemaField{
+	"network": {
+		{Name: "name", Kind: "string"},
+		{Name: "production", Kind: "boolean"}},
+	"companies": {
+		{Name: "company_id", Kind: "string", Required: true},
+		{Name: "company_type", Kind: "string", Required: true, Enum: companyTypes},
+		{Name: "company_name", Kind: "string", Required: true},
+		{Name: "company_location", Kind: "string"},
+		{Name: "bank_balance", Kind: "number"}},
+	"users": {
+		{Name: "user_id", Kind: "string", Required: true},
+		{Name: "password", Kind: "string", Required: true},
+		{Name: "company_id", Kind: "string", Required: true}},
+	"operators": {
+		{Name: "user_id", Kind: "string", Required: true},
+		{Name: "password", Kind: "string", Required: true},
+		{Name: "role", Kind: "string", Required: true, Enum: userRoles},
+		{Name: "company_id", Kind: "string"}},
+	"plans": {
+		{Name: "plan_id", Kind: "string", Required: true},
+		{Name: "company_id", Kind: "string", Required: true},
+		{Name: "plan_date", Kind: "string"},
+		{Name: "gas_price", Kind: "number", Required: true},
+		{Name: "entry_location", Kind: "string", Required: true},
+		{Name: "entry_capacity", Kind: "integer"},
+		{Name: "exit_location", Kind: "string", Required: true},
+		{Name: "exit_capacity", Kind: "integer"},
+		{Name: "effective_from", Kind: "string"},
+		{Name: "effective_to", Kind: "string"}},
+	"network_points": {
+		{Name: "point_name", Kind: "string", Required: true},
+		{Name: "point_type", Kind: "string", Required: true, Enum: pointTypes}},
+}
+
+// The former hardcoded seed data, users log in with their user ID as password
+var demoBootstrap = `{
+  "schema_version": 1,
+  "network": {"name": "demo", "production": false},
+  "companies": [
+    {"company_id": "BUYER1", "company_type": "Buyer", "company_name": "EnBW", "company_location": "Europe", "bank_balance": 100000},
+    {"company_id": "BUYER2", "company_type": "Buyer", "company_name": "Vattenfall", "company_location": "Europe", "bank_balance": 100000},
+    {"company_id": "SHIPPER1", "company_type": "Shipper", "company_name": "RWE Supply and Trading", "company_location": "Europe", "bank_balance": 100000},
+    {"company_id": "SHIPPER2", "company_type": "Shipper", "company_name": "UNIPER Energy Trading", "company_location": "Europe", "bank_balance": 100000},
+    {"company_id": "PRODUCER1", "company_type": "Producer", "company_name": "Dong Energy", "company_location": "Europe", "bank_balance": 100000},
+    {"company_id": "PRODUCER2", "company_type": "Producer", "company_name": "Gaz Promp", "company_location": "Europe", "bank_balance": 100000},
+    {"company_id": "TRANSPORTER1", "company_type": "Transporter", "company_name": "Open Grid Europe", "company_location": "Europe", "bank_balance": 100000},
+    {"company_id": "TRANSPORTER2", "company_type": "Transporter", "company_name": "ONTRAS GMBH", "company_location": "Europe", "bank_balance": 100000},
+    {"company_id": "TRANSPORTER3", "company_type": "Transporter", "company_name": "Gasunie DTS", "company_location": "Europe", "bank_balance": 100000}
+  ],
+  "users": [
+    {"user_id": "buyer1", "password": "buyer1", "company_id": "BUYER1"},
+    {"user_id": "buyer2", "password": "buyer2", "company_id": "BUYER2"},
+    {"user_id": "shipper1", "password": "shipper1", "company_id": "SHIPPER1"},
+    {"user_id": "shipper2", "password": "shipper2", "company_id": "SHIPPER2"},
+    {"user_id": "producer1", "password": "producer1", "company_id": "PRODUCER1"},
+    {"user_id": "producer2", "password": "producer2", "company_id": "PRODUCER2"},
+    {"user_id": "transporter1", "password": "transporter1", "company_id": "TRANSPORTER1"},
+    {"user_id": "transporter2", "password": "transporter2", "company_id": "TRANSPORTER2"},
+    {"user_id": "transporter3", "password": "transporter3", "company_id": "TRANSPORTER3"}
+  ],
+  "operators": [
+    {"user_id": "admin", "password": "admin", "role": "Admin"}
+  ],
+  "plans": [
+    {"plan_id": "SHIPPER1_PLAN", "company_id": "SHIPPER1", "gas_price": 14.0, "entry_location": "Europe", "entry_capacity": 0, "exit_location": "Bunder-Tief, Steinbrink", "exit_capacity": 0},
+    {"plan_id": "SHIPPER2_PLAN", "company_id": "SHIPPER2", "gas_price": 15.0, "entry_location": "Steinitz", "entry_capacity": 0, "exit_location": "Steinitz", "exit_capacity": 0},
+    {"plan_id": "PRODUCER1_PLAN", "company_id": "PRODUCER1", "gas_price": 12.0, "entry_location": "Wardenburg", "entry_capacity": 200, "exit_location": "Wardenburg", "exit_capacity": 200},
+    {"plan_id": "PRODUCER2_PLAN", "company_id": "PRODUCER2", "gas_price": 10.0, "entry_location": "Ellund", "entry_capacity": 300, "exit_location": "Ellund", "exit_capacity": 300},
+    {"plan_id": "TRANSPORTER1_PLAN", "company_id": "TRANSPORTER1", "gas_price": 11.0, "entry_location": "Wardenburg", "entry_capacity": 200, "exit_location": "Bunder-Tief", "exit_capacity": 100},
+    {"plan_id": "TRANSPORTER2_PLAN", "company_id": "TRANSPORTER2", "gas_price": 9.0, "entry_location": "Ellund", "entry_capacity": 300, "exit_location": "Steinbrink", "exit_capacity": 150},
+    {"plan_id": "TRANSPORTER3_PLAN", "company_id": "TRANSPORTER3", "gas_price": 8.0, "entry_location": "Ellund", "entry_capacity": 350, "exit_location": "Steinitz", "exit_capacity": 175}
+  ]
+}`
+
+// Checks a document against the schema, reporting every problem rather than the first
+func validateBootstrapSchema(docBytes []byte) []string {
+	var doc map[string]interface{}
+	var problems []string
+
+	decoder := json.NewDecoder(bytes.NewReader(docBytes))
+	decoder.UseNumber()
+	err := decoder.Decode(&doc)
+	if err != nil {
+		return []string{"not a JSON object: " + err.Error()}
+	}
+
+	for key, value := range doc {
+		if value == nil {
+			continue
+		}
+		if key == "schema_version" {
+			version, ok := value.(json.Number)
+			if !ok || version.String() != strconv.Itoa(bootstrapSchemaVersion) {
+				problems = append(problems, "schema_version: must be "+strconv.Itoa(bootstrapSchemaVersion))
+			}
+			continue
+		}
+		fields, known := bootstrapSchema[key]
+		if !known {
+			problems = append(problems, key+": unknown section")
+			continue
+		}
+		if key == "network" {
+			problems = append(problems, validateSchemaObject(key, value, fields)...)
+			continue
+		}
+		entries, ok := value.([]interface{})
+		if !ok {
+			problems = append(problems, key+": must be a list")
+			continue
+		}
+		for i, entry := range entries {
+			problems = append(problems, validateSchemaObject(key+"["+strconv.Itoa(i)+"]", entry, fields)...)
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+func validateSchemaObject(path string, value interface{}, fields []schemaField) []string {
+	var problems []string
+
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return []string{path + ": must be an object"}
+	}
+
+	known := make(map[string]bool)
+	for _, field := range fields {
+		known[field.Name] = true
+		fieldValue, present := object[field.Name]
+		if !present || fieldValue == nil {
+			if field.Required {
+				problems = append(problems, path+"."+field.Name+": required")
+			}
+			continue
+		}
+
+		switch field.Kind {
+		case "string":
+			text, isString := fieldValue.(string)
+			if !isString {
+				problems = append(problems, path+"."+field.Name+": must be a string")
+			} else if field.Required && strings.TrimSpace(text) == "" {
+				problems = append(problems, path+"."+field.Name+": must not be empty")
+			} else if field.Enum != nil && !contains(field.Enum, text) {
+				problems = append(problems, path+"."+field.Name+": must be one of "+strings.Join(field.Enum, ", "))
+			}
+		case "number", "integer":
+			number, isNumber := fieldValue.(json.Number)
+			if !isNumber {
+				problems = append(problems, path+"."+field.Name+": must be a number")
+			} else if _, err := number.Int64(); field.Kind == "integer" && err != nil {
+				problems = append(problems, path+"."+field.Name+": must be a whole number")
+			} else if value, _ := number.Float64(); value < 0 {
+				problems = append(problems, path+"."+field.Name+": must not be negative")
+			}
+		case "boolean":
+			if _, isBool := fieldValue.(bool); !isBool {
+				problems = append(problems, path+"."+field.Name+": must be true or false")
+			}
+		}
+	}
+	for k := range object {
+		if !known[k] {
+			problems = append(problems, path+"."+k+": unknown field")
+		}
+	}
+	return problems
+}
+
+// Checks what the schema cannot: unique IDs, references between sections and production password rules.
+// Users, companies and plans share the key space of the ledger, so their IDs must not clash either.
+func validateBootstrapReferences(doc bootstrapDocument) []string {
+	var problems []string
+	companyTypeByID := make(map[string]string)
+	keyOwner := make(map[string]string)
+	pointIDs := make(map[string]bool)
+
+	claimKey := func(key string, owner string) {
+		if previous, taken := keyOwner[key]; taken {
+			problems = append(problems, owner+": ID "+key+" is already used by "+previous)
+			return
+		}
+		keyOwner[key] = owner
+	}
+
+	for i, k := range doc.Companies {
+		claimKey(k.CompanyID, "companies["+strconv.Itoa(i)+"]")
+		companyTypeByID[k.CompanyID] = k.CompanyType
+	}
+
+	checkUser := func(path string, userObj bootstrapUser) {
+		claimKey(userObj.UserID, path)
+		if userObj.CompanyID != "" && companyTypeByID[userObj.CompanyID] == "" {
+			problems = append(problems, path+".company_id: unknown company "+userObj.CompanyID)
+		}
+		if doc.Network.Production && (userObj.Password == userObj.UserID || len(userObj.Password) < minProductionPasswordLength) {
+			problems = append(problems, path+".password: production networks need passwords of at least "+
+				strconv.Itoa(minProductionPasswordLength)+" characters that differ from the user ID")
+		}
+	}
+	for i, k := range doc.Users {
+		checkUser("users["+strconv.Itoa(i)+"]", k)
+	}
+	for i, k := range doc.Operators {
+		checkUser("operators["+strconv.Itoa(i)+"]", k)
+	}
+
+	for i, k := range doc.Plans {
+		path := "plans[" + strconv.Itoa(i) + "]"
+		claimKey(k.PlanID, path)
+		companyType := companyTypeByID[k.CompanyID]
+		if companyType == "" {
+			problems = append(problems, path+".company_id: unknown company "+k.CompanyID)
+		} else if companyType == "Buyer" {
+			problems = append(problems, path+".company_id: buyers have no business plans")
+		}
+	}
+
+	for i, k := range doc.NetworkPoints {
+		pointID := networkPointID(k.PointName)
+		if pointIDs[pointID] {
+			problems = append(problems, "network_points["+strconv.Itoa(i)+"]: point "+k.PointName+" is listed twice")
+		}
+		pointIDs[pointID] = true
+	}
+	return problems
+}
+
+// Validates a bootstrap document, an empty one starts an empty ledger
+func parseBootstrap(docBytes []byte) (bootstrapDocument, error) {
+	var doc bootstrapDocument
+
+	problems := validateBootstrapSchema(docBytes)
+	if len(problems) == 0 {
+		_ = json.Unmarshal(docBytes, &doc)
+		problems = validateBootstrapReferences(doc)
+		problems = append(problems, normalizePlanPeriods(doc.Plans)...)
+	}
+	if len(problems) > 0 {
+		return doc, errors.New("Invalid bootstrap document: " + strings.Join(problems, "; "))
+	}
+	doc.SchemaVersion = bootstrapSchemaVersion
+	return doc, nil
+}
+
+// Effective periods of plans are stored as YYYY-MM-DD, as createBusinessPlan stores them when invoked
+func normalizePlanPeriods(planList []bootstrapPlan) []string {
+	var problems []string
+	var err error
+
+	for i := range planList {
+		planList[i].EffectiveFrom, planList[i].EffectiveTo, err = parseEffectivePeriod([]string{planList[i].EffectiveFrom, planList[i].EffectiveTo})
+		if err != nil {
+			problems = append(problems, "plans["+strconv.Itoa(i)+"]: "+err.Error())
+		}
+	}
+	return problems
+}
+
+// The argument of Init: empty, "demo" or a bootstrap document
+func bootstrapArgument(args []string) []byte {
+	if len(args) == 0 || strings.TrimSpace(args[0]) == "" {
+		return []byte("{}")
+	}
+	if args[0] == "demo" {
+		return []byte(demoBootstrap)
+	}
+	return []byte(args[0])
+}
+
+func (t *SimpleChaincode) applyBootstrap(stub shim.ChaincodeStubInterface, doc bootstrapDocument) error {
+	var compIDArr CompanyIDList
+	var bpIDList BusinessPlanIDList
+	userIDArrs := make(map[string]UserIDList)
+	companyTypeByID := make(map[string]string)
+
+	masterKeyList := []string{companyKey, tradeRequestKey, transportRequestKey, gasRequestKey, planKey, bootstrapKey, networkConfigKey,
+		operatorUserType + userIDAffix}
+	for _, k := range companyTypes {
+		masterKeyList = append(masterKeyList, strings.ToLower(k)+userIDAffix)
+	}
+
+	year, month, day := time.Now().Date()
+	currentDateStr := strconv.Itoa(day) + "/" + strconv.Itoa(int(month)) + "/" + strconv.Itoa(year)
+
+	for _, k := range doc.Companies {
+		t.addCompany(stub, compIDArr, k.CompanyID, k.CompanyType, k.CompanyName, k.CompanyLocation, k.BankBalance, 0)
+		compIDArr = append(compIDArr, k.CompanyID)
+		companyTypeByID[k.CompanyID] = k.CompanyType
+		masterKeyList = append(masterKeyList, k.CompanyID, k.CompanyID+iotKeyAffix)
+	}
+
+	for _, k := range doc.Users {
+		companyType := companyTypeByID[k.CompanyID]
+		t.addUser(stub, userIDArrs[companyType], k.UserID, k.Password, k.CompanyID, companyType)
+		userIDArrs[companyType] = append(userIDArrs[companyType], k.UserID)
+		masterKeyList = append(masterKeyList, k.UserID)
+	}
+
+	//Operators keep their role on the user record
+	for _, k := range doc.Operators {
+		userObjBytes, _ := json.Marshal(&user{UserID: k.UserID, Password: k.Password, CompanyID: k.CompanyID, Role: k.Role})
+		err := stub.PutState(k.UserID, userObjBytes)
+		if err != nil {
+			return err
+		}
+		userIDArrs[operatorUserType] = append(userIDArrs[operatorUserType], k.UserID)
+		masterKeyList = append(masterKeyList, k.UserID)
+	}
+	operatorIDArrBytes, _ := json.Marshal(userIDArrs[operatorUserType])
+	_ = stub.PutState(operatorUserType+userIDAffix, operatorIDArrBytes)
+
+	for _, k := range doc.Plans {
+		planDate := k.PlanDate
+		if planDate == "" {
+			planDate = currentDateStr
+		}
+		_, err := t.createBusinessPlan(stub, bpIDList, k.PlanID, planDate, k.GasPrice, k.EntryLocation, k.EntryCapacity,
+			k.ExitLocation, k.ExitCapacity, k.CompanyID, k.EffectiveFrom, k.EffectiveTo)
+		if err != nil {
+			return err
+		}
+		bpIDList = append(bpIDList, k.PlanID)
+		masterKeyList = append(masterKeyList, k.PlanID)
+	}
+
+	for _, k := range doc.NetworkPoints {
+		err := t.saveNetworkPoint(stub, networkPoint{PointID: networkPointID(k.PointName), PointName: strings.TrimSpace(k.PointName), PointType: k.PointType})
+		if err != nil {
+			return err
+		}
+	}
+
+	networkConfigBytes, _ := json.Marshal(&doc.Network)
+	_ = stub.PutState(networkConfigKey, networkConfigBytes)
+
+	//Kept so a reset can load the same data again
+	docBytes, _ := json.Marshal(&doc)
+	_ = stub.PutState(bootstrapKey, docBytes)
+
+	t.updateMasterKeyList(stub, masterKeyList)
+	fmt.Println("Bootstrapped network " + doc.Network.Name + " with " + strconv.Itoa(len(doc.Companies)) + " companies")
+	return nil
+}
+
+func (t *SimpleChaincode) getNetworkConfig(stub shim.ChaincodeStubInterface) networkConfig {
+	var configObj networkConfig
+
+	configObjBytes, _ := stub.GetState(networkConfigKey)
+	_ = json.Unmarshal(configObjBytes, &configObj)
+	return configObj
+}
+
+// The document the network was bootstrapped with, without passwords
+func (t *SimpleChaincode) getBootstrap(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var doc bootstrapDocument
+
+	docBytes, _ := stub.GetState(bootstrapKey)
+	if docBytes == nil {
+		return []byte("{\"statusCode\" : \"FAIL\", \"body\" : \"The network was not bootstrapped\"}"), nil
+	}
+	_ = json.Unmarshal(docBytes, &doc)
+
+	for i := range doc.Users {
+		doc.Users[i].Password = ""
+	}
+	for i := range doc.Operators {
+		doc.Operators[i].Password = ""
+	}
+	docBytes, _ = json.Marshal(&doc)
+	return []byte("{\"statusCode\" : \"SUCCESS\", \"body\" : " + string(docBytes) + "}"), nil
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Longest delivery period that can be booked, about five years of days
+var maxBookingDays = 1830
+
+// Capacity of a plan on one delivery day and the quantities reserved against it per holder (contract or auction ID)
+type capacityDay struct {
+	PlanID       string             `json:"plan_id"`
+	Day          string             `json:"day"`
+	CapacityMWH  float64            `json:"capacity_mwh"`
+	ReservedMWH  float64            `json:"reserved_mwh"`
+	Reservations map[string]float64 `json:"reservations"`
+}
+
+type capacityProfileDay struct {
+	Day            string  `json:"day"`
+	CapacityMWH    float64 `json:"capacity_mwh"`
+	ReservedMWH    float64 `json:"reserved_mwh"`
+	AvailableMWH   float64 `json:"available_mwh"`
+	UtilisationPct float64 `json:"utilisation_pct"`
+}
+
+// Delivery days of a contract, start and end date included
+func contractDays(contractObj contract) ([]string, error) {
+	var days []string
+
+	startDate, err := parseDate(contractObj.ContractStartDate)
+	if err != nil {
+		return nil, err
+	}
+	endDate, err := parseDate(contractObj.ContractEndDate)
+	if err != nil {
+		return nil, err
+	}
+	if endDate.Before(startDate) {
+		return nil, errors.New("Contract " + strconv.Itoa(contractObj.ContractID) + " ends before it starts")
+	}
+
+	for day := startDate; !day.After(endDate); day = day.Add(24 * time.Hour) {
+		days = append(days, day.Format("2006-01-02"))
+		if len(days) > maxBookingDays {
+			return nil, errors.New("Delivery period of contract " + strconv.Itoa(contractObj.ContractID) + " is too long to book")
+		}
+	}
+	return days, nil
+}
+
+// Plan the contract books capacity on: the one named on the contract, otherwise the receiver's plan serving
+// the entry location, otherwise its main plan. Only producers and transporters hold capacity.
+func (t *SimpleChaincode) bookingPlan(stub shim.ChaincodeStubInterface, contractObj contract) string {
+	var receiverObj company
+	var planObj businessPlan
+
+	receiverObjBytes, _ := stub.GetState(contractObj.ReceiverID)
+	_ = json.Unmarshal(receiverObjBytes, &receiverObj)
+	if receiverObj.CompanyType != "Producer" && receiverObj.CompanyType != "Transporter" {
+		return ""
+	}
+
+	if contractObj.PlanID != "" {
+		return contractObj.PlanID
+	}
+
+	planIDList := t.getCompanyPlanIDs(stub, contractObj.ReceiverID)
+	for _, k := range planIDList {
+		planObjBytes, _ := stub.GetState(k)
+		_ = json.Unmarshal(planObjBytes, &planObj)
+		if planHasLocation(planObj, contractObj.EntryLocation) {
+			return k
+		}
+	}
+	if len(planIDList) > 0 {
+		return planIDList[0]
+	}
+	return ""
+}
+
+func (t *SimpleChaincode) getCapacityDay(stub shim.ChaincodeStubInterface, planID string, day string) capacityDay {
+	var capacityObj capacityDay
+
+	capacityObjBytes, _ := stub.GetState(planID + capacityAffix + day)
+	if capacityObjBytes != nil {
+		_ = json.Unmarshal(capacityObjBytes, &capacityObj)
+	} else {
+		capacityObj = capacityDay{PlanID: planID, Day: day}
+	}
+	if capacityObj.Reservations == nil {
+		capacityObj.Reservations = map[string]float64{}
+	}
+
+	//Capacity follows the plan version in effect on the day
+	planObj, found := t.getPlanInEffect(stub, planID, day)
+	if found {
+		capacityObj.CapacityMWH = float64(planCapacity(planObj))
+	} else {
+		capacityObj.CapacityMWH = 0
+	}
+	return capacityObj
+}
+
+func (t *SimpleChaincode) saveCapacityDay(stub shim.ChaincodeStubInterface, capacityObj capacityDay) error {
+	var dayList []string
+	var key = capacityObj.PlanID + capacityAffix + capacityObj.Day
+
+	capacityObj.ReservedMWH = 0
+	for _, v := range capacityObj.Reservations {
+		capacityObj.ReservedMWH = capacityObj.ReservedMWH + v
+	}
+
+	capacityObjBytes, err := json.Marshal(&capacityObj)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(key, capacityObjBytes)
+	if err != nil {
+		return err
+	}
+
+	var arrKey = capacityObj.PlanID + capacityDayAffix
+	dayListBytes, _ := stub.GetState(arrKey)
+	_ = json.Unmarshal(dayListBytes, &dayList)
+	if !contains(dayList, capacityObj.Day) {
+		dayList = append(dayList, capacityObj.Day)
+		sort.Strings(dayList)
+		dayListBytes, _ = json.Marshal(&dayList)
+		_ = stub.PutState(arrKey, dayListBytes)
+		t.updateMasterKeyList(stub, []string{key})
+		t.updateMasterKeyList(stub, []string{arrKey})
+	}
+	return nil
+}
+
+// Capacity of the day left for the holder: the plan capacity less what all other holders reserved
+func availableCapacity(capacityObj capacityDay, holder string) float64 {
+	available := capacityObj.CapacityMWH
+	for k, v := range capacityObj.Reservations {
+		if k != holder {
+			available = available - v
+		}
+	}
+	return available
+}
+
+// Least capacity left for a new booking on the booked days of a plan from fromDay to toDay (YYYY-MM-DD, empty
+// for an open end). Days nothing is booked on have the full plan capacity.
+func (t *SimpleChaincode) planAvailableCapacity(stub shim.ChaincodeStubInterface, planObj businessPlan, fromDay string, toDay string) float64 {
+	var dayList []string
+
+	available := float64(planCapacity(planObj))
+	dayListBytes, _ := stub.GetState(planObj.PlanID + capacityDayAffix)
+	_ = json.Unmarshal(dayListBytes, &dayList)
+	for _, day := range dayList {
+		if fromDay != "" && day < fromDay || toDay != "" && day > toDay {
+			continue
+		}
+		dayAvailable := availableCapacity(t.getCapacityDay(stub, planObj.PlanID, day), "")
+		if dayAvailable < available {
+			available = dayAvailable
+		}
+	}
+	return available
+}
+
+// Reserves dailyMWH on every day for the holder, replacing what it held before. Nothing is written unless every day fits.
+func (t *SimpleChaincode) reserveCapacity(stub shim.ChaincodeStubInterface, planID string, holder string, days []string, dailyMWH float64) error {
+	var capacityList []capacityDay
+
+	for _, day := range days {
+		capacityObj := t.getCapacityDay(stub, planID, day)
+		available := availableCapacity(capacityObj, holder)
+		if dailyMWH > available {
+			return errors.New("Insufficient capacity on plan " + planID + " for " + day + ": " + strconv.FormatFloat(available, 'f', 2, 64) +
+				" MWh available, " + strconv.FormatFloat(dailyMWH, 'f', 2, 64) + " MWh requested")
+		}
+		capacityObj.Reservations[holder] = dailyMWH
+		capacityList = append(capacityList, capacityObj)
+	}
+
+	for _, capacityObj := range capacityList {
+		err := t.saveCapacityDay(stub, capacityObj)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *SimpleChaincode) releaseCapacity(stub shim.ChaincodeStubInterface, planID string, holder string, days []string) error {
+	for _, day := range days {
+		capacityObj := t.getCapacityDay(stub, planID, day)
+		if _, found := capacityObj.Reservations[holder]; !found {
+			continue
+		}
+		delete(capacityObj.Reservations, holder)
+		err := t.saveCapacityDay(stub, capacityObj)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Books the contract quantity, spread evenly over its delivery days, on the receiver's plan
+func (t *SimpleChaincode) reserveContractCapacity(stub shim.ChaincodeStubInterface, contractObj *contract) error {
+	planID := t.bookingPlan(stub, *contractObj)
+	if planID == "" {
+		return nil
+	}
+
+	days, err := contractDays(*contractObj)
+	if err != nil {
+		return err
+	}
+
+	err = t.reserveCapacity(stub, planID, strconv.Itoa(contractObj.ContractID), days, contractObj.EnergyMWH/float64(len(days)))
+	if err != nil {
+		return err
+	}
+
+	contractObj.PlanID = planID
+	return nil
+}
+
+func (t *SimpleChaincode) releaseContractCapacity(stub shim.ChaincodeStubInterface, contractObj contract) error {
+	if contractObj.PlanID == "" {
+		return nil
+	}
+
+	days, err := contractDays(contractObj)
+	if err != nil {
+		return err
+	}
+	return t.releaseCapacity(stub, contractObj.PlanID, strconv.Itoa(contractObj.ContractID), days)
+}
+
+// Capacity, reservations and utilisation of a plan per booked day, optionally limited to a period
+func (t *SimpleChaincode) getCapacityProfile(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var returnMessage, fromDay, toDay string
+	var dayList []string
+	var profile []capacityProfileDay
+
+	if len(args) < 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1 (Plan ID) and optionally From Date, To Date.")
+	}
+
+	fromDay, toDay, err := parseEffectivePeriod(args[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Getting capacity profile of plan " + args[0])
+
+	dayListBytes, _ := stub.GetState(args[0] + capacityDayAffix)
+	_ = json.Unmarshal(dayListBytes, &dayList)
+
+	for _, day := range dayList {
+		if fromDay != "" && day < fromDay || toDay != "" && day > toDay {
+			continue
+		}
+		capacityObj := t.getCapacityDay(stub, args[0], day)
+		profileDay := capacityProfileDay{Day: day, CapacityMWH: capacityObj.CapacityMWH}
+		for _, v := range capacityObj.Reservations {
+			profileDay.ReservedMWH = profileDay.ReservedMWH + v
+		}
+		profileDay.AvailableMWH = profileDay.CapacityMWH - profileDay.ReservedMWH
+		if profileDay.CapacityMWH > 0 {
+			profileDay.UtilisationPct = profileDay.ReservedMWH * 100 / profileDay.CapacityMWH
+		}
+		profile = append(profile, profileDay)
+	}
+	if profile == nil {
+		profile = []capacityProfileDay{}
+	}
+
+	profileBytes, err := json.Marshal(&profile)
+	if err != nil {
+		return nil, err
+	}
+
+	returnMessage = "{\"statusCode\" : \"SUCCESS\", \"body\" : " + string(profileBytes) + "}"
+	return []byte(returnMessage), nil
+}
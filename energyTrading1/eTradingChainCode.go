@@ -22,6 +22,40 @@ var planIDAffix = "_PLAN"      // <CompanyID>_PLAN
 var iotKeyAffix = "_IOTDATA"    //<CompanyID>_IOTDATA
 var invoiceAffix = "_INVOICELIST"   //<ContractID>_INVOICELIST
 var incidentAffix = "_INCIDENTLIST" //<ContractID>_INCIDENTLIST
+var marginCallAffix = "_MARGINCALLLIST" //<CompanyID>_MARGINCALLLIST
+var ledgerAffix = "_LEDGER"         //<CompanyID>_LEDGER
+var settlementKey = "SETTLEMENTIDLIST"
+var settlementPrefix = "SETTLEMENT_" //SETTLEMENT_<SettlementID>
+var disputeKey = "DISPUTEIDLIST"
+var disputePrefix = "DISPUTE_"      //DISPUTE_<DisputeID>, credit notes DISPUTE_<DisputeID>_CN
+var disputeAffix = "_DISPUTELIST"   //<ContractID>_DISPUTELIST
+var creditNoteAffix = "_CREDITNOTELIST" //<ContractID>_CREDITNOTELIST
+var offerAffix = "_OFFERLIST"       //<ContractID>_OFFERLIST
+var indexPrefix = "INDEX_"          //INDEX_<IndexName>_<YYYY-MM-DD>
+var indexDayAffix = "_DAYLIST"      //INDEX_<IndexName>_DAYLIST
+var planListAffix = "_PLANLIST"     //<CompanyID>_PLANLIST
+var planVersionAffix = "_VERSIONLIST" //<PlanID>_VERSIONLIST, versions are stored as <PlanID>_V<Version>
+var capacityAffix = "_CAP_"         //<PlanID>_CAP_<YYYY-MM-DD>
+var capacityDayAffix = "_CAPDAYLIST" //<PlanID>_CAPDAYLIST
+var networkPointKey = "NETWORKPOINTLIST"
+var networkSegmentKey = "SEGMENTIDLIST"
+var pointPrefix = "POINT_"          //POINT_<PointID>
+var segmentPrefix = "SEGMENT_"      //SEGMENT_<SegmentID>
+var dealKey = "DEALIDLIST"
+var nominationAffix = "_NOMINATIONLIST" //<ContractID>_NOMINATIONLIST
+var nominationConfigKey = "NOMINATIONCONFIG"
+var orderBookKey = "ORDERBOOKLIST"
+var bookPrefix = "BOOK_"            //BOOK_<PointID>_<StartDay>_<EndDay>
+var orderAffix = "_ORDERLIST"       //<CompanyID>_ORDERLIST
+var orderSequenceKey = "ORDERSEQUENCE"
+var marketContractKey = "MARKETCONTRACTID"
+var auctionKey = "AUCTIONIDLIST"
+var imbalanceConfigKey = "IMBALANCECONFIG"
+var imbalanceAffix = "_IMBALANCELIST"  //<ShipperID>_IMBALANCELIST, accounts are stored as <ShipperID>_IMB_<YYYY-MM-DD>
+var imbalanceInvoiceKey = "IMBALANCEINVOICEID"
+var bootstrapKey = "BOOTSTRAP"
+var networkConfigKey = "NETWORKCONFIG"
+var importStatusKey = "IMPORTSTATUS"
 
 type SimpleChaincode struct {
 
@@ -34,12 +68,16 @@ type company struct {
 	CompanyLocation	string	`json:"company_location"`
 	BankBalance		float64	`json:"bank_balance"`
     BalanceUpdatedDateMS		int	`json:"bank_balance_date_ms"`
+    CreditLimit		float64	`json:"credit_limit"`
+    Collateral		float64	`json:"collateral"`
+    MarginCallPct	float64	`json:"margin_call_pct"`
 }
 
 type user struct {
 	UserID		    string 	`json:"user_id"`
 	Password 		string	`json:"user_password"`
     CompanyID 		string 	`json:"company_id"`
+    Role 		    string 	`json:"user_role,omitempty"`
 }
 
 type businessPlan struct {
@@ -51,10 +89,14 @@ type businessPlan struct {
 	ExitLocation 	string	`json:"bp_exit_location"`
 	ExitCapacity	int	    `json:"bp_exit_capacity"`
     CompanyID 		string 	`json:"bp_company_id"`
+    Version 		int 	`json:"bp_version"`
+    EffectiveFrom 	string 	`json:"bp_effective_from"`
+    EffectiveTo 	string 	`json:"bp_effective_to"`
 }
 
 type userInfo struct {
 	UserID		 string 	  `json:"user_id"`
+    Role 		 string 	  `json:"user_role,omitempty"`
     Company 	 company      `json:"company"`
     BusinessPlan businessPlan `json:"business_plan"`
 }
@@ -73,6 +115,12 @@ type contract struct {
 	ContractStartDate  string  `json:"contract_start_date"`
 	ContractEndDate    string  `json:"contract_end_date"`
 	ContractStatus     string  `json:"contract_status"`
+	PenaltyRate        float64 `json:"contract_penalty_rate"`
+	OfferVersion       int     `json:"contract_offer_version"`
+	AcceptedOfferVersion int   `json:"contract_accepted_offer_version"`
+	Pricing            contractPricing `json:"contract_pricing"`
+	PlanID             string  `json:"contract_plan_id"`
+	DealID             string  `json:"contract_deal_id"`
 }
 
 type contractInfo struct {
@@ -82,6 +130,7 @@ type contractInfo struct {
     BusinessPlan     businessPlan `json:"business_plan"`
     InvoiceList     []invoice   `json:"invoice_list"`
     IncidentList    []incident  `json:"incident_list"`
+    OfferList       []contractOffer `json:"offer_list"`
 }
 
 type flowMeterData struct {
@@ -101,6 +150,14 @@ type invoice struct {
 	PaymentStatus      string  `json:"payment_status"`
 	PaymentDateMS      int     `json:"payment_date_ms"`
     ContractID         int     `json:"contract_id"`
+    SettlementID       string  `json:"settlement_id"`
+    Adjustments        []invoiceAdjustment `json:"adjustments"`
+    EnergyMWH          float64 `json:"energy_mwh"`
+    UnitPrice          float64 `json:"unit_price"`
+    Amount             float64 `json:"amount"`
+    InvoiceType        string  `json:"invoice_type"`
+    PayerID            string  `json:"payer_id"`
+    PayeeID            string  `json:"payee_id"`
 }
 
 type incident struct {
@@ -110,124 +167,35 @@ type incident struct {
 	ExpectedEnergyMWH   float64 `json:"expected_energy_mwh"`
     ActualEnergyMWH     float64 `json:"actual_energy_mwh"`
     ContractID          int     `json:"contract_id"`
+    ResponsibleParty    string  `json:"responsible_party"`
+    RootCause           string  `json:"root_cause"`
+    ResolutionComments  string  `json:"resolution_comments"`
+    PenaltyAmount       float64 `json:"penalty_amount"`
+    PenaltyStatus       string  `json:"penalty_status"`
+    PenaltyInvoiceID    int     `json:"penalty_invoice_id"`
+    StatusHistory       []incidentStatusChange `json:"status_history"`
 }
 
 type CompanyIDList []string
 type UserIDList []string
 type BusinessPlanIDList []string
 
-func main() {
-	err := shim.Start(new(SimpleChaincode))
-	if err != nil {
-		fmt.Printf("Error starting Simple chaincode: %s", err)
-	}
-	
-}
-
+// Init loads the reference data of the network from a bootstrap document: companies, their users,
+// operators, business plans and network points. Without a document the ledger starts empty, "demo"
+// loads the demo bundle.
 func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, functionName string, args []string) ([]byte, error) {
-    //Initialize master keys list
-    masterKeyList := []string{companyKey, tradeRequestKey, transportRequestKey, gasRequestKey, planKey, 
-                              "buyer"+ userIDAffix, "shipper"+ userIDAffix, "producer"+ userIDAffix, "transporter"+ userIDAffix,
-                             "BUYER1"+ iotKeyAffix, "BUYER2"+ iotKeyAffix, "PRODUCER1"+ iotKeyAffix, "PRODUCER2"+ iotKeyAffix, "TRANSPORTER1"+ iotKeyAffix, "TRANSPORTER2" + iotKeyAffix, "TRANSPORTER3" + iotKeyAffix}
-    
-    var currentDate int
-    currentDate = 0
-    
-    var currentDateStr string
-    year, month, day := time.Now().Date()
-    var monthInNumber int = int(month) //convert time.Month to integer
-    currentDateStr = strconv.Itoa(day) + "/" + strconv.Itoa(monthInNumber) + "/" + strconv.Itoa(year)
-    
-    //Create default companies
-    var compIDArr CompanyIDList
-    t.addCompany (stub, compIDArr, "BUYER1", "Buyer", "EnBW", "Europe", 100000, currentDate)
-    compIDArr = append(compIDArr, "BUYER1")
-    t.addCompany (stub, compIDArr, "BUYER2", "Buyer", "Vattenfall", "Europe", 100000, currentDate)
-    compIDArr = append(compIDArr, "BUYER2")
-    
-    t.addCompany (stub, compIDArr, "SHIPPER1", "Shipper", "RWE Supply and Trading", "Europe", 100000, currentDate)
-    compIDArr = append(compIDArr, "SHIPPER1")
-    t.addCompany (stub, compIDArr, "SHIPPER2", "Shipper", "UNIPER Energy Trading", "Europe", 100000, currentDate)
-    compIDArr = append(compIDArr, "SHIPPER2")
-    
-    t.addCompany (stub, compIDArr, "PRODUCER1", "Producer", "Dong Energy", "Europe", 100000, currentDate)
-    compIDArr = append(compIDArr, "PRODUCER1")
-    t.addCompany (stub, compIDArr, "PRODUCER2", "Producer", "Gaz Promp", "Europe", 100000, currentDate)
-    compIDArr = append(compIDArr, "PRODUCER2")
-    
-    t.addCompany (stub, compIDArr, "TRANSPORTER1", "Transporter", "Open Grid Europe", "Europe", 100000, currentDate)
-    compIDArr = append(compIDArr, "TRANSPORTER1")
-    t.addCompany (stub, compIDArr, "TRANSPORTER2", "Transporter", "ONTRAS GMBH", "Europe", 100000, currentDate)
-    compIDArr = append(compIDArr, "TRANSPORTER2")
-    t.addCompany (stub, compIDArr, "TRANSPORTER3", "Transporter", "Gasunie DTS", "Europe", 100000, currentDate)
-    compIDArr = append(compIDArr, "TRANSPORTER3")
-    
-    masterKeyList = append(masterKeyList, compIDArr...)
-    
-	//create default users
-	var userIDArr UserIDList
-    t.addUser(stub, userIDArr, "buyer1", "buyer1", "BUYER1", "Buyer")	
-    userIDArr = append(userIDArr, "buyer1")
-    t.addUser(stub, userIDArr, "buyer2", "buyer2", "BUYER2", "Buyer")	
-    userIDArr = append(userIDArr, "buyer2")
-    
-    t.addUser(stub, userIDArr, "shipper1", "shipper1", "SHIPPER1", "Shipper")	
-    userIDArr = append(userIDArr, "shipper1")
-    t.addUser(stub, userIDArr, "shipper2", "shipper2", "SHIPPER2", "Shipper")	
-    userIDArr = append(userIDArr, "shipper2")
-    
-    t.addUser(stub, userIDArr, "producer1", "producer1", "PRODUCER1", "Producer")
-    userIDArr = append(userIDArr, "producer1")
-    t.addUser(stub, userIDArr, "producer2", "producer2", "PRODUCER2", "Producer")     
-	userIDArr = append(userIDArr, "producer2")
-    
-    t.addUser(stub, userIDArr, "transporter1", "transporter1", "TRANSPORTER1", "Transporter")
-    userIDArr = append(userIDArr, "transporter1")
-    t.addUser(stub, userIDArr, "transporter2", "transporter2", "TRANSPORTER2", "Transporter")
-    userIDArr = append(userIDArr, "transporter2")
-    t.addUser(stub, userIDArr, "transporter3", "transporter3", "TRANSPORTER3", "Transporter")
-    userIDArr = append(userIDArr, "transporter3")
-	
-    masterKeyList = append(masterKeyList, userIDArr...)
-    
-    //Create business plans
-    var planID string
-    var bpIDList BusinessPlanIDList
-    
-    //Create business plan for shippers
-    planID = "SHIPPER1" + planIDAffix
-    t.createBusinessPlan(stub, bpIDList, planID, currentDateStr, 14.0, "Europe", 0, "Bunder-Tief, Steinbrink", 0, "SHIPPER1") 
-    bpIDList = append(bpIDList, planID)
+    fmt.Println("Entered function Init()")
+    stub = versioned(stub)
     
-    planID = "SHIPPER2" + planIDAffix
-    t.createBusinessPlan(stub, bpIDList, planID, currentDateStr, 15.0, "Steinitz", 0, "Steinitz", 0, "SHIPPER2")  
-    bpIDList = append(bpIDList, planID)
-    
-    //Create business plan for producers
-    planID = "PRODUCER1" + planIDAffix
-    t.createBusinessPlan(stub, bpIDList, planID, currentDateStr, 12.0, "Wardenburg", 200, "Wardenburg", 200, "PRODUCER1")     
-    bpIDList = append(bpIDList, planID)
-    
-    planID = "PRODUCER2" + planIDAffix
-    t.createBusinessPlan(stub, bpIDList, planID, currentDateStr, 10.0, "Ellund", 300, "Ellund", 300, "PRODUCER2")
-    bpIDList = append(bpIDList, planID)
-    
-    //Create business plan for trasporters
-    planID = "TRANSPORTER1" + planIDAffix
-    t.createBusinessPlan(stub, bpIDList, planID, currentDateStr, 11.0, "Wardenburg", 200, "Bunder-Tief", 100, "TRANSPORTER1")  
-    bpIDList = append(bpIDList, planID)
-    
-    planID = "TRANSPORTER2" + planIDAffix
-    t.createBusinessPlan(stub, bpIDList, planID, currentDateStr, 9.0, "Ellund", 300, "Steinbrink", 150, "TRANSPORTER2")
-    bpIDList = append(bpIDList, planID)
-    
-    planID = "TRANSPORTER3" + planIDAffix
-    t.createBusinessPlan(stub, bpIDList, planID, currentDateStr, 8.0, "Ellund", 350, "Steinitz", 175, "TRANSPORTER3")
-    bpIDList = append(bpIDList, planID)
-    
-    masterKeyList = append(masterKeyList, bpIDList...)
+    doc, err := parseBootstrap(bootstrapArgument(args))
+    if err != nil {
+        return nil, err
+    }
     
-    t.updateMasterKeyList (stub, masterKeyList)
+    err = t.applyBootstrap(stub, doc)
+    if err != nil {
+        return nil, err
+    }
 	return nil, nil
 }
 
@@ -294,9 +262,8 @@ func (t *SimpleChaincode) addCompany (stub shim.ChaincodeStubInterface, compIDAr
 }
 
 func (t *SimpleChaincode) getCompanyList(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var lenArr int
 	var compIDArr CompanyIDList
-	var companyType, returnMessage string
+	var companyType, returnMessage, separator string
     var companyObj company
     
     if len(args) < 1 {
@@ -313,20 +280,16 @@ func (t *SimpleChaincode) getCompanyList(stub shim.ChaincodeStubInterface, args
    fmt.Println(compIDArr)
     
 	returnMessage = "{\"statusCode\" : \"SUCCESS\", \"body\" : ["
-	lenArr = len(compIDArr)
 	for _, k := range compIDArr {
 		compObjBytes, _ := stub.GetState(k)
         _ = json.Unmarshal(compObjBytes, &companyObj)
         fmt.Println(companyObj)
         
         if(strings.ToLower(companyType) == "all" || strings.ToLower(companyObj.CompanyType) == strings.ToLower(companyType)) {        
-            returnMessage = returnMessage + string(compObjBytes) 
+            //Only companies of the type are listed, so separate the ones added
+            returnMessage = returnMessage + separator + string(compObjBytes) 
+            separator = ","
         }
-        
-        lenArr = lenArr - 1 
-        if (lenArr != 0) {
-            returnMessage = returnMessage + ","
-        } 
 	} 
 	returnMessage = returnMessage + "]}"
 	return []byte(returnMessage), nil
@@ -395,6 +358,9 @@ func (t *SimpleChaincode) register(stub shim.ChaincodeStubInterface, args []stri
     uList := []string{userName}
     t.updateMasterKeyList(stub, uList)
     
+    t.emitEvent(stub, "UserRegistered", userName, []string{companyObj.CompanyID},
+        userEventData{UserName: userName, CompanyID: companyObj.CompanyID, CompanyType: companyObj.CompanyType})
+    
 	return nil, nil
 
 }
@@ -417,7 +383,13 @@ func (t *SimpleChaincode) getUserInfo(stub shim.ChaincodeStubInterface, args []s
     compInfo, _ := stub.GetState(compID)	
     _ = json.Unmarshal(compInfo, &compStruct)
 
+    //Operators have a role
+    var userObj user
+    userObjBytes, _ := stub.GetState(userName)
+    _ = json.Unmarshal(userObjBytes, &userObj)
+    
     userInfoObj.UserID = userName
+    userInfoObj.Role = userObj.Role
     userInfoObj.Company = compStruct
     fmt.Println(userInfoObj)
 
@@ -492,7 +464,8 @@ func (t *SimpleChaincode) verifyUser(stub shim.ChaincodeStubInterface, args []st
 		return false, err1, ""
 	}
     fmt.Println(loginObj)
-	if password == loginObj.Password {
+    //Users imported without a password cannot log in
+	if loginObj.Password != "" && password == loginObj.Password {
 		return true, nil, loginObj.CompanyID
 	} else {        
 		returnMessage = "Invalid Password"
@@ -538,6 +511,9 @@ func (t *SimpleChaincode) topupBankBalance(stub shim.ChaincodeStubInterface, arg
         return nil, errors.New("Failed to save Company info")
     } 
 
+    t.emitEvent(stub, "BalanceToppedUp", compID, []string{compID},
+        balanceEventData{CompanyID: compID, Amount: topupAmount, BankBalance: companyObj.BankBalance, TopupDateMS: topupDate})
+
     return nil, nil
 }
 
@@ -553,7 +529,10 @@ func (t *SimpleChaincode) changePassword(stub shim.ChaincodeStubInterface, args[
 	validUser, _ , compID := t.verifyUser(stub, argsVerify)
     
 	if validUser == true {		
-        userObj = user{UserID: userName, Password: newPassword, CompanyID: compID}
+        //Keep the role of operators
+        userObjBytes, _ := stub.GetState(userName)
+        _ = json.Unmarshal(userObjBytes, &userObj)
+        userObj = user{UserID: userName, Password: newPassword, CompanyID: compID, Role: userObj.Role}
 		userObjBytes, err1 := json.Marshal(&userObj)
 		if err1 != nil {
             return []byte("Failed to marshal new password credentials."), err1
@@ -572,12 +551,20 @@ func (t *SimpleChaincode) changePassword(stub shim.ChaincodeStubInterface, args[
 }
 
 func (t *SimpleChaincode) createBusinessPlan(stub shim.ChaincodeStubInterface, bpIDList BusinessPlanIDList, planID string, 
-                                             planDate string, gasPrice float64, entryLocation string, entryCapacity int, exitLocation string, exitCapacity int, compID string) ([]byte, error) {
+                                             planDate string, gasPrice float64, entryLocation string, entryCapacity int, exitLocation string, exitCapacity int, compID string,
+                                             effectiveFrom string, effectiveTo string) ([]byte, error) {
     fmt.Println("Creating new Business Plan: " + planID)
     
     var businessPlanObj businessPlan
     
-    businessPlanObj = businessPlan{PlanID: planID, PlanDate: planDate, GasPrice: gasPrice, EntryLocation: entryLocation, EntryCapacity: entryCapacity, ExitLocation: exitLocation, ExitCapacity: exitCapacity, CompanyID: compID}
+    businessPlanObj = businessPlan{PlanID: planID, PlanDate: planDate, GasPrice: gasPrice, EntryLocation: entryLocation, EntryCapacity: entryCapacity, ExitLocation: exitLocation, ExitCapacity: exitCapacity, CompanyID: compID,
+                                   EffectiveFrom: effectiveFrom, EffectiveTo: effectiveTo}
+    
+    //Keep every version of the plan, the plan ID itself holds the latest one
+    errVersion := t.addPlanVersion(stub, &businessPlanObj)
+    if errVersion != nil {
+		return nil, errVersion
+	}
     
     businessPlanObjBytes, err1 := json.Marshal(businessPlanObj)
     if err1 != nil {
@@ -595,34 +582,65 @@ func (t *SimpleChaincode) createBusinessPlan(stub shim.ChaincodeStubInterface, b
         _ = stub.PutState(planKey, bpIDListBytes) 
         
         fmt.Println(bpIDList)
+    } else {
+        //Plans added after Init go into the stored list
+        bpIDListBytes, _ := stub.GetState(planKey)
+        _ = json.Unmarshal(bpIDListBytes, &bpIDList)
+        if !contains(bpIDList, planID) {
+            bpIDList = append(bpIDList, planID)
+            bpIDListBytes, _ = json.Marshal(bpIDList)
+            _ = stub.PutState(planKey, bpIDListBytes)
+        }
     }
         
     return nil, nil
 }
 
-func (t *SimpleChaincode) getBusinessPlanList(stub shim.ChaincodeStubInterface) ([]byte, error) {
-	var lenArr int
+// Optional filters: location, minimum price, maximum price, minimum available capacity and the delivery period
+// (from, to) that capacity has to be available in; pass "" to skip one. Plans are listed as the version in effect
+// on the from date, or today.
+func (t *SimpleChaincode) getBusinessPlanList(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var count int
 	var bpIDArr BusinessPlanIDList
 	var returnMessage string
-    var bpObj businessPlan
     var companyObj company
     var bpInfoObj businessPlanInfo
     
 	fmt.Println("Getting all business plans.")
     
+    filter, err := parsePlanFilter(args)
+    if err != nil {
+        return nil, err
+    }
+    
     bpIDArrBytes, _ := stub.GetState(planKey)
 	_ = json.Unmarshal(bpIDArrBytes, &bpIDArr)
     
    fmt.Println(bpIDArr)
     
+    //Plans are filtered on the version in effect on the From date, or today without one
+    effectiveDay := filter.FromDay
+    if effectiveDay == "" {
+        effectiveDay = time.Now().Format("2006-01-02")
+    }
+    
 	returnMessage = "{\"statusCode\" : \"SUCCESS\", \"body\" : ["
-	lenArr = len(bpIDArr)
 	for _, k := range bpIDArr {
         //Fetch the Business plan
-		bpObjBytes, _ := stub.GetState(k)
-        _ = json.Unmarshal(bpObjBytes, &bpObj)
+        bpObj, found := t.getPlanInEffect(stub, k, effectiveDay)
+        if !found {
+            continue
+        }
         fmt.Println(bpObj)
         
+        var availableMWH float64
+        if filter.MinCapacity > 0 {
+            availableMWH = t.planAvailableCapacity(stub, bpObj, filter.FromDay, filter.ToDay)
+        }
+        if !filter.matches(bpObj, availableMWH) {
+            continue
+        }
+        
         bpInfoObj.BusinessPlan = bpObj;
         
         //Fetch the company details
@@ -633,11 +651,11 @@ func (t *SimpleChaincode) getBusinessPlanList(stub shim.ChaincodeStubInterface)
         bpInfoObj.Company = companyObj;
         bpInfoObjBytes, _ := json.Marshal(bpInfoObj)
         
-        returnMessage = returnMessage + string(bpInfoObjBytes) 
-        lenArr = lenArr - 1 
-        if (lenArr != 0) {
+        if (count != 0) {
             returnMessage = returnMessage + ","
         } 
+        returnMessage = returnMessage + string(bpInfoObjBytes) 
+        count = count + 1
 	} 
 	returnMessage = returnMessage + "]}"
 	return []byte(returnMessage), nil
@@ -648,11 +666,32 @@ func (t *SimpleChaincode) updateBusinessPlan(stub shim.ChaincodeStubInterface, a
     
     var gasPrice float64
     var entryCapacity, exitCapacity int
+    var effectiveFrom, effectiveTo string
+    var existingPlan businessPlan
+    
+    if len(args) < 8 {
+        return nil, errors.New("Incorrect number of arguments. 8 expected (Plan ID, Plan Date, Gas Price, Entry Location, Entry Capacity, Exit Location, Exit Capacity, Company ID) and optionally Effective From, Effective To")
+    }
+    
     gasPrice, _ = strconv.ParseFloat(args[2], 64)
     entryCapacity, _ = strconv.Atoi(args[4])
     exitCapacity, _ = strconv.Atoi(args[6])
+    
+    //A plan can only be changed by the company it belongs to
+    existingPlanBytes, _ := stub.GetState(args[0])
+    if existingPlanBytes != nil {
+        _ = json.Unmarshal(existingPlanBytes, &existingPlan)
+        if existingPlan.CompanyID != args[7] {
+            return nil, errors.New("Business plan " + args[0] + " belongs to company " + existingPlan.CompanyID)
+        }
+    }
+    
+    effectiveFrom, effectiveTo, err := parseEffectivePeriod(args[8:])
+    if err != nil {
+        return nil, err
+    }
        
-    _, err := t.createBusinessPlan(stub, nil, args[0], args[1], gasPrice, args[3], entryCapacity, args[5], exitCapacity, args[7])
+    _, err = t.createBusinessPlan(stub, nil, args[0], args[1], gasPrice, args[3], entryCapacity, args[5], exitCapacity, args[7], effectiveFrom, effectiveTo)
     if err != nil {
 		return nil, err
 	}
@@ -662,20 +701,24 @@ func (t *SimpleChaincode) updateBusinessPlan(stub shim.ChaincodeStubInterface, a
 
 func (t *SimpleChaincode) createContract(stub shim.ChaincodeStubInterface, idArrKey string, args[] string) ([]byte, error) {
     
-	var initiatorID, contractIDString, receiverID, contractStartDate, contractEndDate, contractStatus, entryLocation string
+	var initiatorID, contractIDString, receiverID, contractStartDate, contractEndDate, contractStatus, entryLocation, planID string
 	var contractID int
-	var energyMWH float64
+	var energyMWH, penaltyRate float64
 	var contractObj contract
     var contractIDArr []string
     
 	if len(args) < 6 {
-		return nil, errors.New("Incorrect number of arguments. 6 expected")
+		return nil, errors.New("Incorrect number of arguments. 6 expected (optionally entry location, penalty rate and the receiver's plan ID)")
 	}
     
     fmt.Println("Creating new contract...")
 
 	contractIDString = args[0]
 	contractID, _ = strconv.Atoi(args[0])
+	existingBytes, _ := stub.GetState(contractIDString)
+	if existingBytes != nil {
+		return nil, errors.New("Contract already exists: " + contractIDString)
+	}
 	initiatorID = args[1]
 	receiverID = args[2]
 	energyMWH, _ = strconv.ParseFloat(args[3], 64)
@@ -684,12 +727,31 @@ func (t *SimpleChaincode) createContract(stub shim.ChaincodeStubInterface, idArr
 	contractStatus = "New"	
     entryLocation = "Europe";
     
-    if(len(args) == 7) { // Buyer adds location for gas request
+    if(len(args) >= 7 && args[6] != "") { // Buyer adds location for gas request
         entryLocation = args[6];
     } 
+    if(len(args) >= 8) { // Penalty per MWh of shortfall
+        penaltyRate, _ = strconv.ParseFloat(args[7], 64)
+    }
+    if(len(args) >= 9 && args[8] != "") { // Receiver's plan to book capacity on
+        planID = args[8]
+        planObjBytes, _ := stub.GetState(planID)
+        var planObj businessPlan
+        _ = json.Unmarshal(planObjBytes, &planObj)
+        if planObj.CompanyID != receiverID {
+            return nil, errors.New("Business plan " + planID + " does not belong to " + receiverID)
+        }
+    }
     
 	contractObj = contract{ContractID: contractID, InitiatorID: initiatorID, ReceiverID: receiverID,
-                           EnergyMWH: energyMWH, EntryLocation: entryLocation, ContractStartDate: contractStartDate, ContractEndDate: contractEndDate, ContractStatus: contractStatus }
+                           EnergyMWH: energyMWH, EntryLocation: entryLocation, ContractStartDate: contractStartDate, ContractEndDate: contractEndDate, ContractStatus: contractStatus, PenaltyRate: penaltyRate, OfferVersion: 1, PlanID: planID }
+
+    //Check the initiator's running exposure against its credit limit
+    errCredit := t.checkCreditExposure(stub, contractObj)
+    if errCredit != nil {
+        fmt.Println(errCredit)
+        return nil, errCredit
+    }
 
 	//Putting on RocksDB database.
 	contractObjBytes, err1 := json.Marshal(contractObj)
@@ -698,6 +760,11 @@ func (t *SimpleChaincode) createContract(stub shim.ChaincodeStubInterface, idArr
 	}
 	_ = stub.PutState(contractIDString, contractObjBytes)
     
+    //The initial terms are the first offer of the negotiation thread
+    initialOffer := contractOffer{ContractID: contractID, Version: 1, ProposerID: initiatorID, EnergyMWH: energyMWH, EntryLocation: entryLocation,
+                                  StartDate: contractStartDate, EndDate: contractEndDate, OfferStatus: "Open"}
+    t.saveOfferList(stub, contractIDString, []contractOffer{initialOffer})
+    
     //Putting contract ID in Contract ID array  
 	contractIDListObjBytes, err := stub.GetState(idArrKey)
 	if err != nil {
@@ -713,9 +780,11 @@ func (t *SimpleChaincode) createContract(stub shim.ChaincodeStubInterface, idArr
     fmt.Println(contractIDArr)
     
     //Add new contractID to master key list
-    idList := []string{contractIDString, contractIDString + invoiceAffix, contractIDString + incidentAffix}
+    idList := []string{contractIDString, contractIDString + invoiceAffix, contractIDString + incidentAffix, contractIDString + offerAffix}
     t.updateMasterKeyList(stub, idList)
     
+    t.emitContractEvent(stub, "ContractCreated", contractObj, "")
+    
 	return nil, nil
 }
 
@@ -739,7 +808,7 @@ func (t *SimpleChaincode) updateContractStatus(stub shim.ChaincodeStubInterface,
 	var contractObj contract
 	
 	if len(args) < 2 {
-		return nil, errors.New("Incorrect number of arguments. 2 expected (ContractID and ContractStatus)")
+		return nil, errors.New("Incorrect number of arguments. 2 expected (ContractID and ContractStatus) and optionally Current Date in MilliSecs")
 	}
 	
     fmt.Println("Updating contract ID " + args[0] + " to status " + args[1])
@@ -751,6 +820,29 @@ func (t *SimpleChaincode) updateContractStatus(stub shim.ChaincodeStubInterface,
         fmt.Println(err1)
 		return nil, err1
 	}
+	var previousStatus = contractObj.ContractStatus
+	
+	//Acceptance binds the contract to the current offer of its negotiation thread, priced on the day it is accepted
+	if args[1] == "Accepted" && contractObj.ContractStatus != "Accepted" {
+	    var acceptDate int
+	    if len(args) >= 3 && args[2] != "" {
+	        acceptDate, _ = strconv.Atoi(args[2])
+	    }
+	    err4 := t.acceptCurrentOffer(stub, &contractObj, acceptDate)
+	    if err4 != nil {
+	        fmt.Println(err4)
+	        return nil, err4
+	    }
+	}
+	
+	//Cancelled or rejected contracts give their booked capacity back
+	if (args[1] == "Cancelled" || args[1] == "Rejected") && contractObj.ContractStatus == "Accepted" {
+	    err5 := t.releaseContractCapacity(stub, contractObj)
+	    if err5 != nil {
+	        fmt.Println(err5)
+	        return nil, err5
+	    }
+	}
 	
 	//Update the status
 	contractObj.ContractStatus = args[1]
@@ -767,6 +859,10 @@ func (t *SimpleChaincode) updateContractStatus(stub shim.ChaincodeStubInterface,
 		return nil, err3
 	}
 	
+	if previousStatus != contractObj.ContractStatus {
+	    t.emitContractEvent(stub, "ContractStatusChanged", contractObj, previousStatus)
+	}
+	
 	return nil, nil
 }
 
@@ -779,8 +875,7 @@ func (t *SimpleChaincode) updateContractStatus(stub shim.ChaincodeStubInterface,
 }*/
 
 func (t *SimpleChaincode) getContractList(stub shim.ChaincodeStubInterface, idArrKey string, args[] string) ([]byte, error) {
-	var companyID, contractIDStr, returnMessage, key string
-	var lenMap int	
+	var companyID, contractIDStr, returnMessage, key, separator string
     var contractIDList []string
     var contractObj contract
     var contractFullObj contractInfo
@@ -794,7 +889,6 @@ func (t *SimpleChaincode) getContractList(stub shim.ChaincodeStubInterface, idAr
 	contractListObjBytes, _ := stub.GetState(idArrKey)
 	_ = json.Unmarshal(contractListObjBytes, &contractIDList)
     
-	lenMap = len(contractIDList)
 	returnMessage = "{\"statusCode\" : \"SUCCESS\", \"body\" : ["
 
 	for _, k := range contractIDList {
@@ -829,6 +923,9 @@ func (t *SimpleChaincode) getContractList(stub shim.ChaincodeStubInterface, idAr
             contractFullObj.InvoiceList = invoiceList
             contractFullObj.IncidentList = incidentList
             
+            //Add the negotiation history
+            contractFullObj.OfferList = t.getOfferList(stub, contractIDStr)
+            
             fmt.Println(contractFullObj)
             
             contractFullObjBytes, err1 := json.Marshal(contractFullObj)
@@ -836,13 +933,9 @@ func (t *SimpleChaincode) getContractList(stub shim.ChaincodeStubInterface, idAr
               return nil, err1
             }
             
-            returnMessage = returnMessage + string(contractFullObjBytes)
+            returnMessage = returnMessage + separator + string(contractFullObjBytes)
+            separator = ","
         }
-        
-        lenMap = lenMap - 1
-        if (lenMap!= 0) {
-            returnMessage = returnMessage + ","
-        }                
 	}
 	returnMessage = returnMessage + "]}"
 	return []byte(returnMessage), nil
@@ -906,6 +999,30 @@ func (t *SimpleChaincode) getContractArrKey (stub shim.ChaincodeStubInterface, c
     return companyTypeKey
 }
 
+func (t *SimpleChaincode) getAllContractObjList(stub shim.ChaincodeStubInterface, companyID string) ([]contract) {
+    var contractIDList []string
+    var contractObjList []contract
+    
+    //Collect the contracts of this company from trade, transport and gas request lists
+    for _, idArrKey := range []string{tradeRequestKey, transportRequestKey, gasRequestKey} {
+        contractIDList = nil
+        contractListObjBytes, _ := stub.GetState(idArrKey)
+        _ = json.Unmarshal(contractListObjBytes, &contractIDList)
+        
+        for _, k := range contractIDList {
+            var contractObj contract
+            contractObjBytes, _ := stub.GetState(k)
+            _ = json.Unmarshal(contractObjBytes, &contractObj)
+            
+            if(companyID == "" || contractObj.InitiatorID == companyID || contractObj.ReceiverID == companyID) {
+                contractObjList = append(contractObjList, contractObj)
+            }
+        }
+    }
+    
+    return contractObjList
+}
+
 func (t *SimpleChaincode) addIOTData (stub shim.ChaincodeStubInterface, args[] string ) ([]byte, error) {
     //args[0] = {"device_id": "GasFlowMeter_1", "device_location": "Location 1", "company_id": "TRANSPORTER1", "pressure_kpa": 100, "temperature_c": 20, "specific_gravity": 0.65, "energy_mwh": 100,"timestamp_ms":1503416349302}
     
@@ -946,23 +1063,34 @@ func (t *SimpleChaincode) addIOTData (stub shim.ChaincodeStubInterface, args[] s
     for _, contractObj := range contractObjList {
         
         fmt.Println(contractObj)
-        // If the energy from flow meter is higher or equal to the energy set in the contract, then create an invoice
+        
+        //Flows are checked against the confirmed nomination of the gas day, or the contract total when nothing is nominated
+        expectedEnergyMWH, nominated := t.expectedDelivery(stub, contractObj, flowMeter.TimestampMS)
+        if !nominated {
+            continue
+        }
+        
+        // If the energy from flow meter is higher or equal to the expected energy, then create an invoice
         // Else create an incident
-        if(flowMeter.EnergyMWH >= contractObj.EnergyMWH){
-            //Create invoice
-            t.createInvoice(stub, flowMeter.TimestampMS, contractObj.ContractID)
+        if(flowMeter.EnergyMWH >= expectedEnergyMWH){
+            //Create invoice, a delivery that cannot be priced fails the reading rather than going unbilled
+            _, err := t.createInvoice(stub, flowMeter.TimestampMS, contractObj.ContractID, expectedEnergyMWH)
+            if err != nil {
+                return nil, err
+            }
         } else {
             //Create incident
-            t.createIncident(stub, flowMeter.TimestampMS, contractObj.EnergyMWH, flowMeter.EnergyMWH, contractObj.ContractID)
+            t.createIncident(stub, flowMeter.TimestampMS, expectedEnergyMWH, flowMeter.EnergyMWH, contractObj.ContractID)
         }
     }
     return nil, nil
 }
 
-func (t *SimpleChaincode) createInvoice (stub shim.ChaincodeStubInterface, invoiceID int,  contractID int ) ([]byte, error) {
+func (t *SimpleChaincode) createInvoice (stub shim.ChaincodeStubInterface, invoiceID int,  contractID int, energyMWH float64 ) ([]byte, error) {
 	var contractIDStr, invoiceIDStr, paymentStatus string 
     var invoiceDateMS int
     var invoiceObj invoice
+    var contractObj contract
     var invoiceIDArr []string
     
     fmt.Println("Creating new invoice...")
@@ -973,13 +1101,29 @@ func (t *SimpleChaincode) createInvoice (stub shim.ChaincodeStubInterface, invoi
     contractIDStr = strconv.Itoa(contractID)
     
     //Create invoice and store in database
-    invoiceObj = invoice {InvoiceID: invoiceID, InvoiceDateMS: invoiceDateMS, PaymentStatus: paymentStatus, ContractID: contractID}
+    invoiceObj = invoice {InvoiceID: invoiceID, InvoiceDateMS: invoiceDateMS, PaymentStatus: paymentStatus, ContractID: contractID, EnergyMWH: energyMWH}
+    
+    //Price the delivered energy with the contract's own terms
+    contractObjBytes, _ := stub.GetState(contractIDStr)
+    _ = json.Unmarshal(contractObjBytes, &contractObj)
+    errPrice := t.priceInvoice(stub, contractObj, &invoiceObj)
+    if errPrice != nil {
+        fmt.Println(errPrice)
+        return nil, errPrice
+    }
+    
+    //Charge or credit penalties and credit notes that had no open invoice to go against
+    t.applyPendingPenalties(stub, &invoiceObj)
+    t.applyPendingCreditNotes(stub, &invoiceObj)
+    
     invoiceObjBytes, err1 := json.Marshal(invoiceObj)
 	if err1 != nil {
 		return nil, err1
 	}
 	_ = stub.PutState(invoiceIDStr, invoiceObjBytes)
     
+    t.emitInvoiceEvent(stub, invoiceObj, contractObj.InitiatorID, contractObj.ReceiverID)
+    
     //Add new invoiceID to master key list
     idList := []string{invoiceIDStr}
     t.updateMasterKeyList(stub, idList)
@@ -1010,11 +1154,12 @@ func (t *SimpleChaincode) createIncident (stub shim.ChaincodeStubInterface, inci
     
     incidentIDStr = strconv.Itoa(incidentID)
     incidentDateMS = incidentID
-    incidentStatus = "New"
+    incidentStatus = "Open"
     contractIDStr = strconv.Itoa(contractID)
     
     //Create incident and store in database
     incidentObj = incident {IncidentID: incidentID, IncidentDateMS: incidentDateMS, IncidentStatus: incidentStatus, ExpectedEnergyMWH: expectedEnergyMWH, ActualEnergyMWH: actualEnergyMWH, ContractID: contractID}
+    incidentObj.StatusHistory = []incidentStatusChange{incidentStatusChange{Status: incidentStatus, Comments: "Raised from IOT data", ChangeDateMS: incidentDateMS}}
     incidentObjBytes, err1 := json.Marshal(incidentObj)
 	if err1 != nil {
 		return nil, err1
@@ -1038,6 +1183,12 @@ func (t *SimpleChaincode) createIncident (stub shim.ChaincodeStubInterface, inci
     incidentIDListObjBytes, _ = json.Marshal(&incidentIDArr)
     _ = stub.PutState(arrKey, incidentIDListObjBytes)
     
+    var contractObj contract
+    contractObjBytes, _ := stub.GetState(contractIDStr)
+    _ = json.Unmarshal(contractObjBytes, &contractObj)
+    t.emitEvent(stub, "IncidentRaised", incidentIDStr, []string{contractObj.InitiatorID, contractObj.ReceiverID},
+        incidentEventData{IncidentID: incidentID, ContractID: contractID, ExpectedEnergyMWH: expectedEnergyMWH, ActualEnergyMWH: actualEnergyMWH, IncidentDateMS: incidentDateMS})
+    
     return nil, nil
 }
                                                                                          
@@ -1196,9 +1347,7 @@ func (t *SimpleChaincode) getIncidentList (stub shim.ChaincodeStubInterface, arg
 
 func (t *SimpleChaincode) getInvoiceIncidentList(stub shim.ChaincodeStubInterface, contractID string) ([]invoice, []incident) {
     var invoiceIDList, incidentIDList []string
-    var invoiceObj invoice
     var invoiceObjList []invoice
-    var incidentObj incident
     var incidentObjList []incident
     
     fmt.Println("Getting Invoice and Incident Objects for contract: "+ contractID)
@@ -1208,6 +1357,7 @@ func (t *SimpleChaincode) getInvoiceIncidentList(stub shim.ChaincodeStubInterfac
 	_ = json.Unmarshal(invoiceIDListObjBytes, &invoiceIDList)
     
 	for _, k := range invoiceIDList {
+        var invoiceObj invoice
         
 		invoiceObjBytes, _ := stub.GetState(k)
         _ = json.Unmarshal(invoiceObjBytes, &invoiceObj)
@@ -1222,6 +1372,7 @@ func (t *SimpleChaincode) getInvoiceIncidentList(stub shim.ChaincodeStubInterfac
 	_ = json.Unmarshal(incidentIDListObjBytes, &incidentIDList)
     
 	for _, k := range incidentIDList {
+        var incidentObj incident
         
 		incidentObjBytes, _ := stub.GetState(k)
         _ = json.Unmarshal(incidentObjBytes, &incidentObj)
@@ -1235,17 +1386,16 @@ func (t *SimpleChaincode) getInvoiceIncidentList(stub shim.ChaincodeStubInterfac
 }
 
 func (t *SimpleChaincode) makePayment (stub shim.ChaincodeStubInterface, args[] string ) ([]byte, error) {
-    var returnMessage, invoiceIDStr, contractIDStr, planIDKey, totalCostStr, bankBalStr string
+    var returnMessage, invoiceIDStr, contractIDStr, totalCostStr, bankBalStr, payerID, payeeID string
     var contractObj contract
-    var planObj businessPlan
     var totalCost float64
-    var initiatorCompany company
+    var initiatorCompany, receiverCompany company
     var invoiceObj invoice
     var currentDate int
     
     fmt.Println("Pay for the contract (Invoice ID: "+ args[0] + ")")
     if len(args) < 3 {
-        return nil, errors.New("Incorrect number of arguments. 3 expected (Invoice ID, Contract ID, Current Date in MilliSecs)")
+        return nil, errors.New("Incorrect number of arguments. 3 expected (Invoice ID, Contract ID or empty for invoices without a contract, Current Date in MilliSecs)")
 	}
     
     invoiceIDStr = args[0]
@@ -1254,17 +1404,36 @@ func (t *SimpleChaincode) makePayment (stub shim.ChaincodeStubInterface, args[]
     
     contractObjBytes, _ := stub.GetState(contractIDStr)
     _ = json.Unmarshal(contractObjBytes, &contractObj)
-        
-    //Fetch gas price from the Business Plan
-    planIDKey = contractObj.ReceiverID + planIDAffix 
-    planObjBytes, _ := stub.GetState(planIDKey)
-    _ = json.Unmarshal(planObjBytes, &planObj)
     
+    //Fetch the invoice, it may already have been paid by a settlement run
+    invoiceObjBytes, _ := stub.GetState(invoiceIDStr)
+    _ = json.Unmarshal(invoiceObjBytes, &invoiceObj)
+    if invoiceObj.PaymentStatus == "Paid" {
+        returnMessage = "{\"statusCode\" : \"FAIL\", \"body\" : \"Transaction FAILED: Invoice " + invoiceIDStr + " is already paid\"}"
+        return []byte(returnMessage), nil
+    }
+    if invoiceObj.PaymentStatus == "Disputed" {
+        returnMessage = "{\"statusCode\" : \"FAIL\", \"body\" : \"Transaction FAILED: Invoice " + invoiceIDStr + " is held by an open dispute\"}"
+        return []byte(returnMessage), nil
+    }
+    if invoiceObj.PaymentStatus == "Cancelled" {
+        returnMessage = "{\"statusCode\" : \"FAIL\", \"body\" : \"Transaction FAILED: Invoice " + invoiceIDStr + " is cancelled\"}"
+        return []byte(returnMessage), nil
+    }
+    
+    //The contract parties pay each other, invoices without a contract (imbalance charges) name their payer and payee
+    payerID = contractObj.InitiatorID
+    payeeID = contractObj.ReceiverID
+    if invoiceObj.PayerID != "" {
+        payerID = invoiceObj.PayerID
+        payeeID = invoiceObj.PayeeID
+    }
+        
     //Energy consumed * gas price per mwh
-    totalCost = contractObj.EnergyMWH * planObj.GasPrice
+    totalCost = t.getInvoiceAmount(stub, invoiceObj, contractObj)
     
     //Fetch Initiator company
-    initiatorCompanyObjBytes, _ := stub.GetState(contractObj.InitiatorID)
+    initiatorCompanyObjBytes, _ := stub.GetState(payerID)
     _ = json.Unmarshal(initiatorCompanyObjBytes, &initiatorCompany)
 
     //Subtract amount from initiator company
@@ -1284,27 +1453,22 @@ func (t *SimpleChaincode) makePayment (stub shim.ChaincodeStubInterface, args[]
     }
     
     
-    go func (addAmount float64) {
-        var receiverCompany company
-        
-        //Add the amount to Receiver company
-        receiverCompanyObjBytes, _ := stub.GetState(contractObj.ReceiverID)
-        _ = json.Unmarshal(receiverCompanyObjBytes, &receiverCompany)
+    //Add the amount to Receiver company, in the same transaction as the debit
+    receiverCompanyObjBytes, _ := stub.GetState(payeeID)
+    _ = json.Unmarshal(receiverCompanyObjBytes, &receiverCompany)
 
-        receiverCompany.BankBalance = receiverCompany.BankBalance + addAmount
-        receiverCompany.BalanceUpdatedDateMS = currentDate
+    receiverCompany.BankBalance = receiverCompany.BankBalance + totalCost
+    receiverCompany.BalanceUpdatedDateMS = currentDate
 
-        receiverCompanyObjBytes, _ = json.Marshal(&receiverCompany)
-        _ = stub.PutState(receiverCompany.CompanyID, receiverCompanyObjBytes)
-
-        fmt.Println(receiverCompany)
+    receiverCompanyObjBytes, _ = json.Marshal(&receiverCompany)
+    err := stub.PutState(receiverCompany.CompanyID, receiverCompanyObjBytes)
+    if err != nil {
+        return nil, err
+    }
 
-    } (totalCost)
+    fmt.Println(receiverCompany)
     
     //Update the invoice payment status and date
-    invoiceObjBytes, _ := stub.GetState(invoiceIDStr)
-    _ = json.Unmarshal(invoiceObjBytes, &invoiceObj)
-    
     invoiceObj.PaymentDateMS = currentDate
     invoiceObj.PaymentStatus = "Paid"
     
@@ -1313,31 +1477,17 @@ func (t *SimpleChaincode) makePayment (stub shim.ChaincodeStubInterface, args[]
     
     fmt.Println(invoiceObj)
     
-    return nil, nil
-}
-
-func (t *SimpleChaincode) Reset(stub shim.ChaincodeStubInterface) ([]byte, error) {
-    var masterKeyList []string
-    
-    //Get the existing master array of keys
-    keyListBytes, _ := stub.GetState(allKeys)
-    if keyListBytes != nil {
-	   _ = json.Unmarshal(keyListBytes, &masterKeyList)
-    }
+    t.emitEvent(stub, "PaymentSettled", invoiceIDStr, []string{payerID, payeeID},
+        paymentEventData{InvoiceIDs: []string{invoiceIDStr}, PayerID: payerID, PayeeID: payeeID, Amount: totalCost, PaymentDateMS: currentDate})
     
-	for _, key := range masterKeyList {
-        fmt.Println("Deleting data with key: " + key)
-        err := stub.DelState(key)
-        if err != nil {
-            fmt.Println(err)
-        }
+    //Paying an invoice reduces exposure, so close any margin calls that are now covered
+    if hasCreditFacility(initiatorCompany) {
+        t.reviewMarginCalls(stub, initiatorCompany)
     }
     
-    t.Init(stub, "init", nil)
-
-	return nil, nil
+    return nil, nil
 }
-    
+
 func contains(s []string, e string) bool {
     for _, a := range s {
         if a == e {
@@ -1351,8 +1501,24 @@ func contains(s []string, e string) bool {
 func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 	fmt.Println("Running Invoke function")
 
+	//The events of the transaction are emitted only when it succeeds
+	result, err := t.invoke(versioned(stub), function, args)
+	if err != nil {
+		t.discardEvents(stub)
+		return nil, err
+	}
+	err = t.flushEvents(stub)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (t *SimpleChaincode) invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+
+	//Init runs once when the chaincode is deployed, a network is initialized again only through an administrator's reset
 	if function == "init" {
-		return t.Init(stub, "init", args)
+		return nil, errors.New("The network is initialized when the chaincode is deployed, use reset to initialize it again")
 	} else if function == "delete" {
 		return t.deleteData(stub, args)
 	} else if function == "register" {
@@ -1376,7 +1542,77 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function stri
 	} else if function == "makePayment" {
 		return t.makePayment(stub, args)
 	} else if function == "reset" {
-		return t.Reset(stub)
+		return t.Reset(stub, args)
+	} else if function == "setCreditLimit" {
+		return t.setCreditLimit(stub, args)
+	} else if function == "postCollateral" {
+		return t.postCollateral(stub, args)
+	} else if function == "releaseCollateral" {
+		return t.releaseCollateral(stub, args)
+	} else if function == "runSettlement" {
+		return t.runSettlement(stub, args)
+	} else if function == "updateIncidentStatus" {
+		return t.updateIncidentStatus(stub, args)
+	} else if function == "resolveIncident" {
+		return t.resolveIncident(stub, args)
+	} else if function == "raiseDispute" {
+		return t.raiseDispute(stub, args)
+	} else if function == "addDisputeClaim" {
+		return t.addDisputeClaim(stub, args)
+	} else if function == "resolveDispute" {
+		return t.resolveDispute(stub, args)
+	} else if function == "checkDisputeDeadlines" {
+		return t.checkDisputeDeadlines(stub, args)
+	} else if function == "submitCounterOffer" {
+		return t.submitCounterOffer(stub, args)
+	} else if function == "acceptOffer" {
+		return t.acceptOffer(stub, args)
+	} else if function == "rejectOffer" {
+		return t.rejectOffer(stub, args)
+	} else if function == "setIndexPrice" {
+		return t.setIndexPrice(stub, args)
+	} else if function == "addNetworkPoint" {
+		return t.addNetworkPoint(stub, args)
+	} else if function == "addPipelineSegment" {
+		return t.addPipelineSegment(stub, args)
+	} else if function == "buildNetworkFromPlans" {
+		return t.buildNetworkFromPlans(stub, args)
+	} else if function == "createSupplyChainDeal" {
+		return t.createSupplyChainDeal(stub, args)
+	} else if function == "addDealLeg" {
+		return t.addDealLeg(stub, args)
+	} else if function == "setNominationConfig" {
+		return t.setNominationConfig(stub, args)
+	} else if function == "submitNomination" {
+		return t.submitNomination(stub, args)
+	} else if function == "confirmNomination" {
+		return t.confirmNomination(stub, args)
+	} else if function == "placeOrder" {
+		return t.placeOrder(stub, args)
+	} else if function == "cancelOrder" {
+		return t.cancelOrder(stub, args)
+	} else if function == "createCapacityAuction" {
+		return t.createCapacityAuction(stub, args)
+	} else if function == "submitSealedBid" {
+		return t.submitSealedBid(stub, args)
+	} else if function == "revealBid" {
+		return t.revealBid(stub, args)
+	} else if function == "clearAuction" {
+		return t.clearAuction(stub, args)
+	} else if function == "cancelAuction" {
+		return t.cancelAuction(stub, args)
+	} else if function == "computePriceIndex" {
+		return t.computePriceIndex(stub, args)
+	} else if function == "setImbalanceConfig" {
+		return t.setImbalanceConfig(stub, args)
+	} else if function == "computeImbalance" {
+		return t.computeImbalance(stub, args)
+	} else if function == "importState" {
+		return t.importState(stub, args)
+	} else if function == "migrateRecords" {
+		return t.migrateRecords(stub, args)
+	} else if function == "migrateLegacyData" {
+		return t.migrateLegacyData(stub, args)
 	} 
     
  
@@ -1388,6 +1624,7 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function stri
 // Query is our entry point for queries
 func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
     fmt.Println("Querying function: " + function)
+    stub = versioned(stub)
 
 	// Handle different functions
 	if function == "read" { //read a variable
@@ -1405,7 +1642,11 @@ func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function strin
     } else if function == "getGasRequestList" {
 		return t.getGasRequestList(stub, args)
     } else if function == "getBusinessPlanList" {
-		return t.getBusinessPlanList(stub)
+		return t.getBusinessPlanList(stub, args)
+    } else if function == "getBusinessPlanInEffect" {
+		return t.getBusinessPlanInEffect(stub, args)
+    } else if function == "getBusinessPlanHistory" {
+		return t.getBusinessPlanHistory(stub, args)
     } else if function == "getIOTData" {
 		return t.getIOTData(stub, args)
     } else if function == "getInvoiceList" {
@@ -1416,6 +1657,60 @@ func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function strin
 		return t.getIOTDataForShipper(stub, args)
     } else if function == "getMasterKeyList" {
 		return t.getMasterKeyList(stub)
+    } else if function == "getBootstrap" {
+		return t.getBootstrap(stub, args)
+    } else if function == "getResetPreview" {
+		return t.getResetPreview(stub, args)
+    } else if function == "exportState" {
+		return t.exportState(stub, args)
+    } else if function == "getImportStatus" {
+		return t.getImportStatus(stub, args)
+    } else if function == "getSchemaVersionReport" {
+		return t.getSchemaVersionReport(stub, args)
+    } else if function == "getLegacyMigrationPreview" {
+		return t.getLegacyMigrationPreview(stub, args)
+    } else if function == "getExposure" {
+		return t.getExposure(stub, args)
+    } else if function == "getMarginCallList" {
+		return t.getMarginCallList(stub, args)
+    } else if function == "getSettlementReport" {
+		return t.getSettlementReport(stub, args)
+    } else if function == "getSettlementList" {
+		return t.getSettlementList(stub)
+    } else if function == "getLedgerEntries" {
+		return t.getLedgerEntries(stub, args)
+    } else if function == "getDispute" {
+		return t.getDispute(stub, args)
+    } else if function == "getDisputeList" {
+		return t.getDisputeList(stub, args)
+    } else if function == "getCreditNoteList" {
+		return t.getCreditNoteList(stub, args)
+    } else if function == "getIndexPrice" {
+		return t.getIndexPrice(stub, args)
+    } else if function == "getCapacityProfile" {
+		return t.getCapacityProfile(stub, args)
+    } else if function == "findTransportRoutes" {
+		return t.findTransportRoutes(stub, args)
+    } else if function == "getNetwork" {
+		return t.getNetwork(stub)
+    } else if function == "getSupplyChainDeal" {
+		return t.getSupplyChainDeal(stub, args)
+    } else if function == "getSupplyChainDealList" {
+		return t.getSupplyChainDealList(stub, args)
+    } else if function == "getNominations" {
+		return t.getNominations(stub, args)
+    } else if function == "getOrderBook" {
+		return t.getOrderBook(stub, args)
+    } else if function == "getOrderList" {
+		return t.getOrderList(stub, args)
+    } else if function == "getCapacityAuction" {
+		return t.getCapacityAuction(stub, args)
+    } else if function == "getCapacityAuctionList" {
+		return t.getCapacityAuctionList(stub, args)
+    } else if function == "getPriceIndexHistory" {
+		return t.getPriceIndexHistory(stub, args)
+    } else if function == "getImbalanceAccounts" {
+		return t.getImbalanceAccounts(stub, args)
 	} 
     
 	fmt.Println("Query did not find func: " + function)
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Default share of the credit facility (credit limit + collateral) above which a margin call is raised
+var defaultMarginCallPct = 80.0
+
+type marginCall struct {
+	MarginCallID   string  `json:"margin_call_id"`
+	CompanyID      string  `json:"company_id"`
+	CounterpartyID string  `json:"counterparty_id"`
+	ContractID     int     `json:"contract_id"`
+	Exposure       float64 `json:"exposure"`
+	CreditLimit    float64 `json:"credit_limit"`
+	Collateral     float64 `json:"collateral"`
+	Threshold      float64 `json:"threshold"`
+	CallAmount     float64 `json:"call_amount"`
+	Status         string  `json:"margin_call_status"`
+}
+
+type counterpartyExposure struct {
+	CounterpartyID     string  `json:"counterparty_id"`
+	OpenContractValue  float64 `json:"open_contract_value"`
+	UnpaidInvoiceValue float64 `json:"unpaid_invoice_value"`
+	Exposure           float64 `json:"exposure"`
+}
+
+type exposureInfo struct {
+	CompanyID       string                 `json:"company_id"`
+	CreditLimit     float64                `json:"credit_limit"`
+	Collateral      float64                `json:"collateral"`
+	TotalExposure   float64                `json:"total_exposure"`
+	AvailableCredit float64                `json:"available_credit"`
+	MarginThreshold float64                `json:"margin_threshold"`
+	Counterparties  []counterpartyExposure `json:"counterparties"`
+}
+
+// Value of a contract at its agreed price terms. Contracts that are not priced yet are valued at
+// the gas price of their business plan in effect at the start of delivery.
+func (t *SimpleChaincode) getContractValue(stub shim.ChaincodeStubInterface, contractObj contract) float64 {
+	var day string
+
+	if contractObj.Pricing.PriceType != "" {
+		amount, err := t.priceEnergy(stub, contractObj.Pricing, 0, contractObj.EnergyMWH, "")
+		if err == nil {
+			return amount
+		}
+		fmt.Println(err)
+	}
+
+	startDate, err := parseDate(contractObj.ContractStartDate)
+	if err == nil {
+		day = startDate.Format("2006-01-02")
+	}
+	planObj, err := t.pricingPlan(stub, contractObj, day)
+	if err != nil {
+		fmt.Println(err)
+		return 0
+	}
+
+	return contractObj.EnergyMWH * planObj.GasPrice
+}
+
+// A contract is open while it has been neither rejected nor cancelled
+func isOpenContract(contractObj contract) bool {
+	return contractObj.ContractStatus == "New" || contractObj.ContractStatus == "Negotiating" || contractObj.ContractStatus == "Accepted"
+}
+
+// Exposure of a company is what it owes as contract initiator: unpaid invoices plus the value
+// of open contracts that have not been invoiced yet.
+func (t *SimpleChaincode) calculateExposure(stub shim.ChaincodeStubInterface, companyObj company) exposureInfo {
+	var exposureObj exposureInfo
+	var contractIDStr string
+
+	exposureMap := make(map[string]*counterpartyExposure)
+
+	for _, contractObj := range t.getAllContractObjList(stub, companyObj.CompanyID) {
+		if contractObj.InitiatorID != companyObj.CompanyID {
+			continue
+		}
+
+		cpExposure, ok := exposureMap[contractObj.ReceiverID]
+		if !ok {
+			cpExposure = &counterpartyExposure{CounterpartyID: contractObj.ReceiverID}
+			exposureMap[contractObj.ReceiverID] = cpExposure
+		}
+
+		contractIDStr = strconv.Itoa(contractObj.ContractID)
+		invoiceList, _ := t.getInvoiceIncidentList(stub, contractIDStr)
+
+		if len(invoiceList) == 0 {
+			if isOpenContract(contractObj) {
+				cpExposure.OpenContractValue = cpExposure.OpenContractValue + t.getContractValue(stub, contractObj)
+			}
+		} else {
+			for _, invoiceObj := range invoiceList {
+				if invoiceObj.PaymentStatus != "Paid" {
+					cpExposure.UnpaidInvoiceValue = cpExposure.UnpaidInvoiceValue + t.getInvoiceAmount(stub, invoiceObj, contractObj)
+				}
+			}
+		}
+		cpExposure.Exposure = cpExposure.OpenContractValue + cpExposure.UnpaidInvoiceValue
+	}
+
+	exposureObj.CompanyID = companyObj.CompanyID
+	exposureObj.CreditLimit = companyObj.CreditLimit
+	exposureObj.Collateral = companyObj.Collateral
+	exposureObj.MarginThreshold = getMarginThreshold(companyObj)
+
+	for _, cpExposure := range exposureMap {
+		exposureObj.TotalExposure = exposureObj.TotalExposure + cpExposure.Exposure
+		exposureObj.Counterparties = append(exposureObj.Counterparties, *cpExposure)
+	}
+	sort.Slice(exposureObj.Counterparties, func(i, j int) bool {
+		return exposureObj.Counterparties[i].CounterpartyID < exposureObj.Counterparties[j].CounterpartyID
+	})
+	exposureObj.AvailableCredit = companyObj.CreditLimit + companyObj.Collateral - exposureObj.TotalExposure
+
+	return exposureObj
+}
+
+func hasCreditFacility(companyObj company) bool {
+	return companyObj.CreditLimit > 0 || companyObj.Collateral > 0
+}
+
+func getMarginThreshold(companyObj company) float64 {
+	var marginCallPct = companyObj.MarginCallPct
+	if marginCallPct <= 0 {
+		marginCallPct = defaultMarginCallPct
+	}
+	return (companyObj.CreditLimit + companyObj.Collateral) * marginCallPct / 100
+}
+
+// Called before a new contract or new contract terms are stored. Fails when the new contract takes the initiator beyond its
+// credit limit plus posted collateral and raises a margin call when the margin threshold is crossed.
+// Companies without a credit facility trade on their bank balance and are not checked.
+func (t *SimpleChaincode) checkCreditExposure(stub shim.ChaincodeStubInterface, contractObj contract) error {
+	var companyObj company
+	var newExposure, threshold float64
+
+	companyObjBytes, _ := stub.GetState(contractObj.InitiatorID)
+	_ = json.Unmarshal(companyObjBytes, &companyObj)
+
+	if !hasCreditFacility(companyObj) {
+		return nil
+	}
+
+	exposureObj := t.calculateExposure(stub, companyObj)
+	newExposure = exposureObj.TotalExposure + t.getContractValue(stub, contractObj)
+
+	//When the terms of an existing contract change, its previous value is already part of the exposure
+	var storedContract contract
+	storedContractBytes, _ := stub.GetState(strconv.Itoa(contractObj.ContractID))
+	if storedContractBytes != nil {
+		_ = json.Unmarshal(storedContractBytes, &storedContract)
+		invoiceList, _ := t.getInvoiceIncidentList(stub, strconv.Itoa(storedContract.ContractID))
+		if storedContract.InitiatorID == contractObj.InitiatorID && isOpenContract(storedContract) && len(invoiceList) == 0 {
+			newExposure = newExposure - t.getContractValue(stub, storedContract)
+		}
+	}
+	fmt.Println("Exposure of " + companyObj.CompanyID + " including new contract: " + strconv.FormatFloat(newExposure, 'f', 2, 64))
+
+	if newExposure > companyObj.CreditLimit+companyObj.Collateral {
+		return errors.New("Credit limit exceeded for company " + companyObj.CompanyID + " (Exposure: " + strconv.FormatFloat(newExposure, 'f', 2, 64) +
+			", Credit limit + collateral: " + strconv.FormatFloat(companyObj.CreditLimit+companyObj.Collateral, 'f', 2, 64) + ")")
+	}
+
+	threshold = getMarginThreshold(companyObj)
+	if newExposure > threshold {
+		marginCallObj := marginCall{MarginCallID: companyObj.CompanyID + "_MC_" + strconv.Itoa(contractObj.ContractID), CompanyID: companyObj.CompanyID,
+			CounterpartyID: contractObj.ReceiverID, ContractID: contractObj.ContractID, Exposure: newExposure, CreditLimit: companyObj.CreditLimit,
+			Collateral: companyObj.Collateral, Threshold: threshold, CallAmount: newExposure - threshold, Status: "Open"}
+		_, err := t.createMarginCall(stub, marginCallObj)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *SimpleChaincode) createMarginCall(stub shim.ChaincodeStubInterface, marginCallObj marginCall) ([]byte, error) {
+	var marginCallIDArr []string
+
+	fmt.Println("Creating margin call: " + marginCallObj.MarginCallID)
+
+	marginCallObjBytes, err1 := json.Marshal(marginCallObj)
+	if err1 != nil {
+		return nil, err1
+	}
+	err2 := stub.PutState(marginCallObj.MarginCallID, marginCallObjBytes)
+	if err2 != nil {
+		return nil, err2
+	}
+
+	//Add margin call id into company's margin call list
+	var arrKey = marginCallObj.CompanyID + marginCallAffix
+	marginCallIDListObjBytes, _ := stub.GetState(arrKey)
+	if marginCallIDListObjBytes != nil {
+		_ = json.Unmarshal(marginCallIDListObjBytes, &marginCallIDArr)
+	}
+	if !contains(marginCallIDArr, marginCallObj.MarginCallID) {
+		marginCallIDArr = append(marginCallIDArr, marginCallObj.MarginCallID)
+	}
+	marginCallIDListObjBytes, _ = json.Marshal(&marginCallIDArr)
+	_ = stub.PutState(arrKey, marginCallIDListObjBytes)
+
+	//Add margin call keys to master key list
+	idList := []string{marginCallObj.MarginCallID, arrKey}
+	t.updateMasterKeyList(stub, idList)
+
+	return nil, nil
+}
+
+// Marks the open margin calls of a company as met once its exposure is back under the threshold
+func (t *SimpleChaincode) reviewMarginCalls(stub shim.ChaincodeStubInterface, companyObj company) {
+	var marginCallIDArr []string
+
+	exposureObj := t.calculateExposure(stub, companyObj)
+	if exposureObj.TotalExposure > exposureObj.MarginThreshold {
+		return
+	}
+
+	marginCallIDListObjBytes, _ := stub.GetState(companyObj.CompanyID + marginCallAffix)
+	_ = json.Unmarshal(marginCallIDListObjBytes, &marginCallIDArr)
+
+	for _, k := range marginCallIDArr {
+		var marginCallObj marginCall
+		marginCallObjBytes, _ := stub.GetState(k)
+		_ = json.Unmarshal(marginCallObjBytes, &marginCallObj)
+
+		if marginCallObj.Status == "Open" {
+			marginCallObj.Status = "Met"
+			marginCallObjBytes, _ = json.Marshal(&marginCallObj)
+			_ = stub.PutState(k, marginCallObjBytes)
+		}
+	}
+}
+
+func (t *SimpleChaincode) setCreditLimit(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var companyID string
+	var creditLimit, marginCallPct float64
+	var companyObj company
+
+	fmt.Println("Entered function setCreditLimit()")
+
+	if len(args) < 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2 or 3 arguments (CompanyID, credit limit, margin call %).")
+	}
+
+	companyID = args[0]
+	creditLimit, err := strconv.ParseFloat(args[1], 64)
+	if err != nil || creditLimit < 0 {
+		return nil, errors.New("Invalid credit limit: " + args[1])
+	}
+	if len(args) > 2 {
+		marginCallPct, err = strconv.ParseFloat(args[2], 64)
+		if err != nil || marginCallPct < 0 || marginCallPct > 100 {
+			return nil, errors.New("Invalid margin call percentage: " + args[2])
+		}
+	}
+
+	companyObjBytes, _ := stub.GetState(companyID)
+	if companyObjBytes == nil {
+		return nil, errors.New("Company not found: " + companyID)
+	}
+	_ = json.Unmarshal(companyObjBytes, &companyObj)
+
+	companyObj.CreditLimit = creditLimit
+	companyObj.MarginCallPct = marginCallPct
+
+	companyObjBytes, _ = json.Marshal(&companyObj)
+	err = stub.PutState(companyID, companyObjBytes)
+	if err != nil {
+		return nil, errors.New("Failed to save Company info")
+	}
+
+	t.reviewMarginCalls(stub, companyObj)
+
+	return nil, nil
+}
+
+// Moves an amount from the bank balance of a company into posted collateral
+func (t *SimpleChaincode) postCollateral(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var companyID string
+	var amount float64
+	var postDate int
+	var companyObj company
+
+	fmt.Println("Entered function postCollateral()")
+
+	if len(args) < 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3 arguments (CompanyID, collateral amount, date).")
+	}
+
+	companyID = args[0]
+	amount, err := strconv.ParseFloat(args[1], 64)
+	if err != nil || amount <= 0 {
+		return nil, errors.New("Invalid collateral amount: " + args[1])
+	}
+	postDate, _ = strconv.Atoi(args[2])
+
+	companyObjBytes, _ := stub.GetState(companyID)
+	if companyObjBytes == nil {
+		return nil, errors.New("Company not found: " + companyID)
+	}
+	_ = json.Unmarshal(companyObjBytes, &companyObj)
+
+	if companyObj.BankBalance < amount {
+		return nil, errors.New("Insufficient funds to post collateral (Bank Balance: " + strconv.FormatFloat(companyObj.BankBalance, 'f', 2, 64) + ")")
+	}
+
+	companyObj.BankBalance = companyObj.BankBalance - amount
+	companyObj.Collateral = companyObj.Collateral + amount
+	companyObj.BalanceUpdatedDateMS = postDate
+
+	companyObjBytes, _ = json.Marshal(&companyObj)
+	err = stub.PutState(companyID, companyObjBytes)
+	if err != nil {
+		return nil, errors.New("Failed to save Company info")
+	}
+
+	t.reviewMarginCalls(stub, companyObj)
+
+	return nil, nil
+}
+
+// Returns posted collateral to the bank balance as long as the exposure stays within the credit facility
+func (t *SimpleChaincode) releaseCollateral(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var companyID string
+	var amount float64
+	var releaseDate int
+	var companyObj company
+
+	fmt.Println("Entered function releaseCollateral()")
+
+	if len(args) < 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3 arguments (CompanyID, collateral amount, date).")
+	}
+
+	companyID = args[0]
+	amount, err := strconv.ParseFloat(args[1], 64)
+	if err != nil || amount <= 0 {
+		return nil, errors.New("Invalid collateral amount: " + args[1])
+	}
+	releaseDate, _ = strconv.Atoi(args[2])
+
+	companyObjBytes, _ := stub.GetState(companyID)
+	if companyObjBytes == nil {
+		return nil, errors.New("Company not found: " + companyID)
+	}
+	_ = json.Unmarshal(companyObjBytes, &companyObj)
+
+	if companyObj.Collateral < amount {
+		return nil, errors.New("Cannot release more than the posted collateral (Collateral: " + strconv.FormatFloat(companyObj.Collateral, 'f', 2, 64) + ")")
+	}
+
+	exposureObj := t.calculateExposure(stub, companyObj)
+	if exposureObj.TotalExposure > companyObj.CreditLimit+companyObj.Collateral-amount {
+		return nil, errors.New("Cannot release collateral: exposure " + strconv.FormatFloat(exposureObj.TotalExposure, 'f', 2, 64) + " would exceed the credit facility")
+	}
+
+	companyObj.Collateral = companyObj.Collateral - amount
+	companyObj.BankBalance = companyObj.BankBalance + amount
+	companyObj.BalanceUpdatedDateMS = releaseDate
+
+	companyObjBytes, _ = json.Marshal(&companyObj)
+	err = stub.PutState(companyID, companyObjBytes)
+	if err != nil {
+		return nil, errors.New("Failed to save Company info")
+	}
+
+	return nil, nil
+}
+
+func (t *SimpleChaincode) getExposure(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var companyID, returnMessage string
+	var companyObj company
+
+	if len(args) < 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1 (CompanyID) or 2 (CompanyID, CounterpartyID).")
+	}
+
+	companyID = args[0]
+	fmt.Println("Getting exposure for company: " + companyID)
+
+	companyObjBytes, _ := stub.GetState(companyID)
+	if companyObjBytes == nil {
+		return nil, errors.New("Company not found: " + companyID)
+	}
+	_ = json.Unmarshal(companyObjBytes, &companyObj)
+
+	exposureObj := t.calculateExposure(stub, companyObj)
+
+	//Narrow down to a single counterparty pair
+	if len(args) > 1 {
+		var pairList []counterpartyExposure
+		for _, cpExposure := range exposureObj.Counterparties {
+			if cpExposure.CounterpartyID == args[1] {
+				pairList = append(pairList, cpExposure)
+			}
+		}
+		exposureObj.Counterparties = pairList
+	}
+
+	exposureObjBytes, err := json.Marshal(exposureObj)
+	if err != nil {
+		return nil, err
+	}
+
+	returnMessage = "{\"statusCode\" : \"SUCCESS\", \"body\" : " + string(exposureObjBytes) + "}"
+	return []byte(returnMessage), nil
+}
+
+func (t *SimpleChaincode) getMarginCallList(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var companyID, returnMessage string
+	var marginCallIDArr []string
+	var marginCallList []marginCall
+
+	if len(args) < 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1 (CompanyID).")
+	}
+
+	companyID = args[0]
+	fmt.Println("Getting margin calls for company: " + companyID)
+
+	marginCallIDListObjBytes, _ := stub.GetState(companyID + marginCallAffix)
+	_ = json.Unmarshal(marginCallIDListObjBytes, &marginCallIDArr)
+
+	marginCallList = []marginCall{}
+	for _, k := range marginCallIDArr {
+		var marginCallObj marginCall
+		marginCallObjBytes, _ := stub.GetState(k)
+		_ = json.Unmarshal(marginCallObjBytes, &marginCallObj)
+		marginCallList = append(marginCallList, marginCallObj)
+	}
+
+	marginCallListBytes, _ := json.Marshal(marginCallList)
+	returnMessage = "{\"statusCode\" : \"SUCCESS\", \"body\" : " + string(marginCallListBytes) + "}"
+	return []byte(returnMessage), nil
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// A buyer's gas request served by a shipper through trade requests to producers and transport requests to transporters
+type supplyChainDeal struct {
+	DealID              string `json:"deal_id"`
+	ShipperID           string `json:"shipper_id"`
+	GasRequestID        int    `json:"gas_request_id"`
+	TradeRequestIDs     []int  `json:"trade_request_ids"`
+	TransportRequestIDs []int  `json:"transport_request_ids"`
+	CreatedDateMS       int    `json:"created_date_ms"`
+}
+
+type dealLegStatus struct {
+	LegType           string  `json:"leg_type"`
+	ContractID        int     `json:"contract_id"`
+	CounterpartyID    string  `json:"counterparty_id"`
+	EnergyMWH         float64 `json:"energy_mwh"`
+	StartDate         string  `json:"start_date"`
+	EndDate           string  `json:"end_date"`
+	ContractStatus    string  `json:"contract_status"`
+	ContractValue     float64 `json:"contract_value"`
+	DeliveredMWH      float64 `json:"delivered_mwh"`
+	IOTStatus         string  `json:"iot_status"`
+	OpenIncidents     int     `json:"open_incidents"`
+	InvoiceCount      int     `json:"invoice_count"`
+	InvoicedAmount    float64 `json:"invoiced_amount"`
+	PaidAmount        float64 `json:"paid_amount"`
+	InvoiceStatus     string  `json:"invoice_status"`
+	LastReadingDateMS int     `json:"last_reading_date_ms"`
+}
+
+type dealInfo struct {
+	Deal              supplyChainDeal `json:"deal"`
+	DealStatus        string          `json:"deal_status"`
+	GasRequestMWH     float64         `json:"gas_request_mwh"`
+	TradedMWH         float64         `json:"traded_mwh"`
+	TransportedMWH    float64         `json:"transported_mwh"`
+	Revenue           float64         `json:"revenue"`
+	Cost              float64         `json:"cost"`
+	Margin            float64         `json:"margin"`
+	InvoicedRevenue   float64         `json:"invoiced_revenue"`
+	InvoicedCost      float64         `json:"invoiced_cost"`
+	RealisedMargin    float64         `json:"realised_margin"`
+	Legs              []dealLegStatus `json:"legs"`
+	ConsistencyIssues []string        `json:"consistency_issues"`
+}
+
+// Loads a contract that is one of the given kind of request
+func (t *SimpleChaincode) loadRequest(stub shim.ChaincodeStubInterface, idArrKey string, contractIDStr string) (contract, error) {
+	var contractObj contract
+	var contractIDList []string
+
+	contractIDListBytes, _ := stub.GetState(idArrKey)
+	_ = json.Unmarshal(contractIDListBytes, &contractIDList)
+	if !contains(contractIDList, contractIDStr) {
+		return contractObj, errors.New("Contract " + contractIDStr + " is not in " + idArrKey)
+	}
+
+	contractObjBytes, _ := stub.GetState(contractIDStr)
+	err := json.Unmarshal(contractObjBytes, &contractObj)
+	return contractObj, err
+}
+
+// Checks a trade or transport leg against the gas request: the shipper must initiate it, it must be open,
+// not part of another deal, and deliver over the whole period of the gas request
+func validateDealLeg(dealObj supplyChainDeal, gasRequest contract, legObj contract) error {
+	var legIDStr = strconv.Itoa(legObj.ContractID)
+
+	if legObj.InitiatorID != dealObj.ShipperID {
+		return errors.New("Contract " + legIDStr + " was not initiated by shipper " + dealObj.ShipperID)
+	}
+	if !isOpenContract(legObj) {
+		return errors.New("Contract " + legIDStr + " is " + legObj.ContractStatus)
+	}
+	if legObj.DealID != "" && legObj.DealID != dealObj.DealID {
+		return errors.New("Contract " + legIDStr + " already belongs to deal " + legObj.DealID)
+	}
+
+	return checkDealPeriod(gasRequest, legObj)
+}
+
+func checkDealPeriod(gasRequest contract, legObj contract) error {
+	var legIDStr = strconv.Itoa(legObj.ContractID)
+
+	gasStart, err1 := parseDate(gasRequest.ContractStartDate)
+	gasEnd, err2 := parseDate(gasRequest.ContractEndDate)
+	legStart, err3 := parseDate(legObj.ContractStartDate)
+	legEnd, err4 := parseDate(legObj.ContractEndDate)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		return errors.New("Delivery dates of contract " + legIDStr + " or of the gas request cannot be read")
+	}
+	if legStart.After(gasStart) || legEnd.Before(gasEnd) {
+		return errors.New("Contract " + legIDStr + " (" + legObj.ContractStartDate + " - " + legObj.ContractEndDate + ") does not cover the gas request period " +
+			gasRequest.ContractStartDate + " - " + gasRequest.ContractEndDate)
+	}
+	return nil
+}
+
+func (t *SimpleChaincode) getDealLegs(stub shim.ChaincodeStubInterface, contractIDs []int) []contract {
+	var legList []contract
+
+	for _, k := range contractIDs {
+		var contractObj contract
+		contractObjBytes, _ := stub.GetState(strconv.Itoa(k))
+		_ = json.Unmarshal(contractObjBytes, &contractObj)
+		legList = append(legList, contractObj)
+	}
+	return legList
+}
+
+func sumOpenEnergy(contractList []contract) float64 {
+	var total float64
+	for _, k := range contractList {
+		if isOpenContract(k) {
+			total = total + k.EnergyMWH
+		}
+	}
+	return total
+}
+
+func (t *SimpleChaincode) saveDeal(stub shim.ChaincodeStubInterface, dealObj supplyChainDeal) error {
+	dealObjBytes, err := json.Marshal(&dealObj)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(dealObj.DealID, dealObjBytes)
+}
+
+// Adds a trade or transport leg to a deal. Legs together may not deliver more than the gas request asks for.
+func (t *SimpleChaincode) attachDealLeg(stub shim.ChaincodeStubInterface, dealObj *supplyChainDeal, gasRequest contract, legType string, contractIDStr string) error {
+	var idArrKey string
+	var legIDs []int
+
+	if legType == "Trade" {
+		idArrKey = tradeRequestKey
+		legIDs = dealObj.TradeRequestIDs
+	} else if legType == "Transport" {
+		idArrKey = transportRequestKey
+		legIDs = dealObj.TransportRequestIDs
+	} else {
+		return errors.New("Deal legs are Trade or Transport, not " + legType)
+	}
+
+	legObj, err := t.loadRequest(stub, idArrKey, contractIDStr)
+	if err != nil {
+		return err
+	}
+	for _, k := range legIDs {
+		if k == legObj.ContractID {
+			return errors.New("Contract " + contractIDStr + " is already a leg of deal " + dealObj.DealID)
+		}
+	}
+	err = validateDealLeg(*dealObj, gasRequest, legObj)
+	if err != nil {
+		return err
+	}
+
+	if sumOpenEnergy(t.getDealLegs(stub, legIDs))+legObj.EnergyMWH > gasRequest.EnergyMWH {
+		return errors.New(legType + " legs of deal " + dealObj.DealID + " would exceed the " + strconv.FormatFloat(gasRequest.EnergyMWH, 'f', -1, 64) + " MWh of the gas request")
+	}
+
+	if legType == "Trade" {
+		dealObj.TradeRequestIDs = append(dealObj.TradeRequestIDs, legObj.ContractID)
+	} else {
+		dealObj.TransportRequestIDs = append(dealObj.TransportRequestIDs, legObj.ContractID)
+	}
+
+	legObj.DealID = dealObj.DealID
+	return t.saveContract(stub, legObj)
+}
+
+// Creates a deal for a gas request received by the shipper, optionally with its first legs
+func (t *SimpleChaincode) createSupplyChainDeal(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var dealObj supplyChainDeal
+	var tradeIDs, transportIDs []string
+	var dealIDArr []string
+
+	fmt.Println("Entered function createSupplyChainDeal()")
+
+	if len(args) < 6 {
+		return nil, errors.New("Incorrect number of arguments. 6 expected (Deal ID, Shipper ID, Gas Request ID, Trade Request IDs JSON, Transport Request IDs JSON, Current Date in MilliSecs)")
+	}
+
+	existingBytes, _ := stub.GetState(args[0])
+	if existingBytes != nil {
+		return nil, errors.New("Deal already exists: " + args[0])
+	}
+
+	gasRequest, err := t.loadRequest(stub, gasRequestKey, args[2])
+	if err != nil {
+		return nil, err
+	}
+	if gasRequest.ReceiverID != args[1] {
+		return nil, errors.New("Gas request " + args[2] + " was not sent to shipper " + args[1])
+	}
+	if !isOpenContract(gasRequest) {
+		return nil, errors.New("Gas request " + args[2] + " is " + gasRequest.ContractStatus)
+	}
+	if gasRequest.DealID != "" {
+		return nil, errors.New("Gas request " + args[2] + " already belongs to deal " + gasRequest.DealID)
+	}
+
+	if args[3] != "" {
+		err = json.Unmarshal([]byte(args[3]), &tradeIDs)
+		if err != nil {
+			return nil, errors.New("Invalid trade request ID list: " + err.Error())
+		}
+	}
+	if args[4] != "" {
+		err = json.Unmarshal([]byte(args[4]), &transportIDs)
+		if err != nil {
+			return nil, errors.New("Invalid transport request ID list: " + err.Error())
+		}
+	}
+
+	dealObj = supplyChainDeal{DealID: args[0], ShipperID: args[1], GasRequestID: gasRequest.ContractID}
+	dealObj.CreatedDateMS, _ = strconv.Atoi(args[5])
+
+	for _, k := range tradeIDs {
+		err = t.attachDealLeg(stub, &dealObj, gasRequest, "Trade", k)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, k := range transportIDs {
+		err = t.attachDealLeg(stub, &dealObj, gasRequest, "Transport", k)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = t.saveDeal(stub, dealObj)
+	if err != nil {
+		return nil, err
+	}
+
+	gasRequest.DealID = dealObj.DealID
+	err = t.saveContract(stub, gasRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	dealIDListBytes, _ := stub.GetState(dealKey)
+	_ = json.Unmarshal(dealIDListBytes, &dealIDArr)
+	dealIDArr = append(dealIDArr, dealObj.DealID)
+	dealIDListBytes, _ = json.Marshal(&dealIDArr)
+	_ = stub.PutState(dealKey, dealIDListBytes)
+
+	t.updateMasterKeyList(stub, []string{dealObj.DealID, dealKey})
+
+	return nil, nil
+}
+
+func (t *SimpleChaincode) addDealLeg(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var dealObj supplyChainDeal
+	var gasRequest contract
+
+	fmt.Println("Entered function addDealLeg()")
+
+	if len(args) < 4 {
+		return nil, errors.New("Incorrect number of arguments. 4 expected (Deal ID, Shipper ID, Leg Type, Contract ID)")
+	}
+
+	dealObjBytes, _ := stub.GetState(args[0])
+	if dealObjBytes == nil {
+		return nil, errors.New("Deal not found: " + args[0])
+	}
+	_ = json.Unmarshal(dealObjBytes, &dealObj)
+	if dealObj.ShipperID != args[1] {
+		return nil, errors.New("Deal " + args[0] + " belongs to shipper " + dealObj.ShipperID)
+	}
+
+	gasRequestBytes, _ := stub.GetState(strconv.Itoa(dealObj.GasRequestID))
+	_ = json.Unmarshal(gasRequestBytes, &gasRequest)
+
+	err := t.attachDealLeg(stub, &dealObj, gasRequest, args[2], args[3])
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.saveDeal(stub, dealObj)
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// Delivery and billing of one contract
+func (t *SimpleChaincode) getLegStatus(stub shim.ChaincodeStubInterface, legType string, contractObj contract, counterpartyID string) dealLegStatus {
+	var pending, paid, disputed int
+
+	legObj := dealLegStatus{LegType: legType, ContractID: contractObj.ContractID, CounterpartyID: counterpartyID, EnergyMWH: contractObj.EnergyMWH,
+		StartDate: contractObj.ContractStartDate, EndDate: contractObj.ContractEndDate, ContractStatus: contractObj.ContractStatus, ContractValue: t.getContractValue(stub, contractObj)}
+
+	invoiceList, incidentList := t.getInvoiceIncidentList(stub, strconv.Itoa(contractObj.ContractID))
+
+	//Invoices and incidents are raised from flow meter readings
+	for _, k := range invoiceList {
+		legObj.DeliveredMWH = legObj.DeliveredMWH + k.EnergyMWH
+		if k.InvoiceDateMS > legObj.LastReadingDateMS {
+			legObj.LastReadingDateMS = k.InvoiceDateMS
+		}
+
+		amount := t.getInvoiceAmount(stub, k, contractObj)
+		legObj.InvoicedAmount = legObj.InvoicedAmount + amount
+		if k.PaymentStatus == "Paid" {
+			legObj.PaidAmount = legObj.PaidAmount + amount
+			paid = paid + 1
+		} else if k.PaymentStatus == "Disputed" {
+			disputed = disputed + 1
+		} else {
+			pending = pending + 1
+		}
+	}
+	for _, k := range incidentList {
+		legObj.DeliveredMWH = legObj.DeliveredMWH + k.ActualEnergyMWH
+		if k.IncidentDateMS > legObj.LastReadingDateMS {
+			legObj.LastReadingDateMS = k.IncidentDateMS
+		}
+		if k.IncidentStatus != "Resolved" && k.IncidentStatus != "Waived" {
+			legObj.OpenIncidents = legObj.OpenIncidents + 1
+		}
+	}
+	legObj.InvoiceCount = len(invoiceList)
+
+	if len(invoiceList) == 0 && len(incidentList) == 0 {
+		legObj.IOTStatus = "NoReadings"
+	} else if legObj.OpenIncidents > 0 {
+		legObj.IOTStatus = "Shortfall"
+	} else if legObj.DeliveredMWH >= contractObj.EnergyMWH {
+		legObj.IOTStatus = "Delivered"
+	} else {
+		legObj.IOTStatus = "Delivering"
+	}
+
+	if legObj.InvoiceCount == 0 {
+		legObj.InvoiceStatus = "NotInvoiced"
+	} else if disputed > 0 {
+		legObj.InvoiceStatus = "Disputed"
+	} else if pending > 0 {
+		legObj.InvoiceStatus = "Pending"
+	} else {
+		legObj.InvoiceStatus = "Paid"
+	}
+
+	return legObj
+}
+
+// Status, margin and consistency of a deal from the current state of its contracts
+func (t *SimpleChaincode) buildDealInfo(stub shim.ChaincodeStubInterface, dealObj supplyChainDeal) dealInfo {
+	var gasRequest contract
+	var infoObj dealInfo
+	var allAccepted = true
+	var allPaid = true
+	var anyReadings = false
+	var anyShortfall = false
+
+	gasRequestBytes, _ := stub.GetState(strconv.Itoa(dealObj.GasRequestID))
+	_ = json.Unmarshal(gasRequestBytes, &gasRequest)
+
+	infoObj.Deal = dealObj
+	infoObj.GasRequestMWH = gasRequest.EnergyMWH
+	infoObj.ConsistencyIssues = []string{}
+
+	gasLeg := t.getLegStatus(stub, "Gas", gasRequest, gasRequest.InitiatorID)
+	infoObj.Legs = append(infoObj.Legs, gasLeg)
+	infoObj.Revenue = gasLeg.ContractValue
+	infoObj.InvoicedRevenue = gasLeg.InvoicedAmount
+
+	tradeLegs := t.getDealLegs(stub, dealObj.TradeRequestIDs)
+	transportLegs := t.getDealLegs(stub, dealObj.TransportRequestIDs)
+	infoObj.TradedMWH = sumOpenEnergy(tradeLegs)
+	infoObj.TransportedMWH = sumOpenEnergy(transportLegs)
+
+	for i, legList := range [][]contract{tradeLegs, transportLegs} {
+		var legType = "Trade"
+		if i == 1 {
+			legType = "Transport"
+		}
+		for _, k := range legList {
+			legObj := t.getLegStatus(stub, legType, k, k.ReceiverID)
+			infoObj.Legs = append(infoObj.Legs, legObj)
+			if !isOpenContract(k) {
+				continue
+			}
+			infoObj.Cost = infoObj.Cost + legObj.ContractValue
+			infoObj.InvoicedCost = infoObj.InvoicedCost + legObj.InvoicedAmount
+			if err := checkDealPeriod(gasRequest, k); err != nil {
+				infoObj.ConsistencyIssues = append(infoObj.ConsistencyIssues, err.Error())
+			}
+		}
+	}
+
+	//Legs may have been renegotiated since they were attached
+	if infoObj.TradedMWH != infoObj.GasRequestMWH {
+		infoObj.ConsistencyIssues = append(infoObj.ConsistencyIssues, "Traded "+strconv.FormatFloat(infoObj.TradedMWH, 'f', -1, 64)+" MWh for a gas request of "+strconv.FormatFloat(infoObj.GasRequestMWH, 'f', -1, 64)+" MWh")
+	}
+	if infoObj.TransportedMWH != infoObj.GasRequestMWH {
+		infoObj.ConsistencyIssues = append(infoObj.ConsistencyIssues, "Transport booked for "+strconv.FormatFloat(infoObj.TransportedMWH, 'f', -1, 64)+" MWh for a gas request of "+strconv.FormatFloat(infoObj.GasRequestMWH, 'f', -1, 64)+" MWh")
+	}
+
+	infoObj.Margin = infoObj.Revenue - infoObj.Cost
+	infoObj.RealisedMargin = infoObj.InvoicedRevenue - infoObj.InvoicedCost
+
+	for _, k := range infoObj.Legs {
+		if k.LegType != "Gas" && (k.ContractStatus == "Cancelled" || k.ContractStatus == "Rejected") {
+			continue
+		}
+		if k.ContractStatus != "Accepted" {
+			allAccepted = false
+		}
+		if k.InvoiceStatus != "Paid" || k.IOTStatus != "Delivered" {
+			allPaid = false
+		}
+		if k.IOTStatus != "NoReadings" {
+			anyReadings = true
+		}
+		if k.IOTStatus == "Shortfall" {
+			anyShortfall = true
+		}
+	}
+
+	if !isOpenContract(gasRequest) {
+		infoObj.DealStatus = "Cancelled"
+	} else if infoObj.TradedMWH < infoObj.GasRequestMWH || infoObj.TransportedMWH < infoObj.GasRequestMWH {
+		infoObj.DealStatus = "Incomplete"
+	} else if !allAccepted {
+		infoObj.DealStatus = "Negotiating"
+	} else if anyShortfall {
+		infoObj.DealStatus = "Disrupted"
+	} else if allPaid {
+		infoObj.DealStatus = "Settled"
+	} else if anyReadings {
+		infoObj.DealStatus = "Delivering"
+	} else {
+		infoObj.DealStatus = "Contracted"
+	}
+
+	return infoObj
+}
+
+func (t *SimpleChaincode) getSupplyChainDeal(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var returnMessage string
+	var dealObj supplyChainDeal
+
+	if len(args) < 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1 (Deal ID).")
+	}
+
+	dealObjBytes, _ := stub.GetState(args[0])
+	if dealObjBytes == nil {
+		returnMessage = "{\"statusCode\" : \"FAIL\", \"body\" : \"Deal not found: " + args[0] + "\"}"
+		return []byte(returnMessage), nil
+	}
+	_ = json.Unmarshal(dealObjBytes, &dealObj)
+
+	infoObjBytes, err := json.Marshal(t.buildDealInfo(stub, dealObj))
+	if err != nil {
+		return nil, err
+	}
+
+	returnMessage = "{\"statusCode\" : \"SUCCESS\", \"body\" : " + string(infoObjBytes) + "}"
+	return []byte(returnMessage), nil
+}
+
+// Deals a company takes part in, as shipper or as counterparty of one of the legs
+func (t *SimpleChaincode) getSupplyChainDealList(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var returnMessage string
+	var dealIDArr []string
+	var dealList []dealInfo
+
+	if len(args) < 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1 (Company ID).")
+	}
+
+	fmt.Println("Getting deals for company: " + args[0])
+
+	dealIDListBytes, _ := stub.GetState(dealKey)
+	_ = json.Unmarshal(dealIDListBytes, &dealIDArr)
+
+	dealList = []dealInfo{}
+	for _, k := range dealIDArr {
+		var dealObj supplyChainDeal
+		dealObjBytes, _ := stub.GetState(k)
+		_ = json.Unmarshal(dealObjBytes, &dealObj)
+
+		infoObj := t.buildDealInfo(stub, dealObj)
+		for _, legObj := range infoObj.Legs {
+			if dealObj.ShipperID == args[0] || legObj.CounterpartyID == args[0] {
+				dealList = append(dealList, infoObj)
+				break
+			}
+		}
+	}
+
+	dealListBytes, _ := json.Marshal(dealList)
+	returnMessage = "{\"statusCode\" : \"SUCCESS\", \"body\" : " + string(dealListBytes) + "}"
+	return []byte(returnMessage), nil
+}
@@ -0,0 +1,711 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var dayMS = 24 * 60 * 60 * 1000
+var defaultResponseDays = 7
+var defaultResolutionDays = 30
+
+type evidenceRef struct {
+	EvidenceType string `json:"evidence_type"` // DocumentHash or IOTReading
+	Reference    string `json:"reference"`     // sha256 hex digest or <CompanyID>_IOTDATA/<TimestampMS>
+	Description  string `json:"description"`
+}
+
+type disputeClaim struct {
+	PartyID     string        `json:"party_id"`
+	ClaimType   string        `json:"claim_type"`
+	Statement   string        `json:"statement"`
+	Amount      float64       `json:"amount"`
+	Evidence    []evidenceRef `json:"evidence"`
+	ClaimDateMS int           `json:"claim_date_ms"`
+}
+
+type dispute struct {
+	DisputeID            string            `json:"dispute_id"`
+	TargetType           string            `json:"target_type"`
+	TargetID             string            `json:"target_id"`
+	ContractID           int               `json:"contract_id"`
+	RaisedBy             string            `json:"raised_by"`
+	Respondent           string            `json:"respondent"`
+	DisputedAmount       float64           `json:"disputed_amount"`
+	Claims               []disputeClaim    `json:"claims"`
+	DisputeStatus        string            `json:"dispute_status"`
+	RaisedDateMS         int               `json:"raised_date_ms"`
+	ResponseDeadlineMS   int               `json:"response_deadline_ms"`
+	ResolutionDeadlineMS int               `json:"resolution_deadline_ms"`
+	HeldInvoiceIDs       []string          `json:"held_invoice_ids"`
+	Outcome              string            `json:"outcome"`
+	AwardedAmount        float64           `json:"awarded_amount"`
+	ResolutionComments   string            `json:"resolution_comments"`
+	ResolvedDateMS       int               `json:"resolved_date_ms"`
+	CreditNoteID         string            `json:"credit_note_id"`
+	OutcomeProposals     []disputeProposal `json:"outcome_proposals,omitempty"`
+}
+
+// Outcome a party agrees to for an escalated dispute
+type disputeProposal struct {
+	PartyID        string  `json:"party_id"`
+	Outcome        string  `json:"outcome"`
+	AwardedAmount  float64 `json:"awarded_amount"`
+	Comments       string  `json:"comments"`
+	ProposalDateMS int     `json:"proposal_date_ms"`
+}
+
+type creditNote struct {
+	CreditNoteID  string  `json:"credit_note_id"`
+	NoteType      string  `json:"note_type"`
+	DisputeID     string  `json:"dispute_id"`
+	ContractID    int     `json:"contract_id"`
+	BeneficiaryID string  `json:"beneficiary_id"`
+	Amount        float64 `json:"amount"`
+	IssueDateMS   int     `json:"issue_date_ms"`
+	InvoiceID     int     `json:"invoice_id"`
+	CreditStatus  string  `json:"credit_status"`
+}
+
+var disputeOutcomes = []string{"Upheld", "PartiallyUpheld", "Rejected", "Withdrawn"}
+
+// Evidence must be a sha256 digest of an off-chain document or point at a stored IoT reading
+func (t *SimpleChaincode) validateEvidence(stub shim.ChaincodeStubInterface, evidenceList []evidenceRef) error {
+	for _, evidence := range evidenceList {
+		if evidence.EvidenceType == "DocumentHash" {
+			digest, err := hex.DecodeString(evidence.Reference)
+			if err != nil || len(digest) != 32 {
+				return errors.New("Document evidence must be a sha256 hex digest: " + evidence.Reference)
+			}
+		} else if evidence.EvidenceType == "IOTReading" {
+			var flowMeterList []flowMeterData
+			var found bool
+
+			parts := strings.Split(evidence.Reference, "/")
+			if len(parts) != 2 || !strings.HasSuffix(parts[0], iotKeyAffix) {
+				return errors.New("IOT evidence must look like <CompanyID>" + iotKeyAffix + "/<TimestampMS>: " + evidence.Reference)
+			}
+			timestamp, _ := strconv.Atoi(parts[1])
+
+			flowMeterObjBytes, _ := stub.GetState(parts[0])
+			_ = json.Unmarshal(flowMeterObjBytes, &flowMeterList)
+			for _, flowMeter := range flowMeterList {
+				if flowMeter.TimestampMS == timestamp {
+					found = true
+				}
+			}
+			if !found {
+				return errors.New("IOT reading not found: " + evidence.Reference)
+			}
+		} else {
+			return errors.New("Unknown evidence type: " + evidence.EvidenceType)
+		}
+	}
+	return nil
+}
+
+func (t *SimpleChaincode) saveDispute(stub shim.ChaincodeStubInterface, disputeObj dispute) error {
+	disputeObjBytes, err := json.Marshal(&disputeObj)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(disputePrefix+disputeObj.DisputeID, disputeObjBytes)
+}
+
+func (t *SimpleChaincode) setInvoicePaymentStatus(stub shim.ChaincodeStubInterface, invoiceIDStr string, paymentStatus string) {
+	var invoiceObj invoice
+
+	invoiceObjBytes, _ := stub.GetState(invoiceIDStr)
+	_ = json.Unmarshal(invoiceObjBytes, &invoiceObj)
+
+	invoiceObj.PaymentStatus = paymentStatus
+	invoiceObjBytes, _ = json.Marshal(&invoiceObj)
+	_ = stub.PutState(invoiceIDStr, invoiceObjBytes)
+}
+
+// Raises a dispute against an invoice, incident or contract and holds the payments it covers
+func (t *SimpleChaincode) raiseDispute(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var disputeID, targetType, targetID, raisedBy, statement string
+	var disputedAmount float64
+	var raisedDate, responseDays, resolutionDays int
+	var disputeObj dispute
+	var contractObj contract
+	var evidenceList []evidenceRef
+	var disputeIDArr []string
+
+	fmt.Println("Entered function raiseDispute()")
+
+	if len(args) < 8 {
+		return nil, errors.New("Incorrect number of arguments. 8 expected (Dispute ID, Target Type, Target ID, Raised By, Disputed Amount, Statement, Evidence JSON, Current Date in MilliSecs) and optionally response and resolution days")
+	}
+
+	disputeID = args[0]
+	targetType = args[1]
+	targetID = args[2]
+	raisedBy = args[3]
+	disputedAmount, _ = strconv.ParseFloat(args[4], 64)
+	statement = args[5]
+	raisedDate, _ = strconv.Atoi(args[7])
+
+	responseDays = defaultResponseDays
+	resolutionDays = defaultResolutionDays
+	if len(args) > 8 {
+		responseDays, _ = strconv.Atoi(args[8])
+	}
+	if len(args) > 9 {
+		resolutionDays, _ = strconv.Atoi(args[9])
+	}
+	if responseDays <= 0 || resolutionDays < responseDays {
+		return nil, errors.New("Resolution deadline must not be before the response deadline")
+	}
+
+	existingBytes, _ := stub.GetState(disputePrefix + disputeID)
+	if existingBytes != nil {
+		return nil, errors.New("Dispute already exists: " + disputeID)
+	}
+
+	if args[6] != "" {
+		err := json.Unmarshal([]byte(args[6]), &evidenceList)
+		if err != nil {
+			return nil, errors.New("Invalid evidence list: " + err.Error())
+		}
+	}
+	err := t.validateEvidence(stub, evidenceList)
+	if err != nil {
+		return nil, err
+	}
+
+	//Resolve the disputed object to its contract and find the payments to hold
+	if targetType == "Invoice" {
+		var invoiceObj invoice
+		invoiceObjBytes, _ := stub.GetState(targetID)
+		if invoiceObjBytes == nil {
+			return nil, errors.New("Invoice not found: " + targetID)
+		}
+		_ = json.Unmarshal(invoiceObjBytes, &invoiceObj)
+		if invoiceObj.PaymentStatus != "Pending" {
+			return nil, errors.New("Only pending invoices can be disputed, invoice " + targetID + " is " + invoiceObj.PaymentStatus)
+		}
+		disputeObj.ContractID = invoiceObj.ContractID
+		disputeObj.HeldInvoiceIDs = []string{targetID}
+	} else if targetType == "Incident" {
+		var incidentObj incident
+		incidentObjBytes, _ := stub.GetState(targetID)
+		if incidentObjBytes == nil {
+			return nil, errors.New("Incident not found: " + targetID)
+		}
+		_ = json.Unmarshal(incidentObjBytes, &incidentObj)
+		disputeObj.ContractID = incidentObj.ContractID
+		if incidentObj.PenaltyStatus == "Applied" {
+			disputeObj.HeldInvoiceIDs = []string{strconv.Itoa(incidentObj.PenaltyInvoiceID)}
+		}
+	} else if targetType == "Contract" {
+		disputeObj.ContractID, _ = strconv.Atoi(targetID)
+		invoiceList, _ := t.getInvoiceIncidentList(stub, targetID)
+		for _, invoiceObj := range invoiceList {
+			disputeObj.HeldInvoiceIDs = append(disputeObj.HeldInvoiceIDs, strconv.Itoa(invoiceObj.InvoiceID))
+		}
+	} else {
+		return nil, errors.New("Disputes can be raised against an Invoice, Incident or Contract, not " + targetType)
+	}
+
+	contractObjBytes, _ := stub.GetState(strconv.Itoa(disputeObj.ContractID))
+	if contractObjBytes == nil {
+		return nil, errors.New("Contract not found: " + strconv.Itoa(disputeObj.ContractID))
+	}
+	_ = json.Unmarshal(contractObjBytes, &contractObj)
+
+	if raisedBy == contractObj.InitiatorID {
+		disputeObj.Respondent = contractObj.ReceiverID
+	} else if raisedBy == contractObj.ReceiverID {
+		disputeObj.Respondent = contractObj.InitiatorID
+	} else {
+		return nil, errors.New("Company " + raisedBy + " is not a party to contract " + strconv.Itoa(contractObj.ContractID))
+	}
+
+	//Hold only invoices that are still unpaid
+	var heldInvoiceIDs []string
+	for _, invoiceIDStr := range disputeObj.HeldInvoiceIDs {
+		var invoiceObj invoice
+		invoiceObjBytes, _ := stub.GetState(invoiceIDStr)
+		_ = json.Unmarshal(invoiceObjBytes, &invoiceObj)
+		if invoiceObj.PaymentStatus == "Pending" {
+			t.setInvoicePaymentStatus(stub, invoiceIDStr, "Disputed")
+			heldInvoiceIDs = append(heldInvoiceIDs, invoiceIDStr)
+		}
+	}
+
+	disputeObj.DisputeID = disputeID
+	disputeObj.TargetType = targetType
+	disputeObj.TargetID = targetID
+	disputeObj.RaisedBy = raisedBy
+	disputeObj.DisputedAmount = disputedAmount
+	disputeObj.Claims = []disputeClaim{disputeClaim{PartyID: raisedBy, ClaimType: "Claim", Statement: statement, Amount: disputedAmount, Evidence: evidenceList, ClaimDateMS: raisedDate}}
+	disputeObj.DisputeStatus = "Open"
+	disputeObj.RaisedDateMS = raisedDate
+	disputeObj.ResponseDeadlineMS = raisedDate + responseDays*dayMS
+	disputeObj.ResolutionDeadlineMS = raisedDate + resolutionDays*dayMS
+	disputeObj.HeldInvoiceIDs = heldInvoiceIDs
+
+	err = t.saveDispute(stub, disputeObj)
+	if err != nil {
+		return nil, err
+	}
+
+	//Add dispute id to the global and the contract's dispute list
+	for _, arrKey := range []string{disputeKey, strconv.Itoa(disputeObj.ContractID) + disputeAffix} {
+		disputeIDArr = nil
+		disputeIDListBytes, _ := stub.GetState(arrKey)
+		if disputeIDListBytes != nil {
+			_ = json.Unmarshal(disputeIDListBytes, &disputeIDArr)
+		}
+		disputeIDArr = append(disputeIDArr, disputeID)
+		disputeIDListBytes, _ = json.Marshal(&disputeIDArr)
+		_ = stub.PutState(arrKey, disputeIDListBytes)
+	}
+
+	idList := []string{disputePrefix + disputeID, disputeKey, strconv.Itoa(disputeObj.ContractID) + disputeAffix}
+	t.updateMasterKeyList(stub, idList)
+
+	return nil, nil
+}
+
+// Adds a further claim from the raiser or a counter-claim from the respondent
+func (t *SimpleChaincode) addDisputeClaim(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var disputeID, partyID, claimType string
+	var amount float64
+	var claimDate int
+	var disputeObj dispute
+	var evidenceList []evidenceRef
+
+	fmt.Println("Entered function addDisputeClaim()")
+
+	if len(args) < 6 {
+		return nil, errors.New("Incorrect number of arguments. 6 expected (Dispute ID, Party ID, Statement, Amount, Evidence JSON, Current Date in MilliSecs)")
+	}
+
+	disputeID = args[0]
+	partyID = args[1]
+	amount, _ = strconv.ParseFloat(args[3], 64)
+	claimDate, _ = strconv.Atoi(args[5])
+
+	disputeObjBytes, _ := stub.GetState(disputePrefix + disputeID)
+	if disputeObjBytes == nil {
+		return nil, errors.New("Dispute not found: " + disputeID)
+	}
+	_ = json.Unmarshal(disputeObjBytes, &disputeObj)
+
+	if disputeObj.DisputeStatus != "Open" && disputeObj.DisputeStatus != "Responded" {
+		return nil, errors.New("Dispute " + disputeID + " is " + disputeObj.DisputeStatus + " and no longer accepts claims")
+	}
+	if claimDate > disputeObj.ResolutionDeadlineMS {
+		return nil, errors.New("Resolution deadline of dispute " + disputeID + " has passed")
+	}
+
+	if partyID == disputeObj.RaisedBy {
+		claimType = "Claim"
+	} else if partyID == disputeObj.Respondent {
+		if disputeObj.DisputeStatus == "Open" && claimDate > disputeObj.ResponseDeadlineMS {
+			return nil, errors.New("Response deadline of dispute " + disputeID + " has passed")
+		}
+		claimType = "CounterClaim"
+		disputeObj.DisputeStatus = "Responded"
+	} else {
+		return nil, errors.New("Company " + partyID + " is not a party to dispute " + disputeID)
+	}
+
+	if args[4] != "" {
+		err := json.Unmarshal([]byte(args[4]), &evidenceList)
+		if err != nil {
+			return nil, errors.New("Invalid evidence list: " + err.Error())
+		}
+	}
+	err := t.validateEvidence(stub, evidenceList)
+	if err != nil {
+		return nil, err
+	}
+
+	disputeObj.Claims = append(disputeObj.Claims, disputeClaim{PartyID: partyID, ClaimType: claimType, Statement: args[2], Amount: amount, Evidence: evidenceList, ClaimDateMS: claimDate})
+
+	err = t.saveDispute(stub, disputeObj)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// Closes a dispute. The raiser may only withdraw, the respondent may concede in full or in part, a respondent
+// rejecting the claim escalates the dispute. An escalated dispute is closed by an operator or administrator, who
+// passes its user ID and password, or once both parties have proposed the same outcome and amount.
+func (t *SimpleChaincode) resolveDispute(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var disputeID, companyID, outcome, comments string
+	var awardedAmount float64
+	var resolvedDate int
+	var disputeObj dispute
+
+	fmt.Println("Entered function resolveDispute()")
+
+	if len(args) < 6 {
+		return nil, errors.New("Incorrect number of arguments. 6 expected (Dispute ID, Company ID or operator user ID, Outcome, Awarded Amount, Comments, Current Date in MilliSecs) and the operator's password")
+	}
+
+	disputeID = args[0]
+	companyID = args[1]
+	outcome = args[2]
+	awardedAmount, _ = strconv.ParseFloat(args[3], 64)
+	comments = args[4]
+	resolvedDate, _ = strconv.Atoi(args[5])
+
+	if !contains(disputeOutcomes, outcome) {
+		return nil, errors.New("Unknown dispute outcome: " + outcome)
+	}
+
+	disputeObjBytes, _ := stub.GetState(disputePrefix + disputeID)
+	if disputeObjBytes == nil {
+		return nil, errors.New("Dispute not found: " + disputeID)
+	}
+	_ = json.Unmarshal(disputeObjBytes, &disputeObj)
+
+	if disputeObj.DisputeStatus == "Resolved" {
+		return nil, errors.New("Dispute " + disputeID + " is already resolved")
+	}
+
+	if outcome == "Upheld" {
+		awardedAmount = disputeObj.DisputedAmount
+	} else if outcome == "Rejected" || outcome == "Withdrawn" {
+		awardedAmount = 0
+	} else if awardedAmount <= 0 || awardedAmount > disputeObj.DisputedAmount {
+		return nil, errors.New("Partially upheld disputes need an awarded amount between 0 and the disputed amount")
+	}
+	if outcome == "Withdrawn" && companyID != disputeObj.RaisedBy {
+		return nil, errors.New("Only the raising party can withdraw dispute " + disputeID)
+	}
+
+	if disputeObj.DisputeStatus == "Escalated" {
+		if len(args) > 6 {
+			err := t.checkArbitrator(stub, companyID, args[6])
+			if err != nil {
+				return nil, err
+			}
+		} else if companyID == disputeObj.RaisedBy || companyID == disputeObj.Respondent {
+			agreed, err := t.proposeDisputeOutcome(stub, &disputeObj, disputeProposal{PartyID: companyID, Outcome: outcome,
+				AwardedAmount: awardedAmount, Comments: comments, ProposalDateMS: resolvedDate})
+			if err != nil || !agreed {
+				return nil, err
+			}
+		} else {
+			return nil, errors.New("Company " + companyID + " is not a party to dispute " + disputeID)
+		}
+	} else {
+		if companyID == disputeObj.RaisedBy && outcome != "Withdrawn" {
+			return nil, errors.New("The raising party can only withdraw dispute " + disputeID)
+		}
+		if companyID != disputeObj.RaisedBy && companyID != disputeObj.Respondent {
+			return nil, errors.New("Company " + companyID + " is not a party to dispute " + disputeID)
+		}
+
+		//A respondent cannot close a dispute against the raiser, rejecting it goes to arbitration
+		if companyID == disputeObj.Respondent && outcome == "Rejected" {
+			fmt.Println("Respondent rejected dispute " + disputeID + ", escalating")
+			disputeObj.DisputeStatus = "Escalated"
+			disputeObj.Claims = append(disputeObj.Claims, disputeClaim{PartyID: companyID, ClaimType: "Rejection", Statement: comments, ClaimDateMS: resolvedDate})
+			return nil, t.saveDispute(stub, disputeObj)
+		}
+	}
+
+	err := t.closeDispute(stub, disputeObj, outcome, awardedAmount, comments, resolvedDate)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// Operators and administrators arbitrate escalated disputes
+func (t *SimpleChaincode) checkArbitrator(stub shim.ChaincodeStubInterface, userID string, password string) error {
+	var userObj user
+
+	validUser, _, _ := t.verifyUser(stub, []string{userID, password})
+	if !validUser {
+		return errors.New("Not allowed: invalid user or password")
+	}
+	userObjBytes, _ := stub.GetState(userID)
+	_ = json.Unmarshal(userObjBytes, &userObj)
+	if userObj.Role != "Admin" && userObj.Role != "Operator" {
+		return errors.New("Not allowed: " + userID + " is not an operator or administrator")
+	}
+	return nil
+}
+
+// Records a party's proposal for an escalated dispute, replacing its earlier one. Returns true when the other
+// party has proposed the same outcome and amount, the dispute is then closed by the caller.
+func (t *SimpleChaincode) proposeDisputeOutcome(stub shim.ChaincodeStubInterface, disputeObj *dispute, proposal disputeProposal) (bool, error) {
+	var proposals []disputeProposal
+	var agreed bool
+
+	for _, k := range disputeObj.OutcomeProposals {
+		if k.PartyID == proposal.PartyID {
+			continue
+		}
+		agreed = k.Outcome == proposal.Outcome && k.AwardedAmount == proposal.AwardedAmount
+		proposals = append(proposals, k)
+	}
+	disputeObj.OutcomeProposals = append(proposals, proposal)
+	if agreed {
+		return true, nil
+	}
+
+	fmt.Println("Company " + proposal.PartyID + " proposed " + proposal.Outcome + " for dispute " + disputeObj.DisputeID)
+	return false, t.saveDispute(stub, *disputeObj)
+}
+
+// Records the outcome, issues a credit note for any awarded amount and releases the held invoices
+func (t *SimpleChaincode) closeDispute(stub shim.ChaincodeStubInterface, disputeObj dispute, outcome string, awardedAmount float64, comments string, resolvedDate int) error {
+	var contractObj contract
+
+	contractObjBytes, _ := stub.GetState(strconv.Itoa(disputeObj.ContractID))
+	_ = json.Unmarshal(contractObjBytes, &contractObj)
+
+	disputeObj.DisputeStatus = "Resolved"
+	disputeObj.Outcome = outcome
+	disputeObj.AwardedAmount = awardedAmount
+	disputeObj.ResolutionComments = comments
+	disputeObj.ResolvedDateMS = resolvedDate
+
+	//Release held payments before the credit note so it can go against a released invoice
+	for _, invoiceIDStr := range disputeObj.HeldInvoiceIDs {
+		t.setInvoicePaymentStatus(stub, invoiceIDStr, "Pending")
+	}
+
+	if awardedAmount > 0 {
+		creditNoteObj := creditNote{CreditNoteID: disputeObj.DisputeID + "_CN", NoteType: "CreditNote", DisputeID: disputeObj.DisputeID,
+			ContractID: disputeObj.ContractID, BeneficiaryID: disputeObj.RaisedBy, Amount: awardedAmount, IssueDateMS: resolvedDate, CreditStatus: "Pending"}
+		//A receiver winning a dispute increases what the initiator owes
+		if disputeObj.RaisedBy == contractObj.ReceiverID {
+			creditNoteObj.NoteType = "DebitNote"
+		}
+
+		err := t.issueCreditNote(stub, creditNoteObj, disputeObj)
+		if err != nil {
+			return err
+		}
+		disputeObj.CreditNoteID = creditNoteObj.CreditNoteID
+	}
+
+	return t.saveDispute(stub, disputeObj)
+}
+
+func creditNoteAdjustment(creditNoteObj creditNote) invoiceAdjustment {
+	var amount = -creditNoteObj.Amount
+	if creditNoteObj.NoteType == "DebitNote" {
+		amount = creditNoteObj.Amount
+	}
+	return invoiceAdjustment{AdjustmentType: creditNoteObj.NoteType, Reference: creditNoteObj.CreditNoteID, Amount: amount, Comments: "Dispute " + creditNoteObj.DisputeID}
+}
+
+// Stores a credit note and applies it to the disputed invoice, the latest unpaid invoice of the
+// contract, or leaves it pending for the next invoice
+func (t *SimpleChaincode) issueCreditNote(stub shim.ChaincodeStubInterface, creditNoteObj creditNote, disputeObj dispute) error {
+	var invoiceIDStr string
+	var invoiceObj invoice
+	var creditNoteIDArr []string
+
+	fmt.Println("Issuing credit note: " + creditNoteObj.CreditNoteID)
+
+	if disputeObj.TargetType == "Invoice" {
+		invoiceIDStr = disputeObj.TargetID
+		invoiceObjBytes, _ := stub.GetState(invoiceIDStr)
+		_ = json.Unmarshal(invoiceObjBytes, &invoiceObj)
+		if invoiceObj.PaymentStatus != "Pending" {
+			invoiceIDStr = ""
+		}
+	}
+	if invoiceIDStr == "" {
+		invoiceList, _ := t.getInvoiceIncidentList(stub, strconv.Itoa(creditNoteObj.ContractID))
+		for _, k := range invoiceList {
+			if k.PaymentStatus == "Pending" {
+				invoiceObj = k
+				invoiceIDStr = strconv.Itoa(k.InvoiceID)
+			}
+		}
+	}
+
+	if invoiceIDStr != "" {
+		invoiceObj.Adjustments = append(invoiceObj.Adjustments, creditNoteAdjustment(creditNoteObj))
+		invoiceObjBytes, _ := json.Marshal(&invoiceObj)
+		err := stub.PutState(invoiceIDStr, invoiceObjBytes)
+		if err != nil {
+			return err
+		}
+		creditNoteObj.CreditStatus = "Applied"
+		creditNoteObj.InvoiceID = invoiceObj.InvoiceID
+	}
+
+	creditNoteObjBytes, err := json.Marshal(&creditNoteObj)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(disputePrefix+creditNoteObj.CreditNoteID, creditNoteObjBytes)
+	if err != nil {
+		return err
+	}
+
+	var arrKey = strconv.Itoa(creditNoteObj.ContractID) + creditNoteAffix
+	creditNoteIDListBytes, _ := stub.GetState(arrKey)
+	if creditNoteIDListBytes != nil {
+		_ = json.Unmarshal(creditNoteIDListBytes, &creditNoteIDArr)
+	}
+	creditNoteIDArr = append(creditNoteIDArr, creditNoteObj.CreditNoteID)
+	creditNoteIDListBytes, _ = json.Marshal(&creditNoteIDArr)
+	_ = stub.PutState(arrKey, creditNoteIDListBytes)
+
+	idList := []string{disputePrefix + creditNoteObj.CreditNoteID, arrKey}
+	t.updateMasterKeyList(stub, idList)
+
+	return nil
+}
+
+// Adds credit notes still waiting for an invoice to a new invoice
+func (t *SimpleChaincode) applyPendingCreditNotes(stub shim.ChaincodeStubInterface, invoiceObj *invoice) {
+	var creditNoteIDArr []string
+
+	creditNoteIDListBytes, _ := stub.GetState(strconv.Itoa(invoiceObj.ContractID) + creditNoteAffix)
+	_ = json.Unmarshal(creditNoteIDListBytes, &creditNoteIDArr)
+
+	for _, k := range creditNoteIDArr {
+		var creditNoteObj creditNote
+		creditNoteObjBytes, _ := stub.GetState(disputePrefix + k)
+		_ = json.Unmarshal(creditNoteObjBytes, &creditNoteObj)
+
+		if creditNoteObj.CreditStatus != "Pending" {
+			continue
+		}
+		invoiceObj.Adjustments = append(invoiceObj.Adjustments, creditNoteAdjustment(creditNoteObj))
+
+		creditNoteObj.CreditStatus = "Applied"
+		creditNoteObj.InvoiceID = invoiceObj.InvoiceID
+		creditNoteObjBytes, _ = json.Marshal(&creditNoteObj)
+		_ = stub.PutState(disputePrefix+k, creditNoteObjBytes)
+	}
+}
+
+// Applies dispute deadlines: a respondent that misses the response deadline concedes the claim,
+// disputes still open at the resolution deadline are escalated for arbitration.
+func (t *SimpleChaincode) checkDisputeDeadlines(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var currentDate int
+	var disputeIDArr []string
+
+	fmt.Println("Entered function checkDisputeDeadlines()")
+
+	if len(args) < 1 {
+		return nil, errors.New("Incorrect number of arguments. 1 expected (Current Date in MilliSecs)")
+	}
+	currentDate, _ = strconv.Atoi(args[0])
+
+	disputeIDListBytes, _ := stub.GetState(disputeKey)
+	_ = json.Unmarshal(disputeIDListBytes, &disputeIDArr)
+
+	for _, k := range disputeIDArr {
+		var disputeObj dispute
+		disputeObjBytes, _ := stub.GetState(disputePrefix + k)
+		_ = json.Unmarshal(disputeObjBytes, &disputeObj)
+
+		if disputeObj.DisputeStatus == "Open" && currentDate > disputeObj.ResponseDeadlineMS {
+			fmt.Println("Respondent missed the response deadline of dispute " + k)
+			err := t.closeDispute(stub, disputeObj, "Upheld", disputeObj.DisputedAmount, "No response before the response deadline", currentDate)
+			if err != nil {
+				return nil, err
+			}
+		} else if disputeObj.DisputeStatus == "Responded" && currentDate > disputeObj.ResolutionDeadlineMS {
+			fmt.Println("Escalating dispute " + k)
+			disputeObj.DisputeStatus = "Escalated"
+			err := t.saveDispute(stub, disputeObj)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+func (t *SimpleChaincode) getDispute(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var returnMessage string
+
+	if len(args) < 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1 (Dispute ID).")
+	}
+
+	disputeObjBytes, _ := stub.GetState(disputePrefix + args[0])
+	if disputeObjBytes == nil {
+		returnMessage = "{\"statusCode\" : \"FAIL\", \"body\" : \"Dispute not found: " + args[0] + "\"}"
+		return []byte(returnMessage), nil
+	}
+
+	returnMessage = "{\"statusCode\" : \"SUCCESS\", \"body\" : " + string(disputeObjBytes) + "}"
+	return []byte(returnMessage), nil
+}
+
+// Lists the disputes a company raised or has to respond to
+func (t *SimpleChaincode) getDisputeList(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var companyID, returnMessage string
+	var disputeIDArr []string
+	var disputeList []dispute
+
+	if len(args) < 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1 (Company ID).")
+	}
+
+	companyID = args[0]
+	fmt.Println("Getting disputes for company: " + companyID)
+
+	disputeIDListBytes, _ := stub.GetState(disputeKey)
+	_ = json.Unmarshal(disputeIDListBytes, &disputeIDArr)
+
+	disputeList = []dispute{}
+	for _, k := range disputeIDArr {
+		var disputeObj dispute
+		disputeObjBytes, _ := stub.GetState(disputePrefix + k)
+		_ = json.Unmarshal(disputeObjBytes, &disputeObj)
+
+		if disputeObj.RaisedBy == companyID || disputeObj.Respondent == companyID {
+			disputeList = append(disputeList, disputeObj)
+		}
+	}
+
+	disputeListBytes, _ := json.Marshal(disputeList)
+	returnMessage = "{\"statusCode\" : \"SUCCESS\", \"body\" : " + string(disputeListBytes) + "}"
+	return []byte(returnMessage), nil
+}
+
+func (t *SimpleChaincode) getCreditNoteList(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var returnMessage string
+	var creditNoteIDArr []string
+	var creditNoteList []creditNote
+
+	if len(args) < 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1 (Contract ID).")
+	}
+
+	creditNoteIDListBytes, _ := stub.GetState(args[0] + creditNoteAffix)
+	_ = json.Unmarshal(creditNoteIDListBytes, &creditNoteIDArr)
+
+	creditNoteList = []creditNote{}
+	for _, k := range creditNoteIDArr {
+		var creditNoteObj creditNote
+		creditNoteObjBytes, _ := stub.GetState(disputePrefix + k)
+		_ = json.Unmarshal(creditNoteObjBytes, &creditNoteObj)
+		creditNoteList = append(creditNoteList, creditNoteObj)
+	}
+
+	creditNoteListBytes, _ := json.Marshal(creditNoteList)
+	returnMessage = "{\"statusCode\" : \"SUCCESS\", \"body\" : " + string(creditNoteListBytes) + "}"
+	return []byte(returnMessage), nil
+}
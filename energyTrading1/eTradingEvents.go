@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// A transaction can only set one chaincode event, so the events of an invoke are collected and emitted together
+// under this name when the invoke succeeds. Clients filter on event_type and company_ids.
+var eventName = "etrading"
+
+// Raised when the event payloads change in a way clients have to handle
+var eventSchemaVersion = 1
+
+type eventEnvelope struct {
+	SchemaVersion int             `json:"schema_version"`
+	TxID          string          `json:"tx_id"`
+	Events        []businessEvent `json:"events"`
+}
+
+// EventType is one of ContractCreated, ContractStatusChanged, InvoiceIssued, IncidentRaised, PaymentSettled,
+// BalanceToppedUp or UserRegistered. Data holds the matching *EventData structure.
+type businessEvent struct {
+	Sequence   int         `json:"sequence"`
+	EventType  string      `json:"event_type"`
+	EntityID   string      `json:"entity_id"`
+	CompanyIDs []string    `json:"company_ids"`
+	Data       interface{} `json:"data"`
+}
+
+type contractEventData struct {
+	ContractID     int     `json:"contract_id"`
+	InitiatorID    string  `json:"initiator_id"`
+	ReceiverID     string  `json:"receiver_id"`
+	EnergyMWH      float64 `json:"energy_mwh"`
+	StartDate      string  `json:"start_date"`
+	EndDate        string  `json:"end_date"`
+	Status         string  `json:"status"`
+	PreviousStatus string  `json:"previous_status"`
+}
+
+type invoiceEventData struct {
+	InvoiceID     int     `json:"invoice_id"`
+	ContractID    int     `json:"contract_id"`
+	InvoiceType   string  `json:"invoice_type"`
+	PayerID       string  `json:"payer_id"`
+	PayeeID       string  `json:"payee_id"`
+	EnergyMWH     float64 `json:"energy_mwh"`
+	Amount        float64 `json:"amount"`
+	InvoiceDateMS int     `json:"invoice_date_ms"`
+}
+
+type incidentEventData struct {
+	IncidentID        int     `json:"incident_id"`
+	ContractID        int     `json:"contract_id"`
+	ExpectedEnergyMWH float64 `json:"expected_energy_mwh"`
+	ActualEnergyMWH   float64 `json:"actual_energy_mwh"`
+	IncidentDateMS    int     `json:"incident_date_ms"`
+}
+
+type paymentEventData struct {
+	InvoiceIDs    []string `json:"invoice_ids"`
+	SettlementID  string   `json:"settlement_id"`
+	PayerID       string   `json:"payer_id"`
+	PayeeID       string   `json:"payee_id"`
+	Amount        float64  `json:"amount"`
+	PaymentDateMS int      `json:"payment_date_ms"`
+}
+
+type balanceEventData struct {
+	CompanyID   string  `json:"company_id"`
+	Amount      float64 `json:"amount"`
+	BankBalance float64 `json:"bank_balance"`
+	TopupDateMS int     `json:"topup_date_ms"`
+}
+
+type userEventData struct {
+	UserName    string `json:"user_name"`
+	CompanyID   string `json:"company_id"`
+	CompanyType string `json:"company_type"`
+}
+
+// Events of the transactions in progress by transaction ID
+var pendingEvents = struct {
+	sync.Mutex
+	events map[string][]businessEvent
+}{events: make(map[string][]businessEvent)}
+
+func (t *SimpleChaincode) emitEvent(stub shim.ChaincodeStubInterface, eventType string, entityID string, companyIDs []string, data interface{}) {
+	pendingEvents.Lock()
+	defer pendingEvents.Unlock()
+
+	txID := stub.GetTxID()
+	eventObj := businessEvent{Sequence: len(pendingEvents.events[txID]) + 1, EventType: eventType, EntityID: entityID, CompanyIDs: companyIDs, Data: data}
+	pendingEvents.events[txID] = append(pendingEvents.events[txID], eventObj)
+}
+
+func (t *SimpleChaincode) emitContractEvent(stub shim.ChaincodeStubInterface, eventType string, contractObj contract, previousStatus string) {
+	t.emitEvent(stub, eventType, strconv.Itoa(contractObj.ContractID), []string{contractObj.InitiatorID, contractObj.ReceiverID},
+		contractEventData{ContractID: contractObj.ContractID, InitiatorID: contractObj.InitiatorID, ReceiverID: contractObj.ReceiverID, EnergyMWH: contractObj.EnergyMWH,
+			StartDate: contractObj.ContractStartDate, EndDate: contractObj.ContractEndDate, Status: contractObj.ContractStatus, PreviousStatus: previousStatus})
+}
+
+func (t *SimpleChaincode) emitInvoiceEvent(stub shim.ChaincodeStubInterface, invoiceObj invoice, payerID string, payeeID string) {
+	t.emitEvent(stub, "InvoiceIssued", strconv.Itoa(invoiceObj.InvoiceID), []string{payerID, payeeID},
+		invoiceEventData{InvoiceID: invoiceObj.InvoiceID, ContractID: invoiceObj.ContractID, InvoiceType: invoiceObj.InvoiceType, PayerID: payerID, PayeeID: payeeID,
+			EnergyMWH: invoiceObj.EnergyMWH, Amount: invoiceObj.Amount, InvoiceDateMS: invoiceObj.InvoiceDateMS})
+}
+
+// Sets the collected events of the transaction as its chaincode event
+func (t *SimpleChaincode) flushEvents(stub shim.ChaincodeStubInterface) error {
+	pendingEvents.Lock()
+	txID := stub.GetTxID()
+	events := pendingEvents.events[txID]
+	delete(pendingEvents.events, txID)
+	pendingEvents.Unlock()
+
+	if len(events) == 0 {
+		return nil
+	}
+
+	envelopeBytes, err := json.Marshal(eventEnvelope{SchemaVersion: eventSchemaVersion, TxID: txID, Events: events})
+	if err != nil {
+		return err
+	}
+	return stub.SetEvent(eventName, envelopeBytes)
+}
+
+// Drops the events of a failed transaction, its state changes are not committed either
+func (t *SimpleChaincode) discardEvents(stub shim.ChaincodeStubInterface) {
+	pendingEvents.Lock()
+	delete(pendingEvents.events, stub.GetTxID())
+	pendingEvents.Unlock()
+}
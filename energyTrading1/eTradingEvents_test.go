@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/preethimohan1/learn-chaincode/energyTrading1/localstub"
+)
+
+// An invoke and the business events its transaction is expected to emit, none when wantTypes is empty
+type eventCase struct {
+	txID       string
+	function   string
+	args       []string
+	wantTypes  []string
+	wantEntity string
+	wantIDs    []string
+}
+
+func newEventStub(t *testing.T) *localstub.Stub {
+	stub := localstub.New("etrading", new(SimpleChaincode))
+	_, err := stub.MockInit("init", "init", []string{"demo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub.ClearEvents()
+	return stub
+}
+
+// Chaincode events the stub captured for one transaction
+func eventsOfTx(stub *localstub.Stub, txID string) []localstub.Event {
+	var events []localstub.Event
+
+	for _, k := range stub.Events {
+		if k.TxID == txID {
+			events = append(events, k)
+		}
+	}
+	return events
+}
+
+func checkEnvelope(t *testing.T, stub *localstub.Stub, c eventCase) {
+	events := eventsOfTx(stub, c.txID)
+	if len(c.wantTypes) == 0 {
+		if len(events) != 0 {
+			t.Errorf("%s: expected no event, got %s", c.txID, events[0].Payload)
+		}
+		return
+	}
+	if len(events) != 1 {
+		t.Fatalf("%s: expected one chaincode event, got %d", c.txID, len(events))
+	}
+	if events[0].Name != eventName {
+		t.Errorf("%s: event name %q, expected %q", c.txID, events[0].Name, eventName)
+	}
+
+	envelopeObj, ok := events[0].Envelope()
+	if !ok {
+		t.Fatalf("%s: payload is not an envelope: %s", c.txID, events[0].Payload)
+	}
+	if envelopeObj.SchemaVersion != eventSchemaVersion || envelopeObj.TxID != c.txID {
+		t.Errorf("%s: envelope has schema version %d and tx ID %q", c.txID, envelopeObj.SchemaVersion, envelopeObj.TxID)
+	}
+	if len(envelopeObj.Events) != len(c.wantTypes) {
+		t.Fatalf("%s: expected %d business events, got %d", c.txID, len(c.wantTypes), len(envelopeObj.Events))
+	}
+	for i, e := range envelopeObj.Events {
+		if e.Sequence != i+1 || e.EventType != c.wantTypes[i] {
+			t.Errorf("%s: event %d is %s with sequence %d, expected %s", c.txID, i, e.EventType, e.Sequence, c.wantTypes[i])
+		}
+	}
+	if envelopeObj.Events[0].EntityID != c.wantEntity || !reflect.DeepEqual(envelopeObj.Events[0].CompanyIDs, c.wantIDs) {
+		t.Errorf("%s: event of %s for %v, expected %s for %v", c.txID, envelopeObj.Events[0].EntityID, envelopeObj.Events[0].CompanyIDs, c.wantEntity, c.wantIDs)
+	}
+}
+
+func TestInvokesEmitEnvelope(t *testing.T) {
+	stub := newEventStub(t)
+
+	cases := []eventCase{
+		{"tx-create", "createGasRequest", []string{"555", "BUYER1", "SHIPPER1", "80", "2026-11-01", "2026-11-10", "Ellund"},
+			[]string{"ContractCreated"}, "555", []string{"BUYER1", "SHIPPER1"}},
+		{"tx-create-other", "createGasRequest", []string{"556", "BUYER2", "SHIPPER1", "50", "2026-11-01", "2026-11-10", "Ellund"},
+			[]string{"ContractCreated"}, "556", []string{"BUYER2", "SHIPPER1"}},
+		{"tx-counter", "submitCounterOffer", []string{"556", "SHIPPER1", "1", `{"energy_mwh":40}`, "1500"},
+			[]string{"ContractStatusChanged"}, "556", []string{"BUYER2", "SHIPPER1"}},
+		{"tx-accept", "updateContractStatus", []string{"555", "Accepted", "1790000000000"},
+			[]string{"ContractStatusChanged"}, "555", []string{"BUYER1", "SHIPPER1"}},
+		{"tx-invoice", "addIOTData", []string{`{"device_id":"m","company_id":"BUYER1","energy_mwh":80,"timestamp_ms":1000}`},
+			[]string{"InvoiceIssued"}, "1000", []string{"BUYER1", "SHIPPER1"}},
+		{"tx-incident", "addIOTData", []string{`{"device_id":"m","company_id":"BUYER1","energy_mwh":8,"timestamp_ms":2000}`},
+			[]string{"IncidentRaised"}, "2000", []string{"BUYER1", "SHIPPER1"}},
+		{"tx-pay", "makePayment", []string{"1000", "555", "3000"},
+			[]string{"PaymentSettled"}, "1000", []string{"BUYER1", "SHIPPER1"}},
+		{"tx-topup", "topupBankBalance", []string{"BUYER1", "50", "4000"},
+			[]string{"BalanceToppedUp"}, "BUYER1", []string{"BUYER1"}},
+		{"tx-register", "register", []string{"u9", "p", `{"company_id":"BUYER2","company_type":"Buyer"}`},
+			[]string{"UserRegistered"}, "u9", []string{"BUYER2"}},
+		{"tx-ask", "placeOrder", []string{"A1", "PRODUCER2", "Ask", "Ellund", "2026-11-01", "2026-11-10", "100", "11", "1"},
+			nil, "", nil},
+		{"tx-bid", "placeOrder", []string{"B2", "SHIPPER1", "Bid", "Ellund", "2026-11-01", "2026-11-10", "100", "12", "4"},
+			[]string{"ContractCreated"}, "800000000", []string{"SHIPPER1", "PRODUCER2"}},
+		{"tx-flow", "addIOTData", []string{`{"device_id":"m","company_id":"BUYER1","energy_mwh":80,"timestamp_ms":1793599200000}`},
+			[]string{"InvoiceIssued"}, "1793599200000", []string{"BUYER1", "SHIPPER1"}},
+		{"tx-imbalance-config", "setImbalanceConfig", []string{"TRANSPORTER1", "THE", "10", "10", "10"},
+			nil, "", nil},
+		{"tx-imbalance", "computeImbalance", []string{"SHIPPER1", "2026-11-02", "5000"},
+			[]string{"InvoiceIssued"}, "900000000", []string{"SHIPPER1", "TRANSPORTER1"}},
+		{"tx-settle", "runSettlement", []string{"S1", "0", "1800000000000", "6000"},
+			[]string{"PaymentSettled"}, "S1", []string{"BUYER1", "SHIPPER1", "TRANSPORTER1"}},
+	}
+
+	for _, c := range cases {
+		_, err := stub.MockInvoke(c.txID, c.function, c.args)
+		if err != nil {
+			t.Fatalf("%s: %s failed: %s", c.txID, c.function, err)
+		}
+		checkEnvelope(t, stub, c)
+	}
+}
+
+func TestFailedInvokeEmitsNothing(t *testing.T) {
+	stub := newEventStub(t)
+
+	_, err := stub.MockInvoke("tx-create", "createGasRequest", []string{"555", "BUYER1", "SHIPPER1", "80", "2026-11-01", "2026-11-10", "Ellund"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failing := []eventCase{
+		{txID: "tx-stale-offer", function: "submitCounterOffer", args: []string{"555", "SHIPPER1", "7", `{"energy_mwh":40}`, "1500"}},
+		{txID: "tx-bad-terms", function: "submitCounterOffer", args: []string{"555", "SHIPPER1", "1", `{"energy_mwh":-1}`, "1500"}},
+		{txID: "tx-not-shipper", function: "computeImbalance", args: []string{"BUYER1", "2026-11-02", "5000"}},
+		{txID: "tx-bad-period", function: "runSettlement", args: []string{"S1", "2000", "1000", "3000"}},
+	}
+	for _, c := range failing {
+		_, err = stub.MockInvoke(c.txID, c.function, c.args)
+		if err == nil {
+			t.Fatalf("%s: %s was expected to fail", c.txID, c.function)
+		}
+		checkEnvelope(t, stub, c)
+	}
+
+	//Events a transaction collected before it failed are dropped with it
+	stub.MockTransactionStart("tx-partial")
+	new(SimpleChaincode).emitEvent(stub, "ContractCreated", "999", []string{"BUYER1"}, nil)
+	stub.MockTransactionEnd("tx-partial")
+	_, err = stub.MockInvoke("tx-partial", "computeImbalance", []string{"BUYER1", "2026-11-02", "5000"})
+	if err == nil {
+		t.Fatal("computeImbalance was expected to fail")
+	}
+	checkEnvelope(t, stub, eventCase{txID: "tx-partial"})
+
+	_, err = stub.MockInvoke("tx-partial", "updateContractStatus", []string{"555", "Accepted", "1790000000000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEnvelope(t, stub, eventCase{txID: "tx-partial", wantTypes: []string{"ContractStatusChanged"}, wantEntity: "555", wantIDs: []string{"BUYER1", "SHIPPER1"}})
+
+	var dataObj contractEventData
+	_ = json.Unmarshal(stub.BusinessEvents("ContractStatusChanged")[0].Data, &dataObj)
+	if dataObj.Status != "Accepted" || dataObj.PreviousStatus != "New" {
+		t.Errorf("status change from %s to %s, expected New to Accepted", dataObj.PreviousStatus, dataObj.Status)
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Imbalance invoices are numbered from here, apart from the flow-meter timestamps used for contract invoices.
+// Numbers already taken by another record are skipped.
+var firstImbalanceInvoiceID = 900000000
+
+// Penalty percentages applied to the reference price unless configured otherwise
+var defaultShortPenaltyPct = 10.0
+var defaultLongPenaltyPct = 10.0
+
+// The operator settles imbalances. Short shippers buy the missing gas at the reference price plus
+// ShortPenaltyPct, long shippers sell the excess at the reference price minus LongPenaltyPct.
+// Imbalances within ToleranceMWH are not charged.
+type imbalanceConfig struct {
+	OperatorID      string  `json:"operator_id"`
+	IndexName       string  `json:"index_name"`
+	DefaultPrice    float64 `json:"default_price"`
+	ShortPenaltyPct float64 `json:"short_penalty_pct"`
+	LongPenaltyPct  float64 `json:"long_penalty_pct"`
+	ToleranceMWH    float64 `json:"tolerance_mwh"`
+}
+
+// Daily balancing account of a shipper. Injections are its purchases from producers, withdrawals its sales to buyers.
+type balancingAccount struct {
+	ShipperID       string  `json:"shipper_id"`
+	Day             string  `json:"day"`
+	NominatedInMWH  float64 `json:"nominated_in_mwh"`
+	NominatedOutMWH float64 `json:"nominated_out_mwh"`
+	AllocatedInMWH  float64 `json:"allocated_in_mwh"`
+	AllocatedOutMWH float64 `json:"allocated_out_mwh"`
+	ImbalanceMWH    float64 `json:"imbalance_mwh"`
+	Position        string  `json:"position"`
+	ReferencePrice  float64 `json:"reference_price"`
+	UnitPrice       float64 `json:"unit_price"`
+	Amount          float64 `json:"amount"`
+	InvoiceID       int     `json:"invoice_id"`
+	ComputedDateMS  int     `json:"computed_date_ms"`
+}
+
+type balancingAccountInfo struct {
+	Account balancingAccount `json:"account"`
+	Invoice *invoice         `json:"invoice"`
+}
+
+func balancingAccountID(shipperID string, day string) string {
+	return shipperID + "_IMB_" + day
+}
+
+func (t *SimpleChaincode) getImbalanceConfig(stub shim.ChaincodeStubInterface) imbalanceConfig {
+	var configObj = imbalanceConfig{ShortPenaltyPct: defaultShortPenaltyPct, LongPenaltyPct: defaultLongPenaltyPct}
+
+	configObjBytes, _ := stub.GetState(imbalanceConfigKey)
+	if configObjBytes != nil {
+		_ = json.Unmarshal(configObjBytes, &configObj)
+	}
+	return configObj
+}
+
+func (t *SimpleChaincode) setImbalanceConfig(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var configObj imbalanceConfig
+	var operatorObj company
+
+	fmt.Println("Entered function setImbalanceConfig()")
+
+	if len(args) < 5 {
+		return nil, errors.New("Incorrect number of arguments. 5 expected (Operator ID, Reference Index Name, Default Reference Price, Short Penalty %, Long Penalty %) and optionally Tolerance MWh")
+	}
+
+	operatorObjBytes, _ := stub.GetState(args[0])
+	if operatorObjBytes == nil {
+		return nil, errors.New("Company not found: " + args[0])
+	}
+	_ = json.Unmarshal(operatorObjBytes, &operatorObj)
+	configObj.OperatorID = operatorObj.CompanyID
+	configObj.IndexName = args[1]
+
+	var err error
+	configObj.DefaultPrice, err = strconv.ParseFloat(args[2], 64)
+	if err != nil || configObj.DefaultPrice < 0 {
+		return nil, errors.New("Invalid default reference price: " + args[2])
+	}
+	configObj.ShortPenaltyPct, err = strconv.ParseFloat(args[3], 64)
+	if err != nil || configObj.ShortPenaltyPct < 0 {
+		return nil, errors.New("Invalid short penalty: " + args[3])
+	}
+	configObj.LongPenaltyPct, err = strconv.ParseFloat(args[4], 64)
+	if err != nil || configObj.LongPenaltyPct < 0 || configObj.LongPenaltyPct > 100 {
+		return nil, errors.New("Invalid long penalty: " + args[4])
+	}
+	if len(args) > 5 {
+		configObj.ToleranceMWH, err = strconv.ParseFloat(args[5], 64)
+		if err != nil || configObj.ToleranceMWH < 0 {
+			return nil, errors.New("Invalid tolerance: " + args[5])
+		}
+	}
+
+	configObjBytes, _ := json.Marshal(&configObj)
+	err = stub.PutState(imbalanceConfigKey, configObjBytes)
+	if err != nil {
+		return nil, err
+	}
+	t.updateMasterKeyList(stub, []string{imbalanceConfigKey})
+
+	return nil, nil
+}
+
+// Quantity scheduled on a contract for a gas day: its confirmed nominations, or an even share of the
+// contract quantity when the contract is not nominated
+func (t *SimpleChaincode) scheduledMWH(stub shim.ChaincodeStubInterface, contractObj contract, day string) float64 {
+	var confirmedMWH float64
+
+	days, err := contractDays(contractObj)
+	if err != nil || !contains(days, day) {
+		return 0
+	}
+
+	nominationList := t.getNominationList(stub, strconv.Itoa(contractObj.ContractID))
+	if len(nominationList) == 0 {
+		return contractObj.EnergyMWH / float64(len(days))
+	}
+	for _, k := range nominationList {
+		if k.Day == day && (k.NominationStatus == "Confirmed" || k.NominationStatus == "Curtailed") {
+			confirmedMWH = confirmedMWH + k.ConfirmedMWH
+		}
+	}
+	return confirmedMWH
+}
+
+// Energy measured by the flow meters of a company on a gas day
+func (t *SimpleChaincode) dailyFlowMWH(stub shim.ChaincodeStubInterface, companyID string, day string) float64 {
+	var flowMeterList []flowMeterData
+	var energyMWH float64
+
+	flowMeterObjBytes, _ := stub.GetState(companyID + iotKeyAffix)
+	_ = json.Unmarshal(flowMeterObjBytes, &flowMeterList)
+	for _, k := range flowMeterList {
+		if msToDay(k.TimestampMS) == day {
+			energyMWH = energyMWH + k.EnergyMWH
+		}
+	}
+	return energyMWH
+}
+
+// Adds the scheduled and allocated quantities of the shipper's accepted contracts in one contract list to its account.
+// A counterparty's measured flow is allocated to its contracts in proportion to what each had scheduled.
+func (t *SimpleChaincode) addBalancingFlows(stub shim.ChaincodeStubInterface, accountObj *balancingAccount, idArrKey string, shipperIsInitiator bool) {
+	var contractIDList []string
+	var contractList []contract
+
+	contractListObjBytes, _ := stub.GetState(idArrKey)
+	_ = json.Unmarshal(contractListObjBytes, &contractIDList)
+	for _, k := range contractIDList {
+		var contractObj contract
+		contractObjBytes, _ := stub.GetState(k)
+		_ = json.Unmarshal(contractObjBytes, &contractObj)
+		if contractObj.ContractStatus == "Accepted" {
+			contractList = append(contractList, contractObj)
+		}
+	}
+
+	counterpartyOf := func(contractObj contract) string {
+		if shipperIsInitiator {
+			return contractObj.ReceiverID
+		}
+		return contractObj.InitiatorID
+	}
+
+	scheduledTotal := make(map[string]float64)
+	for _, contractObj := range contractList {
+		counterpartyID := counterpartyOf(contractObj)
+		scheduledTotal[counterpartyID] = scheduledTotal[counterpartyID] + t.scheduledMWH(stub, contractObj, accountObj.Day)
+	}
+
+	for _, contractObj := range contractList {
+		if shipperIsInitiator && contractObj.InitiatorID != accountObj.ShipperID || !shipperIsInitiator && contractObj.ReceiverID != accountObj.ShipperID {
+			continue
+		}
+		scheduled := t.scheduledMWH(stub, contractObj, accountObj.Day)
+		if scheduled == 0 {
+			continue
+		}
+		counterpartyID := counterpartyOf(contractObj)
+		allocated := t.dailyFlowMWH(stub, counterpartyID, accountObj.Day) * scheduled / scheduledTotal[counterpartyID]
+
+		if shipperIsInitiator {
+			accountObj.NominatedInMWH = accountObj.NominatedInMWH + scheduled
+			accountObj.AllocatedInMWH = accountObj.AllocatedInMWH + allocated
+		} else {
+			accountObj.NominatedOutMWH = accountObj.NominatedOutMWH + scheduled
+			accountObj.AllocatedOutMWH = accountObj.AllocatedOutMWH + allocated
+		}
+	}
+}
+
+// Computes the balancing account of a shipper for a gas day and issues the imbalance charge as an invoice.
+// Running it again for the same day recalculates the account and its invoice while that is pending or cancelled.
+func (t *SimpleChaincode) computeImbalance(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var shipperObj company
+	var accountObj, existingAccount balancingAccount
+	var invoiceObj invoice
+	var accountIDList []string
+	var currentDate int
+
+	fmt.Println("Entered function computeImbalance()")
+
+	if len(args) < 3 {
+		return nil, errors.New("Incorrect number of arguments. 3 expected (Shipper ID, Gas Day, Current Date in MilliSecs)")
+	}
+
+	shipperObjBytes, _ := stub.GetState(args[0])
+	_ = json.Unmarshal(shipperObjBytes, &shipperObj)
+	if shipperObj.CompanyType != "Shipper" {
+		return nil, errors.New(args[0] + " is not a shipper")
+	}
+	date, err := parseDate(args[1])
+	if err != nil {
+		return nil, err
+	}
+	currentDate, _ = strconv.Atoi(args[2])
+
+	accountObj = balancingAccount{ShipperID: args[0], Day: date.Format("2006-01-02"), ComputedDateMS: currentDate}
+	accountID := balancingAccountID(accountObj.ShipperID, accountObj.Day)
+
+	existingBytes, _ := stub.GetState(accountID)
+	if existingBytes != nil {
+		_ = json.Unmarshal(existingBytes, &existingAccount)
+	}
+	if existingAccount.InvoiceID != 0 {
+		invoiceObjBytes, _ := stub.GetState(strconv.Itoa(existingAccount.InvoiceID))
+		_ = json.Unmarshal(invoiceObjBytes, &invoiceObj)
+		//Disputed, held or paid charges are not recalculated
+		if invoiceObj.PaymentStatus != "Pending" && invoiceObj.PaymentStatus != "Cancelled" {
+			return nil, errors.New("Imbalance invoice of " + args[0] + " for " + accountObj.Day + " is " + invoiceObj.PaymentStatus +
+				" and cannot be recomputed")
+		}
+	}
+
+	t.addBalancingFlows(stub, &accountObj, tradeRequestKey, true)
+	t.addBalancingFlows(stub, &accountObj, gasRequestKey, false)
+	accountObj.ImbalanceMWH = accountObj.AllocatedInMWH - accountObj.AllocatedOutMWH
+
+	configObj := t.getImbalanceConfig(stub)
+	if math.Abs(accountObj.ImbalanceMWH) <= configObj.ToleranceMWH {
+		accountObj.Position = "Balanced"
+	} else {
+		accountObj.ReferencePrice, err = t.lookupIndexPrice(stub, configObj.IndexName, accountObj.Day)
+		if err != nil || configObj.IndexName == "" {
+			if configObj.DefaultPrice <= 0 {
+				return nil, errors.New("No reference price for " + accountObj.Day + ", configure a published reference index or a default price")
+			}
+			accountObj.ReferencePrice = configObj.DefaultPrice
+		}
+		if configObj.OperatorID == "" {
+			return nil, errors.New("No balancing operator is configured")
+		}
+
+		if accountObj.ImbalanceMWH < 0 {
+			accountObj.Position = "Short"
+			accountObj.UnitPrice = accountObj.ReferencePrice * (1 + configObj.ShortPenaltyPct/100)
+			invoiceObj.PayerID = accountObj.ShipperID
+			invoiceObj.PayeeID = configObj.OperatorID
+		} else {
+			accountObj.Position = "Long"
+			accountObj.UnitPrice = accountObj.ReferencePrice * (1 - configObj.LongPenaltyPct/100)
+			invoiceObj.PayerID = configObj.OperatorID
+			invoiceObj.PayeeID = accountObj.ShipperID
+		}
+		accountObj.Amount = math.Abs(accountObj.ImbalanceMWH) * accountObj.UnitPrice
+	}
+
+	//Issue the imbalance invoice, or withdraw the pending one when the shipper turns out balanced
+	if accountObj.Position != "Balanced" {
+		accountObj.InvoiceID = existingAccount.InvoiceID
+		if accountObj.InvoiceID == 0 {
+			accountObj.InvoiceID = t.nextFreeSequence(stub, imbalanceInvoiceKey, firstImbalanceInvoiceID)
+		}
+		invoiceObj.InvoiceID = accountObj.InvoiceID
+		invoiceObj.InvoiceDateMS = currentDate
+		invoiceObj.PaymentStatus = "Pending"
+		invoiceObj.InvoiceType = "Imbalance"
+		invoiceObj.EnergyMWH = math.Abs(accountObj.ImbalanceMWH)
+		invoiceObj.UnitPrice = accountObj.UnitPrice
+		invoiceObj.Amount = accountObj.Amount
+	} else if existingAccount.InvoiceID != 0 {
+		invoiceObj.PaymentStatus = "Cancelled"
+	}
+	if invoiceObj.InvoiceID != 0 {
+		invoiceObjBytes, _ := json.Marshal(&invoiceObj)
+		err = stub.PutState(strconv.Itoa(invoiceObj.InvoiceID), invoiceObjBytes)
+		if err != nil {
+			return nil, err
+		}
+		t.updateMasterKeyList(stub, []string{strconv.Itoa(invoiceObj.InvoiceID)})
+		if invoiceObj.PaymentStatus == "Pending" {
+			t.emitInvoiceEvent(stub, invoiceObj, invoiceObj.PayerID, invoiceObj.PayeeID)
+		}
+	}
+
+	accountObjBytes, _ := json.Marshal(&accountObj)
+	err = stub.PutState(accountID, accountObjBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if existingBytes == nil {
+		var arrKey = accountObj.ShipperID + imbalanceAffix
+		accountIDListBytes, _ := stub.GetState(arrKey)
+		_ = json.Unmarshal(accountIDListBytes, &accountIDList)
+		accountIDList = append(accountIDList, accountID)
+		accountIDListBytes, _ = json.Marshal(&accountIDList)
+		_ = stub.PutState(arrKey, accountIDListBytes)
+		t.updateMasterKeyList(stub, []string{accountID})
+		t.updateMasterKeyList(stub, []string{arrKey})
+	}
+
+	fmt.Println("Imbalance of " + accountObj.ShipperID + " for " + accountObj.Day + ": " + strconv.FormatFloat(accountObj.ImbalanceMWH, 'f', 2, 64) + " MWh " + accountObj.Position)
+	return nil, nil
+}
+
+// Imbalance invoices of all shippers. They belong to no contract and name their payer and payee.
+func (t *SimpleChaincode) getImbalanceInvoiceList(stub shim.ChaincodeStubInterface) []invoice {
+	var compIDArr CompanyIDList
+	var invoiceList []invoice
+
+	compIDArrBytes, _ := stub.GetState(companyKey)
+	_ = json.Unmarshal(compIDArrBytes, &compIDArr)
+
+	for _, companyID := range compIDArr {
+		var accountIDList []string
+
+		accountIDListBytes, _ := stub.GetState(companyID + imbalanceAffix)
+		_ = json.Unmarshal(accountIDListBytes, &accountIDList)
+		for _, k := range accountIDList {
+			var accountObj balancingAccount
+			var invoiceObj invoice
+
+			accountObjBytes, _ := stub.GetState(k)
+			_ = json.Unmarshal(accountObjBytes, &accountObj)
+			if accountObj.InvoiceID == 0 {
+				continue
+			}
+			invoiceObjBytes, _ := stub.GetState(strconv.Itoa(accountObj.InvoiceID))
+			if invoiceObjBytes == nil {
+				continue
+			}
+			_ = json.Unmarshal(invoiceObjBytes, &invoiceObj)
+			invoiceList = append(invoiceList, invoiceObj)
+		}
+	}
+	return invoiceList
+}
+
+// Balancing accounts of a shipper with their imbalance invoices, optionally limited to a period of gas days
+func (t *SimpleChaincode) getImbalanceAccounts(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var returnMessage string
+	var accountIDList []string
+	var accountList = []balancingAccountInfo{}
+
+	if len(args) < 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1 (Shipper ID) and optionally From Date, To Date.")
+	}
+
+	fromDay, toDay, err := parseEffectivePeriod(args[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	accountIDListBytes, _ := stub.GetState(args[0] + imbalanceAffix)
+	_ = json.Unmarshal(accountIDListBytes, &accountIDList)
+	for _, k := range accountIDList {
+		var accountInfo balancingAccountInfo
+		accountObjBytes, _ := stub.GetState(k)
+		_ = json.Unmarshal(accountObjBytes, &accountInfo.Account)
+		if fromDay != "" && accountInfo.Account.Day < fromDay || toDay != "" && accountInfo.Account.Day > toDay {
+			continue
+		}
+		if accountInfo.Account.InvoiceID != 0 {
+			var invoiceObj invoice
+			invoiceObjBytes, _ := stub.GetState(strconv.Itoa(accountInfo.Account.InvoiceID))
+			_ = json.Unmarshal(invoiceObjBytes, &invoiceObj)
+			accountInfo.Invoice = &invoiceObj
+		}
+		accountList = append(accountList, accountInfo)
+	}
+
+	accountListBytes, _ := json.Marshal(accountList)
+	returnMessage = "{\"statusCode\" : \"SUCCESS\", \"body\" : " + string(accountListBytes) + "}"
+	return []byte(returnMessage), nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+type incidentStatusChange struct {
+	Status       string `json:"status"`
+	CompanyID    string `json:"company_id"`
+	Comments     string `json:"comments"`
+	ChangeDateMS int    `json:"change_date_ms"`
+}
+
+type invoiceAdjustment struct {
+	AdjustmentType string  `json:"adjustment_type"`
+	Reference      string  `json:"reference"`
+	Amount         float64 `json:"amount"`
+	Comments       string  `json:"comments"`
+}
+
+// Allowed incident status transitions: Open -> Acknowledged -> UnderInvestigation -> Resolved/Waived
+var incidentTransitions = map[string][]string{
+	"Open":               []string{"Acknowledged", "Waived"},
+	"Acknowledged":       []string{"UnderInvestigation", "Resolved", "Waived"},
+	"UnderInvestigation": []string{"Resolved", "Waived"},
+}
+
+var rootCauseCategories = []string{"SupplyShortfall", "MeterFault", "PipelineConstraint", "PlannedMaintenance", "ForceMajeure", "Other"}
+
+func (t *SimpleChaincode) loadIncidentForUpdate(stub shim.ChaincodeStubInterface, incidentIDStr string, companyID string, newStatus string) (incident, contract, error) {
+	var incidentObj incident
+	var contractObj contract
+
+	incidentObjBytes, _ := stub.GetState(incidentIDStr)
+	if incidentObjBytes == nil {
+		return incidentObj, contractObj, errors.New("Incident not found: " + incidentIDStr)
+	}
+	err := json.Unmarshal(incidentObjBytes, &incidentObj)
+	if err != nil {
+		return incidentObj, contractObj, err
+	}
+
+	contractObjBytes, _ := stub.GetState(strconv.Itoa(incidentObj.ContractID))
+	_ = json.Unmarshal(contractObjBytes, &contractObj)
+
+	if companyID != contractObj.InitiatorID && companyID != contractObj.ReceiverID {
+		return incidentObj, contractObj, errors.New("Company " + companyID + " is not a party to contract " + strconv.Itoa(incidentObj.ContractID))
+	}
+
+	if !contains(incidentTransitions[incidentObj.IncidentStatus], newStatus) {
+		return incidentObj, contractObj, errors.New("Incident " + incidentIDStr + " cannot move from " + incidentObj.IncidentStatus + " to " + newStatus)
+	}
+
+	return incidentObj, contractObj, nil
+}
+
+func (t *SimpleChaincode) saveIncident(stub shim.ChaincodeStubInterface, incidentObj incident) error {
+	incidentObjBytes, err := json.Marshal(&incidentObj)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(strconv.Itoa(incidentObj.IncidentID), incidentObjBytes)
+}
+
+// Moves an incident to Acknowledged, UnderInvestigation or Waived
+func (t *SimpleChaincode) updateIncidentStatus(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var incidentIDStr, newStatus, companyID, comments string
+	var changeDate int
+
+	fmt.Println("Entered function updateIncidentStatus()")
+
+	if len(args) < 5 {
+		return nil, errors.New("Incorrect number of arguments. 5 expected (Incident ID, Status, Company ID, Comments, Current Date in MilliSecs)")
+	}
+
+	incidentIDStr = args[0]
+	newStatus = args[1]
+	companyID = args[2]
+	comments = args[3]
+	changeDate, _ = strconv.Atoi(args[4])
+
+	if newStatus == "Resolved" {
+		return nil, errors.New("Use resolveIncident to resolve an incident")
+	}
+
+	incidentObj, _, err := t.loadIncidentForUpdate(stub, incidentIDStr, companyID, newStatus)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+
+	incidentObj.IncidentStatus = newStatus
+	if newStatus == "Waived" {
+		incidentObj.ResolutionComments = comments
+		incidentObj.PenaltyStatus = "Waived"
+	}
+	incidentObj.StatusHistory = append(incidentObj.StatusHistory, incidentStatusChange{Status: newStatus, CompanyID: companyID, Comments: comments, ChangeDateMS: changeDate})
+
+	err = t.saveIncident(stub, incidentObj)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// Resolves an incident with its responsible party and root cause. The shortfall is priced at the
+// contract penalty rate: a shortfall caused by the receiver is credited to the initiator, one caused
+// by the initiator is charged on top of the invoice. The adjustment goes against the given invoice,
+// the latest pending invoice of the contract, or the next invoice when none is pending.
+func (t *SimpleChaincode) resolveIncident(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var incidentIDStr, companyID, responsibleParty, rootCause, comments, invoiceIDStr string
+	var resolutionDate int
+	var shortfallMWH, penalty float64
+	var invoiceObj invoice
+
+	fmt.Println("Entered function resolveIncident()")
+
+	if len(args) < 6 {
+		return nil, errors.New("Incorrect number of arguments. 6 expected (Incident ID, Company ID, Responsible Party, Root Cause, Comments, Current Date in MilliSecs) and optionally Invoice ID")
+	}
+
+	incidentIDStr = args[0]
+	companyID = args[1]
+	responsibleParty = args[2]
+	rootCause = args[3]
+	comments = args[4]
+	resolutionDate, _ = strconv.Atoi(args[5])
+
+	if !contains(rootCauseCategories, rootCause) {
+		return nil, errors.New("Unknown root cause category: " + rootCause)
+	}
+
+	incidentObj, contractObj, err := t.loadIncidentForUpdate(stub, incidentIDStr, companyID, "Resolved")
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+
+	if responsibleParty != contractObj.InitiatorID && responsibleParty != contractObj.ReceiverID {
+		return nil, errors.New("Responsible party " + responsibleParty + " is not a party to contract " + strconv.Itoa(contractObj.ContractID))
+	}
+
+	//Compute the penalty from the shortfall and the contract-level rate
+	shortfallMWH = incidentObj.ExpectedEnergyMWH - incidentObj.ActualEnergyMWH
+	if shortfallMWH < 0 {
+		shortfallMWH = 0
+	}
+	if responsibleParty == contractObj.ReceiverID {
+		penalty = -shortfallMWH * contractObj.PenaltyRate
+	} else if responsibleParty == contractObj.InitiatorID {
+		penalty = shortfallMWH * contractObj.PenaltyRate
+	}
+
+	incidentObj.IncidentStatus = "Resolved"
+	incidentObj.ResponsibleParty = responsibleParty
+	incidentObj.RootCause = rootCause
+	incidentObj.ResolutionComments = comments
+	incidentObj.PenaltyAmount = penalty
+	incidentObj.StatusHistory = append(incidentObj.StatusHistory, incidentStatusChange{Status: "Resolved", CompanyID: companyID, Comments: comments, ChangeDateMS: resolutionDate})
+
+	if penalty == 0 {
+		incidentObj.PenaltyStatus = "None"
+	} else {
+		//Find the invoice to adjust
+		if len(args) > 6 && args[6] != "" {
+			invoiceIDStr = args[6]
+			invoiceObjBytes, _ := stub.GetState(invoiceIDStr)
+			_ = json.Unmarshal(invoiceObjBytes, &invoiceObj)
+			if invoiceObj.ContractID != contractObj.ContractID {
+				return nil, errors.New("Invoice " + invoiceIDStr + " does not belong to contract " + strconv.Itoa(contractObj.ContractID))
+			}
+			if invoiceObj.PaymentStatus != "Pending" {
+				return nil, errors.New("Invoice " + invoiceIDStr + " is " + invoiceObj.PaymentStatus + ", only a pending invoice takes a penalty")
+			}
+		} else {
+			//Only an open invoice takes the penalty, disputed, held or cancelled ones leave it to the next invoice
+			invoiceList, _ := t.getInvoiceIncidentList(stub, strconv.Itoa(contractObj.ContractID))
+			for _, k := range invoiceList {
+				if k.PaymentStatus == "Pending" {
+					invoiceObj = k
+					invoiceIDStr = strconv.Itoa(k.InvoiceID)
+				}
+			}
+		}
+
+		if invoiceIDStr == "" {
+			incidentObj.PenaltyStatus = "Pending"
+		} else {
+			invoiceObj.Adjustments = append(invoiceObj.Adjustments, penaltyAdjustment(incidentObj))
+			invoiceObjBytes, _ := json.Marshal(&invoiceObj)
+			err = stub.PutState(invoiceIDStr, invoiceObjBytes)
+			if err != nil {
+				return nil, err
+			}
+			incidentObj.PenaltyStatus = "Applied"
+			incidentObj.PenaltyInvoiceID = invoiceObj.InvoiceID
+		}
+	}
+
+	err = t.saveIncident(stub, incidentObj)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func penaltyAdjustment(incidentObj incident) invoiceAdjustment {
+	var adjustmentType = "PenaltyCharge"
+	if incidentObj.PenaltyAmount < 0 {
+		adjustmentType = "PenaltyCredit"
+	}
+	return invoiceAdjustment{AdjustmentType: adjustmentType, Reference: strconv.Itoa(incidentObj.IncidentID), Amount: incidentObj.PenaltyAmount,
+		Comments: incidentObj.RootCause + ": " + incidentObj.ResolutionComments}
+}
+
+// Adds the penalties of resolved incidents still waiting for an invoice to a new invoice
+func (t *SimpleChaincode) applyPendingPenalties(stub shim.ChaincodeStubInterface, invoiceObj *invoice) {
+	_, incidentList := t.getInvoiceIncidentList(stub, strconv.Itoa(invoiceObj.ContractID))
+
+	for _, incidentObj := range incidentList {
+		if incidentObj.PenaltyStatus != "Pending" {
+			continue
+		}
+		invoiceObj.Adjustments = append(invoiceObj.Adjustments, penaltyAdjustment(incidentObj))
+
+		incidentObj.PenaltyStatus = "Applied"
+		incidentObj.PenaltyInvoiceID = invoiceObj.InvoiceID
+		_ = t.saveIncident(stub, incidentObj)
+	}
+}
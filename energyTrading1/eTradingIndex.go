@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Reference indexes are named after the delivery point, e.g. DA_ELLUND
+var referenceIndexPrefix = "DA_"
+
+// Trade statistics of one delivery location and day collected from accepted contracts
+type indexTrades struct {
+	Location   string
+	VolumeMWH  float64
+	Value      float64
+	HighPrice  float64
+	LowPrice   float64
+	TradeCount int
+}
+
+func referenceIndexName(location string) string {
+	return referenceIndexPrefix + networkPointID(location)
+}
+
+// Average price per MWh agreed on a contract. Index-linked contracts are left out so an index is never computed from itself.
+func (t *SimpleChaincode) tradedPrice(stub shim.ChaincodeStubInterface, contractObj contract) (float64, bool) {
+	if contractObj.Pricing.PriceType == "Index" || contractObj.EnergyMWH <= 0 {
+		return 0, false
+	}
+	return t.getContractValue(stub, contractObj) / contractObj.EnergyMWH, true
+}
+
+// Accepted gas trades delivering on the day, grouped by delivery point. Transport contracts price capacity, not gas, and are not included.
+func (t *SimpleChaincode) collectIndexTrades(stub shim.ChaincodeStubInterface, day string) map[string]*indexTrades {
+	var contractIDList []string
+	tradeMap := make(map[string]*indexTrades)
+
+	for _, idArrKey := range []string{tradeRequestKey, gasRequestKey} {
+		contractIDList = nil
+		contractListObjBytes, _ := stub.GetState(idArrKey)
+		_ = json.Unmarshal(contractListObjBytes, &contractIDList)
+
+		for _, k := range contractIDList {
+			var contractObj contract
+			contractObjBytes, _ := stub.GetState(k)
+			_ = json.Unmarshal(contractObjBytes, &contractObj)
+			if contractObj.ContractStatus != "Accepted" || contractObj.EntryLocation == "" {
+				continue
+			}
+
+			days, err := contractDays(contractObj)
+			if err != nil || !contains(days, day) {
+				continue
+			}
+			price, ok := t.tradedPrice(stub, contractObj)
+			if !ok {
+				continue
+			}
+
+			pointID := networkPointID(contractObj.EntryLocation)
+			trades, found := tradeMap[pointID]
+			if !found {
+				trades = &indexTrades{Location: pointID, HighPrice: price, LowPrice: price}
+				tradeMap[pointID] = trades
+			}
+			dailyMWH := contractObj.EnergyMWH / float64(len(days))
+			trades.VolumeMWH = trades.VolumeMWH + dailyMWH
+			trades.Value = trades.Value + dailyMWH*price
+			trades.HighPrice = maxFloat(trades.HighPrice, price)
+			trades.LowPrice = minFloat(trades.LowPrice, price)
+			trades.TradeCount = trades.TradeCount + 1
+		}
+	}
+	return tradeMap
+}
+
+// Computes the volume-weighted average price of a delivery day from accepted contracts and publishes it as the
+// reference index of each delivery point, or only of the given location
+func (t *SimpleChaincode) computePriceIndex(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var location string
+	var computedDate int
+	var pointIDList []string
+
+	fmt.Println("Entered function computePriceIndex()")
+
+	if len(args) < 1 {
+		return nil, errors.New("Incorrect number of arguments. 1 expected (Delivery Day) and optionally Location, Current Date in MilliSecs")
+	}
+
+	date, err := parseDate(args[0])
+	if err != nil {
+		return nil, err
+	}
+	day := date.Format("2006-01-02")
+	if len(args) > 1 && args[1] != "" {
+		location = networkPointID(args[1])
+	}
+	if len(args) > 2 {
+		computedDate, _ = strconv.Atoi(args[2])
+	}
+
+	tradeMap := t.collectIndexTrades(stub, day)
+	for k := range tradeMap {
+		if location == "" || k == location {
+			pointIDList = append(pointIDList, k)
+		}
+	}
+	if len(pointIDList) == 0 {
+		return nil, errors.New("No accepted trades delivering on " + day)
+	}
+	sort.Strings(pointIDList)
+
+	for _, k := range pointIDList {
+		trades := tradeMap[k]
+		indexObj := priceIndexValue{IndexName: referenceIndexPrefix + k, Day: day, Price: trades.Value / trades.VolumeMWH, Location: k,
+			HighPrice: trades.HighPrice, LowPrice: trades.LowPrice, VolumeMWH: trades.VolumeMWH, TradeCount: trades.TradeCount, ComputedDateMS: computedDate}
+		err = t.savePriceIndexValue(stub, indexObj)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println("Index " + indexObj.IndexName + " for " + day + ": " + strconv.FormatFloat(indexObj.Price, 'f', 2, 64))
+	}
+	return nil, nil
+}
+
+// Published values of an index, optionally limited to a period. A location can be given instead of the index name.
+func (t *SimpleChaincode) getPriceIndexHistory(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var returnMessage string
+	var dayList []string
+	var indexList = []priceIndexValue{}
+
+	if len(args) < 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1 (Index Name or Location) and optionally From Date, To Date.")
+	}
+
+	fromDay, toDay, err := parseEffectivePeriod(args[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	indexName := args[0]
+	dayListBytes, _ := stub.GetState(indexPrefix + indexName + indexDayAffix)
+	if dayListBytes == nil {
+		indexName = referenceIndexName(args[0])
+		dayListBytes, _ = stub.GetState(indexPrefix + indexName + indexDayAffix)
+	}
+	_ = json.Unmarshal(dayListBytes, &dayList)
+
+	for _, day := range dayList {
+		if fromDay != "" && day < fromDay || toDay != "" && day > toDay {
+			continue
+		}
+		var indexObj priceIndexValue
+		indexObjBytes, _ := stub.GetState(indexPrefix + indexName + "_" + day)
+		_ = json.Unmarshal(indexObjBytes, &indexObj)
+		indexList = append(indexList, indexObj)
+	}
+
+	indexListBytes, _ := json.Marshal(indexList)
+	returnMessage = "{\"statusCode\" : \"SUCCESS\", \"body\" : " + string(indexListBytes) + "}"
+	return []byte(returnMessage), nil
+}
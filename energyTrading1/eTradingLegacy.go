@@ -0,0 +1,469 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Migrates the data of the energyTrading chaincode. Its records are read through the legacy chaincode's read
+// query, or from this ledger when no chaincode name is given and the old records were loaded into it.
+//
+// A legacy user is one login of one company: it becomes a company with the upper case login as company ID and a
+// user of that company keeping its login and password. Trade requests become trade request contracts of the
+// shipper's company with the producer's company, with their gas price as fixed contract price. Records already
+// on this network are left as they are, so the migration can be run again. Old records read from this ledger are
+// overwritten where the new record has the same key, the LOGIN records and user lists are left in place, and trade
+// requests that could not be mapped stay on the trade request list until they are fixed and migrated.
+var legacyLoginPrefix = "LOGIN"
+var legacyUserListAffix = "LIST" //<lower case user type>LIST
+
+// Legacy trade request statuses and the contract status each one becomes
+var legacyStatusMapping = map[string]string{
+	"new":         "New",
+	"open":        "New",
+	"negotiating": "Negotiating",
+	"accepted":    "Accepted",
+	"approved":    "Accepted",
+	"rejected":    "Rejected",
+	"declined":    "Rejected",
+	"cancelled":   "Cancelled",
+	"canceled":    "Cancelled",
+}
+
+type legacyUser struct {
+	LoginID         string  `json:"user_id"`
+	UserType        string  `json:"user_type"`
+	CompanyName     string  `json:"company_name"`
+	CompanyLocation string  `json:"company_location"`
+	BankAccountNum  int     `json:"bank_account_num"`
+	BankBalance     float64 `json:"bank_balance"`
+}
+
+type legacyUserLogin struct {
+	LoginName string `json:"login_name"`
+	Password  string `json:"password"`
+}
+
+type legacyTradeRequest struct {
+	TradeRequestID         int     `json:"tr_id"`
+	ShipperID              string  `json:"tr_shipper_id"`
+	ProducerID             string  `json:"tr_producer_id"`
+	EnergyKWH              float64 `json:"tr_energy_kwh"`
+	GasPrice               float64 `json:"tr_gas_price"`
+	EntryLocation          string  `json:"tr_entry_location"`
+	TradeRequestStartDate  string  `json:"tr_start_date"`
+	TradeRequestEndDate    string  `json:"tr_end_date"`
+	TradeRequestStatus     string  `json:"tr_status"`
+	TradeRequestInvoiceID  int     `json:"tr_invoice_id"`
+	TradeRequestIncidentID int     `json:"tr_incident_id"`
+}
+
+type legacyMapping struct {
+	LegacyKey string `json:"legacy_key"`
+	Key       string `json:"key"`
+}
+
+type legacyIssue struct {
+	LegacyKey string `json:"legacy_key"`
+	Field     string `json:"field,omitempty"`
+	Reason    string `json:"reason"`
+}
+
+type legacyMigrationReport struct {
+	Source    string          `json:"source"`
+	PriceUnit string          `json:"price_unit"`
+	DryRun    bool            `json:"dry_run"`
+	Companies []legacyMapping `json:"companies"`
+	Users     []legacyMapping `json:"users"`
+	Contracts []legacyMapping `json:"contracts"`
+	Skipped   []legacyIssue   `json:"skipped"`
+	Unmapped  []legacyIssue   `json:"unmapped"`
+}
+
+// args: adminUserID, password, legacyChaincode (empty to read this ledger), priceUnit (kwh or mwh, the energy unit
+// the legacy gas prices are quoted in, default kwh), dryRun (true/false, default false)
+func (t *SimpleChaincode) migrateLegacyData(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Entered function migrateLegacyData()")
+
+	if len(args) < 2 {
+		return nil, errors.New("Incorrect number of arguments. At least 2 expected (adminUserID, password, legacyChaincode, priceUnit, dryRun)")
+	}
+	dryRun := len(args) > 4 && args[4] == "true"
+	return t.runLegacyMigration(stub, args, dryRun)
+}
+
+// Reports what migrateLegacyData would do, args: adminUserID, password, legacyChaincode, priceUnit
+func (t *SimpleChaincode) getLegacyMigrationPreview(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Entered function getLegacyMigrationPreview()")
+
+	if len(args) < 2 {
+		return nil, errors.New("Incorrect number of arguments. At least 2 expected (adminUserID, password, legacyChaincode, priceUnit)")
+	}
+	return t.runLegacyMigration(stub, args, true)
+}
+
+func (t *SimpleChaincode) runLegacyMigration(stub shim.ChaincodeStubInterface, args []string, dryRun bool) ([]byte, error) {
+	var reportObj legacyMigrationReport
+	var legacyChaincode string
+
+	err := t.checkAdmin(stub, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	if len(args) > 2 {
+		legacyChaincode = strings.TrimSpace(args[2])
+	}
+	reportObj.Source = "ledger"
+	if legacyChaincode != "" {
+		reportObj.Source = legacyChaincode
+	}
+	reportObj.PriceUnit = "kwh"
+	if len(args) > 3 && args[3] != "" {
+		reportObj.PriceUnit = strings.ToLower(args[3])
+	}
+	if reportObj.PriceUnit != "kwh" && reportObj.PriceUnit != "mwh" {
+		return nil, errors.New("Price unit must be kwh or mwh")
+	}
+	reportObj.DryRun = dryRun
+
+	readLegacy := func(key string) ([]byte, error) {
+		if legacyChaincode == "" {
+			return stub.GetState(key)
+		}
+		return stub.QueryChaincode(legacyChaincode, [][]byte{[]byte("read"), []byte(key)})
+	}
+
+	companyByLogin, err := t.migrateLegacyUsers(stub, readLegacy, &reportObj)
+	if err != nil {
+		return nil, err
+	}
+	err = t.migrateLegacyTradeRequests(stub, readLegacy, companyByLogin, &reportObj)
+	if err != nil {
+		return nil, err
+	}
+
+	if reportObj.Companies == nil {
+		reportObj.Companies = []legacyMapping{}
+	}
+	if reportObj.Users == nil {
+		reportObj.Users = []legacyMapping{}
+	}
+	if reportObj.Contracts == nil {
+		reportObj.Contracts = []legacyMapping{}
+	}
+	if reportObj.Skipped == nil {
+		reportObj.Skipped = []legacyIssue{}
+	}
+	if reportObj.Unmapped == nil {
+		reportObj.Unmapped = []legacyIssue{}
+	}
+	reportObjBytes, _ := json.Marshal(&reportObj)
+	fmt.Println("Legacy migration from " + reportObj.Source + ": " + string(reportObjBytes))
+	return []byte("{\"statusCode\" : \"SUCCESS\", \"body\" : " + string(reportObjBytes) + "}"), nil
+}
+
+// Creates a company and a user for each legacy login, returns the company ID of every login that has one
+func (t *SimpleChaincode) migrateLegacyUsers(stub shim.ChaincodeStubInterface, readLegacy func(key string) ([]byte, error),
+	reportObj *legacyMigrationReport) (map[string]string, error) {
+	var compIDArr CompanyIDList
+	var masterKeyList []string
+	companyByLogin := make(map[string]string)
+	userIDArrs := make(map[string]UserIDList)
+
+	compIDArrBytes, _ := stub.GetState(companyKey)
+	_ = json.Unmarshal(compIDArrBytes, &compIDArr)
+	for _, k := range companyTypes {
+		var userIDArr UserIDList
+		userIDArrBytes, _ := stub.GetState(strings.ToLower(k) + userIDAffix)
+		_ = json.Unmarshal(userIDArrBytes, &userIDArr)
+		userIDArrs[k] = userIDArr
+	}
+
+	for _, companyType := range companyTypes {
+		var loginIDArr []string
+
+		listKey := strings.ToLower(companyType) + legacyUserListAffix
+		loginIDArrBytes, err := readLegacy(listKey)
+		if err != nil {
+			return nil, errors.New("Could not read legacy user list " + listKey + ": " + err.Error())
+		}
+		if len(loginIDArrBytes) == 0 {
+			continue
+		}
+		if json.Unmarshal(loginIDArrBytes, &loginIDArr) != nil {
+			reportObj.Unmapped = append(reportObj.Unmapped, legacyIssue{LegacyKey: listKey, Reason: "Not a list of login IDs"})
+			continue
+		}
+
+		for _, loginID := range loginIDArr {
+			var legacyUserObj legacyUser
+			var loginObj legacyUserLogin
+			var existingUserObj user
+
+			//Logins migrated before keep the company they were given
+			existingUserObjBytes, _ := stub.GetState(loginID)
+			if snapshotEntityType(loginID, existingUserObjBytes) == "user" {
+				_ = json.Unmarshal(existingUserObjBytes, &existingUserObj)
+				companyByLogin[loginID] = existingUserObj.CompanyID
+				reportObj.Skipped = append(reportObj.Skipped, legacyIssue{LegacyKey: loginID, Reason: "User already exists"})
+				continue
+			}
+
+			legacyUserObjBytes, err := readLegacy(loginID)
+			if err != nil {
+				return nil, errors.New("Could not read legacy user " + loginID + ": " + err.Error())
+			}
+			if len(legacyUserObjBytes) == 0 || json.Unmarshal(legacyUserObjBytes, &legacyUserObj) != nil {
+				reportObj.Unmapped = append(reportObj.Unmapped, legacyIssue{LegacyKey: loginID, Reason: "Listed in " + listKey + " but has no user record"})
+				continue
+			}
+			if !strings.EqualFold(legacyUserObj.UserType, companyType) {
+				reportObj.Unmapped = append(reportObj.Unmapped, legacyIssue{LegacyKey: loginID, Field: "user_type",
+					Reason: "User type " + legacyUserObj.UserType + " does not match list " + listKey})
+				continue
+			}
+
+			companyID := strings.ToUpper(loginID)
+			if companyID == loginID {
+				//A company cannot share its key with its user
+				companyID = companyID + "_COMPANY"
+			}
+			companyObjBytes, _ := stub.GetState(companyID)
+			if companyObjBytes != nil {
+				reportObj.Unmapped = append(reportObj.Unmapped, legacyIssue{LegacyKey: loginID,
+					Reason: "Company ID " + companyID + " is already taken on this network"})
+				continue
+			}
+
+			loginObjBytes, err := readLegacy(legacyLoginPrefix + loginID)
+			if err != nil {
+				return nil, errors.New("Could not read legacy login " + loginID + ": " + err.Error())
+			}
+			_ = json.Unmarshal(loginObjBytes, &loginObj)
+			if loginObj.Password == "" {
+				//Users without a password cannot log in until an administrator sets one
+				reportObj.Unmapped = append(reportObj.Unmapped, legacyIssue{LegacyKey: legacyLoginPrefix + loginID, Field: "password",
+					Reason: "No login record, the user is created without a password"})
+			}
+			if legacyUserObj.BankAccountNum != 0 {
+				reportObj.Unmapped = append(reportObj.Unmapped, legacyIssue{LegacyKey: loginID, Field: "bank_account_num",
+					Reason: "Companies hold no bank account number, " + strconv.Itoa(legacyUserObj.BankAccountNum) + " is dropped"})
+			}
+
+			companyByLogin[loginID] = companyID
+			reportObj.Companies = append(reportObj.Companies, legacyMapping{LegacyKey: loginID, Key: companyID})
+			reportObj.Users = append(reportObj.Users, legacyMapping{LegacyKey: loginID, Key: loginID})
+			if reportObj.DryRun {
+				continue
+			}
+
+			if !t.addCompany(stub, compIDArr, companyID, companyType, legacyUserObj.CompanyName, legacyUserObj.CompanyLocation,
+				legacyUserObj.BankBalance, 0) {
+				return nil, errors.New("Could not create company " + companyID)
+			}
+			compIDArr = append(compIDArr, companyID)
+			t.addUser(stub, userIDArrs[companyType], loginID, loginObj.Password, companyID, companyType)
+			userIDArrs[companyType] = append(userIDArrs[companyType], loginID)
+			masterKeyList = append(masterKeyList, companyID, companyID+iotKeyAffix, loginID)
+		}
+	}
+
+	if len(masterKeyList) > 0 {
+		masterKeyList = append(masterKeyList, companyKey)
+		for _, k := range companyTypes {
+			masterKeyList = append(masterKeyList, strings.ToLower(k)+userIDAffix)
+		}
+		t.updateMasterKeyList(stub, masterKeyList)
+	}
+	return companyByLogin, nil
+}
+
+// Creates a trade request contract for each legacy trade request
+func (t *SimpleChaincode) migrateLegacyTradeRequests(stub shim.ChaincodeStubInterface, readLegacy func(key string) ([]byte, error),
+	companyByLogin map[string]string, reportObj *legacyMigrationReport) error {
+	var tradeRequestIDArr, contractIDArr, masterKeyList []string
+
+	tradeRequestIDArrBytes, err := readLegacy(tradeRequestKey)
+	if err != nil {
+		return errors.New("Could not read legacy trade request list: " + err.Error())
+	}
+	if len(tradeRequestIDArrBytes) == 0 {
+		return nil
+	}
+	if json.Unmarshal(tradeRequestIDArrBytes, &tradeRequestIDArr) != nil {
+		reportObj.Unmapped = append(reportObj.Unmapped, legacyIssue{LegacyKey: tradeRequestKey, Reason: "Not a list of trade request IDs"})
+		return nil
+	}
+	//Trade requests read from this ledger are already on the list they share with contracts
+	contractIDArrBytes, _ := stub.GetState(tradeRequestKey)
+	_ = json.Unmarshal(contractIDArrBytes, &contractIDArr)
+
+	for _, k := range tradeRequestIDArr {
+		var tradeRequestObj legacyTradeRequest
+
+		existingObjBytes, _ := stub.GetState(k)
+		if snapshotEntityType(k, existingObjBytes) == "contract" {
+			reportObj.Skipped = append(reportObj.Skipped, legacyIssue{LegacyKey: k, Reason: "Contract already exists"})
+			continue
+		}
+		if existingObjBytes != nil && recordFields(existingObjBytes)["tr_id"] == nil {
+			reportObj.Unmapped = append(reportObj.Unmapped, legacyIssue{LegacyKey: k, Reason: "Key " + k + " is already taken on this network"})
+			continue
+		}
+
+		tradeRequestObjBytes, err := readLegacy(k)
+		if err != nil {
+			return errors.New("Could not read legacy trade request " + k + ": " + err.Error())
+		}
+		if len(tradeRequestObjBytes) == 0 || json.Unmarshal(tradeRequestObjBytes, &tradeRequestObj) != nil {
+			reportObj.Unmapped = append(reportObj.Unmapped, legacyIssue{LegacyKey: k, Reason: "Listed in " + tradeRequestKey + " but has no trade request record"})
+			continue
+		}
+		contractIDStr := strconv.Itoa(tradeRequestObj.TradeRequestID)
+		if contractIDStr != k {
+			reportObj.Unmapped = append(reportObj.Unmapped, legacyIssue{LegacyKey: k, Field: "tr_id", Reason: "Trade request ID " + contractIDStr + " does not match its key"})
+			continue
+		}
+
+		contractObj, issues := t.legacyContract(stub, tradeRequestObj, companyByLogin, reportObj.PriceUnit)
+		for i := range issues {
+			issues[i].LegacyKey = k
+		}
+		reportObj.Unmapped = append(reportObj.Unmapped, issues...)
+		if contractObj == nil {
+			continue
+		}
+
+		//Invoices and incidents are linked when this network has their records
+		var linkedLists []string
+		linkedIDs := []struct {
+			Field      string
+			ID         int
+			EntityType string
+			Affix      string
+		}{
+			{"tr_invoice_id", tradeRequestObj.TradeRequestInvoiceID, "invoice", invoiceAffix},
+			{"tr_incident_id", tradeRequestObj.TradeRequestIncidentID, "incident", incidentAffix},
+		}
+		for _, linked := range linkedIDs {
+			if linked.ID == 0 {
+				continue
+			}
+			linkedIDStr := strconv.Itoa(linked.ID)
+			linkedObjBytes, _ := stub.GetState(linkedIDStr)
+			if snapshotEntityType(linkedIDStr, linkedObjBytes) != linked.EntityType {
+				reportObj.Unmapped = append(reportObj.Unmapped, legacyIssue{LegacyKey: k, Field: linked.Field,
+					Reason: "The legacy layout holds no " + linked.EntityType + " records and this network has no " + linked.EntityType + " " + linkedIDStr})
+				continue
+			}
+			linkedLists = append(linkedLists, linked.Affix, linkedIDStr)
+		}
+
+		if !contains(contractIDArr, contractIDStr) {
+			contractIDArr = append(contractIDArr, contractIDStr)
+		}
+		reportObj.Contracts = append(reportObj.Contracts, legacyMapping{LegacyKey: k, Key: contractIDStr})
+		if reportObj.DryRun {
+			continue
+		}
+
+		contractObjBytes, _ := json.Marshal(contractObj)
+		err = stub.PutState(contractIDStr, contractObjBytes)
+		if err != nil {
+			return err
+		}
+		offerObj := contractOffer{ContractID: contractObj.ContractID, Version: 1, ProposerID: contractObj.InitiatorID, EnergyMWH: contractObj.EnergyMWH,
+			GasPrice: contractObj.Pricing.FixedPrice, EntryLocation: contractObj.EntryLocation, StartDate: contractObj.ContractStartDate,
+			EndDate: contractObj.ContractEndDate, Pricing: contractObj.Pricing, OfferStatus: "Open", Comments: "Migrated from the legacy trade request"}
+		if contractObj.ContractStatus == "Accepted" || contractObj.ContractStatus == "Rejected" {
+			offerObj.OfferStatus = contractObj.ContractStatus
+		}
+		err = t.saveOfferList(stub, contractIDStr, []contractOffer{offerObj})
+		if err != nil {
+			return err
+		}
+		for i := 0; i < len(linkedLists); i = i + 2 {
+			var idArr []string
+			idArrBytes, _ := stub.GetState(contractIDStr + linkedLists[i])
+			_ = json.Unmarshal(idArrBytes, &idArr)
+			if !contains(idArr, linkedLists[i+1]) {
+				idArr = append(idArr, linkedLists[i+1])
+			}
+			idArrBytes, _ = json.Marshal(&idArr)
+			_ = stub.PutState(contractIDStr+linkedLists[i], idArrBytes)
+		}
+		masterKeyList = append(masterKeyList, contractIDStr, contractIDStr+invoiceAffix, contractIDStr+incidentAffix, contractIDStr+offerAffix)
+	}
+
+	if !reportObj.DryRun && len(masterKeyList) > 0 {
+		contractIDArrBytes, _ = json.Marshal(&contractIDArr)
+		err = stub.PutState(tradeRequestKey, contractIDArrBytes)
+		if err != nil {
+			return err
+		}
+		t.updateMasterKeyList(stub, append(masterKeyList, tradeRequestKey))
+	}
+	return nil
+}
+
+// Maps a legacy trade request onto a contract, nil if it cannot be mapped. Issues carry no legacy key.
+func (t *SimpleChaincode) legacyContract(stub shim.ChaincodeStubInterface, tradeRequestObj legacyTradeRequest,
+	companyByLogin map[string]string, priceUnit string) (*contract, []legacyIssue) {
+	var issues []legacyIssue
+
+	parties := []struct {
+		Field       string
+		LoginID     string
+		CompanyType string
+	}{
+		{"tr_shipper_id", tradeRequestObj.ShipperID, "Shipper"},
+		{"tr_producer_id", tradeRequestObj.ProducerID, "Producer"},
+	}
+	companyIDs := make([]string, len(parties))
+	for i, k := range parties {
+		var companyObj company
+
+		companyIDs[i] = companyByLogin[k.LoginID]
+		if companyIDs[i] == "" {
+			issues = append(issues, legacyIssue{Field: k.Field, Reason: "No migrated user " + k.LoginID})
+			continue
+		}
+		companyObjBytes, _ := stub.GetState(companyIDs[i])
+		_ = json.Unmarshal(companyObjBytes, &companyObj)
+		if companyObjBytes != nil && companyObj.CompanyType != k.CompanyType {
+			issues = append(issues, legacyIssue{Field: k.Field, Reason: "Company " + companyIDs[i] + " is a " + companyObj.CompanyType + ", not a " + k.CompanyType})
+		}
+	}
+
+	contractStatus, ok := legacyStatusMapping[strings.ToLower(strings.TrimSpace(tradeRequestObj.TradeRequestStatus))]
+	if !ok {
+		issues = append(issues, legacyIssue{Field: "tr_status", Reason: "Unknown trade request status " + tradeRequestObj.TradeRequestStatus})
+	}
+	if len(issues) > 0 {
+		return nil, issues
+	}
+
+	//Contracts are priced per MWh
+	fixedPrice := tradeRequestObj.GasPrice
+	if priceUnit == "kwh" {
+		fixedPrice = fixedPrice * 1000
+	}
+	entryLocation := tradeRequestObj.EntryLocation
+	if entryLocation == "" {
+		entryLocation = "Europe"
+	}
+
+	contractObj := contract{ContractID: tradeRequestObj.TradeRequestID, InitiatorID: companyIDs[0], ReceiverID: companyIDs[1],
+		EnergyMWH: tradeRequestObj.EnergyKWH / 1000, EntryLocation: entryLocation, ContractStartDate: tradeRequestObj.TradeRequestStartDate,
+		ContractEndDate: tradeRequestObj.TradeRequestEndDate, ContractStatus: contractStatus, OfferVersion: 1,
+		Pricing: contractPricing{PriceType: "Fixed", FixedPrice: fixedPrice}}
+	if contractStatus == "Accepted" {
+		contractObj.AcceptedOfferVersion = 1
+	}
+	return &contractObj, nil
+}
@@ -0,0 +1,115 @@
+//go:build local
+// +build local
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/preethimohan1/learn-chaincode/energyTrading1/localstub"
+	"github.com/preethimohan1/learn-chaincode/etrade"
+	"github.com/preethimohan1/learn-chaincode/gateway"
+)
+
+// Built with -tags local the chaincode runs in process as the etrade command line client, for scripting
+// scenarios without a Fabric network. The ledger is kept in a state file between runs, a new state file
+// starts from Init with the -bootstrap document. "etrade serve" puts the REST gateway in front of the same ledger.
+//
+//	go build -tags local -o etrade ./energyTrading1
+//	./etrade -state scenario.json company list --type producer
+//	./etrade -state empty.json -bootstrap empty company list
+func main() {
+	statePath := flag.String("state", "etrade-state.json", "file the ledger is kept in")
+	jsonOutput := flag.Bool("json", false, "print results as JSON instead of tables")
+	peer := flag.String("peer", "", "REST endpoint of a peer to use instead of the local ledger, such as http://localhost:7050")
+	chaincodeName := flag.String("chaincode", "", "chaincode name on the peer")
+	user := flag.String("user", "", "enrolled user the calls to the peer are made as")
+	verbose := flag.Bool("verbose", false, "show the chaincode's log on stderr")
+	bootstrap := flag.String("bootstrap", "demo", "bootstrap document file a new ledger is initialized with, demo for the demo data, empty (or \"\") for a network without companies, plans or users")
+	flag.Parse()
+
+	//The chaincode logs to stdout, which is kept for the results
+	cli := &etrade.CLI{Out: os.Stdout, Err: os.Stderr, JSON: *jsonOutput}
+	os.Stdout = os.Stderr
+	if !*verbose {
+		devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Stdout = devNull
+	}
+	if *peer != "" {
+		cli.Backend = gateway.NewPeerBackend(*peer, *chaincodeName, *user, nil)
+	} else {
+		stub, found, err := localstub.Load(*statePath, "etrading", new(SimpleChaincode))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !found {
+			initArgs, err := bootstrapArgs(*bootstrap)
+			if err != nil {
+				log.Fatal(err)
+			}
+			_, err = stub.MockInit("init", "init", initArgs)
+			if err == nil {
+				err = stub.SaveState(*statePath)
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		cli.Backend = &savingBackend{backend: gateway.NewStubBackend(stub), stub: stub, path: *statePath}
+	}
+
+	err := cli.Run(flag.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Init arguments for the -bootstrap flag. Without a document Init applies an empty one.
+func bootstrapArgs(bootstrap string) ([]string, error) {
+	if bootstrap == "" || bootstrap == "empty" {
+		return nil, nil
+	}
+	if bootstrap == "demo" {
+		return []string{bootstrap}, nil
+	}
+	docBytes, err := ioutil.ReadFile(bootstrap)
+	if err != nil {
+		return nil, err
+	}
+	return []string{string(docBytes)}, nil
+}
+
+// Saves the ledger after every transaction the chaincode accepted
+type savingBackend struct {
+	backend gateway.Backend
+	stub    *localstub.Stub
+	path    string
+	mutex   sync.Mutex
+}
+
+func (b *savingBackend) Invoke(function string, args []string) (gateway.Result, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	result, err := b.backend.Invoke(function, args)
+	if err == nil {
+		err = b.stub.SaveState(b.path)
+	}
+	return result, err
+}
+
+func (b *savingBackend) Query(function string, args []string) (gateway.Result, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.backend.Query(function, args)
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Contracts created by the market are numbered from here so they do not collide with request IDs chosen by clients
+var firstMarketContractID = 800000000
+
+type orderFill struct {
+	ContractID     int     `json:"contract_id"`
+	CounterOrderID string  `json:"counter_order_id"`
+	QuantityMWH    float64 `json:"quantity_mwh"`
+	Price          float64 `json:"price"`
+	FillDateMS     int     `json:"fill_date_ms"`
+}
+
+// Bid of a shipper or ask of a producer for a delivery point and period
+type order struct {
+	OrderID       string      `json:"order_id"`
+	BookID        string      `json:"book_id"`
+	CompanyID     string      `json:"company_id"`
+	Side          string      `json:"side"`
+	DeliveryPoint string      `json:"delivery_point"`
+	StartDate     string      `json:"start_date"`
+	EndDate       string      `json:"end_date"`
+	QuantityMWH   float64     `json:"quantity_mwh"`
+	RemainingMWH  float64     `json:"remaining_mwh"`
+	LimitPrice    float64     `json:"limit_price"`
+	OrderStatus   string      `json:"order_status"`
+	Sequence      int         `json:"sequence"`
+	OrderDateMS   int         `json:"order_date_ms"`
+	PlanID        string      `json:"plan_id"`
+	Fills         []orderFill `json:"fills"`
+}
+
+type orderBook struct {
+	BookID        string  `json:"book_id"`
+	DeliveryPoint string  `json:"delivery_point"`
+	StartDate     string  `json:"start_date"`
+	EndDate       string  `json:"end_date"`
+	Bids          []order `json:"bids"`
+	Asks          []order `json:"asks"`
+}
+
+// Price-time priority: best price first, earlier orders first at the same price
+type ordersByPriority []order
+
+func (o ordersByPriority) Len() int      { return len(o) }
+func (o ordersByPriority) Swap(i, j int) { o[i], o[j] = o[j], o[i] }
+func (o ordersByPriority) Less(i, j int) bool {
+	if o[i].LimitPrice != o[j].LimitPrice {
+		if o[i].Side == "Bid" {
+			return o[i].LimitPrice > o[j].LimitPrice
+		}
+		return o[i].LimitPrice < o[j].LimitPrice
+	}
+	return o[i].Sequence < o[j].Sequence
+}
+
+func orderBookID(deliveryPoint string, startDay string, endDay string) string {
+	return bookPrefix + networkPointID(deliveryPoint) + "_" + startDay + "_" + endDay
+}
+
+// Next value of a counter kept in the state, starting at first
+func (t *SimpleChaincode) nextSequence(stub shim.ChaincodeStubInterface, key string, first int) int {
+	var sequence int
+
+	sequenceBytes, _ := stub.GetState(key)
+	if sequenceBytes == nil {
+		sequence = first
+		t.updateMasterKeyList(stub, []string{key})
+	} else {
+		sequence, _ = strconv.Atoi(string(sequenceBytes))
+		sequence = sequence + 1
+	}
+	_ = stub.PutState(key, []byte(strconv.Itoa(sequence)))
+	return sequence
+}
+
+// Next number of a sequence that numbers records, skipping numbers already taken as a key
+func (t *SimpleChaincode) nextFreeSequence(stub shim.ChaincodeStubInterface, key string, first int) int {
+	sequence := t.nextSequence(stub, key, first)
+	for {
+		existingBytes, _ := stub.GetState(strconv.Itoa(sequence))
+		if existingBytes == nil {
+			return sequence
+		}
+		sequence = t.nextSequence(stub, key, first)
+	}
+}
+
+func (t *SimpleChaincode) saveOrder(stub shim.ChaincodeStubInterface, orderObj order) error {
+	orderObjBytes, err := json.Marshal(&orderObj)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(orderObj.OrderID, orderObjBytes)
+}
+
+func (t *SimpleChaincode) getBookOrders(stub shim.ChaincodeStubInterface, bookID string) []order {
+	var orderIDList []string
+	var orderList []order
+
+	orderIDListBytes, _ := stub.GetState(bookID)
+	_ = json.Unmarshal(orderIDListBytes, &orderIDList)
+
+	for _, k := range orderIDList {
+		var orderObj order
+		orderObjBytes, _ := stub.GetState(k)
+		_ = json.Unmarshal(orderObjBytes, &orderObj)
+		orderList = append(orderList, orderObj)
+	}
+	return orderList
+}
+
+// Keeps the book listing only orders that can still trade
+func (t *SimpleChaincode) saveBookOrderIDs(stub shim.ChaincodeStubInterface, bookID string, orderList []order) {
+	var orderIDList = []string{}
+
+	for _, k := range orderList {
+		if k.OrderStatus == "Open" || k.OrderStatus == "PartiallyFilled" {
+			orderIDList = append(orderIDList, k.OrderID)
+		}
+	}
+	orderIDListBytes, _ := json.Marshal(&orderIDList)
+	_ = stub.PutState(bookID, orderIDListBytes)
+}
+
+// Stores a contract agreed outside a negotiation (market match or auction award) as accepted at a fixed
+// price, checks the initiator's credit, books its capacity and lists it with the other requests of its kind
+func (t *SimpleChaincode) addAwardedContract(stub shim.ChaincodeStubInterface, idArrKey string, contractObj contract, proposerID string, awardDate int) error {
+	var contractIDArr []string
+	var contractIDString = strconv.Itoa(contractObj.ContractID)
+
+	contractObj.ContractStatus = "Accepted"
+	contractObj.OfferVersion = 1
+	contractObj.AcceptedOfferVersion = 1
+
+	err := t.checkCreditExposure(stub, contractObj)
+	if err != nil {
+		return err
+	}
+	err = t.reserveContractCapacity(stub, &contractObj)
+	if err != nil {
+		return err
+	}
+	err = t.saveContract(stub, contractObj)
+	if err != nil {
+		return err
+	}
+
+	awardedOffer := contractOffer{ContractID: contractObj.ContractID, Version: 1, ProposerID: proposerID, EnergyMWH: contractObj.EnergyMWH, GasPrice: contractObj.Pricing.FixedPrice,
+		EntryLocation: contractObj.EntryLocation, StartDate: contractObj.ContractStartDate, EndDate: contractObj.ContractEndDate, Pricing: contractObj.Pricing, OfferStatus: "Accepted", OfferDateMS: awardDate}
+	t.saveOfferList(stub, contractIDString, []contractOffer{awardedOffer})
+
+	contractIDListObjBytes, _ := stub.GetState(idArrKey)
+	_ = json.Unmarshal(contractIDListObjBytes, &contractIDArr)
+	contractIDArr = append(contractIDArr, contractIDString)
+	contractIDListObjBytes, _ = json.Marshal(&contractIDArr)
+	_ = stub.PutState(idArrKey, contractIDListObjBytes)
+
+	idList := []string{contractIDString, contractIDString + invoiceAffix, contractIDString + incidentAffix, contractIDString + offerAffix}
+	t.updateMasterKeyList(stub, idList)
+
+	t.emitContractEvent(stub, "ContractCreated", contractObj, "")
+	return nil
+}
+
+// Holds the remaining quantity of an ask on the producer's plan so the market cannot sell more than it can deliver
+func (t *SimpleChaincode) reserveOrderCapacity(stub shim.ChaincodeStubInterface, orderObj order) error {
+	if orderObj.PlanID == "" {
+		return nil
+	}
+
+	days, err := contractDays(contract{ContractStartDate: orderObj.StartDate, ContractEndDate: orderObj.EndDate})
+	if err != nil {
+		return err
+	}
+	if orderObj.RemainingMWH <= 0 || orderObj.OrderStatus == "Cancelled" {
+		return t.releaseCapacity(stub, orderObj.PlanID, orderObj.OrderID, days)
+	}
+	return t.reserveCapacity(stub, orderObj.PlanID, orderObj.OrderID, days, orderObj.RemainingMWH/float64(len(days)))
+}
+
+// Matches an incoming order against the resting orders of its book. Each fill trades at the price of the
+// resting order and becomes an accepted trade contract between the shipper and the producer.
+func (t *SimpleChaincode) matchOrder(stub shim.ChaincodeStubInterface, incoming *order, bookOrders []order) ([]order, error) {
+	var candidates []order
+
+	for _, k := range bookOrders {
+		if k.Side == incoming.Side || k.OrderStatus == "Cancelled" || k.OrderStatus == "Filled" {
+			continue
+		}
+		if incoming.Side == "Bid" && k.LimitPrice <= incoming.LimitPrice || incoming.Side == "Ask" && k.LimitPrice >= incoming.LimitPrice {
+			candidates = append(candidates, k)
+		}
+	}
+	sort.Sort(ordersByPriority(candidates))
+
+	for i := range candidates {
+		if incoming.RemainingMWH <= 0 {
+			break
+		}
+		resting := &candidates[i]
+		quantity := minFloat(incoming.RemainingMWH, resting.RemainingMWH)
+
+		bid, ask := incoming, resting
+		if incoming.Side == "Ask" {
+			bid, ask = resting, incoming
+		}
+
+		//The producer's ask holds the capacity until it is filled, then the contract holds it
+		ask.RemainingMWH = ask.RemainingMWH - quantity
+		err := t.reserveOrderCapacity(stub, *ask)
+		if err != nil {
+			return nil, err
+		}
+
+		contractObj := contract{ContractID: t.nextFreeSequence(stub, marketContractKey, firstMarketContractID), InitiatorID: bid.CompanyID, ReceiverID: ask.CompanyID,
+			EnergyMWH: quantity, EntryLocation: incoming.DeliveryPoint, ContractStartDate: incoming.StartDate, ContractEndDate: incoming.EndDate, PlanID: ask.PlanID,
+			Pricing: contractPricing{PriceType: "Fixed", FixedPrice: resting.LimitPrice}}
+		err = t.addAwardedContract(stub, tradeRequestKey, contractObj, resting.CompanyID, incoming.OrderDateMS)
+		if err != nil {
+			return nil, err
+		}
+
+		bid.RemainingMWH = bid.RemainingMWH - quantity
+		incoming.Fills = append(incoming.Fills, orderFill{ContractID: contractObj.ContractID, CounterOrderID: resting.OrderID, QuantityMWH: quantity, Price: resting.LimitPrice, FillDateMS: incoming.OrderDateMS})
+		resting.Fills = append(resting.Fills, orderFill{ContractID: contractObj.ContractID, CounterOrderID: incoming.OrderID, QuantityMWH: quantity, Price: resting.LimitPrice, FillDateMS: incoming.OrderDateMS})
+	}
+
+	return candidates, nil
+}
+
+func setOrderStatus(orderObj *order) {
+	if orderObj.OrderStatus == "Cancelled" {
+		return
+	}
+	if orderObj.RemainingMWH <= 0 {
+		orderObj.OrderStatus = "Filled"
+	} else if len(orderObj.Fills) > 0 {
+		orderObj.OrderStatus = "PartiallyFilled"
+	} else {
+		orderObj.OrderStatus = "Open"
+	}
+}
+
+// Shippers bid and producers ask for gas at a delivery point over a delivery period
+func (t *SimpleChaincode) placeOrder(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var companyObj company
+	var orderObj order
+	var bookIDList []string
+
+	fmt.Println("Entered function placeOrder()")
+
+	if len(args) < 8 {
+		return nil, errors.New("Incorrect number of arguments. 8 expected (Order ID, Company ID, Side Bid/Ask, Delivery Point, Start Date, End Date, Quantity MWh, Limit Price) and optionally Current Date in MilliSecs")
+	}
+
+	existingBytes, _ := stub.GetState(args[0])
+	if existingBytes != nil {
+		return nil, errors.New("Order already exists: " + args[0])
+	}
+
+	companyObjBytes, _ := stub.GetState(args[1])
+	_ = json.Unmarshal(companyObjBytes, &companyObj)
+	if args[2] == "Bid" && companyObj.CompanyType != "Shipper" {
+		return nil, errors.New("Only shippers can bid, " + args[1] + " is not a shipper")
+	}
+	if args[2] == "Ask" && companyObj.CompanyType != "Producer" {
+		return nil, errors.New("Only producers can ask, " + args[1] + " is not a producer")
+	}
+	if args[2] != "Bid" && args[2] != "Ask" {
+		return nil, errors.New("Order side must be Bid or Ask, not " + args[2])
+	}
+
+	startDay, endDay, err := parseEffectivePeriod(args[4:6])
+	if err != nil {
+		return nil, err
+	}
+	if startDay == "" || endDay == "" {
+		return nil, errors.New("Orders need a delivery start and end date")
+	}
+
+	orderObj = order{OrderID: args[0], BookID: orderBookID(args[3], startDay, endDay), CompanyID: args[1], Side: args[2], DeliveryPoint: args[3], StartDate: startDay, EndDate: endDay}
+	orderObj.QuantityMWH, err = strconv.ParseFloat(args[6], 64)
+	if err != nil || orderObj.QuantityMWH <= 0 {
+		return nil, errors.New("Invalid order quantity: " + args[6])
+	}
+	orderObj.LimitPrice, err = strconv.ParseFloat(args[7], 64)
+	if err != nil || orderObj.LimitPrice < 0 {
+		return nil, errors.New("Invalid limit price: " + args[7])
+	}
+	if len(args) > 8 {
+		orderObj.OrderDateMS, _ = strconv.Atoi(args[8])
+	}
+	orderObj.RemainingMWH = orderObj.QuantityMWH
+	orderObj.Sequence = t.nextSequence(stub, orderSequenceKey, 1)
+
+	if orderObj.Side == "Ask" {
+		orderObj.PlanID = t.bookingPlan(stub, contract{ReceiverID: orderObj.CompanyID, EntryLocation: orderObj.DeliveryPoint})
+		err = t.reserveOrderCapacity(stub, orderObj)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	bookOrders := t.getBookOrders(stub, orderObj.BookID)
+	matched, err := t.matchOrder(stub, &orderObj, bookOrders)
+	if err != nil {
+		return nil, err
+	}
+
+	//Save the resting orders that traded and the incoming order
+	for i := range bookOrders {
+		for _, k := range matched {
+			if k.OrderID == bookOrders[i].OrderID {
+				bookOrders[i] = k
+			}
+		}
+		setOrderStatus(&bookOrders[i])
+		err = t.saveOrder(stub, bookOrders[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	setOrderStatus(&orderObj)
+	err = t.saveOrder(stub, orderObj)
+	if err != nil {
+		return nil, err
+	}
+	t.saveBookOrderIDs(stub, orderObj.BookID, append(bookOrders, orderObj))
+
+	//Register the book and the company's order
+	bookIDListBytes, _ := stub.GetState(orderBookKey)
+	_ = json.Unmarshal(bookIDListBytes, &bookIDList)
+	if !contains(bookIDList, orderObj.BookID) {
+		bookIDList = append(bookIDList, orderObj.BookID)
+		bookIDListBytes, _ = json.Marshal(&bookIDList)
+		_ = stub.PutState(orderBookKey, bookIDListBytes)
+		t.updateMasterKeyList(stub, []string{orderObj.BookID})
+		t.updateMasterKeyList(stub, []string{orderBookKey})
+	}
+
+	var orderIDList []string
+	var arrKey = orderObj.CompanyID + orderAffix
+	orderIDListBytes, _ := stub.GetState(arrKey)
+	_ = json.Unmarshal(orderIDListBytes, &orderIDList)
+	orderIDList = append(orderIDList, orderObj.OrderID)
+	orderIDListBytes, _ = json.Marshal(&orderIDList)
+	_ = stub.PutState(arrKey, orderIDListBytes)
+	t.updateMasterKeyList(stub, []string{orderObj.OrderID})
+	t.updateMasterKeyList(stub, []string{arrKey})
+
+	return nil, nil
+}
+
+func (t *SimpleChaincode) cancelOrder(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var orderObj order
+
+	fmt.Println("Entered function cancelOrder()")
+
+	if len(args) < 2 {
+		return nil, errors.New("Incorrect number of arguments. 2 expected (Order ID, Company ID)")
+	}
+
+	orderObjBytes, _ := stub.GetState(args[0])
+	if orderObjBytes == nil {
+		return nil, errors.New("Order not found: " + args[0])
+	}
+	_ = json.Unmarshal(orderObjBytes, &orderObj)
+	if orderObj.CompanyID != args[1] {
+		return nil, errors.New("Order " + args[0] + " belongs to " + orderObj.CompanyID)
+	}
+	if orderObj.OrderStatus != "Open" && orderObj.OrderStatus != "PartiallyFilled" {
+		return nil, errors.New("Order " + args[0] + " is already " + orderObj.OrderStatus)
+	}
+
+	orderObj.OrderStatus = "Cancelled"
+	err := t.reserveOrderCapacity(stub, orderObj)
+	if err != nil {
+		return nil, err
+	}
+	err = t.saveOrder(stub, orderObj)
+	if err != nil {
+		return nil, err
+	}
+
+	t.saveBookOrderIDs(stub, orderObj.BookID, t.getBookOrders(stub, orderObj.BookID))
+	return nil, nil
+}
+
+// Resting bids and asks of a book in priority order
+func (t *SimpleChaincode) getOrderBook(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var returnMessage string
+
+	if len(args) < 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3 (Delivery Point, Start Date, End Date).")
+	}
+
+	startDay, endDay, err := parseEffectivePeriod(args[1:3])
+	if err != nil {
+		return nil, err
+	}
+
+	bookObj := orderBook{BookID: orderBookID(args[0], startDay, endDay), DeliveryPoint: networkPointID(args[0]), StartDate: startDay, EndDate: endDay, Bids: []order{}, Asks: []order{}}
+	for _, k := range t.getBookOrders(stub, bookObj.BookID) {
+		if k.Side == "Bid" {
+			bookObj.Bids = append(bookObj.Bids, k)
+		} else {
+			bookObj.Asks = append(bookObj.Asks, k)
+		}
+	}
+	sort.Sort(ordersByPriority(bookObj.Bids))
+	sort.Sort(ordersByPriority(bookObj.Asks))
+
+	bookObjBytes, _ := json.Marshal(&bookObj)
+	returnMessage = "{\"statusCode\" : \"SUCCESS\", \"body\" : " + string(bookObjBytes) + "}"
+	return []byte(returnMessage), nil
+}
+
+func (t *SimpleChaincode) getOrderList(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var returnMessage string
+	var orderIDList []string
+	var orderList = []order{}
+
+	if len(args) < 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1 (Company ID).")
+	}
+
+	orderIDListBytes, _ := stub.GetState(args[0] + orderAffix)
+	_ = json.Unmarshal(orderIDListBytes, &orderIDList)
+	for _, k := range orderIDList {
+		var orderObj order
+		orderObjBytes, _ := stub.GetState(k)
+		_ = json.Unmarshal(orderObjBytes, &orderObj)
+		orderList = append(orderList, orderObj)
+	}
+
+	orderListBytes, _ := json.Marshal(orderList)
+	returnMessage = "{\"statusCode\" : \"SUCCESS\", \"body\" : " + string(orderListBytes) + "}"
+	return []byte(returnMessage), nil
+}
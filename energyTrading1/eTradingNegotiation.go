@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+type contractOffer struct {
+	ContractID    int             `json:"contract_id"`
+	Version       int             `json:"offer_version"`
+	ProposerID    string          `json:"offer_proposer_id"`
+	EnergyMWH     float64         `json:"offer_energy_mwh"`
+	GasPrice      float64         `json:"offer_gas_price"`
+	EntryLocation string          `json:"offer_entry_location"`
+	StartDate     string          `json:"offer_start_date"`
+	EndDate       string          `json:"offer_end_date"`
+	Pricing       contractPricing `json:"offer_pricing"`
+	OfferStatus   string          `json:"offer_status"`
+	Comments      string          `json:"offer_comments"`
+	OfferDateMS   int             `json:"offer_date_ms"`
+}
+
+// Terms of a counter-offer, fields left out keep the value of the offer being countered
+type offerTerms struct {
+	EnergyMWH     *float64         `json:"energy_mwh"`
+	GasPrice      *float64         `json:"gas_price"`
+	EntryLocation *string          `json:"entry_location"`
+	StartDate     *string          `json:"start_date"`
+	EndDate       *string          `json:"end_date"`
+	Pricing       *contractPricing `json:"pricing"`
+	Comments      string           `json:"comments"`
+}
+
+func (t *SimpleChaincode) getOfferList(stub shim.ChaincodeStubInterface, contractIDStr string) []contractOffer {
+	var offerList []contractOffer
+
+	offerListBytes, _ := stub.GetState(contractIDStr + offerAffix)
+	_ = json.Unmarshal(offerListBytes, &offerList)
+
+	return offerList
+}
+
+func (t *SimpleChaincode) saveOfferList(stub shim.ChaincodeStubInterface, contractIDStr string, offerList []contractOffer) error {
+	offerListBytes, err := json.Marshal(&offerList)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(contractIDStr+offerAffix, offerListBytes)
+}
+
+// Loads a contract still under negotiation together with its offers, checking the company is a party
+func (t *SimpleChaincode) loadNegotiation(stub shim.ChaincodeStubInterface, contractIDStr string, companyID string) (contract, []contractOffer, error) {
+	var contractObj contract
+
+	contractObjBytes, _ := stub.GetState(contractIDStr)
+	if contractObjBytes == nil {
+		return contractObj, nil, errors.New("Contract not found: " + contractIDStr)
+	}
+	err := json.Unmarshal(contractObjBytes, &contractObj)
+	if err != nil {
+		return contractObj, nil, err
+	}
+
+	if companyID != contractObj.InitiatorID && companyID != contractObj.ReceiverID {
+		return contractObj, nil, errors.New("Company " + companyID + " is not a party to contract " + contractIDStr)
+	}
+	if contractObj.ContractStatus != "New" && contractObj.ContractStatus != "Negotiating" {
+		return contractObj, nil, errors.New("Contract " + contractIDStr + " is " + contractObj.ContractStatus + " and can no longer be negotiated")
+	}
+
+	offerList := t.getOfferList(stub, contractIDStr)
+	if len(offerList) == 0 {
+		//Contracts created before negotiation threads start with their current terms as version 1
+		offerList = []contractOffer{contractOffer{ContractID: contractObj.ContractID, Version: 1, ProposerID: contractObj.InitiatorID, EnergyMWH: contractObj.EnergyMWH,
+			EntryLocation: contractObj.EntryLocation, StartDate: contractObj.ContractStartDate, EndDate: contractObj.ContractEndDate, OfferStatus: "Open"}}
+		contractObj.OfferVersion = 1
+	}
+
+	return contractObj, offerList, nil
+}
+
+func (t *SimpleChaincode) saveContract(stub shim.ChaincodeStubInterface, contractObj contract) error {
+	contractObjBytes, err := json.Marshal(&contractObj)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(strconv.Itoa(contractObj.ContractID), contractObjBytes)
+}
+
+// Either party counters the current offer with new quantity, price, dates or entry location
+func (t *SimpleChaincode) submitCounterOffer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var contractIDStr, proposerID string
+	var baseVersion, offerDate int
+	var terms offerTerms
+
+	fmt.Println("Entered function submitCounterOffer()")
+
+	if len(args) < 5 {
+		return nil, errors.New("Incorrect number of arguments. 5 expected (Contract ID, Proposer ID, Countered Offer Version, Terms JSON, Current Date in MilliSecs)")
+	}
+
+	contractIDStr = args[0]
+	proposerID = args[1]
+	baseVersion, _ = strconv.Atoi(args[2])
+	offerDate, _ = strconv.Atoi(args[4])
+
+	err := json.Unmarshal([]byte(args[3]), &terms)
+	if err != nil {
+		return nil, errors.New("Invalid offer terms: " + err.Error())
+	}
+
+	contractObj, offerList, err := t.loadNegotiation(stub, contractIDStr, proposerID)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+
+	currentOffer := offerList[len(offerList)-1]
+	if baseVersion != currentOffer.Version {
+		return nil, errors.New("Offer version " + args[2] + " is out of date, the current offer is version " + strconv.Itoa(currentOffer.Version))
+	}
+
+	newOffer := currentOffer
+	newOffer.Version = currentOffer.Version + 1
+	newOffer.ProposerID = proposerID
+	newOffer.OfferStatus = "Open"
+	newOffer.Comments = terms.Comments
+	newOffer.OfferDateMS = offerDate
+	if terms.EnergyMWH != nil {
+		newOffer.EnergyMWH = *terms.EnergyMWH
+	}
+	if terms.GasPrice != nil {
+		newOffer.GasPrice = *terms.GasPrice
+		newOffer.Pricing = contractPricing{}
+	}
+	if terms.Pricing != nil {
+		err = validatePricing(*terms.Pricing)
+		if err != nil {
+			return nil, err
+		}
+		newOffer.Pricing = *terms.Pricing
+	}
+	if terms.EntryLocation != nil {
+		newOffer.EntryLocation = *terms.EntryLocation
+	}
+	if terms.StartDate != nil {
+		newOffer.StartDate = *terms.StartDate
+	}
+	if terms.EndDate != nil {
+		newOffer.EndDate = *terms.EndDate
+	}
+	if newOffer.EnergyMWH <= 0 || newOffer.GasPrice < 0 {
+		return nil, errors.New("Offer needs a positive quantity and a non-negative price")
+	}
+
+	offerList[len(offerList)-1].OfferStatus = "Superseded"
+	offerList = append(offerList, newOffer)
+
+	err = t.saveOfferList(stub, contractIDStr, offerList)
+	if err != nil {
+		return nil, err
+	}
+
+	var previousStatus = contractObj.ContractStatus
+	contractObj.OfferVersion = newOffer.Version
+	contractObj.ContractStatus = "Negotiating"
+	err = t.saveContract(stub, contractObj)
+	if err != nil {
+		return nil, err
+	}
+
+	if previousStatus != contractObj.ContractStatus {
+		t.emitContractEvent(stub, "ContractStatusChanged", contractObj, previousStatus)
+	}
+	return nil, nil
+}
+
+// Accepts a specific offer version on behalf of the party that did not propose it
+func (t *SimpleChaincode) acceptOffer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var contractIDStr, companyID string
+	var version, acceptDate int
+
+	fmt.Println("Entered function acceptOffer()")
+
+	if len(args) < 4 {
+		return nil, errors.New("Incorrect number of arguments. 4 expected (Contract ID, Company ID, Offer Version, Current Date in MilliSecs)")
+	}
+
+	contractIDStr = args[0]
+	companyID = args[1]
+	version, _ = strconv.Atoi(args[2])
+	acceptDate, _ = strconv.Atoi(args[3])
+
+	contractObj, offerList, err := t.loadNegotiation(stub, contractIDStr, companyID)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+
+	var previousStatus = contractObj.ContractStatus
+	err = t.acceptContract(stub, &contractObj, offerList, version, companyID, acceptDate)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+
+	t.emitContractEvent(stub, "ContractStatusChanged", contractObj, previousStatus)
+	return nil, nil
+}
+
+// Rejects the current offer and ends the negotiation
+func (t *SimpleChaincode) rejectOffer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var contractIDStr, companyID string
+	var version int
+
+	fmt.Println("Entered function rejectOffer()")
+
+	if len(args) < 3 {
+		return nil, errors.New("Incorrect number of arguments. 3 expected (Contract ID, Company ID, Offer Version)")
+	}
+
+	contractIDStr = args[0]
+	companyID = args[1]
+	version, _ = strconv.Atoi(args[2])
+
+	contractObj, offerList, err := t.loadNegotiation(stub, contractIDStr, companyID)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+
+	currentOffer := offerList[len(offerList)-1]
+	if version != currentOffer.Version {
+		return nil, errors.New("Only the current offer (version " + strconv.Itoa(currentOffer.Version) + ") can be rejected")
+	}
+	if companyID == currentOffer.ProposerID {
+		return nil, errors.New("Company " + companyID + " cannot reject its own offer")
+	}
+
+	offerList[len(offerList)-1].OfferStatus = "Rejected"
+	err = t.saveOfferList(stub, contractIDStr, offerList)
+	if err != nil {
+		return nil, err
+	}
+
+	var previousStatus = contractObj.ContractStatus
+	contractObj.ContractStatus = "Rejected"
+	err = t.saveContract(stub, contractObj)
+	if err != nil {
+		return nil, err
+	}
+
+	t.emitContractEvent(stub, "ContractStatusChanged", contractObj, previousStatus)
+	return nil, nil
+}
+
+// Binds the contract to the given offer version and marks it Accepted. The contract is saved.
+func (t *SimpleChaincode) acceptContract(stub shim.ChaincodeStubInterface, contractObj *contract, offerList []contractOffer, version int, acceptorID string, acceptDate int) error {
+	currentOffer := offerList[len(offerList)-1]
+	if version != currentOffer.Version || currentOffer.OfferStatus != "Open" {
+		return errors.New("Offer version " + strconv.Itoa(version) + " is not the open offer of contract " + strconv.Itoa(contractObj.ContractID))
+	}
+	if acceptorID == currentOffer.ProposerID {
+		return errors.New("Company " + acceptorID + " cannot accept its own offer")
+	}
+
+	contractObj.EnergyMWH = currentOffer.EnergyMWH
+	contractObj.EntryLocation = currentOffer.EntryLocation
+	contractObj.ContractStartDate = currentOffer.StartDate
+	contractObj.ContractEndDate = currentOffer.EndDate
+	pricing, err := t.agreedPricing(stub, *contractObj, currentOffer, acceptDate)
+	if err != nil {
+		return err
+	}
+	contractObj.Pricing = pricing
+
+	//Agreed terms may differ from the original request, so check credit again
+	err = t.checkCreditExposure(stub, *contractObj)
+	if err != nil {
+		return err
+	}
+
+	//The receiver must still have the capacity to deliver on every day of the contract
+	err = t.reserveContractCapacity(stub, contractObj)
+	if err != nil {
+		return err
+	}
+
+	offerList[len(offerList)-1].OfferStatus = "Accepted"
+	offerList[len(offerList)-1].OfferDateMS = acceptDate
+	err = t.saveOfferList(stub, strconv.Itoa(contractObj.ContractID), offerList)
+	if err != nil {
+		return err
+	}
+
+	contractObj.OfferVersion = currentOffer.Version
+	contractObj.AcceptedOfferVersion = currentOffer.Version
+	contractObj.ContractStatus = "Accepted"
+
+	return t.saveContract(stub, *contractObj)
+}
+
+// Status updates to Accepted bind to the current offer, accepted by the party that did not propose it.
+// Without an acceptance date the offer's own date is used, the initial terms have none.
+func (t *SimpleChaincode) acceptCurrentOffer(stub shim.ChaincodeStubInterface, contractObj *contract, acceptDate int) error {
+	var acceptorID string
+
+	loadedContract, offerList, err := t.loadNegotiation(stub, strconv.Itoa(contractObj.ContractID), contractObj.ReceiverID)
+	if err != nil {
+		return err
+	}
+
+	currentOffer := offerList[len(offerList)-1]
+	acceptorID = loadedContract.ReceiverID
+	if currentOffer.ProposerID == loadedContract.ReceiverID {
+		acceptorID = loadedContract.InitiatorID
+	}
+
+	if acceptDate == 0 {
+		acceptDate = currentOffer.OfferDateMS
+	}
+	if acceptDate == 0 {
+		return errors.New("Accepting contract " + strconv.Itoa(loadedContract.ContractID) + " needs the current date")
+	}
+
+	err = t.acceptContract(stub, &loadedContract, offerList, currentOffer.Version, acceptorID, acceptDate)
+	if err != nil {
+		return err
+	}
+
+	*contractObj = loadedContract
+	return nil
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var pointTypes = []string{"Entry", "Exit", "Interconnection", "Storage"}
+
+// Routes longer than this are not searched
+var maxRouteHops = 6
+
+type networkPoint struct {
+	PointID   string `json:"point_id"`
+	PointName string `json:"point_name"`
+	PointType string `json:"point_type"`
+}
+
+// Directed pipeline segment, tariff per MWh transported
+type pipelineSegment struct {
+	SegmentID     string  `json:"segment_id"`
+	FromPointID   string  `json:"from_point_id"`
+	ToPointID     string  `json:"to_point_id"`
+	TransporterID string  `json:"transporter_id"`
+	PlanID        string  `json:"plan_id"`
+	CapacityMWH   float64 `json:"capacity_mwh"`
+	Tariff        float64 `json:"tariff"`
+}
+
+type transportRoute struct {
+	PointIDs     []string `json:"point_ids"`
+	SegmentIDs   []string `json:"segment_ids"`
+	Transporters []string `json:"transporters"`
+	CostPerMWH   float64  `json:"cost_per_mwh"`
+	CapacityMWH  float64  `json:"capacity_mwh"`
+}
+
+// Cheapest first, fewer hops first at equal cost
+type routesByCost []transportRoute
+
+func (r routesByCost) Len() int      { return len(r) }
+func (r routesByCost) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r routesByCost) Less(i, j int) bool {
+	if r[i].CostPerMWH != r[j].CostPerMWH {
+		return r[i].CostPerMWH < r[j].CostPerMWH
+	}
+	return len(r[i].SegmentIDs) < len(r[j].SegmentIDs)
+}
+
+// Free-text locations such as "Bunder-Tief" map to the point BUNDER-TIEF
+func networkPointID(location string) string {
+	return strings.ToUpper(strings.TrimSpace(location))
+}
+
+func splitLocations(locations string) []string {
+	var locationList []string
+	for _, k := range strings.Split(locations, ",") {
+		if strings.TrimSpace(k) != "" {
+			locationList = append(locationList, strings.TrimSpace(k))
+		}
+	}
+	return locationList
+}
+
+func (t *SimpleChaincode) getNetworkPoint(stub shim.ChaincodeStubInterface, pointID string) (networkPoint, bool) {
+	var pointObj networkPoint
+
+	pointObjBytes, _ := stub.GetState(pointPrefix + pointID)
+	if pointObjBytes == nil {
+		return pointObj, false
+	}
+	_ = json.Unmarshal(pointObjBytes, &pointObj)
+	return pointObj, true
+}
+
+func (t *SimpleChaincode) saveNetworkPoint(stub shim.ChaincodeStubInterface, pointObj networkPoint) error {
+	var pointIDList []string
+
+	pointObjBytes, err := json.Marshal(&pointObj)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(pointPrefix+pointObj.PointID, pointObjBytes)
+	if err != nil {
+		return err
+	}
+
+	pointIDListBytes, _ := stub.GetState(networkPointKey)
+	_ = json.Unmarshal(pointIDListBytes, &pointIDList)
+	if !contains(pointIDList, pointObj.PointID) {
+		pointIDList = append(pointIDList, pointObj.PointID)
+		pointIDListBytes, _ = json.Marshal(&pointIDList)
+		_ = stub.PutState(networkPointKey, pointIDListBytes)
+		t.updateMasterKeyList(stub, []string{pointPrefix + pointObj.PointID})
+		t.updateMasterKeyList(stub, []string{networkPointKey})
+	}
+	return nil
+}
+
+func (t *SimpleChaincode) saveSegment(stub shim.ChaincodeStubInterface, segmentObj pipelineSegment) error {
+	var segmentIDList []string
+
+	segmentObjBytes, err := json.Marshal(&segmentObj)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(segmentPrefix+segmentObj.SegmentID, segmentObjBytes)
+	if err != nil {
+		return err
+	}
+
+	segmentIDListBytes, _ := stub.GetState(networkSegmentKey)
+	_ = json.Unmarshal(segmentIDListBytes, &segmentIDList)
+	if !contains(segmentIDList, segmentObj.SegmentID) {
+		segmentIDList = append(segmentIDList, segmentObj.SegmentID)
+		segmentIDListBytes, _ = json.Marshal(&segmentIDList)
+		_ = stub.PutState(networkSegmentKey, segmentIDListBytes)
+		t.updateMasterKeyList(stub, []string{segmentPrefix + segmentObj.SegmentID})
+		t.updateMasterKeyList(stub, []string{networkSegmentKey})
+	}
+	return nil
+}
+
+func (t *SimpleChaincode) getSegmentList(stub shim.ChaincodeStubInterface) []pipelineSegment {
+	var segmentIDList []string
+	var segmentList []pipelineSegment
+
+	segmentIDListBytes, _ := stub.GetState(networkSegmentKey)
+	_ = json.Unmarshal(segmentIDListBytes, &segmentIDList)
+
+	for _, k := range segmentIDList {
+		var segmentObj pipelineSegment
+		segmentObjBytes, _ := stub.GetState(segmentPrefix + k)
+		_ = json.Unmarshal(segmentObjBytes, &segmentObj)
+		segmentList = append(segmentList, segmentObj)
+	}
+	return segmentList
+}
+
+// Adds a point, or marks an existing point as an interconnection when it is used both ways
+func (t *SimpleChaincode) mergeNetworkPoint(stub shim.ChaincodeStubInterface, location string, pointType string) error {
+	pointID := networkPointID(location)
+
+	pointObj, found := t.getNetworkPoint(stub, pointID)
+	if !found {
+		return t.saveNetworkPoint(stub, networkPoint{PointID: pointID, PointName: location, PointType: pointType})
+	}
+	if pointObj.PointType == pointType || pointObj.PointType == "Interconnection" || pointObj.PointType == "Storage" {
+		return nil
+	}
+	pointObj.PointType = "Interconnection"
+	return t.saveNetworkPoint(stub, pointObj)
+}
+
+func (t *SimpleChaincode) addNetworkPoint(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Entered function addNetworkPoint()")
+
+	if len(args) < 2 {
+		return nil, errors.New("Incorrect number of arguments. 2 expected (Point Name, Point Type)")
+	}
+	if !contains(pointTypes, args[1]) {
+		return nil, errors.New("Unknown point type: " + args[1])
+	}
+	if networkPointID(args[0]) == "" {
+		return nil, errors.New("Point name must not be empty")
+	}
+
+	err := t.saveNetworkPoint(stub, networkPoint{PointID: networkPointID(args[0]), PointName: strings.TrimSpace(args[0]), PointType: args[1]})
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (t *SimpleChaincode) addPipelineSegment(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var transporterObj company
+	var capacity, tariff float64
+	var err error
+
+	fmt.Println("Entered function addPipelineSegment()")
+
+	if len(args) < 6 {
+		return nil, errors.New("Incorrect number of arguments. 6 expected (Segment ID, From Point, To Point, Transporter ID, Capacity MWh, Tariff per MWh) and optionally Plan ID")
+	}
+
+	transporterObjBytes, _ := stub.GetState(args[3])
+	_ = json.Unmarshal(transporterObjBytes, &transporterObj)
+	if transporterObj.CompanyType != "Transporter" {
+		return nil, errors.New("Pipeline segments are owned by transporters, " + args[3] + " is not a transporter")
+	}
+
+	fromPoint, foundFrom := t.getNetworkPoint(stub, networkPointID(args[1]))
+	toPoint, foundTo := t.getNetworkPoint(stub, networkPointID(args[2]))
+	if !foundFrom || !foundTo {
+		return nil, errors.New("Both points of a segment must exist: " + args[1] + ", " + args[2])
+	}
+	if fromPoint.PointID == toPoint.PointID {
+		return nil, errors.New("A segment must connect two different points")
+	}
+
+	capacity, err = strconv.ParseFloat(args[4], 64)
+	if err != nil || capacity < 0 {
+		return nil, errors.New("Invalid capacity: " + args[4])
+	}
+	tariff, err = strconv.ParseFloat(args[5], 64)
+	if err != nil || tariff < 0 {
+		return nil, errors.New("Invalid tariff: " + args[5])
+	}
+
+	segmentObj := pipelineSegment{SegmentID: args[0], FromPointID: fromPoint.PointID, ToPointID: toPoint.PointID, TransporterID: args[3], CapacityMWH: capacity, Tariff: tariff}
+	if len(args) > 6 {
+		segmentObj.PlanID = args[6]
+	}
+
+	err = t.saveSegment(stub, segmentObj)
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// Creates points and segments from the current transporter plans: every entry location of a plan is
+// connected to every exit location, with the plan's capacity and gas price as tariff. Producer exit
+// locations become entry points of the network. Running it again refreshes the segments.
+func (t *SimpleChaincode) buildNetworkFromPlans(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var planIDList []string
+	var count int
+
+	fmt.Println("Entered function buildNetworkFromPlans()")
+
+	planIDListBytes, _ := stub.GetState(planKey)
+	_ = json.Unmarshal(planIDListBytes, &planIDList)
+
+	for _, k := range planIDList {
+		var planObj businessPlan
+		var companyObj company
+
+		planObjBytes, _ := stub.GetState(k)
+		_ = json.Unmarshal(planObjBytes, &planObj)
+		companyObjBytes, _ := stub.GetState(planObj.CompanyID)
+		_ = json.Unmarshal(companyObjBytes, &companyObj)
+
+		if companyObj.CompanyType == "Producer" {
+			for _, location := range splitLocations(planObj.ExitLocation) {
+				err := t.mergeNetworkPoint(stub, location, "Entry")
+				if err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		if companyObj.CompanyType != "Transporter" {
+			continue
+		}
+
+		for _, location := range splitLocations(planObj.EntryLocation) {
+			err := t.mergeNetworkPoint(stub, location, "Entry")
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, location := range splitLocations(planObj.ExitLocation) {
+			err := t.mergeNetworkPoint(stub, location, "Exit")
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, entry := range splitLocations(planObj.EntryLocation) {
+			for _, exit := range splitLocations(planObj.ExitLocation) {
+				if networkPointID(entry) == networkPointID(exit) {
+					continue
+				}
+				segmentObj := pipelineSegment{SegmentID: k + "_" + networkPointID(entry) + "_" + networkPointID(exit), FromPointID: networkPointID(entry), ToPointID: networkPointID(exit),
+					TransporterID: planObj.CompanyID, PlanID: k, CapacityMWH: float64(planCapacity(planObj)), Tariff: planObj.GasPrice}
+				err := t.saveSegment(stub, segmentObj)
+				if err != nil {
+					return nil, err
+				}
+				count = count + 1
+			}
+		}
+	}
+
+	fmt.Println("Network segments built from plans: " + strconv.Itoa(count))
+	return nil, nil
+}
+
+// Capacity of a segment still free on a day, taking bookings on the transporter's plan into account
+func (t *SimpleChaincode) segmentCapacity(stub shim.ChaincodeStubInterface, segmentObj pipelineSegment, day string) float64 {
+	if day == "" || segmentObj.PlanID == "" {
+		return segmentObj.CapacityMWH
+	}
+
+	capacityObj := t.getCapacityDay(stub, segmentObj.PlanID, day)
+	available := capacityObj.CapacityMWH
+	for _, v := range capacityObj.Reservations {
+		available = available - v
+	}
+	return minFloat(segmentObj.CapacityMWH, available)
+}
+
+// Every simple path between two locations, cheapest first. Optional arguments limit routes to a delivery
+// day's free capacity and to a minimum capacity.
+func (t *SimpleChaincode) findTransportRoutes(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var returnMessage, day string
+	var minCapacity float64
+	var routeList []transportRoute
+
+	if len(args) < 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2 (From Location, To Location) and optionally Date, Minimum Capacity.")
+	}
+
+	fromPointID := networkPointID(args[0])
+	toPointID := networkPointID(args[1])
+	if len(args) > 2 && args[2] != "" {
+		date, err := parseDate(args[2])
+		if err != nil {
+			return nil, err
+		}
+		day = date.Format("2006-01-02")
+	}
+	if len(args) > 3 && args[3] != "" {
+		minCapacity, _ = strconv.ParseFloat(args[3], 64)
+	}
+
+	fmt.Println("Finding transport routes from " + fromPointID + " to " + toPointID)
+
+	//Outgoing segments per point with their capacity for the day
+	outgoing := map[string][]pipelineSegment{}
+	for _, segmentObj := range t.getSegmentList(stub) {
+		segmentObj.CapacityMWH = t.segmentCapacity(stub, segmentObj, day)
+		if segmentObj.CapacityMWH <= 0 || segmentObj.CapacityMWH < minCapacity {
+			continue
+		}
+		outgoing[segmentObj.FromPointID] = append(outgoing[segmentObj.FromPointID], segmentObj)
+	}
+
+	var walk func(route transportRoute, visited map[string]bool)
+	walk = func(route transportRoute, visited map[string]bool) {
+		current := route.PointIDs[len(route.PointIDs)-1]
+		if current == toPointID {
+			routeList = append(routeList, route)
+			return
+		}
+		if len(route.SegmentIDs) >= maxRouteHops {
+			return
+		}
+		for _, segmentObj := range outgoing[current] {
+			if visited[segmentObj.ToPointID] {
+				continue
+			}
+			next := transportRoute{
+				PointIDs:     append(append([]string{}, route.PointIDs...), segmentObj.ToPointID),
+				SegmentIDs:   append(append([]string{}, route.SegmentIDs...), segmentObj.SegmentID),
+				Transporters: append(append([]string{}, route.Transporters...), segmentObj.TransporterID),
+				CostPerMWH:   route.CostPerMWH + segmentObj.Tariff,
+				CapacityMWH:  segmentObj.CapacityMWH,
+			}
+			if len(route.SegmentIDs) > 0 {
+				next.CapacityMWH = minFloat(route.CapacityMWH, segmentObj.CapacityMWH)
+			}
+			visited[segmentObj.ToPointID] = true
+			walk(next, visited)
+			delete(visited, segmentObj.ToPointID)
+		}
+	}
+	if fromPointID != toPointID {
+		walk(transportRoute{PointIDs: []string{fromPointID}}, map[string]bool{fromPointID: true})
+	}
+
+	sort.Stable(routesByCost(routeList))
+	if routeList == nil {
+		routeList = []transportRoute{}
+	}
+
+	routeListBytes, err := json.Marshal(&routeList)
+	if err != nil {
+		return nil, err
+	}
+
+	returnMessage = "{\"statusCode\" : \"SUCCESS\", \"body\" : " + string(routeListBytes) + "}"
+	return []byte(returnMessage), nil
+}
+
+// Points and segments of the network
+func (t *SimpleChaincode) getNetwork(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	var returnMessage string
+	var pointIDList []string
+	var pointList = []networkPoint{}
+	var segmentList = []pipelineSegment{}
+
+	pointIDListBytes, _ := stub.GetState(networkPointKey)
+	_ = json.Unmarshal(pointIDListBytes, &pointIDList)
+	for _, k := range pointIDList {
+		pointObj, _ := t.getNetworkPoint(stub, k)
+		pointList = append(pointList, pointObj)
+	}
+
+	pointListBytes, _ := json.Marshal(&pointList)
+	segmentList = append(segmentList, t.getSegmentList(stub)...)
+	segmentListBytes, _ := json.Marshal(&segmentList)
+
+	returnMessage = "{\"statusCode\" : \"SUCCESS\", \"body\" : {\"points\" : " + string(pointListBytes) + ", \"segments\" : " + string(segmentListBytes) + "}}"
+	return []byte(returnMessage), nil
+}
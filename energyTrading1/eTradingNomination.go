@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Renominations close this many minutes before the gas day (or hour) starts unless configured otherwise
+var defaultGateClosureMinutes = 60
+
+type nominationConfig struct {
+	GateClosureMinutes int `json:"gate_closure_minutes"`
+}
+
+type nominationChange struct {
+	Status       string  `json:"status"`
+	CompanyID    string  `json:"company_id"`
+	EnergyMWH    float64 `json:"energy_mwh"`
+	Comments     string  `json:"comments"`
+	ChangeDateMS int     `json:"change_date_ms"`
+}
+
+// Quantity nominated by the shipper for a gas day, or one hour of it (Hour -1 for the whole day)
+type nomination struct {
+	NominationID     string             `json:"nomination_id"`
+	ContractID       int                `json:"contract_id"`
+	Day              string             `json:"day"`
+	Hour             int                `json:"hour"`
+	NominatedMWH     float64            `json:"nominated_mwh"`
+	ConfirmedMWH     float64            `json:"confirmed_mwh"`
+	NominationStatus string             `json:"nomination_status"`
+	Version          int                `json:"version"`
+	History          []nominationChange `json:"history"`
+}
+
+func (t *SimpleChaincode) getNominationConfig(stub shim.ChaincodeStubInterface) nominationConfig {
+	var configObj = nominationConfig{GateClosureMinutes: defaultGateClosureMinutes}
+
+	configObjBytes, _ := stub.GetState(nominationConfigKey)
+	if configObjBytes != nil {
+		_ = json.Unmarshal(configObjBytes, &configObj)
+	}
+	return configObj
+}
+
+func (t *SimpleChaincode) setNominationConfig(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var configObj nominationConfig
+
+	fmt.Println("Entered function setNominationConfig()")
+
+	if len(args) < 1 {
+		return nil, errors.New("Incorrect number of arguments. 1 expected (Gate Closure Minutes before the start of the gas day or hour)")
+	}
+
+	minutes, err := strconv.Atoi(args[0])
+	if err != nil || minutes < 0 {
+		return nil, errors.New("Invalid gate closure: " + args[0])
+	}
+	configObj.GateClosureMinutes = minutes
+
+	configObjBytes, _ := json.Marshal(&configObj)
+	err = stub.PutState(nominationConfigKey, configObjBytes)
+	if err != nil {
+		return nil, err
+	}
+	t.updateMasterKeyList(stub, []string{nominationConfigKey})
+
+	return nil, nil
+}
+
+func nominationID(contractIDStr string, day string, hour int) string {
+	if hour < 0 {
+		return contractIDStr + "_NOM_" + day
+	}
+	return contractIDStr + "_NOM_" + day + "_" + fmt.Sprintf("%02d", hour)
+}
+
+// Start of the delivery period of a nomination in milliseconds
+func nominationStartMS(nominationObj nomination) int {
+	start, _ := time.Parse("2006-01-02", nominationObj.Day)
+	if nominationObj.Hour > 0 {
+		start = start.Add(time.Duration(nominationObj.Hour) * time.Hour)
+	}
+	return int(start.Unix() * 1000)
+}
+
+func (t *SimpleChaincode) getNominationList(stub shim.ChaincodeStubInterface, contractIDStr string) []nomination {
+	var nominationIDList []string
+	var nominationList []nomination
+
+	nominationIDListBytes, _ := stub.GetState(contractIDStr + nominationAffix)
+	_ = json.Unmarshal(nominationIDListBytes, &nominationIDList)
+
+	for _, k := range nominationIDList {
+		var nominationObj nomination
+		nominationObjBytes, _ := stub.GetState(k)
+		_ = json.Unmarshal(nominationObjBytes, &nominationObj)
+		nominationList = append(nominationList, nominationObj)
+	}
+	return nominationList
+}
+
+func (t *SimpleChaincode) saveNomination(stub shim.ChaincodeStubInterface, nominationObj nomination, isNew bool) error {
+	var nominationIDList []string
+
+	nominationObjBytes, err := json.Marshal(&nominationObj)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(nominationObj.NominationID, nominationObjBytes)
+	if err != nil {
+		return err
+	}
+	if !isNew {
+		return nil
+	}
+
+	var arrKey = strconv.Itoa(nominationObj.ContractID) + nominationAffix
+	nominationIDListBytes, _ := stub.GetState(arrKey)
+	_ = json.Unmarshal(nominationIDListBytes, &nominationIDList)
+	nominationIDList = append(nominationIDList, nominationObj.NominationID)
+	nominationIDListBytes, _ = json.Marshal(&nominationIDList)
+	_ = stub.PutState(arrKey, nominationIDListBytes)
+
+	t.updateMasterKeyList(stub, []string{nominationObj.NominationID})
+	t.updateMasterKeyList(stub, []string{arrKey})
+	return nil
+}
+
+// The shipper nominates a quantity for a gas day or hour of an accepted contract. Nominating again
+// before gate closure is a renomination and needs a new confirmation.
+func (t *SimpleChaincode) submitNomination(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var contractObj contract
+	var nominationObj nomination
+	var hour = -1
+	var currentDate int
+	var energyMWH, nominatedTotal float64
+	var isNew bool
+
+	fmt.Println("Entered function submitNomination()")
+
+	if len(args) < 6 {
+		return nil, errors.New("Incorrect number of arguments. 6 expected (Contract ID, Shipper ID, Gas Day, Hour or empty for the whole day, Energy MWh, Current Date in MilliSecs)")
+	}
+
+	contractObjBytes, _ := stub.GetState(args[0])
+	if contractObjBytes == nil {
+		return nil, errors.New("Contract not found: " + args[0])
+	}
+	_ = json.Unmarshal(contractObjBytes, &contractObj)
+
+	if contractObj.ContractStatus != "Accepted" {
+		return nil, errors.New("Only accepted contracts can be nominated, contract " + args[0] + " is " + contractObj.ContractStatus)
+	}
+	if args[1] != contractObj.InitiatorID {
+		return nil, errors.New("Only " + contractObj.InitiatorID + " can nominate on contract " + args[0])
+	}
+
+	date, err := parseDate(args[2])
+	if err != nil {
+		return nil, err
+	}
+	day := date.Format("2006-01-02")
+	days, err := contractDays(contractObj)
+	if err != nil {
+		return nil, err
+	}
+	if !contains(days, day) {
+		return nil, errors.New(day + " is outside the delivery period of contract " + args[0])
+	}
+
+	if args[3] != "" {
+		hour, err = strconv.Atoi(args[3])
+		if err != nil || hour < 0 || hour > 23 {
+			return nil, errors.New("Invalid hour: " + args[3])
+		}
+	}
+	energyMWH, err = strconv.ParseFloat(args[4], 64)
+	if err != nil || energyMWH < 0 {
+		return nil, errors.New("Invalid nomination quantity: " + args[4])
+	}
+	currentDate, _ = strconv.Atoi(args[5])
+
+	//A day is nominated either as a whole or by the hour, and all nominations together stay within the contract
+	for _, k := range t.getNominationList(stub, args[0]) {
+		if k.Day == day && k.Hour < 0 && hour >= 0 {
+			return nil, errors.New(day + " is already nominated for the whole day")
+		}
+		if k.Day == day && k.Hour >= 0 && hour < 0 {
+			return nil, errors.New(day + " is already nominated by the hour")
+		}
+		if k.NominationID != nominationID(args[0], day, hour) {
+			nominatedTotal = nominatedTotal + k.NominatedMWH
+		}
+	}
+	if nominatedTotal+energyMWH > contractObj.EnergyMWH {
+		return nil, errors.New("Nominations would exceed the " + strconv.FormatFloat(contractObj.EnergyMWH, 'f', -1, 64) + " MWh of contract " + args[0])
+	}
+
+	nominationObjBytes, _ := stub.GetState(nominationID(args[0], day, hour))
+	if nominationObjBytes == nil {
+		isNew = true
+		nominationObj = nomination{NominationID: nominationID(args[0], day, hour), ContractID: contractObj.ContractID, Day: day, Hour: hour}
+	} else {
+		_ = json.Unmarshal(nominationObjBytes, &nominationObj)
+	}
+
+	gateClosure := nominationStartMS(nominationObj) - t.getNominationConfig(stub).GateClosureMinutes*60*1000
+	if currentDate >= gateClosure {
+		return nil, errors.New("Gate closure for " + nominationObj.NominationID + " has passed")
+	}
+
+	nominationObj.NominatedMWH = energyMWH
+	nominationObj.ConfirmedMWH = 0
+	nominationObj.NominationStatus = "Submitted"
+	nominationObj.Version = nominationObj.Version + 1
+	var changeStatus = "Submitted"
+	if nominationObj.Version > 1 {
+		changeStatus = "Renominated"
+	}
+	nominationObj.History = append(nominationObj.History, nominationChange{Status: changeStatus, CompanyID: args[1], EnergyMWH: energyMWH, ChangeDateMS: currentDate})
+
+	err = t.saveNomination(stub, nominationObj, isNew)
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// The receiver confirms a nomination in full or curtails it to a lower quantity
+func (t *SimpleChaincode) confirmNomination(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var contractObj contract
+	var nominationObj nomination
+	var confirmedMWH float64
+	var currentDate int
+
+	fmt.Println("Entered function confirmNomination()")
+
+	if len(args) < 5 {
+		return nil, errors.New("Incorrect number of arguments. 5 expected (Nomination ID, Receiver ID, Confirmed MWh, Comments, Current Date in MilliSecs)")
+	}
+
+	nominationObjBytes, _ := stub.GetState(args[0])
+	if nominationObjBytes == nil {
+		return nil, errors.New("Nomination not found: " + args[0])
+	}
+	_ = json.Unmarshal(nominationObjBytes, &nominationObj)
+
+	contractObjBytes, _ := stub.GetState(strconv.Itoa(nominationObj.ContractID))
+	_ = json.Unmarshal(contractObjBytes, &contractObj)
+	if args[1] != contractObj.ReceiverID {
+		return nil, errors.New("Only " + contractObj.ReceiverID + " can confirm nominations on contract " + strconv.Itoa(contractObj.ContractID))
+	}
+	if nominationObj.NominationStatus != "Submitted" {
+		return nil, errors.New("Nomination " + args[0] + " is already " + nominationObj.NominationStatus)
+	}
+
+	confirmedMWH, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || confirmedMWH < 0 || confirmedMWH > nominationObj.NominatedMWH {
+		return nil, errors.New("Confirmed quantity must be between 0 and the nominated " + strconv.FormatFloat(nominationObj.NominatedMWH, 'f', -1, 64) + " MWh")
+	}
+	currentDate, _ = strconv.Atoi(args[4])
+
+	nominationObj.ConfirmedMWH = confirmedMWH
+	nominationObj.NominationStatus = "Confirmed"
+	if confirmedMWH < nominationObj.NominatedMWH {
+		nominationObj.NominationStatus = "Curtailed"
+	}
+	nominationObj.History = append(nominationObj.History, nominationChange{Status: nominationObj.NominationStatus, CompanyID: args[1], EnergyMWH: confirmedMWH, Comments: args[3], ChangeDateMS: currentDate})
+
+	err = t.saveNomination(stub, nominationObj, false)
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// Quantity a flow reading is checked against: the confirmed nomination of its gas day or hour. Contracts
+// without any nominations are checked against the contract total. Returns false when nothing was
+// confirmed for the period of the reading.
+func (t *SimpleChaincode) expectedDelivery(stub shim.ChaincodeStubInterface, contractObj contract, timestampMS int) (float64, bool) {
+	var confirmedMWH float64
+	var found bool
+
+	nominationList := t.getNominationList(stub, strconv.Itoa(contractObj.ContractID))
+	if len(nominationList) == 0 {
+		return contractObj.EnergyMWH, true
+	}
+
+	readingTime := time.Unix(int64(timestampMS)/1000, 0).UTC()
+	day := readingTime.Format("2006-01-02")
+	for _, k := range nominationList {
+		if k.Day != day || k.Hour >= 0 && k.Hour != readingTime.Hour() {
+			continue
+		}
+		if k.NominationStatus == "Confirmed" || k.NominationStatus == "Curtailed" {
+			confirmedMWH = confirmedMWH + k.ConfirmedMWH
+			found = true
+		}
+	}
+	return confirmedMWH, found
+}
+
+// Nominations of a contract, optionally limited to a period of gas days
+func (t *SimpleChaincode) getNominations(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var returnMessage string
+	var nominationList []nomination
+
+	if len(args) < 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1 (Contract ID) and optionally From Date, To Date.")
+	}
+
+	fromDay, toDay, err := parseEffectivePeriod(args[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	nominationList = []nomination{}
+	for _, k := range t.getNominationList(stub, args[0]) {
+		if fromDay != "" && k.Day < fromDay || toDay != "" && k.Day > toDay {
+			continue
+		}
+		nominationList = append(nominationList, k)
+	}
+
+	nominationListBytes, _ := json.Marshal(nominationList)
+	returnMessage = "{\"statusCode\" : \"SUCCESS\", \"body\" : " + string(nominationListBytes) + "}"
+	return []byte(returnMessage), nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var msDatePattern = regexp.MustCompile(`^[0-9]+$`)
+
+// Filters of getBusinessPlanList, zero values mean no filter. MinCapacity applies to the capacity still available
+// for booking on the days from FromDay to ToDay.
+type planFilter struct {
+	Location    string
+	MinPrice    float64
+	MaxPrice    float64
+	MinCapacity int
+	FromDay     string
+	ToDay       string
+}
+
+// Parses a date given as YYYY-MM-DD, d/m/yyyy (the format of plan and contract dates) or milliseconds
+func parseDate(dateStr string) (time.Time, error) {
+	dateStr = strings.TrimSpace(dateStr)
+
+	if msDatePattern.MatchString(dateStr) {
+		ms, _ := strconv.ParseInt(dateStr, 10, 64)
+		return time.Unix(ms/1000, 0).UTC(), nil
+	}
+	if date, err := time.Parse("2006-01-02", dateStr); err == nil {
+		return date, nil
+	}
+	if date, err := time.Parse("2/1/2006", dateStr); err == nil {
+		return date, nil
+	}
+	return time.Time{}, errors.New("Invalid date: " + dateStr)
+}
+
+// Effective From and Effective To as YYYY-MM-DD; missing or empty values leave that end of the period open
+func parseEffectivePeriod(args []string) (string, string, error) {
+	var period [2]string
+
+	for i := 0; i < len(args) && i < 2; i++ {
+		if args[i] == "" {
+			continue
+		}
+		date, err := parseDate(args[i])
+		if err != nil {
+			return "", "", err
+		}
+		period[i] = date.Format("2006-01-02")
+	}
+	if period[0] != "" && period[1] != "" && period[1] < period[0] {
+		return "", "", errors.New("Effective To " + period[1] + " is before Effective From " + period[0])
+	}
+	return period[0], period[1], nil
+}
+
+func parsePlanFilter(args []string) (planFilter, error) {
+	var filter planFilter
+	var err error
+
+	if len(args) > 0 {
+		filter.Location = strings.TrimSpace(args[0])
+	}
+	if len(args) > 1 && args[1] != "" {
+		filter.MinPrice, err = strconv.ParseFloat(args[1], 64)
+		if err != nil {
+			return filter, errors.New("Invalid minimum price: " + args[1])
+		}
+	}
+	if len(args) > 2 && args[2] != "" {
+		filter.MaxPrice, err = strconv.ParseFloat(args[2], 64)
+		if err != nil {
+			return filter, errors.New("Invalid maximum price: " + args[2])
+		}
+	}
+	if len(args) > 3 && args[3] != "" {
+		filter.MinCapacity, err = strconv.Atoi(args[3])
+		if err != nil {
+			return filter, errors.New("Invalid minimum capacity: " + args[3])
+		}
+	}
+	if len(args) > 4 {
+		filter.FromDay, filter.ToDay, err = parseEffectivePeriod(args[4:])
+		if err != nil {
+			return filter, err
+		}
+	}
+	return filter, nil
+}
+
+func (filter planFilter) matches(planObj businessPlan, availableMWH float64) bool {
+	if filter.Location != "" && !planHasLocation(planObj, filter.Location) {
+		return false
+	}
+	if filter.MinPrice > 0 && planObj.GasPrice < filter.MinPrice {
+		return false
+	}
+	if filter.MaxPrice > 0 && planObj.GasPrice > filter.MaxPrice {
+		return false
+	}
+	if filter.MinCapacity > 0 && availableMWH < float64(filter.MinCapacity) {
+		return false
+	}
+	return true
+}
+
+// Locations are comma separated lists such as "Bunder-Tief, Steinbrink"
+func planHasLocation(planObj businessPlan, location string) bool {
+	for _, k := range strings.Split(planObj.EntryLocation+","+planObj.ExitLocation, ",") {
+		if strings.EqualFold(strings.TrimSpace(k), location) {
+			return true
+		}
+	}
+	return false
+}
+
+// Capacity a plan can deliver: gas has to enter and leave, so the smaller of the two
+func planCapacity(planObj businessPlan) int {
+	if planObj.ExitCapacity < planObj.EntryCapacity {
+		return planObj.ExitCapacity
+	}
+	return planObj.EntryCapacity
+}
+
+func planInEffect(planObj businessPlan, day string) bool {
+	return (planObj.EffectiveFrom == "" || planObj.EffectiveFrom <= day) && (planObj.EffectiveTo == "" || day <= planObj.EffectiveTo)
+}
+
+// Numbers the plan as the next version, stores the version and adds the plan to its company's plan list
+func (t *SimpleChaincode) addPlanVersion(stub shim.ChaincodeStubInterface, planObj *businessPlan) error {
+	var versionList, planIDList []string
+	var versionKey string
+
+	var arrKey = planObj.PlanID + planVersionAffix
+	versionListBytes, _ := stub.GetState(arrKey)
+	_ = json.Unmarshal(versionListBytes, &versionList)
+
+	planObj.Version = len(versionList) + 1
+	versionKey = planObj.PlanID + "_V" + strconv.Itoa(planObj.Version)
+
+	planObjBytes, err := json.Marshal(planObj)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(versionKey, planObjBytes)
+	if err != nil {
+		return err
+	}
+
+	versionList = append(versionList, versionKey)
+	versionListBytes, _ = json.Marshal(&versionList)
+	_ = stub.PutState(arrKey, versionListBytes)
+	t.updateMasterKeyList(stub, []string{versionKey})
+	t.updateMasterKeyList(stub, []string{arrKey})
+
+	var companyArrKey = planObj.CompanyID + planListAffix
+	planIDListBytes, _ := stub.GetState(companyArrKey)
+	_ = json.Unmarshal(planIDListBytes, &planIDList)
+	if !contains(planIDList, planObj.PlanID) {
+		planIDList = append(planIDList, planObj.PlanID)
+		planIDListBytes, _ = json.Marshal(&planIDList)
+		_ = stub.PutState(companyArrKey, planIDListBytes)
+		t.updateMasterKeyList(stub, []string{companyArrKey})
+	}
+
+	return nil
+}
+
+func (t *SimpleChaincode) getPlanVersionList(stub shim.ChaincodeStubInterface, planID string) []businessPlan {
+	var versionList []string
+	var planList []businessPlan
+
+	versionListBytes, _ := stub.GetState(planID + planVersionAffix)
+	_ = json.Unmarshal(versionListBytes, &versionList)
+
+	for _, k := range versionList {
+		var planObj businessPlan
+		planObjBytes, _ := stub.GetState(k)
+		_ = json.Unmarshal(planObjBytes, &planObj)
+		planList = append(planList, planObj)
+	}
+
+	//Plans stored before versioning only exist under their plan ID
+	if len(planList) == 0 {
+		var planObj businessPlan
+		planObjBytes, _ := stub.GetState(planID)
+		if planObjBytes != nil {
+			_ = json.Unmarshal(planObjBytes, &planObj)
+			planList = append(planList, planObj)
+		}
+	}
+
+	return planList
+}
+
+// The latest version of a plan whose effective period covers the day (YYYY-MM-DD)
+func (t *SimpleChaincode) getPlanInEffect(stub shim.ChaincodeStubInterface, planID string, day string) (businessPlan, bool) {
+	planList := t.getPlanVersionList(stub, planID)
+
+	for i := len(planList) - 1; i >= 0; i-- {
+		if planInEffect(planList[i], day) {
+			return planList[i], true
+		}
+	}
+	return businessPlan{}, false
+}
+
+func (t *SimpleChaincode) getCompanyPlanIDs(stub shim.ChaincodeStubInterface, companyID string) []string {
+	var planIDList []string
+
+	planIDListBytes, _ := stub.GetState(companyID + planListAffix)
+	_ = json.Unmarshal(planIDListBytes, &planIDList)
+
+	if len(planIDList) == 0 {
+		planObjBytes, _ := stub.GetState(companyID + planIDAffix)
+		if planObjBytes != nil {
+			planIDList = append(planIDList, companyID+planIDAffix)
+		}
+	}
+	return planIDList
+}
+
+// Plans of a company in effect on a date, optionally only those serving a location
+func (t *SimpleChaincode) getBusinessPlanInEffect(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var returnMessage, location string
+	var planList []businessPlan
+
+	if len(args) < 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2 (Company ID, Date) and optionally Location.")
+	}
+	if len(args) > 2 {
+		location = args[2]
+	}
+
+	date, err := parseDate(args[1])
+	if err != nil {
+		return nil, err
+	}
+	day := date.Format("2006-01-02")
+
+	fmt.Println("Getting business plans of " + args[0] + " in effect on " + day)
+
+	for _, k := range t.getCompanyPlanIDs(stub, args[0]) {
+		planObj, found := t.getPlanInEffect(stub, k, day)
+		if !found || location != "" && !planHasLocation(planObj, location) {
+			continue
+		}
+		planList = append(planList, planObj)
+	}
+	if planList == nil {
+		planList = []businessPlan{}
+	}
+
+	planListBytes, err := json.Marshal(&planList)
+	if err != nil {
+		return nil, err
+	}
+
+	returnMessage = "{\"statusCode\" : \"SUCCESS\", \"body\" : " + string(planListBytes) + "}"
+	return []byte(returnMessage), nil
+}
+
+// All versions of a plan, oldest first
+func (t *SimpleChaincode) getBusinessPlanHistory(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var returnMessage string
+
+	if len(args) < 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1 (Plan ID).")
+	}
+
+	planList := t.getPlanVersionList(stub, args[0])
+	if len(planList) == 0 {
+		returnMessage = "{\"statusCode\" : \"FAIL\", \"body\" : \"Business plan not found: " + args[0] + "\"}"
+		return []byte(returnMessage), nil
+	}
+
+	planListBytes, err := json.Marshal(&planList)
+	if err != nil {
+		return nil, err
+	}
+
+	returnMessage = "{\"statusCode\" : \"SUCCESS\", \"body\" : " + string(planListBytes) + "}"
+	return []byte(returnMessage), nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Price terms agreed on a contract.
+// Fixed: FixedPrice per MWh. Index: index value of the delivery day plus Spread.
+// Tiered: each tier prices the volume up to UpToMWH (cumulative over the contract), the last tier may leave UpToMWH at 0 for no limit.
+type contractPricing struct {
+	PriceType  string      `json:"price_type"`
+	FixedPrice float64     `json:"fixed_price"`
+	IndexName  string      `json:"index_name"`
+	Spread     float64     `json:"spread"`
+	Tiers      []priceTier `json:"tiers"`
+}
+
+type priceTier struct {
+	UpToMWH float64 `json:"up_to_mwh"`
+	Price   float64 `json:"price"`
+}
+
+// Value of an index for a day. Reference indexes computed from trades also carry their trade statistics.
+type priceIndexValue struct {
+	IndexName      string  `json:"index_name"`
+	Day            string  `json:"day"`
+	Price          float64 `json:"price"`
+	Location       string  `json:"location,omitempty"`
+	HighPrice      float64 `json:"high_price,omitempty"`
+	LowPrice       float64 `json:"low_price,omitempty"`
+	VolumeMWH      float64 `json:"volume_mwh,omitempty"`
+	TradeCount     int     `json:"trade_count,omitempty"`
+	ComputedDateMS int     `json:"computed_date_ms,omitempty"`
+}
+
+// Converts a timestamp in milliseconds to its UTC delivery day (YYYY-MM-DD)
+func msToDay(ms int) string {
+	return time.Unix(int64(ms)/1000, 0).UTC().Format("2006-01-02")
+}
+
+func validatePricing(pricing contractPricing) error {
+	if pricing.PriceType == "Fixed" {
+		if pricing.FixedPrice < 0 {
+			return errors.New("Fixed price must not be negative")
+		}
+	} else if pricing.PriceType == "Index" {
+		if pricing.IndexName == "" {
+			return errors.New("Index-linked pricing needs an index name")
+		}
+	} else if pricing.PriceType == "Tiered" {
+		if len(pricing.Tiers) == 0 {
+			return errors.New("Tiered pricing needs at least one tier")
+		}
+		for i, tier := range pricing.Tiers {
+			if tier.Price < 0 {
+				return errors.New("Tier prices must not be negative")
+			}
+			if i < len(pricing.Tiers)-1 && (tier.UpToMWH <= 0 || pricing.Tiers[i+1].UpToMWH != 0 && pricing.Tiers[i+1].UpToMWH <= tier.UpToMWH) {
+				return errors.New("Tier volumes must be increasing, only the last tier may be unbounded")
+			}
+		}
+	} else {
+		return errors.New("Unknown price type: " + pricing.PriceType)
+	}
+	return nil
+}
+
+// Business plan a contract is priced from: the version in effect on the day (YYYY-MM-DD) of the plan named
+// on the contract, otherwise of the receiver's main plan
+func (t *SimpleChaincode) pricingPlan(stub shim.ChaincodeStubInterface, contractObj contract, day string) (businessPlan, error) {
+	if contractObj.PlanID != "" {
+		planInEffectObj, found := t.getPlanInEffect(stub, contractObj.PlanID, day)
+		if found {
+			return planInEffectObj, nil
+		}
+	}
+
+	planInEffectObj, found := t.getPlanInEffect(stub, contractObj.ReceiverID+planIDAffix, day)
+	if !found {
+		return businessPlan{}, errors.New("No business plan of " + contractObj.ReceiverID + " in effect on " + day)
+	}
+	return planInEffectObj, nil
+}
+
+// Price terms captured at acceptance: the full pricing of the accepted offer, the gas price it quoted,
+// or otherwise the gas price of the contract's business plan at the time of acceptance.
+func (t *SimpleChaincode) agreedPricing(stub shim.ChaincodeStubInterface, contractObj contract, acceptedOffer contractOffer, acceptDate int) (contractPricing, error) {
+	if acceptedOffer.Pricing.PriceType != "" {
+		return acceptedOffer.Pricing, nil
+	}
+	if acceptedOffer.GasPrice > 0 {
+		return contractPricing{PriceType: "Fixed", FixedPrice: acceptedOffer.GasPrice}, nil
+	}
+
+	planObj, err := t.pricingPlan(stub, contractObj, msToDay(acceptDate))
+	if err != nil {
+		return contractPricing{}, err
+	}
+	return contractPricing{PriceType: "Fixed", FixedPrice: planObj.GasPrice}, nil
+}
+
+// Amount for energyMWH delivered after alreadyMWH of the contract has been invoiced.
+// Index prices are taken for the given day, or the latest published day when day is empty.
+func (t *SimpleChaincode) priceEnergy(stub shim.ChaincodeStubInterface, pricing contractPricing, alreadyMWH float64, energyMWH float64, day string) (float64, error) {
+	var amount, lowerMWH, volume float64
+
+	if pricing.PriceType == "Fixed" {
+		return energyMWH * pricing.FixedPrice, nil
+	} else if pricing.PriceType == "Index" {
+		indexPrice, err := t.lookupIndexPrice(stub, pricing.IndexName, day)
+		if err != nil {
+			return 0, err
+		}
+		return energyMWH * (indexPrice + pricing.Spread), nil
+	} else if pricing.PriceType == "Tiered" {
+		var from = alreadyMWH
+		var to = alreadyMWH + energyMWH
+
+		lowerMWH = 0
+		for i, tier := range pricing.Tiers {
+			var upper = tier.UpToMWH
+			if upper == 0 || i == len(pricing.Tiers)-1 && upper < to {
+				upper = to
+			}
+			//Volume of this delivery that falls in [lowerMWH, upper)
+			volume = minFloat(to, upper) - maxFloat(from, lowerMWH)
+			if volume > 0 {
+				amount = amount + volume*tier.Price
+			}
+			lowerMWH = upper
+		}
+		return amount, nil
+	}
+
+	return 0, errors.New("Unknown price type: " + pricing.PriceType)
+}
+
+// Sets energy, unit price and amount of a new invoice from the contract's price terms
+func (t *SimpleChaincode) priceInvoice(stub shim.ChaincodeStubInterface, contractObj contract, invoiceObj *invoice) error {
+	var alreadyMWH float64
+
+	if contractObj.Pricing.PriceType == "" {
+		//Contracts accepted before contract pricing keep using their business plan
+		planObj, err := t.pricingPlan(stub, contractObj, msToDay(invoiceObj.InvoiceDateMS))
+		if err != nil {
+			return err
+		}
+		invoiceObj.UnitPrice = planObj.GasPrice
+		invoiceObj.Amount = invoiceObj.EnergyMWH * planObj.GasPrice
+		return nil
+	}
+
+	invoiceList, _ := t.getInvoiceIncidentList(stub, strconv.Itoa(contractObj.ContractID))
+	for _, k := range invoiceList {
+		alreadyMWH = alreadyMWH + k.EnergyMWH
+	}
+
+	amount, err := t.priceEnergy(stub, contractObj.Pricing, alreadyMWH, invoiceObj.EnergyMWH, msToDay(invoiceObj.InvoiceDateMS))
+	if err != nil {
+		return err
+	}
+
+	invoiceObj.Amount = amount
+	if invoiceObj.EnergyMWH > 0 {
+		invoiceObj.UnitPrice = amount / invoiceObj.EnergyMWH
+	}
+	return nil
+}
+
+func minFloat(a float64, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxFloat(a float64, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Value of an index on a day, falling back to the latest earlier day
+func (t *SimpleChaincode) lookupIndexPrice(stub shim.ChaincodeStubInterface, indexName string, day string) (float64, error) {
+	var dayList []string
+	var indexObj priceIndexValue
+	var foundDay string
+
+	dayListBytes, _ := stub.GetState(indexPrefix + indexName + indexDayAffix)
+	_ = json.Unmarshal(dayListBytes, &dayList)
+
+	for _, k := range dayList {
+		if (day == "" || k <= day) && k > foundDay {
+			foundDay = k
+		}
+	}
+	if foundDay == "" {
+		return 0, errors.New("No value of index " + indexName + " published on or before " + day)
+	}
+
+	indexObjBytes, _ := stub.GetState(indexPrefix + indexName + "_" + foundDay)
+	_ = json.Unmarshal(indexObjBytes, &indexObj)
+
+	return indexObj.Price, nil
+}
+
+// Stores an index value for a day so index-linked contracts can be priced against it
+func (t *SimpleChaincode) savePriceIndexValue(stub shim.ChaincodeStubInterface, indexObj priceIndexValue) error {
+	var dayList []string
+
+	indexObjBytes, err := json.Marshal(&indexObj)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(indexPrefix+indexObj.IndexName+"_"+indexObj.Day, indexObjBytes)
+	if err != nil {
+		return err
+	}
+
+	var arrKey = indexPrefix + indexObj.IndexName + indexDayAffix
+	dayListBytes, _ := stub.GetState(arrKey)
+	if dayListBytes != nil {
+		_ = json.Unmarshal(dayListBytes, &dayList)
+	}
+	if !contains(dayList, indexObj.Day) {
+		dayList = append(dayList, indexObj.Day)
+		sort.Strings(dayList)
+	}
+	dayListBytes, _ = json.Marshal(&dayList)
+	_ = stub.PutState(arrKey, dayListBytes)
+
+	idList := []string{indexPrefix + indexObj.IndexName + "_" + indexObj.Day, arrKey}
+	t.updateMasterKeyList(stub, idList)
+
+	return nil
+}
+
+func (t *SimpleChaincode) setIndexPrice(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var price float64
+
+	fmt.Println("Entered function setIndexPrice()")
+
+	if len(args) < 3 {
+		return nil, errors.New("Incorrect number of arguments. 3 expected (Index Name, Day as YYYY-MM-DD, Price)")
+	}
+
+	_, err := time.Parse("2006-01-02", args[1])
+	if err != nil {
+		return nil, errors.New("Invalid day, expecting YYYY-MM-DD: " + args[1])
+	}
+	price, err = strconv.ParseFloat(args[2], 64)
+	if err != nil {
+		return nil, errors.New("Invalid index price: " + args[2])
+	}
+
+	err = t.savePriceIndexValue(stub, priceIndexValue{IndexName: args[0], Day: args[1], Price: price})
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (t *SimpleChaincode) getIndexPrice(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var returnMessage, day string
+
+	if len(args) < 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1 (Index Name) or 2 (Index Name, Day as YYYY-MM-DD).")
+	}
+	if len(args) > 1 {
+		day = args[1]
+	}
+
+	price, err := t.lookupIndexPrice(stub, args[0], day)
+	if err != nil {
+		returnMessage = "{\"statusCode\" : \"FAIL\", \"body\" : \"" + err.Error() + "\"}"
+		return []byte(returnMessage), nil
+	}
+
+	returnMessage = "{\"statusCode\" : \"SUCCESS\", \"body\" : {\"index_name\" : \"" + args[0] + "\", \"day\" : \"" + day + "\", \"price\" : " + strconv.FormatFloat(price, 'f', -1, 64) + "}}"
+	return []byte(returnMessage), nil
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// A reset works from a scan of the whole state rather than ALLKEYS, so keys that were never put on the master
+// list are removed as well. Scopes:
+//
+//	all               every key, then the network is bootstrapped again with the document it started with
+//	iot               the flow-meter readings of all companies
+//	contracts         contracts and what was issued on them: offers, invoices, incidents, disputes, credit notes,
+//	                  nominations, margin calls, deals, settlements and capacity bookings
+//	company:<ID>      the company, its users, plans, orders, IoT data and ledger, and the contracts it is party to
+//
+// Company balances and ledgers are kept when contracts are reset.
+var resetScopes = []string{"all", "iot", "contracts", "company:<company ID>"}
+
+// Lists of IDs the keys deleted by a scoped reset are taken out of
+var resetIDListKeys = []string{allKeys, companyKey, planKey, tradeRequestKey, transportRequestKey, gasRequestKey, disputeKey,
+	dealKey, settlementKey}
+
+// ID lists of records stored under a prefix, with the prefix of their keys
+var prefixedIDListKeys = map[string]string{disputeKey: disputePrefix, settlementKey: settlementPrefix}
+
+var contractListKeys = []string{tradeRequestKey, transportRequestKey, gasRequestKey, disputeKey, dealKey, settlementKey,
+	marketContractKey, imbalanceInvoiceKey}
+var contractAffixes = []string{invoiceAffix, incidentAffix, disputeAffix, creditNoteAffix, offerAffix, nominationAffix,
+	marginCallAffix, capacityDayAffix}
+
+// Records that belong to contracts carry one of these fields
+var contractRecordFields = []string{"contract_id", "deal_id", "settlement_id"}
+
+type resetReport struct {
+	Scope         string   `json:"scope"`
+	DryRun        bool     `json:"dry_run"`
+	DeletedKeys   []string `json:"deleted_keys"`
+	UpdatedKeys   []string `json:"updated_keys"`
+	Reinitialized bool     `json:"reinitialized"`
+}
+
+// args: adminUserID, password, scope (default all), dryRun (true/false, default false)
+func (t *SimpleChaincode) Reset(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Entered function Reset()")
+
+	if len(args) < 2 {
+		return nil, errors.New("Incorrect number of arguments. At least 2 expected (adminUserID, password, scope, dryRun)")
+	}
+	dryRun := len(args) > 3 && args[3] == "true"
+	return t.resetLedger(stub, args, dryRun)
+}
+
+// Reports what a reset would delete, args: adminUserID, password, scope (default all)
+func (t *SimpleChaincode) getResetPreview(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Entered function getResetPreview()")
+
+	if len(args) < 2 {
+		return nil, errors.New("Incorrect number of arguments. At least 2 expected (adminUserID, password, scope)")
+	}
+	return t.resetLedger(stub, args, true)
+}
+
+func (t *SimpleChaincode) resetLedger(stub shim.ChaincodeStubInterface, args []string, dryRun bool) ([]byte, error) {
+	var reportObj resetReport
+
+	err := t.checkResetAllowed(stub, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	reportObj.Scope = "all"
+	if len(args) > 2 && strings.TrimSpace(args[2]) != "" {
+		reportObj.Scope = strings.TrimSpace(args[2])
+	}
+	reportObj.DryRun = dryRun
+
+	state, err := scanState(stub)
+	if err != nil {
+		return nil, err
+	}
+	deleteKeys, err := selectResetKeys(reportObj.Scope, state)
+	if err != nil {
+		return nil, err
+	}
+	reportObj.DeletedKeys = deleteKeys
+
+	deleted := make(map[string]bool)
+	for _, k := range deleteKeys {
+		deleted[k] = true
+	}
+	updatedLists := make(map[string][]byte)
+	if reportObj.Scope != "all" {
+		updatedLists = pruneIDLists(state, deleted)
+	}
+	for k := range updatedLists {
+		reportObj.UpdatedKeys = append(reportObj.UpdatedKeys, k)
+	}
+	sort.Strings(reportObj.UpdatedKeys)
+
+	if !dryRun {
+		for _, k := range deleteKeys {
+			err = stub.DelState(k)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, k := range reportObj.UpdatedKeys {
+			err = stub.PutState(k, updatedLists[k])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		//The network is bootstrapped again with the document it started with
+		if reportObj.Scope == "all" {
+			var bootstrapArgs []string
+			if state[bootstrapKey] != nil {
+				bootstrapArgs = []string{string(state[bootstrapKey])}
+			}
+			_, err = t.Init(stub, "init", bootstrapArgs)
+			if err != nil {
+				return nil, err
+			}
+			reportObj.Reinitialized = true
+		}
+	}
+
+	if reportObj.DeletedKeys == nil {
+		reportObj.DeletedKeys = []string{}
+	}
+	if reportObj.UpdatedKeys == nil {
+		reportObj.UpdatedKeys = []string{}
+	}
+	reportObjBytes, _ := json.Marshal(&reportObj)
+	fmt.Println("Reset " + reportObj.Scope + ": " + string(reportObjBytes))
+	return []byte("{\"statusCode\" : \"SUCCESS\", \"body\" : " + string(reportObjBytes) + "}"), nil
+}
+
+// Only administrators may reset, and only networks bootstrapped as non-production
+func (t *SimpleChaincode) checkResetAllowed(stub shim.ChaincodeStubInterface, userID string, password string) error {
+	configObjBytes, _ := stub.GetState(networkConfigKey)
+	if configObjBytes == nil || t.getNetworkConfig(stub).Production {
+		return errors.New("Reset is disabled unless the network is flagged as non-production")
+	}
+	return t.checkAdmin(stub, userID, password)
+}
+
+func (t *SimpleChaincode) checkAdmin(stub shim.ChaincodeStubInterface, userID string, password string) error {
+	var userObj user
+
+	validUser, _, _ := t.verifyUser(stub, []string{userID, password})
+	if !validUser {
+		return errors.New("Not allowed: invalid user or password")
+	}
+	userObjBytes, _ := stub.GetState(userID)
+	_ = json.Unmarshal(userObjBytes, &userObj)
+	if userObj.Role != "Admin" {
+		return errors.New("Not allowed: " + userID + " is not an administrator")
+	}
+	return nil
+}
+
+func scanState(stub shim.ChaincodeStubInterface) (map[string][]byte, error) {
+	state := make(map[string][]byte)
+
+	keysIter, err := stub.RangeQueryState("", "")
+	if err != nil {
+		return nil, err
+	}
+	defer keysIter.Close()
+
+	for keysIter.HasNext() {
+		key, value, err := keysIter.Next()
+		if err != nil {
+			return nil, err
+		}
+		state[key] = value
+	}
+	return state, nil
+}
+
+// Top-level fields of a JSON object, nil for other values such as lists
+func recordFields(value []byte) map[string]json.RawMessage {
+	var fields map[string]json.RawMessage
+
+	if json.Unmarshal(value, &fields) != nil {
+		return nil
+	}
+	return fields
+}
+
+// Value of a string or number field as text
+func fieldText(fields map[string]json.RawMessage, name string) string {
+	var text string
+
+	raw, ok := fields[name]
+	if !ok {
+		return ""
+	}
+	if json.Unmarshal(raw, &text) == nil {
+		return text
+	}
+	return string(raw)
+}
+
+func selectResetKeys(scope string, state map[string][]byte) ([]string, error) {
+	var deleteKeys []string
+	var match func(key string, fields map[string]json.RawMessage) bool
+
+	switch {
+	case scope == "all":
+		match = func(key string, fields map[string]json.RawMessage) bool { return true }
+	case scope == "iot":
+		match = func(key string, fields map[string]json.RawMessage) bool { return strings.HasSuffix(key, iotKeyAffix) }
+	case scope == "contracts":
+		match = isContractKey
+	case strings.HasPrefix(scope, "company:"):
+		companyID := strings.TrimPrefix(scope, "company:")
+		companyFields := recordFields(state[companyID])
+		if companyFields == nil || fieldText(companyFields, "company_type") == "" {
+			return nil, errors.New("Unknown company: " + companyID)
+		}
+		match = companyKeyMatcher(companyID, state)
+	default:
+		return nil, errors.New("Unknown reset scope " + scope + ", expecting one of " + strings.Join(resetScopes, ", "))
+	}
+
+	for key, value := range state {
+		if match(key, recordFields(value)) {
+			deleteKeys = append(deleteKeys, key)
+		}
+	}
+	sort.Strings(deleteKeys)
+	return deleteKeys, nil
+}
+
+func isContractKey(key string, fields map[string]json.RawMessage) bool {
+	if contains(contractListKeys, key) || strings.Contains(key, capacityAffix) {
+		return true
+	}
+	for _, affix := range contractAffixes {
+		if strings.HasSuffix(key, affix) {
+			return true
+		}
+	}
+	for _, field := range contractRecordFields {
+		if _, ok := fields[field]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Keys of a company are its own ID and keys starting with it, its plans, the contracts it is party to,
+// records that name it as their company and records issued on its contracts
+func companyKeyMatcher(companyID string, state map[string][]byte) func(key string, fields map[string]json.RawMessage) bool {
+	var ownerIDs []string
+	contractIDs := make(map[string]bool)
+
+	ownerIDs = append(ownerIDs, companyID)
+	for key, value := range state {
+		fields := recordFields(value)
+		if fieldText(fields, "bp_company_id") == companyID {
+			ownerIDs = append(ownerIDs, key)
+		}
+		if fieldText(fields, "contract_initiator_id") == companyID || fieldText(fields, "contract_receiver_id") == companyID {
+			ownerIDs = append(ownerIDs, key)
+			contractIDs[key] = true
+		}
+	}
+
+	return func(key string, fields map[string]json.RawMessage) bool {
+		for _, k := range ownerIDs {
+			if key == k || strings.HasPrefix(key, k+"_") {
+				return true
+			}
+		}
+		return fieldText(fields, "company_id") == companyID || contractIDs[fieldText(fields, "contract_id")]
+	}
+}
+
+// Takes deleted keys out of the ID lists that are kept, returns the lists that changed
+func pruneIDLists(state map[string][]byte, deleted map[string]bool) map[string][]byte {
+	updatedLists := make(map[string][]byte)
+
+	for key, value := range state {
+		var idList, keptIDs []string
+
+		if deleted[key] || !(contains(resetIDListKeys, key) || strings.HasSuffix(key, userIDAffix)) {
+			continue
+		}
+		if json.Unmarshal(value, &idList) != nil {
+			continue
+		}
+		for _, k := range idList {
+			if !deleted[prefixedIDListKeys[key]+k] {
+				keptIDs = append(keptIDs, k)
+			}
+		}
+		if len(keptIDs) != len(idList) {
+			if keptIDs == nil {
+				keptIDs = []string{}
+			}
+			keptIDsBytes, _ := json.Marshal(&keptIDs)
+			updatedLists[key] = keptIDsBytes
+		}
+	}
+	return updatedLists
+}
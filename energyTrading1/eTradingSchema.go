@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Entity records carry the schema_version of their type. Records written before versioning have none and
+// count as version 0. The chaincode works on a versionedStub, which stamps the current version on every
+// entity it puts and upgrades older records as they are read, so the functions only ever see the current
+// layout. migrateRecords upgrades the stored records in batches. Lists, IoT readings, ledger entries and
+// configuration records are not entities and carry no version.
+var schemaVersionField = "schema_version"
+
+// Upgrades a decoded record from FromVersion to FromVersion + 1
+type recordMigration struct {
+	FromVersion int
+	Migrate     func(record map[string]interface{})
+}
+
+// Migrations of each entity type in order, the current version of a type is one past its last migration.
+// Types without migrations are at version 1.
+var entityMigrations = map[string][]recordMigration{
+	"contract": {{FromVersion: 0, Migrate: migrateContractV0}},
+	"plan":     {{FromVersion: 0, Migrate: migratePlanV0}},
+	"incident": {{FromVersion: 0, Migrate: migrateIncidentV0}},
+}
+
+var defaultMigrationBatchSize = 500
+
+type schemaVersionCount struct {
+	EntityType     string         `json:"entity_type"`
+	CurrentVersion int            `json:"current_version"`
+	Versions       map[string]int `json:"versions"`
+}
+
+type migrationReport struct {
+	EntityType string         `json:"entity_type"`
+	Migrated   map[string]int `json:"migrated"`
+	Remaining  int            `json:"remaining"`
+}
+
+// Contracts created before negotiation threads hold their terms as offer 1
+func migrateContractV0(record map[string]interface{}) {
+	if recordNumber(record, "contract_offer_version") == 0 {
+		record["contract_offer_version"] = 1
+	}
+	if recordNumber(record, "contract_accepted_offer_version") == 0 && record["contract_status"] == "Accepted" {
+		record["contract_accepted_offer_version"] = 1
+	}
+}
+
+// Plans stored before versioning are their own version 1
+func migratePlanV0(record map[string]interface{}) {
+	if recordNumber(record, "bp_version") == 0 {
+		record["bp_version"] = 1
+	}
+}
+
+// Incidents raised before the status history start it with their current status. They were raised as New,
+// which is Open in the incident workflow.
+func migrateIncidentV0(record map[string]interface{}) {
+	if record["incident_status"] == "New" {
+		record["incident_status"] = "Open"
+	}
+	if record["status_history"] == nil {
+		record["status_history"] = []interface{}{map[string]interface{}{"status": record["incident_status"], "company_id": "",
+			"comments": "Recorded before status history", "change_date_ms": record["incident_date_ms"]}}
+	}
+}
+
+func recordNumber(record map[string]interface{}, field string) float64 {
+	number, ok := record[field].(json.Number)
+	if !ok {
+		return 0
+	}
+	value, _ := number.Float64()
+	return value
+}
+
+func currentSchemaVersion(entityType string) int {
+	migrations := entityMigrations[entityType]
+	if len(migrations) == 0 {
+		return 1
+	}
+	return migrations[len(migrations)-1].FromVersion + 1
+}
+
+func isVersionedEntity(entityType string) bool {
+	for _, k := range snapshotRecordTypes {
+		if k.Type == entityType {
+			return true
+		}
+	}
+	return false
+}
+
+// Entity type and schema version of a stored value, an empty type for values that are not entities
+func recordSchemaVersion(key string, value []byte) (string, int) {
+	fields := recordFields(value)
+	if fields == nil {
+		return "", 0
+	}
+	entityType := snapshotEntityType(key, value)
+	if !isVersionedEntity(entityType) {
+		return "", 0
+	}
+	version, _ := strconv.Atoi(string(fields[schemaVersionField]))
+	return entityType, version
+}
+
+// Upgrades a record to the current version of its type, other values are returned as they are
+func migrateRecord(key string, value []byte) ([]byte, error) {
+	var record map[string]interface{}
+
+	entityType, version := recordSchemaVersion(key, value)
+	if entityType == "" || version >= currentSchemaVersion(entityType) {
+		return value, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+	err := decoder.Decode(&record)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range entityMigrations[entityType] {
+		if k.FromVersion >= version {
+			k.Migrate(record)
+		}
+	}
+	record[schemaVersionField] = currentSchemaVersion(entityType)
+	return json.Marshal(record)
+}
+
+// Records the chaincode writes are in the current layout, older ones put as they are, such as imported
+// records, are upgraded first
+func stampRecord(key string, value []byte) ([]byte, error) {
+	entityType, _ := recordSchemaVersion(key, value)
+	if entityType == "" {
+		return value, nil
+	}
+	if _, stamped := recordFields(value)[schemaVersionField]; stamped {
+		return migrateRecord(key, value)
+	}
+
+	trimmed := bytes.TrimSpace(value)
+	stamp := "{\"" + schemaVersionField + "\":" + strconv.Itoa(currentSchemaVersion(entityType))
+	if len(bytes.TrimSpace(trimmed[1:])) > 1 {
+		stamp = stamp + ","
+	}
+	return append([]byte(stamp), trimmed[1:]...), nil
+}
+
+type versionedStub struct {
+	shim.ChaincodeStubInterface
+}
+
+func versioned(stub shim.ChaincodeStubInterface) shim.ChaincodeStubInterface {
+	if _, ok := stub.(versionedStub); ok {
+		return stub
+	}
+	return versionedStub{stub}
+}
+
+func (s versionedStub) GetState(key string) ([]byte, error) {
+	value, err := s.ChaincodeStubInterface.GetState(key)
+	if err != nil || value == nil {
+		return value, err
+	}
+	migratedValue, err := migrateRecord(key, value)
+	if err != nil {
+		fmt.Println("Record " + key + " could not be migrated: " + err.Error())
+		return value, nil
+	}
+	return migratedValue, nil
+}
+
+func (s versionedStub) PutState(key string, value []byte) error {
+	stampedValue, err := stampRecord(key, value)
+	if err != nil {
+		return err
+	}
+	return s.ChaincodeStubInterface.PutState(key, stampedValue)
+}
+
+// args: adminUserID, password, entityType (default all), batchSize (default 500). Run again while remaining is not 0.
+func (t *SimpleChaincode) migrateRecords(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var reportObj migrationReport
+	var keys []string
+	var batchSize = defaultMigrationBatchSize
+
+	fmt.Println("Entered function migrateRecords()")
+
+	if len(args) < 2 {
+		return nil, errors.New("Incorrect number of arguments. At least 2 expected (adminUserID, password, entityType, batchSize)")
+	}
+	err := t.checkAdmin(stub, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	reportObj.EntityType = "all"
+	if len(args) > 2 && strings.TrimSpace(args[2]) != "" {
+		reportObj.EntityType = strings.TrimSpace(args[2])
+		if !isVersionedEntity(reportObj.EntityType) {
+			return nil, errors.New("Unknown entity type: " + reportObj.EntityType)
+		}
+	}
+	if len(args) > 3 && args[3] != "" {
+		batchSize, err = strconv.Atoi(args[3])
+		if err != nil || batchSize < 1 {
+			return nil, errors.New("Batch size must be a positive number")
+		}
+	}
+
+	state, err := scanState(stub)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range state {
+		entityType, version := recordSchemaVersion(k, v)
+		if entityType != "" && (reportObj.EntityType == "all" || reportObj.EntityType == entityType) &&
+			version < currentSchemaVersion(entityType) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	reportObj.Migrated = make(map[string]int)
+	for i, k := range keys {
+		if i == batchSize {
+			reportObj.Remaining = len(keys) - batchSize
+			break
+		}
+		migratedValue, err := migrateRecord(k, state[k])
+		if err != nil {
+			return nil, errors.New("Record " + k + " could not be migrated: " + err.Error())
+		}
+		err = stub.PutState(k, migratedValue)
+		if err != nil {
+			return nil, err
+		}
+		entityType, _ := recordSchemaVersion(k, state[k])
+		reportObj.Migrated[entityType] = reportObj.Migrated[entityType] + 1
+	}
+
+	reportObjBytes, _ := json.Marshal(&reportObj)
+	return []byte("{\"statusCode\" : \"SUCCESS\", \"body\" : " + string(reportObjBytes) + "}"), nil
+}
+
+// How many records of each entity type are stored at each schema version
+func (t *SimpleChaincode) getSchemaVersionReport(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var reportList []schemaVersionCount
+
+	state, err := scanState(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]map[string]int)
+	for _, k := range snapshotRecordTypes {
+		counts[k.Type] = make(map[string]int)
+	}
+	for k, v := range state {
+		entityType, version := recordSchemaVersion(k, v)
+		if entityType != "" {
+			counts[entityType][strconv.Itoa(version)] = counts[entityType][strconv.Itoa(version)] + 1
+		}
+	}
+
+	for _, k := range snapshotRecordTypes {
+		reportList = append(reportList, schemaVersionCount{EntityType: k.Type, CurrentVersion: currentSchemaVersion(k.Type), Versions: counts[k.Type]})
+	}
+	reportListBytes, _ := json.Marshal(&reportList)
+	return []byte("{\"statusCode\" : \"SUCCESS\", \"body\" : " + string(reportListBytes) + "}"), nil
+}
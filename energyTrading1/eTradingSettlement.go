@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+type ledgerEntry struct {
+	CompanyID    string  `json:"company_id"`
+	EntryType    string  `json:"entry_type"`
+	Amount       float64 `json:"amount"`
+	BalanceAfter float64 `json:"balance_after"`
+	Reference    string  `json:"reference"`
+	EntryDateMS  int     `json:"entry_date_ms"`
+}
+
+type bilateralPosition struct {
+	CompanyA  string  `json:"company_a"`
+	CompanyB  string  `json:"company_b"`
+	AOwesB    float64 `json:"a_owes_b"`
+	BOwesA    float64 `json:"b_owes_a"`
+	NetAmount float64 `json:"net_amount"`
+	NetPayer  string  `json:"net_payer"`
+	NetPayee  string  `json:"net_payee"`
+}
+
+type netPosition struct {
+	CompanyID   string  `json:"company_id"`
+	Receivable  float64 `json:"receivable"`
+	Payable     float64 `json:"payable"`
+	NetPosition float64 `json:"net_position"`
+}
+
+type settlementReport struct {
+	SettlementID          string              `json:"settlement_id"`
+	PeriodStartMS         int                 `json:"period_start_ms"`
+	PeriodEndMS           int                 `json:"period_end_ms"`
+	SettlementDateMS      int                 `json:"settlement_date_ms"`
+	InvoiceIDs            []string            `json:"invoice_ids"`
+	GrossAmount           float64             `json:"gross_amount"`
+	BilateralNetAmount    float64             `json:"bilateral_net_amount"`
+	MultilateralNetAmount float64             `json:"multilateral_net_amount"`
+	BilateralPositions    []bilateralPosition `json:"bilateral_positions"`
+	MultilateralPositions []netPosition       `json:"multilateral_positions"`
+	SettlementStatus      string              `json:"settlement_status"`
+}
+
+// Amount due on an invoice, including penalty charges and credits. Credits never make an invoice negative.
+func (t *SimpleChaincode) getInvoiceAmount(stub shim.ChaincodeStubInterface, invoiceObj invoice, contractObj contract) float64 {
+	var amount = t.getSignedInvoiceAmount(stub, invoiceObj, contractObj)
+	if amount < 0 {
+		amount = 0
+	}
+	return amount
+}
+
+// Amount due on an invoice, negative when credits exceed the charge and the payee owes the difference.
+// Invoices issued before contract pricing carry no amount and are valued from the contract.
+func (t *SimpleChaincode) getSignedInvoiceAmount(stub shim.ChaincodeStubInterface, invoiceObj invoice, contractObj contract) float64 {
+	var amount = invoiceObj.Amount
+	if invoiceObj.EnergyMWH == 0 {
+		amount = t.getContractValue(stub, contractObj)
+	}
+
+	for _, adjustment := range invoiceObj.Adjustments {
+		amount = amount + adjustment.Amount
+	}
+	return amount
+}
+
+// Appends a balance movement to the ledger of a company
+func (t *SimpleChaincode) addLedgerEntry(stub shim.ChaincodeStubInterface, entry ledgerEntry) {
+	var ledgerList []ledgerEntry
+
+	var arrKey = entry.CompanyID + ledgerAffix
+	ledgerObjBytes, _ := stub.GetState(arrKey)
+	if ledgerObjBytes != nil {
+		_ = json.Unmarshal(ledgerObjBytes, &ledgerList)
+	}
+
+	ledgerList = append(ledgerList, entry)
+	ledgerObjBytes, _ = json.Marshal(&ledgerList)
+	_ = stub.PutState(arrKey, ledgerObjBytes)
+
+	t.updateMasterKeyList(stub, []string{arrKey})
+}
+
+// Nets all open invoices of a period, contract invoices and imbalance charges alike, per company pair
+// and across all companies, moves only the multilateral net amounts between bank balances and marks
+// every included invoice Paid.
+// Invoices held by a dispute stay out of the run.
+// Nothing is written unless every net payer can cover its position.
+func (t *SimpleChaincode) runSettlement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var settlementID, returnMessage, contractIDStr, pairKey string
+	var periodStart, periodEnd, currentDate int
+	var reportObj settlementReport
+	var settlementIDArr []string
+
+	fmt.Println("Entered function runSettlement()")
+
+	if len(args) < 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4 (Settlement ID, Period start in MilliSecs, Period end in MilliSecs, Current Date in MilliSecs)")
+	}
+
+	settlementID = args[0]
+	periodStart, _ = strconv.Atoi(args[1])
+	periodEnd, _ = strconv.Atoi(args[2])
+	currentDate, _ = strconv.Atoi(args[3])
+
+	if periodEnd < periodStart {
+		return nil, errors.New("Settlement period end is before period start")
+	}
+
+	existingBytes, _ := stub.GetState(settlementPrefix + settlementID)
+	if existingBytes != nil {
+		return nil, errors.New("Settlement already exists: " + settlementID)
+	}
+
+	openInvoices := make(map[string]invoice)
+	pairMap := make(map[string]*bilateralPosition)
+	positionMap := make(map[string]*netPosition)
+
+	getPosition := func(companyID string) *netPosition {
+		position, ok := positionMap[companyID]
+		if !ok {
+			position = &netPosition{CompanyID: companyID}
+			positionMap[companyID] = position
+		}
+		return position
+	}
+
+	//Accumulates the gross obligation of an open invoice of the period
+	collectInvoice := func(invoiceObj invoice, contractObj contract) {
+		if invoiceObj.PaymentStatus != "Pending" || invoiceObj.InvoiceDateMS < periodStart || invoiceObj.InvoiceDateMS > periodEnd {
+			return
+		}
+
+		var amount = t.getSignedInvoiceAmount(stub, invoiceObj, contractObj)
+		var payer = contractObj.InitiatorID
+		var payee = contractObj.ReceiverID
+
+		//Invoices that name their payer and payee, such as imbalance charges, are paid between those
+		if invoiceObj.PayerID != "" {
+			payer = invoiceObj.PayerID
+			payee = invoiceObj.PayeeID
+		}
+
+		//A net credit is owed the other way round
+		if amount < 0 {
+			amount = -amount
+			payer, payee = payee, payer
+		}
+
+		openInvoices[strconv.Itoa(invoiceObj.InvoiceID)] = invoiceObj
+		reportObj.GrossAmount = reportObj.GrossAmount + amount
+
+		getPosition(payer).Payable = getPosition(payer).Payable + amount
+		getPosition(payee).Receivable = getPosition(payee).Receivable + amount
+
+		//Company pairs are kept in alphabetical order so both directions land on the same position
+		if payer < payee {
+			pairKey = payer + "|" + payee
+		} else {
+			pairKey = payee + "|" + payer
+		}
+		pair, ok := pairMap[pairKey]
+		if !ok {
+			if payer < payee {
+				pair = &bilateralPosition{CompanyA: payer, CompanyB: payee}
+			} else {
+				pair = &bilateralPosition{CompanyA: payee, CompanyB: payer}
+			}
+			pairMap[pairKey] = pair
+		}
+		if pair.CompanyA == payer {
+			pair.AOwesB = pair.AOwesB + amount
+		} else {
+			pair.BOwesA = pair.BOwesA + amount
+		}
+	}
+
+	//Collect the open invoices of the contracts and the imbalance charges of the shippers
+	for _, contractObj := range t.getAllContractObjList(stub, "") {
+		contractIDStr = strconv.Itoa(contractObj.ContractID)
+		invoiceList, _ := t.getInvoiceIncidentList(stub, contractIDStr)
+
+		for _, invoiceObj := range invoiceList {
+			collectInvoice(invoiceObj, contractObj)
+		}
+	}
+	for _, invoiceObj := range t.getImbalanceInvoiceList(stub) {
+		collectInvoice(invoiceObj, contract{})
+	}
+
+	if len(openInvoices) == 0 {
+		returnMessage = "{\"statusCode\" : \"FAIL\", \"body\" : \"Settlement FAILED: No open invoices in the settlement period\"}"
+		return []byte(returnMessage), nil
+	}
+
+	//Bilateral netting per company pair
+	for _, pair := range pairMap {
+		if pair.AOwesB >= pair.BOwesA {
+			pair.NetAmount = pair.AOwesB - pair.BOwesA
+			pair.NetPayer = pair.CompanyA
+			pair.NetPayee = pair.CompanyB
+		} else {
+			pair.NetAmount = pair.BOwesA - pair.AOwesB
+			pair.NetPayer = pair.CompanyB
+			pair.NetPayee = pair.CompanyA
+		}
+		reportObj.BilateralNetAmount = reportObj.BilateralNetAmount + pair.NetAmount
+		reportObj.BilateralPositions = append(reportObj.BilateralPositions, *pair)
+	}
+	sort.Slice(reportObj.BilateralPositions, func(i, j int) bool {
+		return reportObj.BilateralPositions[i].CompanyA+reportObj.BilateralPositions[i].CompanyB <
+			reportObj.BilateralPositions[j].CompanyA+reportObj.BilateralPositions[j].CompanyB
+	})
+
+	//Multilateral netting across all companies
+	var companyIDArr []string
+	for companyID := range positionMap {
+		companyIDArr = append(companyIDArr, companyID)
+	}
+	sort.Strings(companyIDArr)
+
+	companyMap := make(map[string]company)
+	for _, companyID := range companyIDArr {
+		var companyObj company
+		var position = positionMap[companyID]
+
+		position.NetPosition = position.Receivable - position.Payable
+		if position.NetPosition < 0 {
+			reportObj.MultilateralNetAmount = reportObj.MultilateralNetAmount - position.NetPosition
+		}
+
+		companyObjBytes, _ := stub.GetState(companyID)
+		if companyObjBytes == nil {
+			return nil, errors.New("Company not found: " + companyID)
+		}
+		_ = json.Unmarshal(companyObjBytes, &companyObj)
+
+		if companyObj.BankBalance+position.NetPosition < 0 {
+			returnMessage = "{\"statusCode\" : \"FAIL\", \"body\" : \"Settlement FAILED: Insufficient funds for " + companyID +
+				" (Bank Balance: " + strconv.FormatFloat(companyObj.BankBalance, 'f', 2, 64) +
+				", Net payment amount: " + strconv.FormatFloat(-position.NetPosition, 'f', 2, 64) + ")\"}"
+			return []byte(returnMessage), nil
+		}
+		companyMap[companyID] = companyObj
+		reportObj.MultilateralPositions = append(reportObj.MultilateralPositions, *position)
+	}
+
+	//Execute the net transfers
+	for _, position := range reportObj.MultilateralPositions {
+		companyObj := companyMap[position.CompanyID]
+		if position.NetPosition == 0 {
+			continue
+		}
+
+		companyObj.BankBalance = companyObj.BankBalance + position.NetPosition
+		companyObj.BalanceUpdatedDateMS = currentDate
+		companyObjBytes, _ := json.Marshal(&companyObj)
+		err := stub.PutState(companyObj.CompanyID, companyObjBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		t.addLedgerEntry(stub, ledgerEntry{CompanyID: companyObj.CompanyID, EntryType: "Settlement", Amount: position.NetPosition,
+			BalanceAfter: companyObj.BankBalance, Reference: settlementID, EntryDateMS: currentDate})
+	}
+
+	//Mark every included invoice as paid
+	for invoiceIDStr, invoiceObj := range openInvoices {
+		invoiceObj.PaymentStatus = "Paid"
+		invoiceObj.PaymentDateMS = currentDate
+		invoiceObj.SettlementID = settlementID
+
+		invoiceObjBytes, _ := json.Marshal(&invoiceObj)
+		err := stub.PutState(invoiceIDStr, invoiceObjBytes)
+		if err != nil {
+			return nil, err
+		}
+		reportObj.InvoiceIDs = append(reportObj.InvoiceIDs, invoiceIDStr)
+	}
+	sort.Strings(reportObj.InvoiceIDs)
+
+	//Store the settlement report
+	reportObj.SettlementID = settlementID
+	reportObj.PeriodStartMS = periodStart
+	reportObj.PeriodEndMS = periodEnd
+	reportObj.SettlementDateMS = currentDate
+	reportObj.SettlementStatus = "Completed"
+
+	reportObjBytes, err1 := json.Marshal(reportObj)
+	if err1 != nil {
+		return nil, err1
+	}
+	err2 := stub.PutState(settlementPrefix+settlementID, reportObjBytes)
+	if err2 != nil {
+		return nil, err2
+	}
+
+	settlementIDListBytes, _ := stub.GetState(settlementKey)
+	if settlementIDListBytes != nil {
+		_ = json.Unmarshal(settlementIDListBytes, &settlementIDArr)
+	}
+	settlementIDArr = append(settlementIDArr, settlementID)
+	settlementIDListBytes, _ = json.Marshal(&settlementIDArr)
+	_ = stub.PutState(settlementKey, settlementIDListBytes)
+
+	//Add new settlement keys to master key list
+	idList := []string{settlementPrefix + settlementID, settlementKey}
+	t.updateMasterKeyList(stub, idList)
+
+	//Paid invoices lower the exposure of the payers
+	for _, companyObj := range companyMap {
+		if hasCreditFacility(companyObj) {
+			t.reviewMarginCalls(stub, companyObj)
+		}
+	}
+
+	t.emitEvent(stub, "PaymentSettled", settlementID, companyIDArr, paymentEventData{InvoiceIDs: reportObj.InvoiceIDs, SettlementID: settlementID,
+		Amount: reportObj.GrossAmount, PaymentDateMS: currentDate})
+
+	returnMessage = "{\"statusCode\" : \"SUCCESS\", \"body\" : " + string(reportObjBytes) + "}"
+	return []byte(returnMessage), nil
+}
+
+func (t *SimpleChaincode) getSettlementReport(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var returnMessage string
+
+	if len(args) < 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1 (Settlement ID).")
+	}
+
+	reportObjBytes, _ := stub.GetState(settlementPrefix + args[0])
+	if reportObjBytes == nil {
+		returnMessage = "{\"statusCode\" : \"FAIL\", \"body\" : \"Settlement not found: " + args[0] + "\"}"
+		return []byte(returnMessage), nil
+	}
+
+	returnMessage = "{\"statusCode\" : \"SUCCESS\", \"body\" : " + string(reportObjBytes) + "}"
+	return []byte(returnMessage), nil
+}
+
+func (t *SimpleChaincode) getSettlementList(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	var lenArr int
+	var settlementIDArr []string
+	var returnMessage string
+
+	fmt.Println("Getting all settlement reports.")
+
+	settlementIDListBytes, _ := stub.GetState(settlementKey)
+	_ = json.Unmarshal(settlementIDListBytes, &settlementIDArr)
+
+	returnMessage = "{\"statusCode\" : \"SUCCESS\", \"body\" : ["
+	lenArr = len(settlementIDArr)
+	for _, k := range settlementIDArr {
+		reportObjBytes, _ := stub.GetState(settlementPrefix + k)
+		returnMessage = returnMessage + string(reportObjBytes)
+
+		lenArr = lenArr - 1
+		if lenArr != 0 {
+			returnMessage = returnMessage + ","
+		}
+	}
+	returnMessage = returnMessage + "]}"
+	return []byte(returnMessage), nil
+}
+
+func (t *SimpleChaincode) getLedgerEntries(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var returnMessage string
+
+	if len(args) < 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1 (Company ID).")
+	}
+
+	ledgerObjBytes, _ := stub.GetState(args[0] + ledgerAffix)
+	if ledgerObjBytes == nil {
+		ledgerObjBytes = []byte("[]")
+	}
+
+	returnMessage = "{\"statusCode\" : \"SUCCESS\", \"body\" : " + string(ledgerObjBytes) + "}"
+	return []byte(returnMessage), nil
+}
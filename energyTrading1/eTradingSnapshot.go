@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Snapshots are exported in pages of entities in key order. Each page is a chunk that importState loads
+// as it is: the sha256 of its entities must match and chunks must follow on from each other by cursor,
+// starting from the chunk with an empty cursor.
+var snapshotVersion = 1
+
+var defaultSnapshotPageSize = 100
+var maxSnapshotPageSize = 500
+
+// Keys of the network itself, which a snapshot does not carry from one network to another
+var snapshotExcludedKeys = []string{allKeys, bootstrapKey, networkConfigKey, importStatusKey}
+
+type snapshotChunk struct {
+	SnapshotVersion int              `json:"snapshot_version"`
+	Network         string           `json:"network"`
+	Cursor          string           `json:"cursor"`
+	NextCursor      string           `json:"next_cursor"`
+	EntityCount     int              `json:"entity_count"`
+	Entities        []snapshotEntity `json:"entities"`
+	SHA256          string           `json:"sha256"`
+}
+
+// Value holds JSON values, Text the few values that are not JSON
+type snapshotEntity struct {
+	Key   string          `json:"key"`
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value,omitempty"`
+	Text  string          `json:"text,omitempty"`
+}
+
+type importStatus struct {
+	Network      string `json:"network"`
+	Chunks       int    `json:"chunks"`
+	Entities     int    `json:"entities"`
+	NextCursor   string `json:"next_cursor"`
+	ImportStatus string `json:"import_status"` // InProgress or Completed
+	ImportedBy   string `json:"imported_by"`
+}
+
+// Entity types, told apart by a field only records of the type carry
+var snapshotRecordTypes = []struct {
+	Field string
+	Type  string
+}{
+	{"company_type", "company"},
+	{"user_password", "user"},
+	{"bp_plan_id", "plan"},
+	{"contract_status", "contract"},
+	{"payment_status", "invoice"},
+	{"incident_id", "incident"},
+	{"dispute_status", "dispute"},
+	{"note_type", "credit_note"},
+	{"nomination_status", "nomination"},
+	{"margin_call_status", "margin_call"},
+	{"deal_id", "deal"},
+	{"settlement_status", "settlement"},
+	{"order_status", "order"},
+	{"auction_id", "auction"},
+}
+
+func snapshotEntityType(key string, value []byte) string {
+	if strings.HasSuffix(key, iotKeyAffix) {
+		return "iot_readings"
+	}
+	if strings.HasSuffix(key, ledgerAffix) {
+		return "ledger_entries"
+	}
+	fields := recordFields(value)
+	for _, k := range snapshotRecordTypes {
+		if _, ok := fields[k.Field]; ok {
+			return k.Type
+		}
+	}
+	return "state"
+}
+
+// Values are hashed in canonical form, sorted keys and no spaces, so a chunk that was re-encoded on the
+// way still checks out
+func snapshotDigest(entities []snapshotEntity) string {
+	canonicalEntities := make([]snapshotEntity, len(entities))
+	for i, k := range entities {
+		var value interface{}
+
+		canonicalEntities[i] = k
+		decoder := json.NewDecoder(bytes.NewReader(k.Value))
+		decoder.UseNumber()
+		if len(k.Value) > 0 && decoder.Decode(&value) == nil {
+			canonicalEntities[i].Value, _ = json.Marshal(value)
+		}
+	}
+	entitiesBytes, _ := json.Marshal(canonicalEntities)
+	hash := sha256.Sum256(entitiesBytes)
+	return hex.EncodeToString(hash[:])
+}
+
+// args: cursor (first key of the page, empty for the first page), pageSize (optional)
+func (t *SimpleChaincode) exportState(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var chunkObj snapshotChunk
+	var keys []string
+	var cursor string
+	var pageSize = defaultSnapshotPageSize
+
+	fmt.Println("Entered function exportState()")
+
+	if len(args) > 0 {
+		cursor = args[0]
+	}
+	if len(args) > 1 && args[1] != "" {
+		size, err := strconv.Atoi(args[1])
+		if err != nil || size < 1 || size > maxSnapshotPageSize {
+			return nil, errors.New("Page size must be a number from 1 to " + strconv.Itoa(maxSnapshotPageSize))
+		}
+		pageSize = size
+	}
+
+	state, err := scanState(stub)
+	if err != nil {
+		return nil, err
+	}
+	for k := range state {
+		if k >= cursor && !contains(snapshotExcludedKeys, k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	chunkObj.SnapshotVersion = snapshotVersion
+	chunkObj.Network = t.getNetworkConfig(stub).Name
+	chunkObj.Cursor = cursor
+	if len(keys) > pageSize {
+		chunkObj.NextCursor = keys[pageSize]
+		keys = keys[:pageSize]
+	}
+
+	chunkObj.Entities = []snapshotEntity{}
+	for _, k := range keys {
+		entityObj := snapshotEntity{Key: k, Type: snapshotEntityType(k, state[k])}
+		if entityObj.Type == "user" {
+			//Passwords stay on the network
+			var userObj user
+			_ = json.Unmarshal(state[k], &userObj)
+			userObj.Password = ""
+			entityObj.Value, _ = json.Marshal(&userObj)
+		} else if isJSONValue(state[k]) {
+			entityObj.Value = state[k]
+		} else {
+			entityObj.Text = string(state[k])
+		}
+		chunkObj.Entities = append(chunkObj.Entities, entityObj)
+	}
+	chunkObj.EntityCount = len(chunkObj.Entities)
+	chunkObj.SHA256 = snapshotDigest(chunkObj.Entities)
+
+	chunkObjBytes, _ := json.Marshal(&chunkObj)
+	return []byte("{\"statusCode\" : \"SUCCESS\", \"body\" : " + string(chunkObjBytes) + "}"), nil
+}
+
+func isJSONValue(data []byte) bool {
+	var value json.RawMessage
+	return len(data) > 0 && json.Unmarshal(data, &value) == nil
+}
+
+// Loads one exported chunk, args: adminUserID, password, chunk, newUserPassword (optional). Like reset, import
+// needs an administrator on a non-production network. Imported users keep the password they have on this
+// network, new ones get newUserPassword and cannot log in without it. Start from a reset ledger to reproduce
+// a snapshot exactly.
+func (t *SimpleChaincode) importState(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var chunkObj snapshotChunk
+	var statusObj importStatus
+
+	fmt.Println("Entered function importState()")
+
+	if len(args) < 3 {
+		return nil, errors.New("Incorrect number of arguments. At least 3 expected (adminUserID, password, chunk, newUserPassword)")
+	}
+	err := t.checkResetAllowed(stub, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal([]byte(args[2]), &chunkObj)
+	if err != nil {
+		return nil, errors.New("Invalid snapshot chunk: " + err.Error())
+	}
+	if chunkObj.SnapshotVersion != snapshotVersion {
+		return nil, errors.New("Unsupported snapshot version " + strconv.Itoa(chunkObj.SnapshotVersion) + ", expecting " + strconv.Itoa(snapshotVersion))
+	}
+	if chunkObj.EntityCount != len(chunkObj.Entities) || snapshotDigest(chunkObj.Entities) != chunkObj.SHA256 {
+		return nil, errors.New("Snapshot chunk at cursor \"" + chunkObj.Cursor + "\" failed the integrity check")
+	}
+
+	//Chunks are loaded in the order they were exported
+	statusObjBytes, _ := stub.GetState(importStatusKey)
+	_ = json.Unmarshal(statusObjBytes, &statusObj)
+	if chunkObj.Cursor == "" {
+		statusObj = importStatus{Network: chunkObj.Network}
+	} else if statusObj.ImportStatus != "InProgress" || chunkObj.Cursor != statusObj.NextCursor {
+		return nil, errors.New("Snapshot chunk at cursor \"" + chunkObj.Cursor + "\" is out of order, expecting the chunk at \"" +
+			statusObj.NextCursor + "\"")
+	}
+
+	for _, k := range chunkObj.Entities {
+		if k.Key == "" || contains(snapshotExcludedKeys, k.Key) || k.Key < chunkObj.Cursor ||
+			(chunkObj.NextCursor != "" && k.Key >= chunkObj.NextCursor) {
+			return nil, errors.New("Snapshot chunk at cursor \"" + chunkObj.Cursor + "\" has an unexpected key: " + k.Key)
+		}
+		valueBytes := []byte(k.Text)
+		if len(k.Value) > 0 {
+			valueBytes = k.Value
+		}
+		if snapshotEntityType(k.Key, valueBytes) == "user" {
+			var userObj, existingUserObj user
+			_ = json.Unmarshal(k.Value, &userObj)
+			existingUserObjBytes, _ := stub.GetState(k.Key)
+			_ = json.Unmarshal(existingUserObjBytes, &existingUserObj)
+			userObj.Password = existingUserObj.Password
+			if existingUserObjBytes == nil && len(args) > 3 {
+				userObj.Password = args[3]
+			}
+			valueBytes, _ = json.Marshal(&userObj)
+		}
+
+		//Records of snapshots taken before schema versioning are upgraded like stored ones
+		valueBytes, err = migrateRecord(k.Key, valueBytes)
+		if err != nil {
+			return nil, errors.New("Record " + k.Key + " could not be migrated: " + err.Error())
+		}
+		err = stub.PutState(k.Key, valueBytes)
+		if err != nil {
+			return nil, err
+		}
+		t.updateMasterKeyList(stub, []string{k.Key})
+	}
+
+	statusObj.Chunks = statusObj.Chunks + 1
+	statusObj.Entities = statusObj.Entities + len(chunkObj.Entities)
+	statusObj.NextCursor = chunkObj.NextCursor
+	statusObj.ImportedBy = args[0]
+	statusObj.ImportStatus = "InProgress"
+	if chunkObj.NextCursor == "" {
+		statusObj.ImportStatus = "Completed"
+	}
+	statusObjBytes, _ = json.Marshal(&statusObj)
+	err = stub.PutState(importStatusKey, statusObjBytes)
+	if err != nil {
+		return nil, err
+	}
+	t.updateMasterKeyList(stub, []string{importStatusKey})
+
+	return []byte("{\"statusCode\" : \"SUCCESS\", \"body\" : " + string(statusObjBytes) + "}"), nil
+}
+
+func (t *SimpleChaincode) getImportStatus(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	statusObjBytes, _ := stub.GetState(importStatusKey)
+	if statusObjBytes == nil {
+		return []byte("{\"statusCode\" : \"FAIL\", \"body\" : \"No snapshot was imported\"}"), nil
+	}
+	return []byte("{\"statusCode\" : \"SUCCESS\", \"body\" : " + string(statusObjBytes) + "}"), nil
+}
@@ -0,0 +1,153 @@
+// Package localstub runs the energy trading chaincode against an in-memory ledger, without a peer. Besides the
+// state it keeps the chaincode events every transaction sets, so tests and local tools can look at them.
+// The ledger can be saved to a file and loaded again, so local tools can keep state between runs.
+package localstub
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Chaincode event as set by a transaction
+type Event struct {
+	TxID    string
+	Name    string
+	Payload []byte
+}
+
+// Payload of the "etrading" event: every business event of one transaction
+type Envelope struct {
+	SchemaVersion int             `json:"schema_version"`
+	TxID          string          `json:"tx_id"`
+	Events        []BusinessEvent `json:"events"`
+}
+
+type BusinessEvent struct {
+	Sequence   int             `json:"sequence"`
+	EventType  string          `json:"event_type"`
+	EntityID   string          `json:"entity_id"`
+	CompanyIDs []string        `json:"company_ids"`
+	Data       json.RawMessage `json:"data"`
+}
+
+// Stub is a shim.MockStub that passes itself to the chaincode, so the events the chaincode sets are captured
+type Stub struct {
+	*shim.MockStub
+	cc     shim.Chaincode
+	Events []Event
+}
+
+func New(name string, cc shim.Chaincode) *Stub {
+	return &Stub{MockStub: shim.NewMockStub(name, cc), cc: cc}
+}
+
+func (s *Stub) SetEvent(name string, payload []byte) error {
+	s.Events = append(s.Events, Event{TxID: s.GetTxID(), Name: name, Payload: payload})
+	return nil
+}
+
+func (s *Stub) MockInit(uuid string, function string, args []string) ([]byte, error) {
+	s.MockTransactionStart(uuid)
+	defer s.MockTransactionEnd(uuid)
+	return s.cc.Init(s, function, args)
+}
+
+func (s *Stub) MockInvoke(uuid string, function string, args []string) ([]byte, error) {
+	s.MockTransactionStart(uuid)
+	defer s.MockTransactionEnd(uuid)
+	return s.cc.Invoke(s, function, args)
+}
+
+func (s *Stub) MockQuery(function string, args []string) ([]byte, error) {
+	return s.cc.Query(s, function, args)
+}
+
+// Decodes the envelope of an event, events under other names have none
+func (e Event) Envelope() (Envelope, bool) {
+	var envelopeObj Envelope
+
+	if e.Name != "etrading" {
+		return envelopeObj, false
+	}
+	err := json.Unmarshal(e.Payload, &envelopeObj)
+	return envelopeObj, err == nil
+}
+
+// Business events of all captured transactions in the order they were emitted, optionally of one type only
+func (s *Stub) BusinessEvents(eventType string) []BusinessEvent {
+	var events []BusinessEvent
+
+	for _, k := range s.Events {
+		envelopeObj, ok := k.Envelope()
+		if !ok {
+			continue
+		}
+		for _, e := range envelopeObj.Events {
+			if eventType == "" || e.EventType == eventType {
+				events = append(events, e)
+			}
+		}
+	}
+	return events
+}
+
+func (s *Stub) ClearEvents() {
+	s.Events = nil
+}
+
+// Load creates a stub whose ledger starts from a state file written by SaveState. It reports false when the
+// file does not exist yet, the ledger is then empty.
+func Load(path string, name string, cc shim.Chaincode) (*Stub, bool, error) {
+	var state map[string]string
+	var keys []string
+
+	s := New(name, cc)
+	stateBytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	err = json.Unmarshal(stateBytes, &state)
+	if err != nil {
+		return nil, false, err
+	}
+
+	//Written through PutState so the stub also knows the keys for range queries
+	for k := range state {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	s.MockTransactionStart("load")
+	defer s.MockTransactionEnd("load")
+	for _, k := range keys {
+		err = s.PutState(k, []byte(state[k]))
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return s, true, nil
+}
+
+// SaveState writes the ledger to a file as a JSON object of keys and values
+func (s *Stub) SaveState(path string) error {
+	state := make(map[string]string)
+	for k, v := range s.State {
+		state[k] = string(v)
+	}
+
+	stateBytes, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path+".tmp", stateBytes, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
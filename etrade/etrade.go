@@ -0,0 +1,429 @@
+// Package etrade is the command line client of the energy trading chaincode. Commands are run against a
+// gateway.Backend, a peer or the chaincode in process, and print their result as a table or as JSON.
+//
+//	etrade company list --type producer
+//	etrade contract create trade --id 5001 --initiator SHIPPER1 --receiver PRODUCER1 --mwh 100 --start 2017-10-01 --end 2017-10-31
+//	etrade contract accept 5001
+//	etrade iot push readings.json
+//	etrade invoice pay 3 --contract 5001
+//	etrade plan update SHIPPER1_PLAN --date 2017-10-01 --price 2.5 --entry-location Europe --entry-capacity 100 ...
+package etrade
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/preethimohan1/learn-chaincode/gateway"
+)
+
+type CLI struct {
+	Backend gateway.Backend
+	Out     io.Writer
+	Err     io.Writer
+	JSON    bool
+}
+
+type command struct {
+	name  string
+	usage string
+	run   func(c *CLI, args []string) error
+}
+
+var commands = []command{
+	{"company list", "company list [--type buyer|shipper|producer|transporter|all]", (*CLI).companyList},
+	{"company topup", "company topup <company ID> <amount> [--date ms]", (*CLI).companyTopup},
+	{"contract create", "contract create trade|transport|gas --id --initiator --receiver --mwh --start --end [--location --penalty --plan]", (*CLI).contractCreate},
+	{"contract list", "contract list trade|transport|gas --company <company ID>", (*CLI).contractList},
+	{"contract accept", "contract accept <contract ID> [--date ms]", contractStatusCommand("Accepted")},
+	{"contract reject", "contract reject <contract ID>", contractStatusCommand("Rejected")},
+	{"contract cancel", "contract cancel <contract ID>", contractStatusCommand("Cancelled")},
+	{"contract invoices", "contract invoices <contract ID>", (*CLI).contractInvoices},
+	{"contract incidents", "contract incidents <contract ID>", (*CLI).contractIncidents},
+	{"iot push", "iot push <file with a reading, a JSON array of readings or one reading per line, - for stdin>", (*CLI).iotPush},
+	{"iot list", "iot list --company <company ID>", (*CLI).iotList},
+	{"invoice pay", "invoice pay <invoice ID> [--contract ID] [--date ms]", (*CLI).invoicePay},
+	{"plan list", "plan list [--location --min-price --max-price --min-capacity --from --to]", (*CLI).planList},
+	{"plan update", "plan update <plan ID> --company --date --price --entry-location --entry-capacity --exit-location --exit-capacity [--from --to]", (*CLI).planUpdate},
+	{"reset", "reset --user <admin user ID> --password [--scope all|iot|contracts|company:<ID>] [--dry-run]", (*CLI).reset},
+	{"snapshot export", "snapshot export [--out file] [--page-size n]", (*CLI).snapshotExport},
+	{"snapshot import", "snapshot import <file, - for stdin> --user <admin user ID> --password [--new-user-password]", (*CLI).snapshotImport},
+	{"schema versions", "schema versions", (*CLI).schemaVersions},
+	{"schema migrate", "schema migrate --user <admin user ID> --password [--type entity type] [--batch n]", (*CLI).schemaMigrate},
+	{"legacy migrate", "legacy migrate --user <admin user ID> --password [--chaincode name] [--price-unit kwh|mwh] [--dry-run]", (*CLI).legacyMigrate},
+	{"raw invoke", "raw invoke <function> [args...]", rawCommand("invoke")},
+	{"raw query", "raw query <function> [args...]", rawCommand("query")},
+	{"serve", "serve [--listen :8080]", (*CLI).serve},
+}
+
+// Run runs the command the arguments name, such as ["company", "list", "--type", "producer"]
+func (c *CLI) Run(args []string) error {
+	for _, k := range commands {
+		words := strings.Fields(k.name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == k.name {
+			return k.run(c, args[len(words):])
+		}
+	}
+	c.Usage()
+	if len(args) == 0 {
+		return errors.New("No command given")
+	}
+	return errors.New("Unknown command: " + strings.Join(args, " "))
+}
+
+func (c *CLI) Usage() {
+	fmt.Fprintln(c.Err, "Commands:")
+	for _, k := range commands {
+		fmt.Fprintln(c.Err, "  "+k.usage)
+	}
+}
+
+func (c *CLI) newFlags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(c.Err)
+	return fs
+}
+
+// Flags may come before, between or after the positional arguments, which are returned
+func parseFlags(fs *flag.FlagSet, args []string, positional int) ([]string, error) {
+	var values []string
+
+	for {
+		err := fs.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		values = append(values, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if positional >= 0 && len(values) != positional {
+		return nil, errors.New("Expected " + strconv.Itoa(positional) + " arguments, got " + strconv.Itoa(len(values)) + ": " + strings.Join(values, " "))
+	}
+	return values, nil
+}
+
+func required(flags map[string]*string) error {
+	var missing []string
+
+	for name, value := range flags {
+		if *value == "" {
+			missing = append(missing, "--"+name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return errors.New("Missing " + strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func nowMS() string {
+	return strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+}
+
+// Trailing optional arguments that are empty are left out, the functions check len(args) for those
+func trimArgs(args []string, requiredCount int) []string {
+	for len(args) > requiredCount && args[len(args)-1] == "" {
+		args = args[:len(args)-1]
+	}
+	return args
+}
+
+func (c *CLI) query(function string, args []string, columns []column) error {
+	result, err := c.Backend.Query(function, args)
+	if err != nil {
+		return err
+	}
+	body, err := gateway.Unwrap(result.Payload)
+	if err != nil {
+		return err
+	}
+	return c.print(body, columns)
+}
+
+func (c *CLI) invoke(function string, args []string) error {
+	result, err := c.Backend.Invoke(function, args)
+	if err != nil {
+		return err
+	}
+	body, err := gateway.Unwrap(result.Payload)
+	if err != nil {
+		return err
+	}
+	if body == nil {
+		if c.JSON {
+			return c.print([]byte("{\"tx_id\": "+strconv.Quote(result.TxID)+"}"), nil)
+		}
+		fmt.Fprintln(c.Out, "OK "+result.TxID)
+		return nil
+	}
+	return c.print(body, nil)
+}
+
+func (c *CLI) companyList(args []string) error {
+	fs := c.newFlags("company list")
+	companyType := fs.String("type", "all", "company type")
+	_, err := parseFlags(fs, args, 0)
+	if err != nil {
+		return err
+	}
+	return c.query("getCompanyList", []string{*companyType}, companyColumns)
+}
+
+func (c *CLI) companyTopup(args []string) error {
+	fs := c.newFlags("company topup")
+	date := fs.String("date", nowMS(), "top-up date in milliseconds")
+	values, err := parseFlags(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	return c.invoke("topupBankBalance", []string{values[0], values[1], *date})
+}
+
+func contractFunction(contractType string, prefix string) (string, error) {
+	switch contractType {
+	case "trade":
+		return prefix + "TradeRequest", nil
+	case "transport":
+		return prefix + "TransportRequest", nil
+	case "gas":
+		return prefix + "GasRequest", nil
+	}
+	return "", errors.New("Contract type must be trade, transport or gas, not " + contractType)
+}
+
+func (c *CLI) contractCreate(args []string) error {
+	fs := c.newFlags("contract create")
+	id := fs.String("id", "", "contract ID")
+	initiator := fs.String("initiator", "", "initiating company ID")
+	receiver := fs.String("receiver", "", "receiving company ID")
+	mwh := fs.String("mwh", "", "energy in MWh")
+	start := fs.String("start", "", "start date")
+	end := fs.String("end", "", "end date")
+	location := fs.String("location", "", "entry location")
+	penalty := fs.String("penalty", "", "penalty per MWh of shortfall")
+	plan := fs.String("plan", "", "receiver's business plan to book capacity on")
+	values, err := parseFlags(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	function, err := contractFunction(values[0], "create")
+	if err != nil {
+		return err
+	}
+	err = required(map[string]*string{"id": id, "initiator": initiator, "receiver": receiver, "mwh": mwh, "start": start, "end": end})
+	if err != nil {
+		return err
+	}
+	return c.invoke(function, trimArgs([]string{*id, *initiator, *receiver, *mwh, *start, *end, *location, *penalty, *plan}, 6))
+}
+
+func (c *CLI) contractList(args []string) error {
+	fs := c.newFlags("contract list")
+	company := fs.String("company", "", "company ID")
+	values, err := parseFlags(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	function, err := contractFunction(values[0], "get")
+	if err != nil {
+		return err
+	}
+	err = required(map[string]*string{"company": company})
+	if err != nil {
+		return err
+	}
+	return c.query(function+"List", []string{*company}, contractColumns)
+}
+
+func contractStatusCommand(status string) func(c *CLI, args []string) error {
+	return func(c *CLI, args []string) error {
+		fs := c.newFlags("contract")
+		date := fs.String("date", nowMS(), "status change date in milliseconds, accepted contracts are priced on it")
+		values, err := parseFlags(fs, args, 1)
+		if err != nil {
+			return err
+		}
+		return c.invoke("updateContractStatus", []string{values[0], status, *date})
+	}
+}
+
+func (c *CLI) contractInvoices(args []string) error {
+	values, err := parseFlags(c.newFlags("contract invoices"), args, 1)
+	if err != nil {
+		return err
+	}
+	return c.query("getInvoiceList", values, invoiceColumns)
+}
+
+func (c *CLI) contractIncidents(args []string) error {
+	values, err := parseFlags(c.newFlags("contract incidents"), args, 1)
+	if err != nil {
+		return err
+	}
+	return c.query("getIncidentList", values, incidentColumns)
+}
+
+func (c *CLI) iotList(args []string) error {
+	fs := c.newFlags("iot list")
+	company := fs.String("company", "", "company ID")
+	_, err := parseFlags(fs, args, 0)
+	if err != nil {
+		return err
+	}
+	err = required(map[string]*string{"company": company})
+	if err != nil {
+		return err
+	}
+	return c.query("getIOTData", []string{*company}, iotColumns)
+}
+
+func (c *CLI) invoicePay(args []string) error {
+	fs := c.newFlags("invoice pay")
+	contract := fs.String("contract", "", "contract ID, empty for invoices without a contract")
+	date := fs.String("date", nowMS(), "payment date in milliseconds")
+	values, err := parseFlags(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	return c.invoke("makePayment", []string{values[0], *contract, *date})
+}
+
+func (c *CLI) planList(args []string) error {
+	fs := c.newFlags("plan list")
+	location := fs.String("location", "", "entry or exit location")
+	minPrice := fs.String("min-price", "", "minimum gas price")
+	maxPrice := fs.String("max-price", "", "maximum gas price")
+	minCapacity := fs.String("min-capacity", "", "minimum capacity available for booking")
+	from := fs.String("from", "", "first delivery day the capacity has to be available on")
+	to := fs.String("to", "", "last delivery day the capacity has to be available on")
+	_, err := parseFlags(fs, args, 0)
+	if err != nil {
+		return err
+	}
+	return c.query("getBusinessPlanList", trimArgs([]string{*location, *minPrice, *maxPrice, *minCapacity, *from, *to}, 0), planColumns)
+}
+
+func (c *CLI) planUpdate(args []string) error {
+	fs := c.newFlags("plan update")
+	company := fs.String("company", "", "company ID")
+	date := fs.String("date", "", "plan date")
+	price := fs.String("price", "", "gas price")
+	entryLocation := fs.String("entry-location", "", "entry location")
+	entryCapacity := fs.String("entry-capacity", "", "entry capacity")
+	exitLocation := fs.String("exit-location", "", "exit location")
+	exitCapacity := fs.String("exit-capacity", "", "exit capacity")
+	from := fs.String("from", "", "effective from")
+	to := fs.String("to", "", "effective to")
+	values, err := parseFlags(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	err = required(map[string]*string{"company": company, "date": date, "price": price, "entry-location": entryLocation,
+		"entry-capacity": entryCapacity, "exit-location": exitLocation, "exit-capacity": exitCapacity})
+	if err != nil {
+		return err
+	}
+	return c.invoke("updateBusinessPlan", trimArgs([]string{values[0], *date, *price, *entryLocation, *entryCapacity, *exitLocation,
+		*exitCapacity, *company, *from, *to}, 8))
+}
+
+// A dry run is a query, so it also reports what would be deleted when run against a peer
+func (c *CLI) reset(args []string) error {
+	fs := c.newFlags("reset")
+	userID := fs.String("user", "", "administrator user ID")
+	password := fs.String("password", "", "administrator password")
+	scope := fs.String("scope", "all", "what to delete")
+	dryRun := fs.Bool("dry-run", false, "only report what would be deleted")
+	_, err := parseFlags(fs, args, 0)
+	if err != nil {
+		return err
+	}
+	err = required(map[string]*string{"user": userID, "password": password})
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		return c.query("getResetPreview", []string{*userID, *password, *scope}, nil)
+	}
+	return c.invoke("reset", []string{*userID, *password, *scope})
+}
+
+func (c *CLI) schemaVersions(args []string) error {
+	_, err := parseFlags(c.newFlags("schema versions"), args, 0)
+	if err != nil {
+		return err
+	}
+	return c.query("getSchemaVersionReport", nil, schemaVersionColumns)
+}
+
+func (c *CLI) schemaMigrate(args []string) error {
+	fs := c.newFlags("schema migrate")
+	userID := fs.String("user", "", "administrator user ID")
+	password := fs.String("password", "", "administrator password")
+	entityType := fs.String("type", "", "entity type, all types if empty")
+	batch := fs.String("batch", "", "records to migrate per transaction")
+	_, err := parseFlags(fs, args, 0)
+	if err != nil {
+		return err
+	}
+	err = required(map[string]*string{"user": userID, "password": password})
+	if err != nil {
+		return err
+	}
+	return c.invoke("migrateRecords", trimArgs([]string{*userID, *password, *entityType, *batch}, 2))
+}
+
+// Moves the users and trade requests of the energyTrading chaincode onto this network
+func (c *CLI) legacyMigrate(args []string) error {
+	fs := c.newFlags("legacy migrate")
+	userID := fs.String("user", "", "administrator user ID")
+	password := fs.String("password", "", "administrator password")
+	chaincode := fs.String("chaincode", "", "name of the energyTrading chaincode, empty to read this ledger")
+	priceUnit := fs.String("price-unit", "kwh", "energy unit the legacy gas prices are quoted in")
+	dryRun := fs.Bool("dry-run", false, "only report what would be migrated")
+	_, err := parseFlags(fs, args, 0)
+	if err != nil {
+		return err
+	}
+	err = required(map[string]*string{"user": userID, "password": password})
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		return c.query("getLegacyMigrationPreview", []string{*userID, *password, *chaincode, *priceUnit}, nil)
+	}
+	return c.invoke("migrateLegacyData", []string{*userID, *password, *chaincode, *priceUnit})
+}
+
+func rawCommand(kind string) func(c *CLI, args []string) error {
+	return func(c *CLI, args []string) error {
+		if len(args) < 1 {
+			return errors.New("Expected a function name")
+		}
+		if kind == "invoke" {
+			return c.invoke(args[0], args[1:])
+		}
+		return c.query(args[0], args[1:], nil)
+	}
+}
+
+func (c *CLI) serve(args []string) error {
+	fs := c.newFlags("serve")
+	listen := fs.String("listen", ":8080", "address to serve the REST API on")
+	_, err := parseFlags(fs, args, 0)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.Err, "Serving the energy trading API on "+*listen)
+	return http.ListenAndServe(*listen, gateway.NewServer(c.Backend))
+}
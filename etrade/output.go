@@ -0,0 +1,235 @@
+package etrade
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/preethimohan1/learn-chaincode/gateway"
+)
+
+// A table column, Path is a field of the listed objects and may be dotted for nested objects
+type column struct {
+	Header string
+	Path   string
+}
+
+var companyColumns = []column{{"ID", "company_id"}, {"TYPE", "company_type"}, {"NAME", "company_name"}, {"LOCATION", "company_location"},
+	{"BALANCE", "bank_balance"}, {"CREDIT LIMIT", "credit_limit"}}
+
+var contractColumns = []column{{"ID", "contract.contract_id"}, {"INITIATOR", "contract.contract_initiator_id"},
+	{"RECEIVER", "contract.contract_receiver_id"}, {"MWH", "contract.contract_energy_mwh"}, {"START", "contract.contract_start_date"},
+	{"END", "contract.contract_end_date"}, {"STATUS", "contract.contract_status"}}
+
+var invoiceColumns = []column{{"ID", "invoice_id"}, {"CONTRACT", "contract_id"}, {"TYPE", "invoice_type"}, {"MWH", "energy_mwh"},
+	{"UNIT PRICE", "unit_price"}, {"AMOUNT", "amount"}, {"STATUS", "payment_status"}}
+
+var incidentColumns = []column{{"ID", "incident_id"}, {"CONTRACT", "contract_id"}, {"STATUS", "incident_status"},
+	{"EXPECTED MWH", "expected_energy_mwh"}, {"ACTUAL MWH", "actual_energy_mwh"}}
+
+var iotColumns = []column{{"DEVICE", "device_id"}, {"LOCATION", "device_location"}, {"COMPANY", "company_id"}, {"MWH", "energy_mwh"},
+	{"PRESSURE KPA", "pressure_kpa"}, {"TEMPERATURE C", "temperature_c"}, {"TIMESTAMP MS", "timestamp_ms"}}
+
+var planColumns = []column{{"PLAN", "business_plan.bp_plan_id"}, {"COMPANY", "business_plan.bp_company_id"}, {"DATE", "business_plan.bp_plan_date"},
+	{"PRICE", "business_plan.bp_gas_price"}, {"ENTRY", "business_plan.bp_entry_location"}, {"ENTRY CAP", "business_plan.bp_entry_capacity"},
+	{"EXIT", "business_plan.bp_exit_location"}, {"EXIT CAP", "business_plan.bp_exit_capacity"}, {"VERSION", "business_plan.bp_version"}}
+
+var schemaVersionColumns = []column{{"TYPE", "entity_type"}, {"CURRENT VERSION", "current_version"}, {"RECORDS BY VERSION", "versions"}}
+
+// Prints a result as indented JSON, or as a table: lists row by row in the given columns, objects field by field
+func (c *CLI) print(body []byte, columns []column) error {
+	var value interface{}
+
+	if c.JSON {
+		var indented bytes.Buffer
+		if json.Indent(&indented, body, "", "  ") != nil {
+			indented.Write(body)
+		}
+		fmt.Fprintln(c.Out, indented.String())
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	err := decoder.Decode(&value)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(c.Out, 0, 4, 2, ' ', 0)
+	switch v := value.(type) {
+	case []interface{}:
+		if len(v) == 0 {
+			fmt.Fprintln(c.Out, "(none)")
+			return nil
+		}
+		if columns == nil {
+			columns = columnsOf(v[0])
+		}
+		printRow(w, headers(columns))
+		for _, k := range v {
+			var cells []string
+			for _, col := range columns {
+				cells = append(cells, cell(lookup(k, col.Path)))
+			}
+			printRow(w, cells)
+		}
+	case map[string]interface{}:
+		var keys []string
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			printRow(w, []string{k, cell(v[k])})
+		}
+	default:
+		fmt.Fprintln(w, cell(v))
+	}
+	return w.Flush()
+}
+
+func headers(columns []column) []string {
+	var result []string
+
+	for _, k := range columns {
+		result = append(result, k.Header)
+	}
+	return result
+}
+
+// Columns for lists without a layout of their own: the plain fields of the first object
+func columnsOf(value interface{}) []column {
+	var columns []column
+
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return []column{{"VALUE", ""}}
+	}
+	for k, v := range object {
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+			continue
+		}
+		columns = append(columns, column{strings.ToUpper(k), k})
+	}
+	sort.Sort(columnsByPath(columns))
+	return columns
+}
+
+type columnsByPath []column
+
+func (a columnsByPath) Len() int           { return len(a) }
+func (a columnsByPath) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a columnsByPath) Less(i, j int) bool { return a[i].Path < a[j].Path }
+
+func lookup(value interface{}, path string) interface{} {
+	if path == "" {
+		return value
+	}
+	for _, k := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[k]
+	}
+	return value
+}
+
+func cell(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	}
+	valueBytes, _ := json.Marshal(value)
+	return string(valueBytes)
+}
+
+func printRow(w io.Writer, cells []string) {
+	fmt.Fprintln(w, strings.Join(cells, "\t"))
+}
+
+// Readings are pushed one addIOTData transaction each, in the order of the file
+func (c *CLI) iotPush(args []string) error {
+	var data []byte
+	var err error
+
+	values, err := parseFlags(c.newFlags("iot push"), args, 1)
+	if err != nil {
+		return err
+	}
+	if values[0] == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(values[0])
+	}
+	if err != nil {
+		return err
+	}
+
+	readings, err := parseReadings(data)
+	if err != nil {
+		return err
+	}
+	for i, k := range readings {
+		result, err := c.Backend.Invoke("addIOTData", []string{string(k)})
+		if err == nil {
+			_, err = gateway.Unwrap(result.Payload)
+		}
+		if err != nil {
+			return fmt.Errorf("Reading %d of %d: %v", i+1, len(readings), err)
+		}
+	}
+	fmt.Fprintf(c.Out, "Pushed %d readings\n", len(readings))
+	return nil
+}
+
+// A file holds one reading, a JSON array of readings or one reading per line
+func parseReadings(data []byte) ([]json.RawMessage, error) {
+	var readings []json.RawMessage
+
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		err := json.Unmarshal(data, &readings)
+		return readings, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), len(data)+1)
+	for scanner.Scan() {
+		var reading json.RawMessage
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		err := json.Unmarshal(line, &reading)
+		if err != nil {
+			//Not one reading per line, so the whole file is one reading
+			err = json.Unmarshal(data, &reading)
+			if err != nil {
+				return nil, errors.New("Readings must be JSON: " + err.Error())
+			}
+			return []json.RawMessage{reading}, nil
+		}
+		readings = append(readings, reading)
+	}
+	return readings, scanner.Err()
+}
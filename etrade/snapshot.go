@@ -0,0 +1,128 @@
+package etrade
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/preethimohan1/learn-chaincode/gateway"
+)
+
+// A snapshot file holds the exported chunks one per line, in the order they are imported
+func (c *CLI) snapshotExport(args []string) error {
+	var cursor string
+	var out io.Writer = c.Out
+	var chunks, entities int
+
+	fs := c.newFlags("snapshot export")
+	outPath := fs.String("out", "-", "file to write the snapshot to, - for stdout")
+	pageSize := fs.String("page-size", "", "entities per chunk")
+	_, err := parseFlags(fs, args, 0)
+	if err != nil {
+		return err
+	}
+	if *outPath != "-" {
+		file, err := os.Create(*outPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	for {
+		var chunk struct {
+			NextCursor  string `json:"next_cursor"`
+			EntityCount int    `json:"entity_count"`
+		}
+
+		result, err := c.Backend.Query("exportState", trimArgs([]string{cursor, *pageSize}, 1))
+		if err != nil {
+			return err
+		}
+		body, err := gateway.Unwrap(result.Payload)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(body, &chunk)
+		if err != nil {
+			return errors.New("Invalid snapshot chunk: " + err.Error())
+		}
+		var line bytes.Buffer
+		err = json.Compact(&line, body)
+		if err != nil {
+			return err
+		}
+		line.WriteString("\n")
+		_, err = out.Write(line.Bytes())
+		if err != nil {
+			return err
+		}
+
+		chunks++
+		entities = entities + chunk.EntityCount
+		if chunk.NextCursor == "" {
+			break
+		}
+		cursor = chunk.NextCursor
+	}
+	if *outPath != "-" {
+		fmt.Fprintf(c.Out, "Exported %d entities in %d chunks to %s\n", entities, chunks, *outPath)
+	}
+	return nil
+}
+
+func (c *CLI) snapshotImport(args []string) error {
+	var input io.Reader = os.Stdin
+	var chunks int
+
+	fs := c.newFlags("snapshot import")
+	userID := fs.String("user", "", "administrator user ID")
+	password := fs.String("password", "", "administrator password")
+	newUserPassword := fs.String("new-user-password", "", "password for imported users this network does not have yet")
+	values, err := parseFlags(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	err = required(map[string]*string{"user": userID, "password": password})
+	if err != nil {
+		return err
+	}
+	if values[0] != "-" {
+		file, err := os.Open(values[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		input = file
+	}
+
+	reader := bufio.NewReader(input)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			chunks++
+			result, err := c.Backend.Invoke("importState", trimArgs([]string{*userID, *password, string(line), *newUserPassword}, 3))
+			if err == nil {
+				_, err = gateway.Unwrap(result.Payload)
+			}
+			if err != nil {
+				return errors.New("Chunk " + strconv.Itoa(chunks) + ": " + err.Error())
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+	fmt.Fprintf(c.Out, "Imported %d chunks\n", chunks)
+	return c.query("getImportStatus", nil, nil)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"time"
+)
+
+// Configuration file of the relay, see relay.example.json
+type config struct {
+	Source         sourceConfig `json:"source"`
+	Sinks          []sinkConfig `json:"sinks"`
+	JournalPath    string       `json:"journal_path"`
+	CheckpointPath string       `json:"checkpoint_path"`
+}
+
+// Type "fabric" subscribes to the peer's event hub, type "local" reads event envelopes line by line from
+// Path ("-" for stdin), following the file as it grows when Follow is set
+type sourceConfig struct {
+	Type              string `json:"type"`
+	PeerEventAddress  string `json:"peer_event_address"`
+	ChaincodeID       string `json:"chaincode_id"`
+	EventName         string `json:"event_name"`
+	RegTimeoutSeconds int    `json:"reg_timeout_seconds"`
+	Path              string `json:"path"`
+	Follow            bool   `json:"follow"`
+}
+
+// Type is "webhook", "file" or "stdout". EventTypes and CompanyIDs restrict what the sink receives.
+type sinkConfig struct {
+	Name           string   `json:"name"`
+	Type           string   `json:"type"`
+	URL            string   `json:"url"`
+	Secret         string   `json:"secret"`
+	MaxAttempts    int      `json:"max_attempts"`
+	TimeoutSeconds int      `json:"timeout_seconds"`
+	Path           string   `json:"path"`
+	EventTypes     []string `json:"event_types"`
+	CompanyIDs     []string `json:"company_ids"`
+}
+
+var defaultEventName = "etrading"
+var defaultMaxAttempts = 5
+var defaultTimeout = 10 * time.Second
+
+func loadConfig(path string) (config, error) {
+	var cfg config
+
+	cfgBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	err = json.Unmarshal(cfgBytes, &cfg)
+	if err != nil {
+		return cfg, errors.New("Invalid configuration " + path + ": " + err.Error())
+	}
+
+	if cfg.Source.EventName == "" {
+		cfg.Source.EventName = defaultEventName
+	}
+	if cfg.Source.Type != "fabric" && cfg.Source.Type != "local" {
+		return cfg, errors.New("Source type must be fabric or local, not " + cfg.Source.Type)
+	}
+	if cfg.Source.Type == "fabric" && (cfg.Source.PeerEventAddress == "" || cfg.Source.ChaincodeID == "") {
+		return cfg, errors.New("A fabric source needs peer_event_address and chaincode_id")
+	}
+	if len(cfg.Sinks) == 0 {
+		return cfg, errors.New("No sinks configured")
+	}
+	if cfg.JournalPath == "" || cfg.CheckpointPath == "" {
+		return cfg, errors.New("journal_path and checkpoint_path are required")
+	}
+
+	for i := range cfg.Sinks {
+		if cfg.Sinks[i].Name == "" {
+			cfg.Sinks[i].Name = cfg.Sinks[i].Type
+		}
+		if cfg.Sinks[i].MaxAttempts <= 0 {
+			cfg.Sinks[i].MaxAttempts = defaultMaxAttempts
+		}
+	}
+	return cfg, nil
+}
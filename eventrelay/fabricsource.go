@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/hyperledger/fabric/events/consumer"
+	pb "github.com/hyperledger/fabric/protos"
+)
+
+var reconnectDelay = 5 * time.Second
+var maxReconnectDelay = 2 * time.Minute
+
+// Subscribes to the chaincode events of the peer's event hub and reconnects when the connection drops
+type fabricSource struct {
+	peerAddress string
+	chaincodeID string
+	eventName   string
+	regTimeout  time.Duration
+	payloads    chan<- []byte
+	ctx         context.Context
+	lost        chan error
+}
+
+func newFabricSource(cfg sourceConfig) *fabricSource {
+	regTimeout := time.Duration(cfg.RegTimeoutSeconds) * time.Second
+	if regTimeout <= 0 {
+		regTimeout = 5 * time.Second
+	}
+	return &fabricSource{peerAddress: cfg.PeerEventAddress, chaincodeID: cfg.ChaincodeID, eventName: cfg.EventName, regTimeout: regTimeout}
+}
+
+func (s *fabricSource) GetInterestedEvents() ([]*pb.Interest, error) {
+	return []*pb.Interest{
+		{EventType: pb.EventType_CHAINCODE,
+			RegInfo: &pb.Interest_ChaincodeRegInfo{
+				ChaincodeRegInfo: &pb.ChaincodeReg{ChaincodeID: s.chaincodeID, EventName: s.eventName}}}}, nil
+}
+
+func (s *fabricSource) Recv(msg *pb.Event) (bool, error) {
+	chaincodeEvent, ok := msg.Event.(*pb.Event_ChaincodeEvent)
+	if !ok || chaincodeEvent.ChaincodeEvent == nil || chaincodeEvent.ChaincodeEvent.EventName != s.eventName {
+		return true, nil
+	}
+	select {
+	case s.payloads <- chaincodeEvent.ChaincodeEvent.Payload:
+		return true, nil
+	case <-s.ctx.Done():
+		return false, s.ctx.Err()
+	}
+}
+
+func (s *fabricSource) Disconnected(err error) {
+	if err == nil {
+		err = errors.New("disconnected")
+	}
+	select {
+	case s.lost <- err:
+	default:
+	}
+}
+
+func (s *fabricSource) Run(ctx context.Context, payloads chan<- []byte) error {
+	s.ctx = ctx
+	s.payloads = payloads
+	delay := reconnectDelay
+
+	for {
+		s.lost = make(chan error, 1)
+		client, err := consumer.NewEventsClient(s.peerAddress, s.regTimeout, s)
+		if err == nil {
+			err = client.Start()
+		}
+		if err == nil {
+			log.Printf("Listening for %s events of chaincode %s on %s", s.eventName, s.chaincodeID, s.peerAddress)
+			delay = reconnectDelay
+			select {
+			case err = <-s.lost:
+			case <-ctx.Done():
+				client.Stop()
+				return ctx.Err()
+			}
+			client.Stop()
+		}
+
+		log.Printf("Event hub connection to %s lost (%v), reconnecting in %s", s.peerAddress, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay = delay * 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
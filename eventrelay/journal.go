@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Every envelope received is appended to the journal before it is delivered. The checkpoint holds the
+// sequence number of the last journal entry delivered to all sinks, so a restart resumes after it and
+// a replay can start from any earlier entry.
+type journalEntry struct {
+	Seq        int64           `json:"seq"`
+	TxID       string          `json:"tx_id"`
+	ReceivedAt string          `json:"received_at"`
+	Envelope   json.RawMessage `json:"envelope"`
+}
+
+type checkpoint struct {
+	Seq       int64  `json:"seq"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+type journal struct {
+	path    string
+	file    *os.File
+	lastSeq int64
+	txIDs   map[string]bool
+}
+
+// Journal lines can be large, an envelope carries all events of a transaction
+var maxJournalLine = 16 * 1024 * 1024
+
+func openJournal(path string) (*journal, error) {
+	journalObj := &journal{path: path, txIDs: make(map[string]bool)}
+
+	entries, err := readJournal(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range entries {
+		journalObj.lastSeq = k.Seq
+		journalObj.txIDs[k.TxID] = true
+	}
+
+	journalObj.file, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return journalObj, nil
+}
+
+func readJournal(path string) ([]journalEntry, error) {
+	var entries []journalEntry
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxJournalLine)
+	for scanner.Scan() {
+		var entry journalEntry
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return nil, errors.New("Corrupt journal entry after seq " + strconv.FormatInt(lastSeq(entries), 10) + ": " + err.Error())
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+func lastSeq(entries []journalEntry) int64 {
+	if len(entries) == 0 {
+		return 0
+	}
+	return entries[len(entries)-1].Seq
+}
+
+// Seen tells whether a transaction's envelope is already journaled, the event hub can repeat events after a reconnect
+func (j *journal) Seen(txID string) bool {
+	return txID != "" && j.txIDs[txID]
+}
+
+func (j *journal) Append(txID string, envelope []byte) (journalEntry, error) {
+	entry := journalEntry{Seq: j.lastSeq + 1, TxID: txID, ReceivedAt: time.Now().UTC().Format(time.RFC3339), Envelope: json.RawMessage(envelope)}
+
+	entryBytes, err := json.Marshal(&entry)
+	if err != nil {
+		return entry, err
+	}
+	_, err = j.file.Write(append(entryBytes, '\n'))
+	if err != nil {
+		return entry, err
+	}
+	err = j.file.Sync()
+	if err != nil {
+		return entry, err
+	}
+
+	j.lastSeq = entry.Seq
+	j.txIDs[txID] = true
+	return entry, nil
+}
+
+// Entries with a sequence number from fromSeq on
+func (j *journal) EntriesFrom(fromSeq int64) ([]journalEntry, error) {
+	var result []journalEntry
+
+	entries, err := readJournal(j.path)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range entries {
+		if k.Seq >= fromSeq {
+			result = append(result, k)
+		}
+	}
+	return result, nil
+}
+
+func (j *journal) Close() error {
+	return j.file.Close()
+}
+
+func loadCheckpoint(path string) (int64, error) {
+	var checkpointObj checkpoint
+
+	checkpointBytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	err = json.Unmarshal(checkpointBytes, &checkpointObj)
+	if err != nil {
+		return 0, errors.New("Invalid checkpoint " + path + ": " + err.Error())
+	}
+	return checkpointObj.Seq, nil
+}
+
+// Written to a temporary file first so a crash never leaves a half written checkpoint
+func saveCheckpoint(path string, seq int64) error {
+	checkpointBytes, _ := json.Marshal(checkpoint{Seq: seq, UpdatedAt: time.Now().UTC().Format(time.RFC3339)})
+
+	err := ioutil.WriteFile(path+".tmp", checkpointBytes, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,80 @@
+// Command eventrelay delivers the chaincode events of the energy trading network to webhooks, JSONL files
+// and stdout. Received events are journaled and a checkpoint records what was delivered, so the relay
+// resumes where it stopped and can replay earlier events.
+//
+//	eventrelay -config relay.json
+//	eventrelay -config relay.json -replay-from 1 -replay-only
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	configPath := flag.String("config", "relay.json", "configuration file")
+	replayFrom := flag.Int64("replay-from", 0, "deliver the journal again from this sequence number before relaying new events")
+	replayOnly := flag.Bool("replay-only", false, "stop after delivering the journal instead of relaying new events")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	journalObj, err := openJournal(cfg.JournalPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	relayObj := &relay{journal: journalObj, checkpointPath: cfg.CheckpointPath}
+	defer relayObj.Close()
+
+	for _, k := range cfg.Sinks {
+		s, err := newSink(k)
+		if err != nil {
+			log.Fatal(err)
+		}
+		relayObj.sinks = append(relayObj.sinks, filteredSink{sink: s, eventTypes: k.EventTypes, companyIDs: k.CompanyIDs})
+	}
+
+	var src source
+	if cfg.Source.Type == "fabric" {
+		src = newFabricSource(cfg.Source)
+	} else {
+		src = newLocalSource(cfg.Source.Path, cfg.Source.Follow)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	//Without an explicit replay, resume after the last entry delivered to all sinks
+	fromSeq := *replayFrom
+	if fromSeq <= 0 {
+		checkpointSeq, err := loadCheckpoint(cfg.CheckpointPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fromSeq = checkpointSeq + 1
+	}
+	err = relayObj.replay(ctx, fromSeq)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *replayOnly {
+		return
+	}
+
+	err = relayObj.run(ctx, src)
+	if err != nil && err != context.Canceled {
+		log.Fatal(err)
+	}
+}
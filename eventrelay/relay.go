@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+)
+
+// Envelope the chaincode sets as its "etrading" event, one per transaction
+type eventEnvelope struct {
+	SchemaVersion int          `json:"schema_version"`
+	TxID          string       `json:"tx_id"`
+	Events        []relayEvent `json:"events"`
+}
+
+type relayEvent struct {
+	Sequence   int             `json:"sequence"`
+	EventType  string          `json:"event_type"`
+	EntityID   string          `json:"entity_id"`
+	CompanyIDs []string        `json:"company_ids"`
+	Data       json.RawMessage `json:"data"`
+}
+
+// What sinks receive for each business event. DeliveryID (<tx_id>-<sequence>) stays the same when an event
+// is delivered again after a restart or replay, so receivers can drop duplicates.
+type delivery struct {
+	DeliveryID    string     `json:"delivery_id"`
+	JournalSeq    int64      `json:"journal_seq"`
+	SchemaVersion int        `json:"schema_version"`
+	TxID          string     `json:"tx_id"`
+	Event         relayEvent `json:"event"`
+}
+
+type relay struct {
+	journal        *journal
+	checkpointPath string
+	sinks          []filteredSink
+}
+
+// Delivers every event of a journal entry to the sinks that want it, then moves the checkpoint past the entry
+func (r *relay) deliverEntry(ctx context.Context, entry journalEntry) error {
+	var envelopeObj eventEnvelope
+
+	err := json.Unmarshal(entry.Envelope, &envelopeObj)
+	if err != nil {
+		log.Printf("Skipping journal entry %d, not an event envelope: %v", entry.Seq, err)
+		return saveCheckpoint(r.checkpointPath, entry.Seq)
+	}
+
+	for _, eventObj := range envelopeObj.Events {
+		deliveryObj := delivery{DeliveryID: envelopeObj.TxID + "-" + strconv.Itoa(eventObj.Sequence), JournalSeq: entry.Seq,
+			SchemaVersion: envelopeObj.SchemaVersion, TxID: envelopeObj.TxID, Event: eventObj}
+		body, err := json.Marshal(&deliveryObj)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range r.sinks {
+			if !s.accepts(eventObj) {
+				continue
+			}
+			err = s.Deliver(ctx, deliveryObj, body)
+			if _, permanent := err.(permanentError); permanent {
+				log.Printf("Dropping delivery %s for %s: %v", deliveryObj.DeliveryID, s.Name(), err)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return saveCheckpoint(r.checkpointPath, entry.Seq)
+}
+
+// Delivers the journal again from an entry on
+func (r *relay) replay(ctx context.Context, fromSeq int64) error {
+	entries, err := r.journal.EntriesFrom(fromSeq)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		log.Printf("Replaying %d journal entries from seq %d", len(entries), fromSeq)
+	}
+	for _, entry := range entries {
+		err = r.deliverEntry(ctx, entry)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Journals and delivers envelopes from the source until the context ends or a delivery keeps failing.
+// A failed entry stays in the journal behind the checkpoint and is delivered again on the next start.
+func (r *relay) run(ctx context.Context, src source) error {
+	payloads := make(chan []byte)
+	sourceErr := make(chan error, 1)
+
+	go func() {
+		sourceErr <- src.Run(ctx, payloads)
+	}()
+
+	for {
+		select {
+		case payload := <-payloads:
+			var envelopeObj eventEnvelope
+			err := json.Unmarshal(payload, &envelopeObj)
+			if err != nil {
+				log.Printf("Ignoring event payload that is not an envelope: %v", err)
+				continue
+			}
+			if r.journal.Seen(envelopeObj.TxID) {
+				continue
+			}
+
+			entry, err := r.journal.Append(envelopeObj.TxID, payload)
+			if err != nil {
+				return err
+			}
+			err = r.deliverEntry(ctx, entry)
+			if err != nil {
+				return err
+			}
+		case err := <-sourceErr:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (r *relay) Close() {
+	for _, s := range r.sinks {
+		s.Close()
+	}
+	r.journal.Close()
+}
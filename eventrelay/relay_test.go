@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func init() {
+	firstRetryDelay = time.Millisecond
+}
+
+// Webhook receiver that records every request and answers the first failures requests with status
+type webhookRecorder struct {
+	server   *httptest.Server
+	mutex    sync.Mutex
+	requests []recordedRequest
+	failures int
+	status   int
+}
+
+type recordedRequest struct {
+	header http.Header
+	body   []byte
+	status int
+}
+
+func newWebhookRecorder(failures int, status int) *webhookRecorder {
+	rec := &webhookRecorder{failures: failures, status: status}
+	rec.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+
+		rec.mutex.Lock()
+		defer rec.mutex.Unlock()
+		status := http.StatusOK
+		if rec.failures > 0 {
+			rec.failures--
+			status = rec.status
+		}
+		rec.requests = append(rec.requests, recordedRequest{header: req.Header, body: body, status: status})
+		w.WriteHeader(status)
+	}))
+	return rec
+}
+
+func (rec *webhookRecorder) sink(secret string, maxAttempts int) *webhookSink {
+	return &webhookSink{name: "hook", url: rec.server.URL, secret: secret, maxAttempts: maxAttempts, client: rec.server.Client()}
+}
+
+// Requests the receiver accepted, the retried ones left out
+func (rec *webhookRecorder) accepted() []recordedRequest {
+	var result []recordedRequest
+
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	for _, k := range rec.requests {
+		if k.status == http.StatusOK {
+			result = append(result, k)
+		}
+	}
+	return result
+}
+
+func (rec *webhookRecorder) deliveryIDs() []string {
+	var ids []string
+
+	for _, k := range rec.accepted() {
+		ids = append(ids, k.header.Get("X-Etrading-Delivery"))
+	}
+	return ids
+}
+
+func testEnvelope(txID string, events ...relayEvent) []byte {
+	for i := range events {
+		events[i].Sequence = i + 1
+		events[i].Data = json.RawMessage("{}")
+	}
+	envelopeBytes, _ := json.Marshal(eventEnvelope{SchemaVersion: 1, TxID: txID, Events: events})
+	return envelopeBytes
+}
+
+func testDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "eventrelay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func openTestRelay(t *testing.T, dir string, sinks ...filteredSink) *relay {
+	journalObj, err := openJournal(filepath.Join(dir, "journal.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &relay{journal: journalObj, checkpointPath: filepath.Join(dir, "checkpoint.json"), sinks: sinks}
+}
+
+// Runs the relay over a local source until done reports true or run returns, and returns what run returned
+func runRelay(t *testing.T, r *relay, payloads [][]byte, done func() bool) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	src := newLocalSource("", false)
+	result := make(chan error, 1)
+	go func() {
+		result <- r.run(ctx, src)
+	}()
+	for _, k := range payloads {
+		src.Publish(k)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		select {
+		case err := <-result:
+			return err
+		case <-time.After(5 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("relay did not deliver in time")
+		}
+	}
+	cancel()
+	return <-result
+}
+
+func TestRelayDeliversEachTransactionOnce(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	rec := newWebhookRecorder(0, 0)
+	defer rec.server.Close()
+
+	r := openTestRelay(t, dir, filteredSink{sink: rec.sink("", 1)})
+	payloads := [][]byte{
+		testEnvelope("tx1", relayEvent{EventType: "ContractCreated"}, relayEvent{EventType: "ContractStatusChanged"}),
+		testEnvelope("tx1", relayEvent{EventType: "ContractCreated"}, relayEvent{EventType: "ContractStatusChanged"}),
+		testEnvelope("tx2", relayEvent{EventType: "InvoiceIssued"}),
+	}
+	runRelay(t, r, payloads, func() bool { return len(rec.accepted()) >= 3 })
+	r.Close()
+
+	want := []string{"tx1-1", "tx1-2", "tx2-1"}
+	if ids := rec.deliveryIDs(); !reflect.DeepEqual(ids, want) {
+		t.Fatalf("delivered %v, expected %v", ids, want)
+	}
+	checkpointSeq, _ := loadCheckpoint(r.checkpointPath)
+	if checkpointSeq != 2 {
+		t.Errorf("checkpoint at %d, expected 2", checkpointSeq)
+	}
+
+	//The journal remembers the transactions after a restart, so repeated events are still dropped
+	r = openTestRelay(t, dir, filteredSink{sink: rec.sink("", 1)})
+	defer r.Close()
+	runRelay(t, r, [][]byte{payloads[0], testEnvelope("tx3", relayEvent{EventType: "InvoiceIssued"})},
+		func() bool { return len(rec.accepted()) >= 4 })
+
+	want = append(want, "tx3-1")
+	if ids := rec.deliveryIDs(); !reflect.DeepEqual(ids, want) {
+		t.Errorf("delivered %v after restart, expected %v", ids, want)
+	}
+}
+
+func TestRelayResumesAfterCheckpoint(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	down := newWebhookRecorder(1000, http.StatusServiceUnavailable)
+	defer down.server.Close()
+
+	//tx1 is delivered, tx2 fails and stops the relay behind the checkpoint
+	up := newWebhookRecorder(0, 0)
+	r := openTestRelay(t, dir, filteredSink{sink: up.sink("", 1)})
+	runRelay(t, r, [][]byte{testEnvelope("tx1", relayEvent{EventType: "InvoiceIssued"})}, func() bool { return len(up.accepted()) >= 1 })
+	up.server.Close()
+	r.sinks = []filteredSink{{sink: down.sink("", 2)}}
+	err := runRelay(t, r, [][]byte{testEnvelope("tx2", relayEvent{EventType: "InvoiceIssued"})}, func() bool { return false })
+	if err == nil {
+		t.Fatal("relay was expected to stop on the failing webhook")
+	}
+	r.Close()
+
+	checkpointSeq, _ := loadCheckpoint(r.checkpointPath)
+	if checkpointSeq != 1 {
+		t.Fatalf("checkpoint at %d, expected 1", checkpointSeq)
+	}
+
+	//A restart delivers only what is behind the checkpoint
+	rec := newWebhookRecorder(0, 0)
+	defer rec.server.Close()
+	r = openTestRelay(t, dir, filteredSink{sink: rec.sink("", 1)})
+	defer r.Close()
+	err = r.replay(context.Background(), checkpointSeq+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ids := rec.deliveryIDs(); !reflect.DeepEqual(ids, []string{"tx2-1"}) {
+		t.Errorf("resumed with %v, expected [tx2-1]", ids)
+	}
+	checkpointSeq, _ = loadCheckpoint(r.checkpointPath)
+	if checkpointSeq != 2 {
+		t.Errorf("checkpoint at %d after resuming, expected 2", checkpointSeq)
+	}
+}
+
+func TestWebhookSignsTimestampAndBody(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	rec := newWebhookRecorder(0, 0)
+	defer rec.server.Close()
+
+	r := openTestRelay(t, dir, filteredSink{sink: rec.sink("s3cret", 1)})
+	defer r.Close()
+	runRelay(t, r, [][]byte{testEnvelope("tx1", relayEvent{EventType: "InvoiceIssued"})}, func() bool { return len(rec.accepted()) >= 1 })
+
+	req := rec.accepted()[0]
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(req.header.Get("X-Etrading-Timestamp") + "." + string(req.body)))
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := req.header.Get("X-Etrading-Signature"); got != want {
+		t.Errorf("signature %q, expected %q", got, want)
+	}
+
+	var deliveryObj delivery
+	_ = json.Unmarshal(req.body, &deliveryObj)
+	if deliveryObj.DeliveryID != "tx1-1" || deliveryObj.TxID != "tx1" || deliveryObj.JournalSeq != 1 || deliveryObj.Event.EventType != "InvoiceIssued" {
+		t.Errorf("unexpected delivery %s", req.body)
+	}
+}
+
+func TestWebhookRetriesServerErrors(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	flaky := newWebhookRecorder(2, http.StatusBadGateway)
+	defer flaky.server.Close()
+	rejecting := newWebhookRecorder(1000, http.StatusBadRequest)
+	defer rejecting.server.Close()
+
+	r := openTestRelay(t, dir, filteredSink{sink: rejecting.sink("", 3)}, filteredSink{sink: flaky.sink("", 3)})
+	defer r.Close()
+	runRelay(t, r, [][]byte{testEnvelope("tx1", relayEvent{EventType: "InvoiceIssued"})}, func() bool { return len(flaky.accepted()) >= 1 })
+
+	flaky.mutex.Lock()
+	attempts := len(flaky.requests)
+	flaky.mutex.Unlock()
+	if attempts != 3 {
+		t.Errorf("%d attempts on 502, expected 3", attempts)
+	}
+
+	//A 4xx answer is not retried and does not hold up the other sinks
+	rejecting.mutex.Lock()
+	attempts = len(rejecting.requests)
+	rejecting.mutex.Unlock()
+	if attempts != 1 {
+		t.Errorf("%d attempts on 400, expected 1", attempts)
+	}
+	checkpointSeq, _ := loadCheckpoint(r.checkpointPath)
+	if checkpointSeq != 1 {
+		t.Errorf("checkpoint at %d, expected 1", checkpointSeq)
+	}
+}
+
+func TestFilteredSink(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	invoices := newWebhookRecorder(0, 0)
+	defer invoices.server.Close()
+	buyer := newWebhookRecorder(0, 0)
+	defer buyer.server.Close()
+	all := newWebhookRecorder(0, 0)
+	defer all.server.Close()
+
+	r := openTestRelay(t, dir,
+		filteredSink{sink: invoices.sink("", 1), eventTypes: []string{"InvoiceIssued", "PaymentSettled"}},
+		filteredSink{sink: buyer.sink("", 1), companyIDs: []string{"BUYER1"}},
+		filteredSink{sink: all.sink("", 1)})
+	defer r.Close()
+	payloads := [][]byte{
+		testEnvelope("tx1", relayEvent{EventType: "ContractCreated", CompanyIDs: []string{"BUYER1", "SHIPPER1"}},
+			relayEvent{EventType: "InvoiceIssued", CompanyIDs: []string{"BUYER2", "SHIPPER1"}}),
+		testEnvelope("tx2", relayEvent{EventType: "PaymentSettled", CompanyIDs: []string{"SHIPPER1", "BUYER1"}}),
+	}
+	runRelay(t, r, payloads, func() bool { return len(all.accepted()) >= 3 })
+
+	if ids := invoices.deliveryIDs(); !reflect.DeepEqual(ids, []string{"tx1-2", "tx2-1"}) {
+		t.Errorf("event type filter passed %v", ids)
+	}
+	if ids := buyer.deliveryIDs(); !reflect.DeepEqual(ids, []string{"tx1-1", "tx2-1"}) {
+		t.Errorf("company filter passed %v", ids)
+	}
+	if ids := all.deliveryIDs(); !reflect.DeepEqual(ids, []string{"tx1-1", "tx1-2", "tx2-1"}) {
+		t.Errorf("unfiltered sink got %v", ids)
+	}
+
+	both := filteredSink{eventTypes: []string{"InvoiceIssued"}, companyIDs: []string{"BUYER1"}}
+	if both.accepts(relayEvent{EventType: "InvoiceIssued", CompanyIDs: []string{"BUYER2"}}) ||
+		both.accepts(relayEvent{EventType: "ContractCreated", CompanyIDs: []string{"BUYER1"}}) ||
+		!both.accepts(relayEvent{EventType: "InvoiceIssued", CompanyIDs: []string{"SHIPPER1", "BUYER1"}}) {
+		t.Error("event type and company filters have to match together")
+	}
+}
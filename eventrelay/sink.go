@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A sink receives every business event as a delivery, body is the delivery encoded as JSON
+type sink interface {
+	Name() string
+	Deliver(ctx context.Context, deliveryObj delivery, body []byte) error
+	Close() error
+}
+
+// Returned when retrying cannot help, the relay skips the delivery for this sink
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+var firstRetryDelay = time.Second
+var maxRetryDelay = 30 * time.Second
+
+func newSink(cfg sinkConfig) (sink, error) {
+	switch cfg.Type {
+	case "webhook":
+		if cfg.URL == "" {
+			return nil, errors.New("Webhook sink " + cfg.Name + " needs a url")
+		}
+		timeout := defaultTimeout
+		if cfg.TimeoutSeconds > 0 {
+			timeout = time.Duration(cfg.TimeoutSeconds) * time.Second
+		}
+		return &webhookSink{name: cfg.Name, url: cfg.URL, secret: cfg.Secret, maxAttempts: cfg.MaxAttempts, client: &http.Client{Timeout: timeout}}, nil
+	case "file":
+		if cfg.Path == "" {
+			return nil, errors.New("File sink " + cfg.Name + " needs a path")
+		}
+		file, err := os.OpenFile(cfg.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return &writerSink{name: cfg.Name, writer: file, file: file}, nil
+	case "stdout":
+		return &writerSink{name: cfg.Name, writer: os.Stdout}, nil
+	}
+	return nil, errors.New("Unknown sink type: " + cfg.Type)
+}
+
+// Posts each delivery to a URL. With a secret the request carries X-Etrading-Signature, the hex HMAC-SHA256
+// of "<X-Etrading-Timestamp>.<body>", so receivers can check origin and reject old requests.
+// Network errors, 408, 429 and 5xx responses are retried with exponential backoff.
+type webhookSink struct {
+	name        string
+	url         string
+	secret      string
+	maxAttempts int
+	client      *http.Client
+}
+
+func (s *webhookSink) Name() string {
+	return s.name
+}
+
+func signPayload(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *webhookSink) Deliver(ctx context.Context, deliveryObj delivery, body []byte) error {
+	var lastErr error
+	delay := firstRetryDelay
+
+	for attempt := 1; attempt <= s.maxAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			delay = delay * 2
+			if delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+		}
+
+		lastErr = s.post(ctx, deliveryObj, body)
+		if lastErr == nil {
+			return nil
+		}
+		if _, permanent := lastErr.(permanentError); permanent {
+			return lastErr
+		}
+		fmt.Fprintf(os.Stderr, "Delivery %s to %s failed (attempt %d of %d): %v\n", deliveryObj.DeliveryID, s.name, attempt, s.maxAttempts, lastErr)
+	}
+	return lastErr
+}
+
+func (s *webhookSink) post(ctx context.Context, deliveryObj delivery, body []byte) error {
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req = req.WithContext(ctx)
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Etrading-Delivery", deliveryObj.DeliveryID)
+	req.Header.Set("X-Etrading-Event", deliveryObj.Event.EventType)
+	req.Header.Set("X-Etrading-Timestamp", timestamp)
+	if s.secret != "" {
+		req.Header.Set("X-Etrading-Signature", signPayload(s.secret, timestamp, body))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err = errors.New("webhook answered " + resp.Status)
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != 408 && resp.StatusCode != 429 {
+		return permanentError{err}
+	}
+	return err
+}
+
+func (s *webhookSink) Close() error {
+	return nil
+}
+
+// Appends one delivery per line to a JSONL file or stdout
+type writerSink struct {
+	name   string
+	writer io.Writer
+	file   *os.File
+	mutex  sync.Mutex
+}
+
+func (s *writerSink) Name() string {
+	return s.name
+}
+
+func (s *writerSink) Deliver(ctx context.Context, deliveryObj delivery, body []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.writer.Write(append(body, '\n'))
+	if err != nil {
+		return err
+	}
+	if s.file != nil {
+		return s.file.Sync()
+	}
+	return nil
+}
+
+func (s *writerSink) Close() error {
+	if s.file != nil {
+		return s.file.Close()
+	}
+	return nil
+}
+
+// Passes on only the event types and companies a sink is configured for
+type filteredSink struct {
+	sink
+	eventTypes []string
+	companyIDs []string
+}
+
+func (s filteredSink) accepts(eventObj relayEvent) bool {
+	if len(s.eventTypes) > 0 && !containsString(s.eventTypes, eventObj.EventType) {
+		return false
+	}
+	if len(s.companyIDs) == 0 {
+		return true
+	}
+	for _, k := range eventObj.CompanyIDs {
+		if containsString(s.companyIDs, k) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, value string) bool {
+	for _, k := range list {
+		if k == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"time"
+)
+
+// A source hands the payloads of chaincode events (event envelopes) to the relay until the context ends
+// or, for a local file that is not followed, until the end of the file
+type source interface {
+	Run(ctx context.Context, payloads chan<- []byte) error
+}
+
+var followInterval = 500 * time.Millisecond
+
+// Stand-in for the peer: envelopes are read line by line from a file or stdin, and can be published in process
+type localSource struct {
+	path      string
+	follow    bool
+	published chan []byte
+}
+
+func newLocalSource(path string, follow bool) *localSource {
+	return &localSource{path: path, follow: follow, published: make(chan []byte, 16)}
+}
+
+// Publish hands an envelope to the relay as if the peer had emitted it
+func (s *localSource) Publish(payload []byte) {
+	s.published <- payload
+}
+
+func (s *localSource) Run(ctx context.Context, payloads chan<- []byte) error {
+	if s.path == "" {
+		return s.forwardPublished(ctx, payloads)
+	}
+
+	var reader io.Reader = os.Stdin
+	if s.path != "-" {
+		file, err := os.Open(s.path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		reader = file
+	}
+
+	go s.forwardPublished(ctx, payloads)
+
+	//Lines are only complete once they end in a newline, a partial last line waits for the rest when following
+	bufReader := bufio.NewReader(reader)
+	var pending []byte
+	for {
+		line, err := bufReader.ReadBytes('\n')
+		pending = append(pending, line...)
+		if err == nil {
+			payload := bytes.TrimSpace(pending)
+			pending = nil
+			if len(payload) > 0 {
+				select {
+				case payloads <- payload:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			continue
+		}
+		if err != io.EOF {
+			return err
+		}
+		if !s.follow {
+			payload := bytes.TrimSpace(pending)
+			if len(payload) > 0 {
+				select {
+				case payloads <- payload:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			return nil
+		}
+		select {
+		case <-time.After(followInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *localSource) forwardPublished(ctx context.Context, payloads chan<- []byte) error {
+	for {
+		select {
+		case payload := <-s.published:
+			select {
+			case payloads <- payload:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Result of a chaincode call. Invokes through a peer only return the transaction ID, the in-process
+// backend also returns what the function returned.
+type Result struct {
+	TxID    string
+	Payload []byte
+}
+
+// A Backend runs the Invoke and Query functions of the chaincode
+type Backend interface {
+	Invoke(function string, args []string) (Result, error)
+	Query(function string, args []string) (Result, error)
+}
+
+// Error returned by the chaincode itself, as opposed to a failure to reach it
+type ChaincodeError struct {
+	Message string
+}
+
+func (e ChaincodeError) Error() string {
+	return e.Message
+}
+
+// Calls the JSON-RPC /chaincode endpoint of a Fabric v0.6 peer, the same requests as the Postman collection
+type peerBackend struct {
+	url           string
+	chaincodeName string
+	secureContext string
+	client        *http.Client
+	mutex         sync.Mutex
+	requestID     int
+}
+
+type rpcRequest struct {
+	JSONRPC string    `json:"jsonrpc"`
+	Method  string    `json:"method"`
+	Params  rpcParams `json:"params"`
+	ID      int       `json:"id"`
+}
+
+type rpcParams struct {
+	Type          int            `json:"type"`
+	ChaincodeID   rpcChaincodeID `json:"chaincodeID"`
+	CtorMsg       rpcCtorMsg     `json:"ctorMsg"`
+	SecureContext string         `json:"secureContext,omitempty"`
+}
+
+type rpcChaincodeID struct {
+	Name string `json:"name"`
+}
+
+type rpcCtorMsg struct {
+	Function string   `json:"function"`
+	Args     []string `json:"args"`
+}
+
+type rpcResponse struct {
+	Result *struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+	} `json:"result"`
+	Error *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Data    string `json:"data"`
+	} `json:"error"`
+}
+
+// NewPeerBackend talks to the REST API of a peer, peerURL is like http://localhost:7050
+func NewPeerBackend(peerURL string, chaincodeName string, secureContext string, client *http.Client) Backend {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &peerBackend{url: peerURL + "/chaincode", chaincodeName: chaincodeName, secureContext: secureContext, client: client}
+}
+
+func (b *peerBackend) Invoke(function string, args []string) (Result, error) {
+	message, err := b.call("invoke", function, args)
+	return Result{TxID: message}, err
+}
+
+func (b *peerBackend) Query(function string, args []string) (Result, error) {
+	message, err := b.call("query", function, args)
+	return Result{Payload: []byte(message)}, err
+}
+
+func (b *peerBackend) call(method string, function string, args []string) (string, error) {
+	var responseObj rpcResponse
+
+	b.mutex.Lock()
+	b.requestID++
+	requestObj := rpcRequest{JSONRPC: "2.0", Method: method, ID: b.requestID,
+		Params: rpcParams{Type: 1, ChaincodeID: rpcChaincodeID{Name: b.chaincodeName},
+			CtorMsg: rpcCtorMsg{Function: function, Args: args}, SecureContext: b.secureContext}}
+	b.mutex.Unlock()
+	if requestObj.Params.CtorMsg.Args == nil {
+		requestObj.Params.CtorMsg.Args = []string{}
+	}
+
+	requestBytes, _ := json.Marshal(&requestObj)
+	resp, err := b.client.Post(b.url, "application/json", bytes.NewReader(requestBytes))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(&responseObj)
+	if err != nil {
+		return "", errors.New("Invalid response from peer (HTTP " + strconv.Itoa(resp.StatusCode) + "): " + err.Error())
+	}
+	if responseObj.Error != nil {
+		//The peer reports errors of the chaincode in data
+		message := responseObj.Error.Data
+		if message == "" {
+			message = responseObj.Error.Message
+		}
+		return "", ChaincodeError{Message: message}
+	}
+	if responseObj.Result == nil {
+		return "", errors.New("Peer response has neither result nor error")
+	}
+	return responseObj.Result.Message, nil
+}
+
+// Chaincode running in process on a mock ledger, such as a localstub.Stub
+type MockChaincode interface {
+	MockInvoke(uuid string, function string, args []string) ([]byte, error)
+	MockQuery(function string, args []string) ([]byte, error)
+}
+
+// The mock ledger is not safe for concurrent use, calls are run one at a time
+type stubBackend struct {
+	stub     MockChaincode
+	mutex    sync.Mutex
+	txPrefix string
+	txNumber int
+}
+
+// NewStubBackend runs calls against chaincode on a mock ledger, for local testing without a peer.
+// Transaction IDs are local-<start time>-<n>, so they stay unique when a ledger is used by several runs.
+func NewStubBackend(stub MockChaincode) Backend {
+	return &stubBackend{stub: stub, txPrefix: "local-" + strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10) + "-"}
+}
+
+func (b *stubBackend) Invoke(function string, args []string) (Result, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.txNumber++
+	txID := b.txPrefix + strconv.Itoa(b.txNumber)
+	payload, err := b.stub.MockInvoke(txID, function, args)
+	if err != nil {
+		return Result{TxID: txID}, ChaincodeError{Message: err.Error()}
+	}
+	return Result{TxID: txID, Payload: payload}, nil
+}
+
+func (b *stubBackend) Query(function string, args []string) (Result, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	payload, err := b.stub.MockQuery(function, args)
+	if err != nil {
+		return Result{}, ChaincodeError{Message: err.Error()}
+	}
+	return Result{Payload: payload}, nil
+}
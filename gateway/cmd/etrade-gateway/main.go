@@ -0,0 +1,32 @@
+// Command etrade-gateway serves the REST API of package gateway against the chaincode deployed on a peer.
+// To run it without a peer, build the chaincode with the local tag and use its serve command instead:
+//
+//	etrade-gateway -peer http://localhost:7050 -chaincode <name returned by deploy> -user <enrolled user>
+//	go build -tags local -o etrade ./energyTrading1 && ./etrade serve -listen :8080
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/preethimohan1/learn-chaincode/gateway"
+)
+
+func main() {
+	listen := flag.String("listen", ":8080", "address to serve the API on")
+	peer := flag.String("peer", "http://localhost:7050", "REST endpoint of the peer")
+	chaincodeName := flag.String("chaincode", "", "chaincode name returned by the deploy request")
+	user := flag.String("user", "", "enrolled user the calls are made as (secureContext)")
+	timeout := flag.Duration("timeout", 30*time.Second, "timeout of calls to the peer")
+	flag.Parse()
+
+	if *chaincodeName == "" {
+		log.Fatal("-chaincode is required")
+	}
+
+	backend := gateway.NewPeerBackend(*peer, *chaincodeName, *user, &http.Client{Timeout: *timeout})
+	log.Printf("Serving the energy trading API on %s for chaincode %s on %s", *listen, *chaincodeName, *peer)
+	log.Fatal(http.ListenAndServe(*listen, gateway.NewServer(backend)))
+}
@@ -0,0 +1,145 @@
+package gateway
+
+// Where a positional argument of a chaincode function comes from
+type param struct {
+	Name     string `json:"name"`
+	In       string `json:"in"` // path, query, body or json (a body field passed on as JSON text)
+	Required bool   `json:"required,omitempty"`
+	Default  string `json:"default,omitempty"`
+}
+
+// A Route maps a resource endpoint to a chaincode function. Params are the function's arguments in order,
+// a route with WholeBody passes the request body as the only argument.
+type Route struct {
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Kind      string  `json:"kind"` // invoke or query
+	Function  string  `json:"function"`
+	Params    []param `json:"params,omitempty"`
+	WholeBody bool    `json:"whole_body,omitempty"`
+}
+
+func pathArg(name string) param {
+	return param{Name: name, In: "path", Required: true}
+}
+
+func queryArg(name string, required bool) param {
+	return param{Name: name, In: "query", Required: required}
+}
+
+func bodyArg(name string, required bool) param {
+	return param{Name: name, In: "body", Required: required}
+}
+
+func jsonArg(name string, required bool) param {
+	return param{Name: name, In: "json", Required: required}
+}
+
+func contractRoutes(contractType string, createFunction string, listFunction string) []Route {
+	return []Route{
+		{Method: "POST", Path: "/contracts/" + contractType, Kind: "invoke", Function: createFunction, Params: []param{
+			bodyArg("contract_id", true), bodyArg("initiator_id", true), bodyArg("receiver_id", true), bodyArg("energy_mwh", true),
+			bodyArg("start_date", true), bodyArg("end_date", true), bodyArg("entry_location", false), bodyArg("penalty_rate", false),
+			bodyArg("plan_id", false)}},
+		{Method: "GET", Path: "/contracts/" + contractType, Kind: "query", Function: listFunction, Params: []param{queryArg("company_id", true)}},
+	}
+}
+
+// DefaultRoutes covers the main functions of energyTrading1, anything else can be reached through
+// POST /invoke/{function} and POST /query/{function} with {"args": [...]}
+func DefaultRoutes() []Route {
+	var routes []Route
+
+	routes = append(routes, []Route{
+		{Method: "GET", Path: "/companies", Kind: "query", Function: "getCompanyList", Params: []param{{Name: "type", In: "query", Default: "all"}}},
+		{Method: "POST", Path: "/companies/{id}/topups", Kind: "invoke", Function: "topupBankBalance", Params: []param{
+			pathArg("id"), bodyArg("amount", true), bodyArg("date_ms", true)}},
+		{Method: "PUT", Path: "/companies/{id}/credit-limit", Kind: "invoke", Function: "setCreditLimit", Params: []param{
+			pathArg("id"), bodyArg("credit_limit", true), bodyArg("margin_call_pct", false)}},
+		{Method: "GET", Path: "/companies/{id}/exposure", Kind: "query", Function: "getExposure", Params: []param{
+			pathArg("id"), queryArg("counterparty_id", false)}},
+		{Method: "GET", Path: "/companies/{id}/ledger", Kind: "query", Function: "getLedgerEntries", Params: []param{pathArg("id")}},
+		{Method: "GET", Path: "/companies/{id}/disputes", Kind: "query", Function: "getDisputeList", Params: []param{pathArg("id")}},
+		{Method: "GET", Path: "/companies/{id}/orders", Kind: "query", Function: "getOrderList", Params: []param{pathArg("id")}},
+		{Method: "GET", Path: "/companies/{id}/imbalances", Kind: "query", Function: "getImbalanceAccounts", Params: []param{
+			pathArg("id"), queryArg("from", false), queryArg("to", false)}},
+
+		{Method: "POST", Path: "/users", Kind: "invoke", Function: "register", Params: []param{
+			bodyArg("user_name", true), bodyArg("password", true), jsonArg("company", true)}},
+		{Method: "GET", Path: "/users/{name}", Kind: "query", Function: "getUserInfo", Params: []param{pathArg("name"), queryArg("company_id", true)}},
+		{Method: "POST", Path: "/sessions", Kind: "query", Function: "validateUser", Params: []param{
+			bodyArg("user_name", true), bodyArg("password", true)}},
+
+		{Method: "GET", Path: "/plans", Kind: "query", Function: "getBusinessPlanList", Params: []param{
+			queryArg("location", false), queryArg("min_price", false), queryArg("max_price", false), queryArg("min_capacity", false),
+			queryArg("from", false), queryArg("to", false)}},
+		{Method: "PUT", Path: "/plans/{id}", Kind: "invoke", Function: "updateBusinessPlan", Params: []param{
+			pathArg("id"), bodyArg("plan_date", true), bodyArg("gas_price", true), bodyArg("entry_location", true), bodyArg("entry_capacity", true),
+			bodyArg("exit_location", true), bodyArg("exit_capacity", true), bodyArg("company_id", true), bodyArg("effective_from", false),
+			bodyArg("effective_to", false)}},
+	}...)
+
+	routes = append(routes, contractRoutes("trade", "createTradeRequest", "getTradeRequestList")...)
+	routes = append(routes, contractRoutes("transport", "createTransportRequest", "getTransportRequestList")...)
+	routes = append(routes, contractRoutes("gas", "createGasRequest", "getGasRequestList")...)
+
+	routes = append(routes, []Route{
+		{Method: "PUT", Path: "/contracts/{id}/status", Kind: "invoke", Function: "updateContractStatus", Params: []param{
+			pathArg("id"), bodyArg("status", true), bodyArg("date_ms", false)}},
+		{Method: "GET", Path: "/contracts/{id}/invoices", Kind: "query", Function: "getInvoiceList", Params: []param{pathArg("id")}},
+		{Method: "GET", Path: "/contracts/{id}/incidents", Kind: "query", Function: "getIncidentList", Params: []param{pathArg("id")}},
+		{Method: "GET", Path: "/contracts/{id}/credit-notes", Kind: "query", Function: "getCreditNoteList", Params: []param{pathArg("id")}},
+		{Method: "POST", Path: "/contracts/{id}/offers", Kind: "invoke", Function: "submitCounterOffer", Params: []param{
+			pathArg("id"), bodyArg("proposer_id", true), bodyArg("countered_version", true), jsonArg("terms", true), bodyArg("date_ms", true)}},
+		{Method: "POST", Path: "/contracts/{id}/offers/{version}/accept", Kind: "invoke", Function: "acceptOffer", Params: []param{
+			pathArg("id"), bodyArg("company_id", true), pathArg("version"), bodyArg("date_ms", true)}},
+		{Method: "POST", Path: "/contracts/{id}/offers/{version}/reject", Kind: "invoke", Function: "rejectOffer", Params: []param{
+			pathArg("id"), bodyArg("company_id", true), pathArg("version")}},
+
+		{Method: "POST", Path: "/iot/readings", Kind: "invoke", Function: "addIOTData", WholeBody: true},
+		{Method: "GET", Path: "/iot/readings", Kind: "query", Function: "getIOTData", Params: []param{queryArg("company_id", true)}},
+		{Method: "GET", Path: "/shippers/{id}/iot/readings", Kind: "query", Function: "getIOTDataForShipper", Params: []param{pathArg("id")}},
+
+		{Method: "POST", Path: "/invoices/{id}/payments", Kind: "invoke", Function: "makePayment", Params: []param{
+			pathArg("id"), bodyArg("contract_id", false), bodyArg("date_ms", true)}},
+		{Method: "PUT", Path: "/incidents/{id}/status", Kind: "invoke", Function: "updateIncidentStatus", Params: []param{
+			pathArg("id"), bodyArg("status", true), bodyArg("company_id", true), bodyArg("comments", false), bodyArg("date_ms", true)}},
+		{Method: "POST", Path: "/incidents/{id}/resolution", Kind: "invoke", Function: "resolveIncident", Params: []param{
+			pathArg("id"), bodyArg("company_id", true), bodyArg("responsible_party", true), bodyArg("root_cause", true), bodyArg("comments", false),
+			bodyArg("date_ms", true), bodyArg("invoice_id", false)}},
+		{Method: "GET", Path: "/disputes/{id}", Kind: "query", Function: "getDispute", Params: []param{pathArg("id")}},
+
+		{Method: "POST", Path: "/settlements", Kind: "invoke", Function: "runSettlement", Params: []param{
+			bodyArg("settlement_id", true), bodyArg("period_start_ms", true), bodyArg("period_end_ms", true), bodyArg("date_ms", true)}},
+		{Method: "GET", Path: "/settlements", Kind: "query", Function: "getSettlementList"},
+		{Method: "GET", Path: "/settlements/{id}", Kind: "query", Function: "getSettlementReport", Params: []param{pathArg("id")}},
+
+		{Method: "POST", Path: "/orders", Kind: "invoke", Function: "placeOrder", Params: []param{
+			bodyArg("order_id", true), bodyArg("company_id", true), bodyArg("side", true), bodyArg("delivery_point", true), bodyArg("start_date", true),
+			bodyArg("end_date", true), bodyArg("quantity_mwh", true), bodyArg("limit_price", true), bodyArg("date_ms", false)}},
+		{Method: "DELETE", Path: "/orders/{id}", Kind: "invoke", Function: "cancelOrder", Params: []param{pathArg("id"), queryArg("company_id", true)}},
+		{Method: "GET", Path: "/orderbook", Kind: "query", Function: "getOrderBook", Params: []param{
+			queryArg("delivery_point", true), queryArg("start_date", true), queryArg("end_date", true)}},
+		{Method: "POST", Path: "/admin/reset", Kind: "invoke", Function: "reset", Params: []param{
+			bodyArg("user_id", true), bodyArg("password", true), bodyArg("scope", false), bodyArg("dry_run", false)}},
+		{Method: "POST", Path: "/admin/reset/preview", Kind: "query", Function: "getResetPreview", Params: []param{
+			bodyArg("user_id", true), bodyArg("password", true), bodyArg("scope", false)}},
+		{Method: "GET", Path: "/admin/snapshot", Kind: "query", Function: "exportState", Params: []param{
+			queryArg("cursor", false), queryArg("page_size", false)}},
+		{Method: "POST", Path: "/admin/snapshot/chunks", Kind: "invoke", Function: "importState", Params: []param{
+			bodyArg("user_id", true), bodyArg("password", true), jsonArg("chunk", true), bodyArg("new_user_password", false)}},
+		{Method: "GET", Path: "/admin/snapshot/import", Kind: "query", Function: "getImportStatus"},
+		{Method: "GET", Path: "/admin/schema-versions", Kind: "query", Function: "getSchemaVersionReport"},
+		{Method: "POST", Path: "/admin/migrations", Kind: "invoke", Function: "migrateRecords", Params: []param{
+			bodyArg("user_id", true), bodyArg("password", true), bodyArg("entity_type", false), bodyArg("batch_size", false)}},
+		{Method: "POST", Path: "/admin/legacy-migrations", Kind: "invoke", Function: "migrateLegacyData", Params: []param{
+			bodyArg("user_id", true), bodyArg("password", true), bodyArg("legacy_chaincode", false), bodyArg("price_unit", false),
+			bodyArg("dry_run", false)}},
+		{Method: "POST", Path: "/admin/legacy-migrations/preview", Kind: "query", Function: "getLegacyMigrationPreview", Params: []param{
+			bodyArg("user_id", true), bodyArg("password", true), bodyArg("legacy_chaincode", false), bodyArg("price_unit", false)}},
+		{Method: "GET", Path: "/price-indices/{name}", Kind: "query", Function: "getPriceIndexHistory", Params: []param{
+			pathArg("name"), queryArg("from", false), queryArg("to", false)}},
+	}...)
+
+	return routes
+}
@@ -0,0 +1,319 @@
+// Package gateway exposes the energyTrading1 chaincode as a resource style REST API. Requests are mapped to
+// Invoke and Query functions, typed JSON bodies become positional arguments and the statusCode/body
+// envelope the functions return is unwrapped:
+//
+//	SUCCESS          200 with the body
+//	FAIL             422 {"error": <body>}
+//	chaincode error  400 {"error": "..."}
+//	backend failure  502 {"error": "..."}
+//
+// Invokes that return nothing answer {"tx_id": "..."}, the transaction ID is also in the X-Transaction-ID header.
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var maxBodyBytes int64 = 1024 * 1024
+
+type Server struct {
+	backend Backend
+	routes  []Route
+}
+
+// NewServer serves the DefaultRoutes against a backend
+func NewServer(backend Backend) *Server {
+	return &Server{backend: backend, routes: DefaultRoutes()}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments := splitPath(r.URL.Path)
+
+	//GET /routes describes the API, POST /invoke/{function} and /query/{function} take positional args
+	if r.Method == "GET" && len(segments) == 1 && segments[0] == "routes" {
+		writeJSON(w, http.StatusOK, s.routes)
+		return
+	}
+	if r.Method == "POST" && len(segments) == 2 && (segments[0] == "invoke" || segments[0] == "query") {
+		var request struct {
+			Args []string `json:"args"`
+		}
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes)).Decode(&request)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Body must be {\"args\": [...]}: "+err.Error())
+			return
+		}
+		s.call(w, segments[0], segments[1], request.Args)
+		return
+	}
+
+	route, pathValues, methodAllowed := s.match(r.Method, segments)
+	if route == nil {
+		if methodAllowed {
+			writeError(w, http.StatusMethodNotAllowed, "Method "+r.Method+" not allowed on "+r.URL.Path)
+		} else {
+			writeError(w, http.StatusNotFound, "No route for "+r.URL.Path)
+		}
+		return
+	}
+
+	args, err := buildArgs(*route, r, w, pathValues)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.call(w, route.Kind, route.Function, args)
+}
+
+func (s *Server) call(w http.ResponseWriter, kind string, function string, args []string) {
+	var result Result
+	var err error
+
+	if kind == "invoke" {
+		result, err = s.backend.Invoke(function, args)
+	} else {
+		result, err = s.backend.Query(function, args)
+	}
+	if result.TxID != "" {
+		w.Header().Set("X-Transaction-ID", result.TxID)
+	}
+	if err != nil {
+		if _, ok := err.(ChaincodeError); ok {
+			writeError(w, http.StatusBadRequest, err.Error())
+		} else {
+			writeError(w, http.StatusBadGateway, err.Error())
+		}
+		return
+	}
+	writeResult(w, kind, result)
+}
+
+func (s *Server) match(method string, segments []string) (*Route, map[string]string, bool) {
+	methodAllowed := false
+
+	for i := range s.routes {
+		pathValues, ok := matchPath(s.routes[i].Path, segments)
+		if !ok {
+			continue
+		}
+		if s.routes[i].Method != method {
+			methodAllowed = true
+			continue
+		}
+		return &s.routes[i], pathValues, false
+	}
+	return nil, nil, methodAllowed
+}
+
+func splitPath(path string) []string {
+	var segments []string
+
+	for _, k := range strings.Split(path, "/") {
+		if k != "" {
+			segments = append(segments, k)
+		}
+	}
+	return segments
+}
+
+func matchPath(pattern string, segments []string) (map[string]string, bool) {
+	patternSegments := splitPath(pattern)
+	if len(patternSegments) != len(segments) {
+		return nil, false
+	}
+
+	pathValues := make(map[string]string)
+	for i, k := range patternSegments {
+		if strings.HasPrefix(k, "{") && strings.HasSuffix(k, "}") {
+			pathValues[k[1:len(k)-1]] = segments[i]
+		} else if k != segments[i] {
+			return nil, false
+		}
+	}
+	return pathValues, true
+}
+
+// Turns path values, query parameters and body fields into the function's positional arguments.
+// Trailing optional arguments that were not given are left out, the functions check len(args) for those.
+func buildArgs(route Route, r *http.Request, w http.ResponseWriter, pathValues map[string]string) ([]string, error) {
+	var args []string
+	var body map[string]interface{}
+	var lastGiven int
+
+	if route.WholeBody || hasBodyParams(route) {
+		bodyBytes, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+		if err != nil {
+			return nil, err
+		}
+		if route.WholeBody {
+			if !isJSON(bodyBytes) {
+				return nil, errors.New("Body must be a JSON document")
+			}
+			return []string{string(bytes.TrimSpace(bodyBytes))}, nil
+		}
+		if len(bytes.TrimSpace(bodyBytes)) > 0 {
+			decoder := json.NewDecoder(bytes.NewReader(bodyBytes))
+			decoder.UseNumber()
+			err = decoder.Decode(&body)
+			if err != nil {
+				return nil, errors.New("Body must be a JSON object: " + err.Error())
+			}
+		}
+	}
+
+	for _, p := range route.Params {
+		var value string
+		var given bool
+		var err error
+
+		switch p.In {
+		case "path":
+			value, given = pathValues[p.Name]
+		case "query":
+			_, given = r.URL.Query()[p.Name]
+			value = r.URL.Query().Get(p.Name)
+		default:
+			value, given, err = bodyValue(body, p)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if !given && p.Default != "" {
+			value, given = p.Default, true
+		}
+		if !given && p.Required {
+			return nil, errors.New("Missing " + p.In + " parameter " + p.Name)
+		}
+		args = append(args, value)
+		if given {
+			lastGiven = len(args)
+		}
+	}
+	return args[:lastGiven], nil
+}
+
+func hasBodyParams(route Route) bool {
+	for _, p := range route.Params {
+		if p.In == "body" || p.In == "json" {
+			return true
+		}
+	}
+	return false
+}
+
+// Strings are passed as they are, numbers and booleans as their JSON text. Json parameters take any value
+// and pass it on as JSON text, a string is taken to be JSON text already.
+func bodyValue(body map[string]interface{}, p param) (string, bool, error) {
+	raw, ok := body[p.Name]
+	if !ok || raw == nil {
+		return "", false, nil
+	}
+
+	switch value := raw.(type) {
+	case string:
+		return value, true, nil
+	case json.Number:
+		return value.String(), true, nil
+	case bool:
+		return strconv.FormatBool(value), true, nil
+	}
+	if p.In != "json" {
+		return "", false, errors.New("Field " + p.Name + " must be a string, number or boolean")
+	}
+	valueBytes, err := json.Marshal(raw)
+	if err != nil {
+		return "", false, err
+	}
+	return string(valueBytes), true, nil
+}
+
+// Returned by Unwrap for a FAIL envelope
+type FailError struct {
+	Body json.RawMessage
+}
+
+func (e FailError) Error() string {
+	var message string
+
+	if json.Unmarshal(e.Body, &message) == nil {
+		return message
+	}
+	return string(e.Body)
+}
+
+// Unwrap returns the body of a statusCode/body envelope, a FAIL envelope becomes a FailError.
+// JSON payloads without an envelope are returned as they are, others as a JSON string.
+func Unwrap(payload []byte) (json.RawMessage, error) {
+	var envelope struct {
+		StatusCode string          `json:"statusCode"`
+		Body       json.RawMessage `json:"body"`
+	}
+
+	payload = bytes.TrimSpace(payload)
+	if len(payload) == 0 {
+		return nil, nil
+	}
+	//Payloads that are not JSON, such as values written with write
+	if !isJSON(payload) {
+		payloadBytes, _ := json.Marshal(string(payload))
+		return payloadBytes, nil
+	}
+	err := json.Unmarshal(payload, &envelope)
+	if err != nil || envelope.StatusCode == "" {
+		return payload, nil
+	}
+
+	if len(envelope.Body) == 0 {
+		envelope.Body = json.RawMessage("null")
+	}
+	if envelope.StatusCode != "SUCCESS" {
+		return nil, FailError{Body: envelope.Body}
+	}
+	return envelope.Body, nil
+}
+
+func writeResult(w http.ResponseWriter, kind string, result Result) {
+	body, err := Unwrap(result.Payload)
+	if failErr, ok := err.(FailError); ok {
+		errorBytes, _ := json.Marshal(map[string]json.RawMessage{"error": failErr.Body})
+		writeRaw(w, http.StatusUnprocessableEntity, errorBytes)
+		return
+	}
+	if body == nil {
+		if kind == "invoke" {
+			writeJSON(w, http.StatusOK, map[string]string{"tx_id": result.TxID})
+		} else {
+			writeError(w, http.StatusNotFound, "Not found")
+		}
+		return
+	}
+	writeRaw(w, http.StatusOK, body)
+}
+
+func isJSON(data []byte) bool {
+	var value json.RawMessage
+	return json.Unmarshal(data, &value) == nil
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	valueBytes, _ := json.Marshal(value)
+	writeRaw(w, status, valueBytes)
+}
+
+func writeRaw(w http.ResponseWriter, status int, body []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+	w.Write([]byte("\n"))
+}
@@ -0,0 +1,108 @@
+package gateway
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Chaincode that records the call it gets and answers with a canned payload or error
+type fakeChaincode struct {
+	function string
+	args     []string
+	called   bool
+	payload  []byte
+	err      error
+}
+
+func (f *fakeChaincode) MockInvoke(uuid string, function string, args []string) ([]byte, error) {
+	return f.record(function, args)
+}
+
+func (f *fakeChaincode) MockQuery(function string, args []string) ([]byte, error) {
+	return f.record(function, args)
+}
+
+func (f *fakeChaincode) record(function string, args []string) ([]byte, error) {
+	f.function, f.args, f.called = function, args, true
+	return f.payload, f.err
+}
+
+// A request, what the chaincode answers and the call and response expected from the gateway.
+// wantFunction is empty when the request must not reach the chaincode.
+type serverCase struct {
+	name         string
+	method       string
+	path         string
+	body         string
+	payload      string
+	err          error
+	wantFunction string
+	wantArgs     []string
+	wantStatus   int
+	wantBody     string
+}
+
+func TestServerRoutes(t *testing.T) {
+	cases := []serverCase{
+		{name: "trailing optional args trimmed", method: "PUT", path: "/contracts/555/status", body: `{"status":"Accepted"}`,
+			wantFunction: "updateContractStatus", wantArgs: []string{"555", "Accepted"}, wantStatus: 200, wantBody: `"tx_id"`},
+		{name: "optional arg given", method: "PUT", path: "/contracts/555/status", body: `{"status":"Accepted","date_ms":1500}`,
+			wantFunction: "updateContractStatus", wantArgs: []string{"555", "Accepted", "1500"}, wantStatus: 200, wantBody: `"tx_id"`},
+		{name: "gap before a given optional arg kept", method: "GET", path: "/plans?min_capacity=10",
+			payload:      `{"statusCode" : "SUCCESS", "body" : []}`,
+			wantFunction: "getBusinessPlanList", wantArgs: []string{"", "", "", "10"}, wantStatus: 200, wantBody: `[]`},
+		{name: "query default", method: "GET", path: "/companies", payload: `{"statusCode" : "SUCCESS", "body" : [{"company_id":"BUYER1"}]}`,
+			wantFunction: "getCompanyList", wantArgs: []string{"all"}, wantStatus: 200, wantBody: `[{"company_id":"BUYER1"}]`},
+		{name: "json body field", method: "POST", path: "/contracts/555/offers",
+			body:         `{"proposer_id":"SHIPPER1","countered_version":1,"terms":{"energy_mwh":40},"date_ms":1500}`,
+			wantFunction: "submitCounterOffer", wantArgs: []string{"555", "SHIPPER1", "1", `{"energy_mwh":40}`, "1500"}, wantStatus: 200},
+		{name: "FAIL envelope", method: "GET", path: "/settlements/S9", payload: `{"statusCode" : "FAIL", "body" : "Settlement not found: S9"}`,
+			wantFunction: "getSettlementReport", wantArgs: []string{"S9"}, wantStatus: 422, wantBody: `{"error":"Settlement not found: S9"}`},
+		{name: "chaincode error", method: "PUT", path: "/contracts/555/status", body: `{"status":"Accepted"}`, err: errors.New("Contract already exists: 555"),
+			wantFunction: "updateContractStatus", wantArgs: []string{"555", "Accepted"}, wantStatus: 400, wantBody: `{"error":"Contract already exists: 555"}`},
+		{name: "query without result", method: "GET", path: "/settlements/S1",
+			wantFunction: "getSettlementReport", wantArgs: []string{"S1"}, wantStatus: 404},
+		{name: "positional invoke", method: "POST", path: "/invoke/runSettlement", body: `{"args":["S1","0","1000","2000"]}`,
+			wantFunction: "runSettlement", wantArgs: []string{"S1", "0", "1000", "2000"}, wantStatus: 200},
+		{name: "missing required arg", method: "PUT", path: "/contracts/555/status", body: `{}`, wantStatus: 400, wantBody: `Missing body parameter status`},
+		{name: "body that is not an object", method: "PUT", path: "/contracts/555/status", body: `[1]`, wantStatus: 400},
+		{name: "unknown route", method: "GET", path: "/nothing", wantStatus: 404},
+		{name: "method not allowed", method: "DELETE", path: "/contracts/555/status", wantStatus: 405},
+	}
+
+	for _, c := range cases {
+		chaincode := &fakeChaincode{payload: []byte(c.payload), err: c.err}
+		server := httptest.NewServer(NewServer(NewStubBackend(chaincode)))
+
+		request, _ := http.NewRequest(c.method, server.URL+c.path, strings.NewReader(c.body))
+		response, err := server.Client().Do(request)
+		if err != nil {
+			server.Close()
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		server.Close()
+
+		if response.StatusCode != c.wantStatus {
+			t.Errorf("%s: status %d, expected %d: %s", c.name, response.StatusCode, c.wantStatus, body)
+		}
+		if !strings.Contains(string(body), c.wantBody) {
+			t.Errorf("%s: body %s, expected it to contain %s", c.name, body, c.wantBody)
+		}
+		if c.wantFunction == "" {
+			if chaincode.called {
+				t.Errorf("%s: %s was called, expected no chaincode call", c.name, chaincode.function)
+			}
+			continue
+		}
+		if chaincode.function != c.wantFunction || !reflect.DeepEqual(chaincode.args, c.wantArgs) {
+			t.Errorf("%s: called %s%q, expected %s%q", c.name, chaincode.function, chaincode.args, c.wantFunction, c.wantArgs)
+		}
+	}
+}